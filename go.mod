@@ -4,15 +4,18 @@ go 1.23.3
 
 require (
 	github.com/BurntSushi/toml v1.5.0
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/aws/aws-sdk-go-v2 v1.36.6
 	github.com/aws/aws-sdk-go-v2/credentials v1.17.71
 	github.com/aws/smithy-go v1.22.4
 	github.com/dzjyyds666/Allspark-go v0.0.0-20250819064801-4d5e52527c37
 	github.com/dzjyyds666/vortex/v2 v2.0.0-20250817152308-f25ff31fde56
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.16.7
 	github.com/redis/go-redis/v9 v9.11.0
 	github.com/smartystreets/goconvey v1.8.1
 	go.mongodb.org/mongo-driver v1.17.4
+	golang.org/x/image v0.26.0
 )
 
 require (
@@ -33,7 +36,6 @@ require (
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/klauspost/compress v1.16.7 // indirect
 	github.com/montanaflynn/stats v0.7.1 // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
 	github.com/xdg-go/scram v1.1.2 // indirect
@@ -55,7 +57,7 @@ require (
 	github.com/smarty/assertions v1.15.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
-	golang.org/x/crypto v0.38.0 // indirect
+	golang.org/x/crypto v0.38.0
 	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.25.0 // indirect
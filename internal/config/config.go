@@ -6,37 +6,116 @@ import (
 )
 
 // Config 结构体定义了配置文件的结构
+// 密钥和密码类的字段不序列化为json，启动时打印配置不会输出到日志
 type Config struct {
 	Group  *string `toml:"group"`
 	Port   *string `toml:"port"`
 	S3     *S3     `toml:"s3"`
 	Server *Server `toml:"server"`
 	Admin  *Admin  `toml:"admin"`
+
+	Reconcile *Reconcile `toml:"reconcile"`
+	Fetch     *Fetch     `toml:"fetch"`
+	Archive   *Archive   `toml:"archive"`
+	Download  *Download  `toml:"download"`
+	Scanner   *Scanner   `toml:"scanner"`
+	UrlSign   *UrlSign   `toml:"url_sign"`
+	RateLimit *RateLimit `toml:"rate_limit"`
+	Oidc      *Oidc      `toml:"oidc"`
 }
 
+// Admin 启动时创建的超级管理员
 type Admin struct {
 	Username string `toml:"username"`
-	Password string `toml:"password"`
+	Password string `toml:"password" json:"-"`
 }
 
 // S3 结构体定义了S3存储的配置
 type S3 struct {
 	Bucket    string `toml:"bucket"`
 	Endpoint  string `toml:"endpoint"`
-	AccessKey string `toml:"access_key"` // AccessKey for S3
-	SecretKey string `toml:"secret_key"` // SecretKey for S3
+	AccessKey string `toml:"access_key"`          // AccessKey for S3
+	SecretKey string `toml:"secret_key" json:"-"` // SecretKey for S3
 	Region    string `toml:"region"`
+
+	SSECKeys map[string]string `toml:"sse_c_keys" json:"-"` // sse-c 客户密钥, keyId => base64(32字节)
 }
 
 type Server struct {
 	DBConfig   *ds.DsConfig `toml:"ds_config"`   // 数据库配置
 	Jwt        *Jwt         `toml:"jwt"`         // 服务端jwt
 	ConsoleJwt *Jwt         `toml:"console_jwt"` // 控制台jwt
+
+	TrustedProxies []string `toml:"trusted_proxies"` // 可信的反向代理，ip 或者 cidr，只有来自这些地址的请求才使用 X-Forwarded-For
+}
+
+// Reconcile 索引与存储对账的定时任务配置
+type Reconcile struct {
+	Interval int64  `toml:"interval"` // 执行间隔，单位秒，0表示不启用
+	Action   string `toml:"action"`   // 孤儿对象的处理方式 report / quarantine / delete
+}
+
+// Fetch 从url拉取文件的限制
+type Fetch struct {
+	MaxSize      int64 `toml:"max_size"`      // 最大文件大小，单位字节
+	Timeout      int64 `toml:"timeout"`       // 拉取超时时间，单位秒
+	AllowPrivate bool  `toml:"allow_private"` // 是否允许访问内网地址
+}
+
+// Archive 归档文件解压的限制
+type Archive struct {
+	MaxEntries   int   `toml:"max_entries"`    // 最大文件数
+	MaxTotalSize int64 `toml:"max_total_size"` // 解压后的最大总大小，单位字节
+}
+
+// Download 打包下载的限制
+type Download struct {
+	MaxSize int64 `toml:"max_size"` // 单次打包的最大大小，单位字节
+	Timeout int64 `toml:"timeout"`  // 单次打包的超时时间，单位秒
+}
+
+// 病毒扫描配置
+type Scanner struct {
+	Type    string `toml:"type"`    // clamd / http，为空时不扫描
+	Addr    string `toml:"addr"`    // clamd 的地址，如 127.0.0.1:3310
+	Url     string `toml:"url"`     // http 扫描服务的地址
+	Timeout int64  `toml:"timeout"` // 单个文件的扫描超时时间，单位秒
+}
+
+// UrlSign 服务签发的文件访问url
+type UrlSign struct {
+	Secret    string `toml:"secret" json:"-"` // 签名密钥，为空时从 jwt 密钥派生
+	MaxExpire int64  `toml:"max_expire"`      // 最长有效期，单位秒，默认7天
+	Bucket    int64  `toml:"bucket"`          // 过期时间对齐的粒度，单位秒，默认300
+}
+
+// RateLimit 请求频率和带宽限制，按用户、访问密钥或者ip分别计算，0表示不限制
+// 仓库上可以单独配置，不为0的字段覆盖全局配置
+type RateLimit struct {
+	RequestRate  float64 `toml:"request_rate" json:"request_rate,omitempty" bson:"request_rate,omitempty"`    // 每秒请求数
+	RequestBurst int64   `toml:"request_burst" json:"request_burst,omitempty" bson:"request_burst,omitempty"` // 允许的突发请求数，默认等于每秒请求数
+	DownloadRate int64   `toml:"download_rate" json:"download_rate,omitempty" bson:"download_rate,omitempty"` // 下载带宽，单位字节每秒
+	UploadRate   int64   `toml:"upload_rate" json:"upload_rate,omitempty" bson:"upload_rate,omitempty"`       // 上传带宽，单位字节每秒
+}
+
+// Oidc 控制台使用 OpenID Connect 登录，授权码模式 + PKCE，issuer 为空时不启用
+type Oidc struct {
+	Issuer        string            `toml:"issuer"` // IdP 地址，通过 /.well-known/openid-configuration 发现端点
+	ClientId      string            `toml:"client_id"`
+	ClientSecret  string            `toml:"client_secret" json:"-"` // 公共客户端可以为空，只使用 PKCE
+	RedirectUrl   string            `toml:"redirect_url"`           // 回调地址，指向 /console/oidc/callback
+	Scopes        []string          `toml:"scopes"`                 // 默认 openid profile email
+	UsernameClaim string            `toml:"username_claim"`         // 用户名使用的claim，默认 preferred_username
+	GroupsClaim   string            `toml:"groups_claim"`           // 用户组使用的claim，默认 groups
+	RoleMapping   map[string]string `toml:"role_mapping"`           // IdP 组 => 存储角色 admin / user
+	DefaultRole   string            `toml:"default_role"`           // 没有匹配的组时使用的角色，为空时拒绝登录
+	DisableAdmin  bool              `toml:"disable_admin"`          // 禁止配置文件中的管理员使用密码登录
 }
 
 type Jwt struct {
-	Secret string `toml:"secret"`
-	Expire int64  `toml:"expire"`
+	Secret        string `toml:"secret" json:"-"`
+	Expire        int64  `toml:"expire"`
+	RefreshExpire int64  `toml:"refresh_expire"` // refresh token 有效期，单位秒，0表示使用默认的7天
 }
 
 // LoadConfig 从指定路径加载TOML配置文件
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/dzjyyds666/Allspark-go/conv"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+// 获取当前登录的用户id，未登录时为空，密钥签名的请求不返回所属用户
+// 只使用中间件校验过的 claims，不使用框架解析出的会话
+func sessionUid(ctx *vortex.Context) string {
+	// 管理接口使用控制台 token 中的用户
+	if claims, ok := ctx.Get(consoleClaimsContextKey).(*logic.AccessClaims); ok && claims != nil {
+		return claims.Uid
+	}
+	if claims, ok := ctx.Get(tokenClaimsContextKey).(*logic.AccessClaims); ok && claims != nil {
+		return claims.Uid
+	}
+	return ""
+}
+
+// 获取当前请求的调用方，密钥签名的请求使用密钥所属的用户，权限受密钥范围限制
+func principal(ctx *vortex.Context) *logic.Principal {
+	if key, ok := ctx.Get(accessKeyContextKey).(*logic.AccessKey); ok && key != nil {
+		return &logic.Principal{Uid: key.Owner, AccessKey: key}
+	}
+	return &logic.Principal{Uid: sessionUid(ctx)}
+}
+
+// 查询失败时对应的子状态码
+func accessSubCode(err error) vortex.SubCode {
+	switch {
+	case errors.Is(err, pkg.ErrorEnums.ErrUserNotExist):
+		return pkg.SubStatusCodes.UserNotExist
+	case errors.Is(err, pkg.ErrorEnums.ErrBoxNotExist):
+		return pkg.SubStatusCodes.BoxNotExist
+	case errors.Is(err, pkg.ErrorEnums.ErrDepotNotExist), errors.Is(err, pkg.ErrorEnums.ErrAccessRoleInvalid):
+		return pkg.SubStatusCodes.BadRequest
+	default:
+		return pkg.SubStatusCodes.InternalError
+	}
+}
+
+type AccessHandler struct {
+	ctx    context.Context
+	access *logic.AccessLogic
+	depot  *logic.DepotLogic
+}
+
+func NewAccessHandler(ctx context.Context, access *logic.AccessLogic, depot *logic.DepotLogic) *AccessHandler {
+	return &AccessHandler{
+		ctx:    ctx,
+		access: access,
+		depot:  depot,
+	}
+}
+
+// 校验当前用户是否可以管理授权范围，仓库的所有者可以管理仓库和其中的box
+func (ah *AccessHandler) checkScopeAdmin(ctx *vortex.Context, depotId, boxId string) (vortex.SubCode, bool) {
+	depot, err := ah.depot.QueryDepotInfo(ctx.GetContext(), depotId)
+	if err != nil {
+		logx.Errorf("AccessHandler|checkScopeAdmin|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+		return accessSubCode(err), false
+	}
+	if !ah.access.CheckPermission(ctx.GetContext(), principal(ctx), depot, boxId, logic.AccessActions.Admin) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "permission deny")
+		return pkg.SubStatusCodes.PermissionDeny, false
+	}
+	return vortex.SubCode{}, true
+}
+
+// 授予角色
+func (ah *AccessHandler) HandleGrant(ctx *vortex.Context) error {
+	var grant logic.AccessGrant
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&grant); err != nil {
+		logx.Errorf("HandleGrant|ParamsError|decoder err: %v", err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, "param error")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	auditEntry(ctx).SetTarget(grant.Uid)
+	auditEntry(ctx).SetScope(grant.DepotId, ptr.ToString(grant.BoxId), "")
+	if len(grant.Uid) == 0 || len(grant.DepotId) == 0 {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, "param error")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	if code, ok := ah.checkScopeAdmin(ctx, grant.DepotId, ptr.ToString(grant.BoxId)); !ok {
+		auditFail(ctx, code, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(code), nil)
+	}
+
+	if err := ah.access.Grant(ctx.GetContext(), &grant); err != nil {
+		logx.Errorf("HandleGrant|Grant|grant: %s|err: %v", conv.ToJsonWithoutError(grant), err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(accessSubCode(err)), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"grant": grant,
+	})
+}
+
+type revokeReq struct {
+	Uid     string  `json:"uid"`
+	DepotId string  `json:"depot_id"`
+	BoxId   *string `json:"box_id,omitempty"`
+}
+
+// 撤销角色
+func (ah *AccessHandler) HandleRevoke(ctx *vortex.Context) error {
+	var req revokeReq
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		logx.Errorf("HandleRevoke|ParamsError|decoder err: %v", err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, "param error")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	auditEntry(ctx).SetTarget(req.Uid)
+	auditEntry(ctx).SetScope(req.DepotId, ptr.ToString(req.BoxId), "")
+	if len(req.Uid) == 0 || len(req.DepotId) == 0 {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, "param error")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	if code, ok := ah.checkScopeAdmin(ctx, req.DepotId, ptr.ToString(req.BoxId)); !ok {
+		auditFail(ctx, code, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(code), nil)
+	}
+
+	if err := ah.access.Revoke(ctx.GetContext(), req.Uid, req.DepotId, ptr.ToString(req.BoxId)); err != nil {
+		logx.Errorf("HandleRevoke|Revoke|uid: %s|depotId: %s|err: %v", req.Uid, req.DepotId, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, nil)
+}
+
+// 列举仓库或者box上的授权
+func (ah *AccessHandler) HandleListGrants(ctx *vortex.Context) error {
+	depotId, boxId := GetDepotId(ctx), ctx.QueryParam("box_id")
+	if code, ok := ah.checkScopeAdmin(ctx, depotId, boxId); !ok {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(code), nil)
+	}
+	grants, err := ah.access.ListGrants(ctx.GetContext(), depotId, boxId)
+	if err != nil {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"grants": grants,
+	})
+}
+
+// 查询用户在仓库或者box上的最终权限，查询其他用户需要管理权限
+func (ah *AccessHandler) HandleEffectivePermissions(ctx *vortex.Context) error {
+	depotId, boxId := GetDepotId(ctx), ctx.QueryParam("box_id")
+	caller := principal(ctx)
+	uid := ctx.QueryParam("uid")
+	if len(uid) == 0 {
+		uid = caller.Uid
+	}
+	if uid != caller.Uid {
+		caller = &logic.Principal{Uid: uid}
+		if code, ok := ah.checkScopeAdmin(ctx, depotId, boxId); !ok {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(code), nil)
+		}
+	}
+
+	depot, err := ah.depot.QueryDepotInfo(ctx.GetContext(), depotId)
+	if err != nil {
+		logx.Errorf("HandleEffectivePermissions|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(accessSubCode(err)), nil)
+	}
+	permission, err := ah.access.EffectivePermissions(ctx.GetContext(), caller, depot, boxId)
+	if err != nil {
+		logx.Errorf("HandleEffectivePermissions|EffectivePermissions|uid: %s|depotId: %s|err: %v", uid, depotId, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"permission": permission,
+	})
+}
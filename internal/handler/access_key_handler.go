@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+// 签名校验通过后密钥在请求上下文中的key
+const accessKeyContextKey = "media_storage_access_key"
+
+// 密钥接口的错误码
+func accessKeySubCode(err error) vortex.SubCode {
+	switch {
+	case errors.Is(err, pkg.ErrorEnums.ErrAccessKeyNotExist):
+		return pkg.SubStatusCodes.AccessKeyNotExist
+	case errors.Is(err, pkg.ErrorEnums.ErrSignatureExpired), errors.Is(err, pkg.ErrorEnums.ErrAccessKeyExpired):
+		return pkg.SubStatusCodes.SignatureExpired
+	case errors.Is(err, pkg.ErrorEnums.ErrSignatureInvalid), errors.Is(err, pkg.ErrorEnums.ErrSignatureReplayed),
+		errors.Is(err, pkg.ErrorEnums.ErrPayloadNotSigned):
+		return pkg.SubStatusCodes.SignatureInvalid
+	case errors.Is(err, pkg.ErrorEnums.ErrAccessKeyScopeInvalid), errors.Is(err, pkg.ErrorEnums.ErrDepotNotExist):
+		return pkg.SubStatusCodes.BadRequest
+	default:
+		return pkg.SubStatusCodes.InternalError
+	}
+}
+
+type AccessKeyHandler struct {
+	ctx       context.Context
+	accessKey *logic.AccessKeyLogic
+	user      *logic.UserLogic
+	depot     *logic.DepotLogic
+}
+
+func NewAccessKeyHandler(ctx context.Context, accessKey *logic.AccessKeyLogic, user *logic.UserLogic, depot *logic.DepotLogic) *AccessKeyHandler {
+	return &AccessKeyHandler{
+		ctx:       ctx,
+		accessKey: accessKey,
+		user:      user,
+		depot:     depot,
+	}
+}
+
+// VerifySignature 校验密钥签名的中间件，没有签名的请求直接交给下一个处理函数
+func (akh *AccessKeyHandler) VerifySignature(next func(*vortex.Context) error) func(*vortex.Context) error {
+	return akh.verifySignature(next, false)
+}
+
+// VerifyStreamSignature 流式上传接口使用，允许不对请求体签名
+func (akh *AccessKeyHandler) VerifyStreamSignature(next func(*vortex.Context) error) func(*vortex.Context) error {
+	return akh.verifySignature(next, true)
+}
+
+func (akh *AccessKeyHandler) verifySignature(next func(*vortex.Context) error, allowUnsigned bool) func(*vortex.Context) error {
+	return func(ctx *vortex.Context) error {
+		if !logic.IsSignedRequest(ctx.Request()) {
+			return next(ctx)
+		}
+		key, err := akh.accessKey.VerifyRequest(ctx.GetContext(), ctx.Request(), allowUnsigned)
+		if err != nil {
+			logx.Errorf("AccessKeyHandler|VerifySignature|VerifyRequest|path: %s|err: %v", ctx.Request().URL.Path, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(accessKeySubCode(err)), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		ctx.Set(accessKeyContextKey, key)
+		return next(ctx)
+	}
+}
+
+// 密钥只能由登录的用户管理，不能使用密钥签名的请求管理密钥
+func (akh *AccessKeyHandler) currentUser(ctx *vortex.Context) *logic.User {
+	uid := sessionUid(ctx)
+	if len(uid) == 0 {
+		return nil
+	}
+	user, err := akh.user.QueryUser(ctx.GetContext(), uid)
+	if err != nil || user.Disabled {
+		return nil
+	}
+	return user
+}
+
+// 查询密钥，只有所属用户和管理员可以操作
+func (akh *AccessKeyHandler) queryOwnedKey(ctx *vortex.Context, user *logic.User) (*logic.AccessKey, vortex.SubCode, bool) {
+	key, err := akh.accessKey.QueryAccessKey(ctx.GetContext(), ctx.Param("access_key_id"))
+	if err != nil {
+		logx.Errorf("AccessKeyHandler|queryOwnedKey|QueryAccessKey|id: %s|err: %v", ctx.Param("access_key_id"), err)
+		return nil, accessKeySubCode(err), false
+	}
+	if key.Owner != user.Uid && !user.IsAdmin() {
+		return nil, pkg.SubStatusCodes.PermissionDeny, false
+	}
+	return key, vortex.SubCode{}, true
+}
+
+type createAccessKeyReq struct {
+	DepotIds    []string `json:"depot_ids"`
+	Actions     []string `json:"actions"`
+	Description *string  `json:"description,omitempty"`
+	ExpiresIn   *int64   `json:"expires_in,omitempty"` // 有效期，单位秒
+}
+
+// 创建密钥，secret 只在这里返回一次
+func (akh *AccessKeyHandler) HandleCreate(ctx *vortex.Context) error {
+	user := akh.currentUser(ctx)
+	if user == nil {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	var req createAccessKeyReq
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		logx.Errorf("HandleCreateAccessKey|ParamsError|decoder err: %v", err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	for _, depotId := range req.DepotIds {
+		if _, err := akh.depot.QueryDepotInfo(ctx.GetContext(), depotId); err != nil {
+			logx.Errorf("HandleCreateAccessKey|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+			auditFail(ctx, accessKeySubCode(err), err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(accessKeySubCode(err)), echo.Map{
+				"depot_id": depotId,
+			})
+		}
+	}
+
+	key := &logic.AccessKey{
+		Owner:       user.Uid,
+		DepotIds:    req.DepotIds,
+		Actions:     req.Actions,
+		Description: req.Description,
+	}
+	if req.ExpiresIn != nil {
+		key.ExpiresTs = ptr.Int64(time.Now().Unix() + *req.ExpiresIn)
+	}
+	key, secret, err := akh.accessKey.CreateAccessKey(ctx.GetContext(), key)
+	if err != nil {
+		logx.Errorf("HandleCreateAccessKey|CreateAccessKey|uid: %s|err: %v", user.Uid, err)
+		auditFail(ctx, accessKeySubCode(err), err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(accessKeySubCode(err)), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"access_key": key,
+		"secret_key": secret,
+	})
+}
+
+// 列举自己的密钥，管理员可以通过 owner 参数查看其他用户的密钥
+func (akh *AccessKeyHandler) HandleList(ctx *vortex.Context) error {
+	user := akh.currentUser(ctx)
+	if user == nil {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	owner := user.Uid
+	if user.IsAdmin() {
+		owner = ctx.QueryParam("owner")
+	}
+	keys, err := akh.accessKey.ListAccessKeys(ctx.GetContext(), owner)
+	if err != nil {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"access_keys": keys,
+	})
+}
+
+type rotateAccessKeyReq struct {
+	GraceSeconds *int64 `json:"grace_seconds,omitempty"` // 旧密钥继续可用的时间
+}
+
+// 轮换密钥，返回新的 secret
+func (akh *AccessKeyHandler) HandleRotate(ctx *vortex.Context) error {
+	user := akh.currentUser(ctx)
+	if user == nil {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	var req rotateAccessKeyReq
+	if ctx.Request().ContentLength > 0 {
+		if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+			logx.Errorf("HandleRotateAccessKey|ParamsError|decoder err: %v", err)
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+		}
+	}
+	key, code, ok := akh.queryOwnedKey(ctx, user)
+	if !ok {
+		auditFail(ctx, code, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(code), nil)
+	}
+
+	grace := time.Duration(ptr.ToInt64(req.GraceSeconds)) * time.Second
+	secret, err := akh.accessKey.RotateAccessKey(ctx.GetContext(), key, grace)
+	if err != nil {
+		auditFail(ctx, accessKeySubCode(err), err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(accessKeySubCode(err)), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"access_key": key,
+		"secret_key": secret,
+	})
+}
+
+// 删除密钥
+func (akh *AccessKeyHandler) HandleDelete(ctx *vortex.Context) error {
+	user := akh.currentUser(ctx)
+	if user == nil {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	key, code, ok := akh.queryOwnedKey(ctx, user)
+	if !ok {
+		auditFail(ctx, code, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(code), nil)
+	}
+	if err := akh.accessKey.DeleteAccessKey(ctx.GetContext(), key.AccessKeyId); err != nil {
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, nil)
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+// 当前请求的审计记录在请求上下文中的key
+const auditContextKey = "media_storage_audit_entry"
+
+type AuditHandler struct {
+	ctx      context.Context
+	audit    *logic.AuditLogic
+	access   *logic.AccessLogic
+	clientIp echo.IPExtractor
+}
+
+func NewAuditHandler(ctx context.Context, audit *logic.AuditLogic, access *logic.AccessLogic, clientIp echo.IPExtractor) *AuditHandler {
+	return &AuditHandler{
+		ctx:      ctx,
+		audit:    audit,
+		access:   access,
+		clientIp: clientIp,
+	}
+}
+
+// 获取当前请求的审计记录，接口没有开启审计时返回nil，调用 Mark 等方法时会被忽略
+func auditEntry(ctx *vortex.Context) *logic.AuditEntry {
+	entry, _ := ctx.Get(auditContextKey).(*logic.AuditEntry)
+	return entry
+}
+
+// 标记为拒绝的子状态码，其他错误标记为失败
+var auditDeniedSubCodes = []vortex.SubCode{
+	pkg.SubStatusCodes.PermissionDeny,
+	pkg.SubStatusCodes.UserDisabled,
+	pkg.SubStatusCodes.PasswordNotMatch,
+	pkg.SubStatusCodes.TokenInvalid,
+	pkg.SubStatusCodes.TokenRevoked,
+	pkg.SubStatusCodes.SignatureInvalid,
+	pkg.SubStatusCodes.SignatureExpired,
+	pkg.SubStatusCodes.SharePasswordNotMatch,
+}
+
+// 按返回的子状态码标记审计结果，处理函数已经标记过时不覆盖
+func auditFail(ctx *vortex.Context, code vortex.SubCode, err error) {
+	entry := auditEntry(ctx)
+	if entry == nil || len(entry.Outcome) > 0 {
+		return
+	}
+	detail := ""
+	if err != nil {
+		detail = err.Error()
+	}
+	if slices.Contains(auditDeniedSubCodes, code) {
+		entry.Mark(logic.AuditOutcomes.Denied, detail)
+		return
+	}
+	entry.Mark(logic.AuditOutcomes.Failure, detail)
+}
+
+// Record 审计中间件，请求处理完成后写入一条审计记录
+// 需要放在签名和 token 校验之后，才能记录调用方，处理函数可以通过 auditEntry 补充操作对象和结果
+func (ah *AuditHandler) Record(action string, next func(*vortex.Context) error) func(*vortex.Context) error {
+	return func(ctx *vortex.Context) error {
+		caller := principal(ctx)
+		entry := &logic.AuditEntry{
+			Action:    action,
+			Actor:     caller.Uid,
+			Ip:        ah.clientIp(ctx.Request()),
+			UserAgent: ctx.Request().UserAgent(),
+			Method:    ctx.Request().Method,
+			Path:      ctx.Request().URL.Path,
+		}
+		if caller.AccessKey != nil {
+			entry.AccessKeyId = &caller.AccessKey.AccessKeyId
+		}
+		if depotId := GetDepotId(ctx); len(depotId) > 0 {
+			entry.DepotId = &depotId
+		}
+		if boxId := ctx.Param("box_id"); len(boxId) > 0 {
+			entry.BoxId = &boxId
+		}
+		if fid := ctx.Param("fid"); len(fid) > 0 {
+			entry.Fid = &fid
+		}
+		// 路径中的操作对象
+		for _, name := range []string{"uid", "access_key_id"} {
+			if target := ctx.Param(name); len(target) > 0 {
+				entry.SetTarget(target)
+			}
+		}
+		entry.SetTokenTarget(ctx.Param("token"))
+		ctx.Set(auditContextKey, entry)
+
+		err := next(ctx)
+		switch {
+		case err != nil:
+			entry.Mark(logic.AuditOutcomes.Failure, err.Error())
+		case len(entry.Outcome) > 0:
+			// 处理函数已经标记了结果
+		case ctx.Response().Status == http.StatusForbidden || ctx.Response().Status == http.StatusUnauthorized:
+			entry.Mark(logic.AuditOutcomes.Denied, "")
+		case ctx.Response().Status >= http.StatusBadRequest:
+			entry.Mark(logic.AuditOutcomes.Failure, "")
+		default:
+			entry.Mark(logic.AuditOutcomes.Success, "")
+		}
+		ah.audit.Record(entry)
+		return err
+	}
+}
+
+// 从请求参数中解析查询条件，时间为毫秒时间戳
+func parseAuditQuery(ctx *vortex.Context) (*logic.AuditQuery, error) {
+	q := &logic.AuditQuery{
+		Actor:   ctx.QueryParam("actor"),
+		Action:  ctx.QueryParam("action"),
+		DepotId: ctx.QueryParam("depot_id"),
+		BoxId:   ctx.QueryParam("box_id"),
+		Fid:     ctx.QueryParam("fid"),
+		Outcome: ctx.QueryParam("outcome"),
+		Ip:      ctx.QueryParam("ip"),
+	}
+	for name, dst := range map[string]*int64{
+		"start_ts": &q.StartTs,
+		"end_ts":   &q.EndTs,
+		"offset":   &q.Offset,
+		"limit":    &q.Limit,
+	} {
+		value := ctx.QueryParam(name)
+		if len(value) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", name, value)
+		}
+		*dst = n
+	}
+	return q, nil
+}
+
+// 查询审计记录，只有全局管理员可以查看
+func (ah *AuditHandler) HandleAuditQuery(ctx *vortex.Context) error {
+	if !ah.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	q, err := parseAuditQuery(ctx)
+	if err != nil {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	entries, total, err := ah.audit.Query(ctx.GetContext(), q)
+	if err != nil {
+		logx.Errorf("HandleAuditQuery|Query|err: %v", err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"entries": entries,
+		"total":   total,
+		"offset":  q.Offset,
+		"limit":   q.Limit,
+	})
+}
+
+// 按条件导出审计记录，每行一条 json，忽略分页参数中的 limit
+func (ah *AuditHandler) HandleAuditExport(ctx *vortex.Context) error {
+	if !ah.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	q, err := parseAuditQuery(ctx)
+	if err != nil {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	resp := ctx.Response()
+	resp.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	resp.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", "audit_"+time.Now().Format("20060102150405")+".jsonl"))
+	resp.WriteHeader(http.StatusOK)
+	// 响应头已经发出，之后的错误只能中断连接
+	if err = ah.audit.Export(ctx.GetContext(), q, resp); err != nil {
+		logx.Errorf("HandleAuditExport|Export|err: %v", err)
+	}
+	return nil
+}
@@ -3,9 +3,11 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 
 	"github.com/dzjyyds666/Allspark-go/conv"
 	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/Allspark-go/ptr"
 	"github.com/dzjyyds666/mediaStorage/internal/logic"
 	"github.com/dzjyyds666/mediaStorage/pkg"
 	"github.com/dzjyyds666/vortex/v2"
@@ -13,32 +15,110 @@ import (
 )
 
 type BoxHandler struct {
-	ctx context.Context
-	box *logic.BoxLogic
+	ctx    context.Context
+	box    *logic.BoxLogic
+	depot  *logic.DepotLogic
+	access *logic.AccessLogic
 }
 
-func NewBoxHandler(ctx context.Context, box *logic.BoxLogic) *BoxHandler {
+func NewBoxHandler(ctx context.Context, box *logic.BoxLogic, depot *logic.DepotLogic, access *logic.AccessLogic) *BoxHandler {
 	return &BoxHandler{
-		ctx: ctx,
-		box: box,
+		ctx:    ctx,
+		box:    box,
+		depot:  depot,
+		access: access,
 	}
 }
 
+// 检查当前用户在仓库或者box上的权限
+func (bh *BoxHandler) checkPermission(ctx *vortex.Context, depotId, boxId, action string) bool {
+	depot, err := bh.depot.QueryDepotInfo(ctx.GetContext(), depotId)
+	if err != nil {
+		logx.Errorf("BoxHandler|checkPermission|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+		return false
+	}
+	if !bh.access.CheckPermission(ctx.GetContext(), principal(ctx), depot, boxId, action) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "permission deny")
+		return false
+	}
+	return true
+}
+
 // 创建box
 func (bh *BoxHandler) HandleBoxCreate(ctx *vortex.Context) error {
 	var info logic.Box
 	decoder := json.NewDecoder(ctx.Request().Body)
 	if err := decoder.Decode(&info); err != nil {
 		logx.Errorf("HandleBoxCreate|ParamsError|decoder err: %v", err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
 	}
+	// 在仓库中创建box需要仓库的管理权限
+	depotId := ptr.ToString(info.DepotId)
+	if len(depotId) == 0 {
+		depotId = "default"
+	}
+	if !bh.checkPermission(ctx, depotId, "", logic.AccessActions.Admin) {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
 
 	box, err := bh.box.CreateBox(ctx.GetContext(), &info)
 	if nil != err {
 		logx.Errorf("HandleBoxCreate|CreateBox|boxInfo: %s|err: %v", conv.ToJsonWithoutError(info), err)
+		if errors.Is(err, pkg.ErrorEnums.ErrImageTransformInvalid) {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
 	}
 	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
 		"box_info": box,
 	})
 }
+
+// 查询box信息，包含用量
+func (bh *BoxHandler) HandleBoxInfo(ctx *vortex.Context) error {
+	boxId := ctx.Param("box_id")
+	if len(boxId) == 0 {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+
+	box, err := bh.box.QueryBoxInfo(ctx.GetContext(), boxId)
+	if nil != err {
+		logx.Errorf("HandleBoxInfo|QueryBoxInfo|boxId: %s|err: %v", boxId, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrBoxNotExist) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BoxNotExist), nil)
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if !bh.checkPermission(ctx, ptr.ToString(box.DepotId), box.BoxId, logic.AccessActions.Info) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	if err = bh.box.QueryBoxUsage(ctx.GetContext(), box); nil != err {
+		logx.Errorf("HandleBoxInfo|QueryBoxUsage|boxId: %s|err: %v", boxId, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"box_info": box,
+	})
+}
+
+// 列举仓库下的box，需要仓库的查看权限
+func (bh *BoxHandler) HandleBoxList(ctx *vortex.Context) error {
+	depotId := GetDepotId(ctx)
+	if !bh.checkPermission(ctx, depotId, "", logic.AccessActions.Info) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	boxes, err := bh.box.ListBoxes(ctx.GetContext(), depotId)
+	if err != nil {
+		logx.Errorf("HandleBoxList|ListBoxes|depotId: %s|err: %v", depotId, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"boxes": boxes,
+	})
+}
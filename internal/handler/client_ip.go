@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NewClientIpExtractor 获取请求方的ip，只有来自可信代理的请求才使用 X-Forwarded-For
+// 没有配置可信代理时直接使用连接的地址，不信任请求头
+func NewClientIpExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	// 默认信任的内网和回环地址也需要显式配置
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q invalid: %w", proxy, err)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
@@ -3,9 +3,11 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 
 	"github.com/dzjyyds666/Allspark-go/conv"
 	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/Allspark-go/ptr"
 	"github.com/dzjyyds666/mediaStorage/internal/logic"
 	"github.com/dzjyyds666/mediaStorage/pkg"
 	"github.com/dzjyyds666/vortex/v2"
@@ -13,32 +15,139 @@ import (
 )
 
 type DepotHandler struct {
-	ctx   context.Context
-	depot *logic.DepotLogic
+	ctx    context.Context
+	depot  *logic.DepotLogic
+	file   *logic.FileIndexLogic
+	access *logic.AccessLogic
 }
 
-func NewDepotHandler(ctx context.Context, depot *logic.DepotLogic) *DepotHandler {
+func NewDepotHandler(ctx context.Context, depot *logic.DepotLogic, file *logic.FileIndexLogic, access *logic.AccessLogic) *DepotHandler {
 	return &DepotHandler{
-		ctx:   ctx,
-		depot: depot,
+		ctx:    ctx,
+		depot:  depot,
+		file:   file,
+		access: access,
 	}
 }
 
 // 创建deport
 func (dh *DepotHandler) HandleDeportCreate(ctx *vortex.Context) error {
+	// 只有管理员可以创建仓库
+	if !dh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
 	var info logic.Depot
 	decoder := json.NewDecoder(ctx.Request().Body)
 	if err := decoder.Decode(&info); err != nil {
 		logx.Errorf("HandleDeportCreate|ParamsError|decoder err: %v", err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
 	}
 
 	depot, err := dh.depot.CreateDepot(ctx.GetContext(), &info)
 	if nil != err {
 		logx.Errorf("HandleDeportCreate|CreateDepot|depotInfo: %s|err: %v", conv.ToJsonWithoutError(info), err)
+		if errors.Is(err, pkg.ErrorEnums.ErrSSECKeyNotExist) || errors.Is(err, pkg.ErrorEnums.ErrSSEModeNotSupport) ||
+			errors.Is(err, pkg.ErrorEnums.ErrCompressionNotSupport) || errors.Is(err, pkg.ErrorEnums.ErrMetadataStripNotSupport) ||
+			errors.Is(err, pkg.ErrorEnums.ErrWatermarkInvalid) || errors.Is(err, pkg.ErrorEnums.ErrRateLimitInvalid) {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"depot_info": depot,
+	})
+}
+
+// 修改仓库的配置，只有管理员可以修改
+func (dh *DepotHandler) HandleDepotUpdate(ctx *vortex.Context) error {
+	if !dh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	depotId := GetDepotId(ctx)
+	var update logic.DepotUpdate
+	decoder := json.NewDecoder(ctx.Request().Body)
+	if err := decoder.Decode(&update); err != nil || len(depotId) == 0 {
+		logx.Errorf("HandleDepotUpdate|ParamsError|depotId: %s|decoder err: %v", depotId, err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	// 水印图片需要是本仓库中可以读取的图片
+	if wm := update.Watermark; wm != nil && wm.ImageFid != nil && !update.ClearWatermark {
+		mark, err := dh.file.QueryFileInfo(ctx.GetContext(), depotId, ptr.ToString(wm.ImageFid))
+		if err != nil && !errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+			logx.Errorf("HandleDepotUpdate|QueryFileInfo|depotId: %s|fid: %s|err: %v", depotId, ptr.ToString(wm.ImageFid), err)
+			auditFail(ctx, pkg.SubStatusCodes.InternalError, nil)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+		}
+		if err != nil || !logic.IsImage(mark) || mark.CheckReadable() != nil {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": pkg.ErrorEnums.ErrWatermarkInvalid.Error(),
+			})
+		}
+	}
+
+	depot, err := dh.depot.UpdateDepot(ctx.GetContext(), depotId, &update)
+	if nil != err {
+		logx.Errorf("HandleDepotUpdate|UpdateDepot|depotId: %s|update: %s|err: %v", depotId, conv.ToJsonWithoutError(update), err)
+		if errors.Is(err, pkg.ErrorEnums.ErrDepotNotExist) || errors.Is(err, pkg.ErrorEnums.ErrMetadataStripNotSupport) ||
+			errors.Is(err, pkg.ErrorEnums.ErrWatermarkInvalid) || errors.Is(err, pkg.ErrorEnums.ErrRateLimitInvalid) {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
 	}
 	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
 		"depot_info": depot,
 	})
 }
+
+// 列举所有仓库，只有管理员可以查看
+func (dh *DepotHandler) HandleDepotList(ctx *vortex.Context) error {
+	if !dh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	depots, err := dh.depot.ListDepots(ctx.GetContext())
+	if err != nil {
+		logx.Errorf("HandleDepotList|ListDepots|err: %v", err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"depots": depots,
+	})
+}
+
+// 查询仓库的用量，汇总仓库下所有box的文件数和空间
+func (dh *DepotHandler) HandleDepotUsage(ctx *vortex.Context) error {
+	depotId := GetDepotId(ctx)
+	depot, err := dh.depot.QueryDepotInfo(ctx.GetContext(), depotId)
+	if err != nil {
+		logx.Errorf("HandleDepotUsage|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrDepotNotExist) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if !dh.access.CheckPermission(ctx.GetContext(), principal(ctx), depot, "", logic.AccessActions.Info) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	usage, boxes, err := dh.depot.QueryDepotUsage(ctx.GetContext(), depotId)
+	if err != nil {
+		logx.Errorf("HandleDepotUsage|QueryDepotUsage|depotId: %s|err: %v", depotId, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"usage": usage,
+		"boxes": boxes,
+	})
+}
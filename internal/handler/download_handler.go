@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultZipMaxSize = 10 << 30  // 默认单次打包最大10G
+	defaultZipTimeout = time.Hour // 默认单次打包超时
+)
+
+type zipDownloadReq struct {
+	BoxId    *string  `json:"box_id,omitempty"` // 下载整个box
+	Fids     []string `json:"fids,omitempty"`   // 下载指定的文件
+	FileName *string  `json:"file_name,omitempty"`
+}
+
+// 打包下载box或者指定的文件，边读边写zip，不落盘
+func (fh *FileHandler) HandleZipDownload(ctx *vortex.Context) error {
+	var req zipDownloadReq
+	decoder := json.NewDecoder(ctx.Request().Body)
+	if err := decoder.Decode(&req); err != nil {
+		logx.Errorf("HandleZipDownload|ParamsError|decoder err: %v", err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	if req.BoxId == nil && len(req.Fids) == 0 {
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+
+	caller := principal(ctx)
+	depotId := GetDepotId(ctx)
+	depot, err := fh.depot.QueryDepotInfo(ctx.GetContext(), depotId)
+	if err != nil {
+		logx.Errorf("HandleZipDownload|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+
+	infos := make([]*logic.MediaFileInfo, 0, len(req.Fids))
+	if len(req.Fids) > 0 {
+		// 指定的文件必须全部可读
+		for _, fid := range req.Fids {
+			info, err := fh.file.QueryFileInfo(ctx.GetContext(), depotId, fid)
+			if err != nil {
+				logx.Errorf("HandleZipDownload|QueryFileInfo|fid: %s|err: %v", fid, err)
+				if errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+					auditFail(ctx, pkg.SubStatusCodes.FileNotExist, err)
+					return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileNotExist), echo.Map{
+						"fid": fid,
+					})
+				}
+				auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+				return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+			}
+			// 打包的是原图，设置了水印的仓库中的图片需要有原图权限
+			if !fh.access.CheckFilePermission(ctx.GetContext(), caller, depot, info, logic.AccessActions.Read) ||
+				(depot.WatermarkApplies(info) && !fh.access.CheckFilePermission(ctx.GetContext(), caller, depot, info, logic.AccessActions.Original)) {
+				auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+				return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), echo.Map{
+					"fid": fid,
+				})
+			}
+			if err = info.CheckReadable(); err != nil {
+				auditFail(ctx, ScanSubCode(err), err)
+				return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(ScanSubCode(err)), echo.Map{
+					"fid": fid,
+				})
+			}
+			infos = append(infos, info)
+		}
+	} else {
+		// 整个box下载时跳过没有权限和扫描未通过的文件，没有原图权限时跳过需要加水印的图片
+		boxId := ptr.ToString(req.BoxId)
+		permission, err := fh.access.EffectivePermissions(ctx.GetContext(), caller, depot, boxId)
+		if err != nil {
+			logx.Errorf("HandleZipDownload|EffectivePermissions|boxId: %s|err: %v", boxId, err)
+			auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+		}
+		// 箱子的文件列表按上传时间排序，多次下载的顺序稳定
+		err = fh.file.ScanBoxFiles(ctx.GetContext(), depotId, boxId, func(info *logic.MediaFileInfo) error {
+			if permission.AllowFile(info, logic.AccessActions.Read) && info.CheckReadable() == nil &&
+				(!depot.WatermarkApplies(info) || permission.AllowFile(info, logic.AccessActions.Original)) {
+				infos = append(infos, info)
+			}
+			return nil
+		})
+		if err != nil {
+			logx.Errorf("HandleZipDownload|ScanBoxFiles|boxId: %s|err: %v", boxId, err)
+			auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+		}
+	}
+
+	maxSize, timeout := fh.zipLimits()
+	var total int64
+	for _, info := range infos {
+		total += ptr.ToInt64(info.ContentLength)
+	}
+	if total > maxSize {
+		logx.Errorf("HandleZipDownload|too large|depotId: %s|size: %d|maxSize: %d", depotId, total, maxSize)
+		auditFail(ctx, pkg.SubStatusCodes.DownloadTooLarge, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.DownloadTooLarge), nil)
+	}
+
+	zipName := ptr.ToString(req.FileName)
+	if len(zipName) == 0 {
+		zipName = "download"
+		if req.BoxId != nil {
+			zipName = ptr.ToString(req.BoxId)
+		}
+	}
+	if !strings.HasSuffix(zipName, ".zip") {
+		zipName += ".zip"
+	}
+
+	resp := ctx.Response()
+	resp.Header().Set(echo.HeaderContentType, "application/zip")
+	resp.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", sanitizeZipName(zipName)))
+	resp.WriteHeader(http.StatusOK)
+
+	// 响应头已经发出，之后的错误只能中断连接
+	zipCtx, cancel := context.WithTimeout(ctx.GetContext(), timeout)
+	defer cancel()
+	// 索引中记录的大小不可信，按实际写入的字节数限制
+	remain := maxSize
+	zw := zip.NewWriter(resp)
+	names := newZipNamer()
+	for _, info := range infos {
+		if err := fh.writeZipEntry(zipCtx, zw, names.next(info), info, &remain); err != nil {
+			logx.Errorf("HandleZipDownload|writeZipEntry|fid: %s|err: %v", info.Fid, err)
+			return err
+		}
+		resp.Flush()
+	}
+	if err := zw.Close(); err != nil {
+		logx.Errorf("HandleZipDownload|Close|err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// 打包下载的大小和时间限制
+func (fh *FileHandler) zipLimits() (maxSize int64, timeout time.Duration) {
+	maxSize, timeout = defaultZipMaxSize, defaultZipTimeout
+	if fh.downloadCfg != nil {
+		if fh.downloadCfg.MaxSize > 0 {
+			maxSize = fh.downloadCfg.MaxSize
+		}
+		if fh.downloadCfg.Timeout > 0 {
+			timeout = time.Duration(fh.downloadCfg.Timeout) * time.Second
+		}
+	}
+	return
+}
+
+// 写入单个文件，压缩存储的文件先解压，remain 为剩余可以写入的字节数
+func (fh *FileHandler) writeZipEntry(ctx context.Context, zw *zip.Writer, name string, info *logic.MediaFileInfo, remain *int64) error {
+	body, err := fh.openFileBody(ctx, info)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if encoding := ptr.ToString(info.ContentEncoding); len(encoding) > 0 {
+		decoded, err := logic.NewDecompressReader(encoding, body)
+		if err != nil {
+			return err
+		}
+		defer decoded.Close()
+		r = decoded
+	}
+
+	header := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Store, // 媒体文件大多已经压缩过，直接存储
+	}
+	if info.CreatedTs != nil {
+		header.Modified = time.Unix(*info.CreatedTs, 0)
+	}
+	// 超过4G的文件和归档由zip.Writer根据实际写入的大小自动使用zip64
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, logic.NewBudgetReader(r, remain))
+	return err
+}
+
+// 去掉文件名中的路径分隔符等字符
+func sanitizeZipName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '"', 0:
+			return '_'
+		}
+		return r
+	}, name)
+	return strings.TrimSpace(name)
+}
+
+// 生成zip中不重复的文件名
+type zipNamer struct {
+	used map[string]bool
+}
+
+func newZipNamer() *zipNamer {
+	return &zipNamer{used: make(map[string]bool)}
+}
+
+func (z *zipNamer) next(info *logic.MediaFileInfo) string {
+	name := sanitizeZipName(info.FileName)
+	if len(name) == 0 || name == "." || name == ".." {
+		name = info.Fid
+	}
+	candidate := name
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; z.used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	z.used[strings.ToLower(candidate)] = true
+	return candidate
+}
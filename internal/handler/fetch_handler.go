@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/conv"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultFetchMaxSize = 1 << 30          // 默认最大1G
+	defaultFetchTimeout = 10 * time.Minute // 默认拉取超时
+	fetchProgressStep   = 4 << 20          // 每拉取4M更新一次进度
+)
+
+type fetchReq struct {
+	Url         string     `json:"url"`
+	BoxId       *string    `json:"box_id,omitempty"`
+	FileName    *string    `json:"file_name,omitempty"`
+	ContentType *string    `json:"content_type,omitempty"`
+	Header      url.Values `json:"header,omitempty"`
+}
+
+// 从url拉取文件上传，异步执行，返回任务id
+func (fh *FileHandler) HandleFetchUpload(ctx *vortex.Context) error {
+	var req fetchReq
+	decoder := json.NewDecoder(ctx.Request().Body)
+	if err := decoder.Decode(&req); err != nil {
+		logx.Errorf("HandleFetchUpload|ParamsError|decoder err: %v", err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	if req.BoxId == nil {
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	source, err := logic.ParseFetchUrl(req.Url)
+	if err != nil {
+		logx.Errorf("HandleFetchUpload|ParseFetchUrl|url: %s|err: %v", req.Url, err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+
+	caller := principal(ctx)
+	if len(caller.Uid) == 0 {
+		logx.Errorf("HandleFetchUpload|principal|err|Permission Deny")
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+
+	boxInfo, err := fh.box.QueryBoxInfo(ctx.GetContext(), ptr.ToString(req.BoxId))
+	if err != nil {
+		logx.Errorf("HandleFetchUpload|QueryBoxInfo|boxId: %s|err: %v", ptr.ToString(req.BoxId), err)
+		if errors.Is(err, pkg.ErrorEnums.ErrBoxNotExist) {
+			auditFail(ctx, pkg.SubStatusCodes.BoxNotExist, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BoxNotExist), nil)
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if !fh.checkBoxPermission(ctx, boxInfo, logic.AccessActions.Upload) {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+
+	job, err := fh.job.CreateJob(ctx.GetContext(), &logic.Job{
+		JobType: logic.JobTypes.Fetch,
+		Source:  ptr.String(source.String()),
+		BoxId:   ptr.String(boxInfo.BoxId),
+		DepotId: boxInfo.DepotId,
+		Creator: ptr.String(caller.Uid),
+	})
+	if err != nil {
+		logx.Errorf("HandleFetchUpload|CreateJob|url: %s|err: %v", req.Url, err)
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+
+	init := &logic.InitUpload{
+		FileName:    req.FileName,
+		ContentType: req.ContentType,
+		Header:      req.Header,
+		Uploader:    ptr.String(caller.Uid),
+		BoxId:       req.BoxId,
+	}
+	// 请求结束后继续拉取，使用服务的ctx
+	go fh.fetchToStorage(fh.ctx, job, source, init, boxInfo)
+
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"job": job,
+	})
+}
+
+// 拉取文件并写入存储
+func (fh *FileHandler) fetchToStorage(ctx context.Context, job *logic.Job, source *url.URL, init *logic.InitUpload, boxInfo *logic.Box) {
+	err := fh.doFetch(ctx, job, source, init, boxInfo)
+	if err != nil {
+		logx.Errorf("FileHandler|fetchToStorage|jobId: %s|url: %s|err: %v", job.JobId, source.String(), err)
+		job.Fail(err)
+	} else {
+		job.Status = logic.JobStatuses.Success
+	}
+	if err = fh.job.SaveJob(ctx, job); err != nil && !errors.Is(err, pkg.ErrorEnums.ErrJobCanceled) {
+		logx.Errorf("FileHandler|fetchToStorage|SaveJob|jobId: %s|err: %v", job.JobId, err)
+	}
+}
+
+func (fh *FileHandler) doFetch(ctx context.Context, job *logic.Job, source *url.URL, init *logic.InitUpload, boxInfo *logic.Box) error {
+	maxSize, timeout := int64(defaultFetchMaxSize), defaultFetchTimeout
+	if fh.fetchCfg != nil {
+		if fh.fetchCfg.MaxSize > 0 {
+			maxSize = fh.fetchCfg.MaxSize
+		}
+		if fh.fetchCfg.Timeout > 0 {
+			timeout = time.Duration(fh.fetchCfg.Timeout) * time.Second
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	job.Status = logic.JobStatuses.Running
+	if err := fh.job.SaveJob(ctx, job); errors.Is(err, pkg.ErrorEnums.ErrJobCanceled) {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := fh.fetchCli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch status code: %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxSize {
+		return pkg.ErrorEnums.ErrFetchTooLarge
+	}
+	if resp.ContentLength > 0 {
+		job.Total = ptr.Int64(resp.ContentLength)
+	}
+
+	// 补全文件信息之后申请上传
+	if init.FileName == nil {
+		name := path.Base(source.Path)
+		if name == "/" || name == "." {
+			name = source.Hostname()
+		}
+		init.FileName = ptr.String(name)
+	}
+	if init.ContentType == nil {
+		if mediaType, _, err := mime.ParseMediaType(resp.Header.Get(echo.HeaderContentType)); err == nil {
+			init.ContentType = ptr.String(mediaType)
+		}
+	}
+	fid, err := fh.file.ApplyUpload(ctx, init, boxInfo)
+	if err != nil {
+		return err
+	}
+	job.Fid = ptr.String(fid)
+
+	// 先落到临时文件，保证上传到s3时可以seek
+	tmp, err := os.CreateTemp("", "media-fetch-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	progress := &fetchProgress{job: job, jobLogic: fh.job, ctx: ctx}
+	n, err := io.Copy(io.MultiWriter(tmp, progress), io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxSize {
+		return pkg.ErrorEnums.ErrFetchTooLarge
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err = fh.file.SingleUpload(ctx, boxInfo, fid, tmp); err != nil {
+		return err
+	}
+	info, err := fh.file.QueryFileInfo(ctx, ptr.ToString(boxInfo.DepotId), fid)
+	if err != nil {
+		return err
+	}
+	job.FileInfo = info
+	logx.Infof("FileHandler|doFetch|jobId: %s|url: %s|fileInfo: %s", job.JobId, source.String(), conv.ToJsonWithoutError(info))
+	return nil
+}
+
+// 记录拉取进度
+type fetchProgress struct {
+	ctx      context.Context
+	job      *logic.Job
+	jobLogic *logic.JobLogic
+	reported int64
+}
+
+func (p *fetchProgress) Write(b []byte) (int, error) {
+	p.job.Progress += int64(len(b))
+	if p.job.Progress-p.reported >= fetchProgressStep {
+		p.reported = p.job.Progress
+		if err := p.jobLogic.SaveJob(p.ctx, p.job); err != nil {
+			logx.Errorf("FileHandler|fetchProgress|SaveJob|jobId: %s|err: %v", p.job.JobId, err)
+			// 任务被取消时中断拉取
+			if errors.Is(err, pkg.ErrorEnums.ErrJobCanceled) {
+				return 0, err
+			}
+		}
+	}
+	return len(b), nil
+}
@@ -4,30 +4,71 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dzjyyds666/Allspark-go/conv"
 	"github.com/dzjyyds666/Allspark-go/logx"
 	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
 	"github.com/dzjyyds666/mediaStorage/internal/logic"
 	"github.com/dzjyyds666/mediaStorage/pkg"
 	"github.com/dzjyyds666/vortex/v2"
 	"github.com/labstack/echo/v4"
 )
 
+// 列举文件时默认和最大的数量
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// 公开仓库的文件允许缓存的时间
+const publicCacheMaxAge = time.Hour
+
 type FileHandler struct {
-	ctx  context.Context
-	hcli *http.Client
-	file *logic.FileIndexLogic
-	box  *logic.BoxLogic
+	ctx      context.Context
+	file     *logic.FileIndexLogic
+	box      *logic.BoxLogic
+	depot    *logic.DepotLogic
+	job      *logic.JobLogic
+	archive  *logic.ArchiveLogic
+	image    *logic.ImageLogic
+	access   *logic.AccessLogic
+	share    *logic.ShareLogic
+	urlSign  *logic.UrlSignLogic
+	fetchCfg *config.Fetch
+	fetchCli *http.Client // 拉取外部url使用的客户端，只能访问公网地址
+
+	downloadCfg *config.Download
+	streamCli   *http.Client // 读取存储中文件的客户端，没有总超时
+
+	clientIp echo.IPExtractor // 分享链接按请求方的ip限制尝试次数
 }
 
-func NewFileHandler(ctx context.Context, file *logic.FileIndexLogic, box *logic.BoxLogic, hcli *http.Client) *FileHandler {
+func NewFileHandler(ctx context.Context, file *logic.FileIndexLogic, box *logic.BoxLogic, depot *logic.DepotLogic, job *logic.JobLogic, archive *logic.ArchiveLogic, image *logic.ImageLogic, access *logic.AccessLogic, share *logic.ShareLogic, urlSign *logic.UrlSignLogic, fetchCfg *config.Fetch, downloadCfg *config.Download, clientIp echo.IPExtractor) *FileHandler {
 	return &FileHandler{
-		ctx:  ctx,
-		hcli: hcli,
-		file: file,
-		box:  box,
+		ctx:      ctx,
+		file:     file,
+		box:      box,
+		depot:    depot,
+		job:      job,
+		archive:  archive,
+		image:    image,
+		access:   access,
+		share:    share,
+		urlSign:  urlSign,
+		fetchCfg: fetchCfg,
+		fetchCli: logic.NewFetchClient(fetchCfg != nil && fetchCfg.AllowPrivate),
+
+		downloadCfg: downloadCfg,
+		streamCli:   logic.NewStreamClient(),
+
+		clientIp: clientIp,
 	}
 }
 
@@ -36,6 +77,7 @@ func (fh *FileHandler) HandleFile(ctx *vortex.Context) error {
 	fid := ctx.Param("fid")
 	if len(fid) == 0 {
 		logx.Errorf("HandleFile|fid is empty")
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
 			"msg": "fid not be null",
 		})
@@ -44,6 +86,7 @@ func (fh *FileHandler) HandleFile(ctx *vortex.Context) error {
 	fileInfo, err := fh.file.QueryFileInfo(ctx.GetContext(), depotId, fid)
 	if nil != err {
 		logx.Errorf("HandleFile|QueryFileInfo|fid: %s|err: %v", fid, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
 		if errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
 			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileNotExist), echo.Map{
 				"msg": "file not exist",
@@ -55,28 +98,246 @@ func (fh *FileHandler) HandleFile(ctx *vortex.Context) error {
 		}
 	}
 
-	url, err := fh.file.SignFileUrl(ctx.GetContext(), fileInfo)
+	depot, err := fh.depot.QueryDepotInfo(ctx.GetContext(), depotId)
 	if nil != err {
-		logx.Errorf("HandleFile|SignFileUrl|fid: %s|err: %v", fid, err)
+		logx.Errorf("HandleFile|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), echo.Map{
-			"msg": "get file url error",
+			"msg": "query depot info error",
 		})
 	}
+	// 带签名的url不需要登录，签发时已经校验过读取权限
+	if logic.IsSignedUrl(ctx.QueryParams()) {
+		expires, err := fh.urlSign.Verify(fid, ctx.QueryParams())
+		if nil != err {
+			logx.Errorf("HandleFile|Verify|fid: %s|err: %v", fid, err)
+			auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, err.Error())
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(accessKeySubCode(err)), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		// 是否加水印已经包含在签名中，不同的内容对应不同的url，可以被公共缓存
+		ctx.Response().Header().Set(echo.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", max(expires-time.Now().Unix(), 0)))
+		var watermark *logic.Watermark
+		if depot.WatermarkApplies(fileInfo) && ctx.QueryParam(logic.UrlWatermarkParam) == "1" {
+			watermark = depot.Watermark
+		}
+		return fh.serveFile(ctx, fileInfo, watermark)
+	}
 
-	resp, err := fh.hcli.Get(url)
+	if !fh.access.CheckFilePermission(ctx.GetContext(), principal(ctx), depot, fileInfo, logic.AccessActions.Read) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "permission deny")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), echo.Map{
+			"msg": "permission deny",
+		})
+	}
+	ctx.Response().Header().Set(echo.HeaderCacheControl, fileCacheControl(depot, fileInfo))
+
+	// 没有原图权限的用户读取图片时返回加了水印的图片
+	var watermark *logic.Watermark
+	if depot.WatermarkApplies(fileInfo) &&
+		!fh.access.CheckFilePermission(ctx.GetContext(), principal(ctx), depot, fileInfo, logic.AccessActions.Original) {
+		watermark = depot.Watermark
+	}
+	return fh.serveFile(ctx, fileInfo, watermark)
+}
+
+// 公开可读的仓库允许公共缓存，同一个url对不同用户返回不同内容(是否加水印)时只允许私有缓存
+func fileCacheControl(depot *logic.Depot, fileInfo *logic.MediaFileInfo) string {
+	permission := ptr.ToString(depot.Permission)
+	public := permission == logic.DepotPermissions.Public || permission == logic.DepotPermissions.PublicRead
+	if public && !depot.WatermarkApplies(fileInfo) {
+		return fmt.Sprintf("public, max-age=%d", int64(publicCacheMaxAge.Seconds()))
+	}
+	return "private"
+}
+
+// 返回文件内容，watermark 不为空时返回加了水印的图片，衍生图和图片处理参数同样生效
+func (fh *FileHandler) serveFile(ctx *vortex.Context, fileInfo *logic.MediaFileInfo, watermark *logic.Watermark) error {
+	fid := fileInfo.Fid
+	// 扫描未通过的文件不可读
+	if err := fileInfo.CheckReadable(); nil != err {
+		logx.Errorf("HandleFile|CheckReadable|fid: %s|err: %v", fid, err)
+		auditFail(ctx, ScanSubCode(err), err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(ScanSubCode(err)), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+
+	if watermark != nil {
+		return fh.handleWatermarkedImage(ctx, fileInfo, watermark)
+	}
+
+	// 指定了预设的衍生图
+	if variant := ctx.QueryParam("variant"); len(variant) > 0 {
+		return fh.handleVariant(ctx, fileInfo, variant)
+	}
+
+	// 带有图片处理参数时返回处理后的图片
+	transform, err := logic.ParseImageTransform(ctx.QueryParams())
+	if nil != err {
+		logx.Errorf("HandleFile|ParseImageTransform|fid: %s|err: %v", fid, err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	if transform != nil {
+		return fh.handleTransformedImage(ctx, fileInfo, transform)
+	}
+
+	body, err := fh.openFileBody(ctx.GetContext(), fileInfo)
 	if nil != err {
-		logx.Errorf("HandleFile|Get|url: %s|err: %v", url, err)
+		logx.Errorf("HandleFile|openFileBody|fid: %s|err: %v", fid, err)
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), echo.Map{
 			"msg": "get file url error",
 		})
 	}
-	defer resp.Body.Close()
+	defer body.Close()
+
+	// 压缩存储的文件，客户端支持时直接返回压缩数据，否则实时解压
+	if encoding := ptr.ToString(fileInfo.ContentEncoding); len(encoding) > 0 {
+		ctx.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+		if acceptEncoding(ctx.Request().Header.Get(echo.HeaderAcceptEncoding), encoding) {
+			ctx.Response().Header().Set(echo.HeaderContentEncoding, encoding)
+		} else {
+			decoded, err := logic.NewDecompressReader(encoding, body)
+			if nil != err {
+				logx.Errorf("HandleFile|NewDecompressReader|fid: %s|encoding: %s|err: %v", fid, encoding, err)
+				auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+				return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), echo.Map{
+					"msg": "decompress file error",
+				})
+			}
+			defer decoded.Close()
+			body = decoded
+		}
+	}
 
 	if fileInfo.ContentType == nil {
-		return vortex.HttpStreamResponse(ctx, "application/octet-stream", resp.Body)
+		return vortex.HttpStreamResponse(ctx, "application/octet-stream", body)
 	} else {
-		return vortex.HttpStreamResponse(ctx, ptr.ToString(fileInfo.ContentType), resp.Body)
+		return vortex.HttpStreamResponse(ctx, ptr.ToString(fileInfo.ContentType), body)
+	}
+}
+
+// 返回处理后的图片
+func (fh *FileHandler) handleTransformedImage(ctx *vortex.Context, fileInfo *logic.MediaFileInfo, transform *logic.ImageTransform) error {
+	body, err := fh.image.OpenTransformed(ctx.GetContext(), fileInfo, transform)
+	if nil != err {
+		logx.Errorf("HandleFile|OpenTransformed|fid: %s|transform: %s|err: %v", fileInfo.Fid, conv.ToJsonWithoutError(transform), err)
+		if errors.Is(err, pkg.ErrorEnums.ErrNotImage) || errors.Is(err, pkg.ErrorEnums.ErrImageTooLarge) {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), echo.Map{
+			"msg": "transform image error",
+		})
 	}
+	defer body.Close()
+	return vortex.HttpStreamResponse(ctx, transform.ContentType(), body)
+}
+
+// 返回加了水印的图片，衍生图和图片处理参数同样生效
+func (fh *FileHandler) handleWatermarkedImage(ctx *vortex.Context, fileInfo *logic.MediaFileInfo, watermark *logic.Watermark) error {
+	var transform *logic.ImageTransform
+	var err error
+	if variant := ctx.QueryParam("variant"); len(variant) > 0 {
+		transform, err = fh.image.VariantTransform(ctx.GetContext(), fileInfo, variant)
+	} else {
+		transform, err = logic.ParseImageTransform(ctx.QueryParams())
+	}
+	if nil != err {
+		logx.Errorf("HandleFile|handleWatermarkedImage|fid: %s|err: %v", fileInfo.Fid, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrVariantNotExist) || errors.Is(err, pkg.ErrorEnums.ErrImageTransformInvalid) {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+
+	body, contentType, err := fh.image.OpenWatermarked(ctx.GetContext(), fileInfo, transform, watermark)
+	if nil != err {
+		logx.Errorf("HandleFile|OpenWatermarked|fid: %s|err: %v", fileInfo.Fid, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrNotImage) || errors.Is(err, pkg.ErrorEnums.ErrImageTooLarge) {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), echo.Map{
+			"msg": "watermark image error",
+		})
+	}
+	defer body.Close()
+	return vortex.HttpStreamResponse(ctx, contentType, body)
+}
+
+// 返回预设的衍生图
+func (fh *FileHandler) handleVariant(ctx *vortex.Context, fileInfo *logic.MediaFileInfo, name string) error {
+	body, contentType, err := fh.image.OpenVariant(ctx.GetContext(), fileInfo, name)
+	if nil != err {
+		logx.Errorf("HandleFile|OpenVariant|fid: %s|variant: %s|err: %v", fileInfo.Fid, name, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrVariantNotExist) || errors.Is(err, pkg.ErrorEnums.ErrNotImage) {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), echo.Map{
+			"msg": "get variant error",
+		})
+	}
+	defer body.Close()
+	return vortex.HttpStreamResponse(ctx, contentType, body)
+}
+
+// 判断客户端的 Accept-Encoding 是否接受指定的编码
+func acceptEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+		// q=0 表示明确不接受
+		for _, f := range fields[1:] {
+			if q := strings.TrimSpace(f); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// 打开文件的数据流，优先走预签名url，不允许预签名的文件(sse-c)直接从s3读取
+func (fh *FileHandler) openFileBody(ctx context.Context, fileInfo *logic.MediaFileInfo) (io.ReadCloser, error) {
+	url, err := fh.file.SignFileUrl(ctx, fileInfo)
+	if errors.Is(err, pkg.ErrorEnums.ErrPresignNotAllowed) {
+		return fh.file.OpenFileData(ctx, fileInfo)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	body, err := logic.OpenUrl(ctx, fh.streamCli, url)
+	if nil != err {
+		logx.Errorf("HandleFile|OpenUrl|fid: %s|err: %v", fileInfo.Fid, err)
+		return nil, err
+	}
+	return body, nil
 }
 
 // 申请上传
@@ -85,39 +346,53 @@ func (fh *FileHandler) HandleApplyUpload(ctx *vortex.Context) error {
 	decoder := json.NewDecoder(ctx.Request().Body)
 	if err := decoder.Decode(&init); err != nil {
 		logx.Errorf("HandleApplyUpload|ParamsError|decoder err: %v", err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
 	}
 
 	if init.BoxId == nil {
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
 	}
 
-	payload := ctx.GetSessionPayload()
-	if payload == nil {
-		logx.Errorf("HandleApplyUpload|GetSessionPayload|err|Permission Deny")
+	caller := principal(ctx)
+	if len(caller.Uid) == 0 {
+		logx.Errorf("HandleApplyUpload|principal|err|Permission Deny")
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "not login")
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
 	}
 
-	init.Uploader = ptr.String(payload.Uid)
+	init.Uploader = ptr.String(caller.Uid)
 
+	auditEntry(ctx).SetScope("", ptr.ToString(init.BoxId), "")
 	boxInfo, err := fh.box.QueryBoxInfo(ctx.GetContext(), ptr.ToString(init.BoxId))
 	if err != nil {
 		logx.Errorf("StorageCoreServer|ApplyUpload|QueryBoxInfo|boxId: %s|err: %s", ptr.ToString(init.BoxId), err.Error())
 		if errors.Is(err, pkg.ErrorEnums.ErrBoxNotExist) {
+			auditFail(ctx, pkg.SubStatusCodes.BoxNotExist, err)
 			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BoxNotExist), nil)
 		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
 	}
+	if !fh.checkBoxPermission(ctx, boxInfo, logic.AccessActions.Upload) {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
 	// 开始申请文件信息
 	fid, err := fh.file.ApplyUpload(ctx.GetContext(), &init, boxInfo)
 	if err != nil {
 		logx.Errorf("HandleApplyUpload|ApplyUpload|fid: %s|err: %v", fid, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
 		if errors.Is(err, pkg.ErrorEnums.ErrFileExist) {
 			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileExist), nil)
+		} else if errors.Is(err, pkg.ErrorEnums.ErrFileTypeNotAllowed) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileTypeNotAllow), nil)
 		}
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
 	}
 	logx.Infof("HandleApplyUpload|ApplyUpload|fid: %s|fileInfo: %s", fid, conv.ToJsonWithoutError(init))
+	auditEntry(ctx).SetScope(ptr.ToString(boxInfo.DepotId), "", fid)
 	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
 		"init_info": init,
 	})
@@ -130,34 +405,99 @@ func (fh *FileHandler) HandleSingleUpload(ctx *vortex.Context) error {
 	file, err := ctx.FormFile("file")
 	if err != nil {
 		logx.Errorf("HandleSingleUpload|FormFile|fid: %s|err: %v", fid, err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
 	}
 	fileOpen, err := file.Open()
 	if err != nil {
 		logx.Errorf("HandleSingleUpload|Open|fid: %s|err: %v", fid, err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
 	}
 	defer fileOpen.Close()
 
-	if len(boxId) == 0 {
-		boxId = "default"
+	// 申请上传的记录在仓库下，传了 boxId 时按箱子所在的仓库查找
+	depotId := GetDepotId(ctx)
+	if len(boxId) > 0 {
+		boxInfo, err := fh.box.QueryBoxInfo(ctx.GetContext(), boxId)
+		if nil != err {
+			logx.Errorf("HandleSingleUpload|QueryBoxInfo|boxId: %s|err: %v", boxId, err)
+			if errors.Is(err, pkg.ErrorEnums.ErrBoxNotExist) {
+				auditFail(ctx, pkg.SubStatusCodes.BoxNotExist, err)
+				return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BoxNotExist), nil)
+			}
+			auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+		}
+		depotId = ptr.ToString(boxInfo.DepotId)
+	}
+	auditEntry(ctx).SetScope(depotId, boxId, fid)
+	prepare, err := fh.file.QueryPrepareFileInfo(ctx.GetContext(), depotId, fid)
+	if nil != err {
+		logx.Errorf("HandleSingleUpload|QueryPrepareFileInfo|depotId: %s|fid: %s|err: %v", depotId, fid, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		if errors.Is(err, pkg.ErrorEnums.ErrNoPrepareFileInfo) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.NoPrepareFileInfo), nil)
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if prepare.Box == nil || (len(boxId) > 0 && prepare.Box.BoxId != boxId) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, pkg.ErrorEnums.ErrFileBoxNotMatch.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
 	}
 
-	boxInfo, err := fh.box.QueryBoxInfo(ctx.GetContext(), boxId)
+	// 以申请上传时的箱子为准，只有申请上传的用户可以上传数据
+	auditEntry(ctx).SetScope(depotId, prepare.Box.BoxId, fid)
+	boxInfo, err := fh.box.QueryBoxInfo(ctx.GetContext(), prepare.Box.BoxId)
 	if nil != err {
-		logx.Errorf("HandleSingleUpload|QueryBoxInfo|boxId: %s|err: %v", boxId, err)
+		logx.Errorf("HandleSingleUpload|QueryBoxInfo|boxId: %s|err: %v", prepare.Box.BoxId, err)
 		if errors.Is(err, pkg.ErrorEnums.ErrBoxNotExist) {
+			auditFail(ctx, pkg.SubStatusCodes.BoxNotExist, err)
 			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BoxNotExist), nil)
 		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
 	}
+	if !fh.checkBoxPermission(ctx, boxInfo, logic.AccessActions.Upload) {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	if !prepare.IsUploader(principal(ctx).Uid) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "not the uploader")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	// 申请上传时指定了解压，归档文件展开到箱子中
+	if prepare.Extract != nil && *prepare.Extract {
+		job, err := fh.archive.StartExtract(ctx.GetContext(), prepare, boxInfo, fileOpen)
+		if nil != err {
+			logx.Errorf("HandleSingleUpload|StartExtract|fid: %s|err: %v", fid, err)
+			auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+			"fid": fid,
+			"job": job,
+		})
+	}
+
 	err = fh.file.SingleUpload(ctx.GetContext(), boxInfo, fid, fileOpen)
 	if nil != err {
 		logx.Errorf("HandleSingleUpload|SingleUpload|fid: %s|err: %v", fid, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
 		if errors.Is(err, pkg.ErrorEnums.ErrBoxNotExist) {
 			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BoxNotExist), nil)
 		} else if errors.Is(err, pkg.ErrorEnums.ErrNoPrepareFileInfo) {
 			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.NoPrepareFileInfo), nil)
+		} else if errors.Is(err, pkg.ErrorEnums.ErrFileExist) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileExist), nil)
+		} else if errors.Is(err, pkg.ErrorEnums.ErrFileBoxNotMatch) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+		} else if errors.Is(err, pkg.ErrorEnums.ErrFileTypeNotAllowed) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileTypeNotAllow), nil)
+		} else if errors.Is(err, pkg.ErrorEnums.ErrImageTooLarge) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
 		} else {
 			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
 		}
@@ -167,6 +507,42 @@ func (fh *FileHandler) HandleSingleUpload(ctx *vortex.Context) error {
 	})
 }
 
+// 检查当前用户对文件的权限
+func (fh *FileHandler) checkFilePermission(ctx *vortex.Context, info *logic.MediaFileInfo, action string) bool {
+	depot, err := fh.depot.QueryDepotInfo(ctx.GetContext(), info.GetDepotId())
+	if err != nil {
+		logx.Errorf("FileHandler|checkFilePermission|QueryDepotInfo|fid: %s|err: %v", info.Fid, err)
+		return false
+	}
+	if !fh.access.CheckFilePermission(ctx.GetContext(), principal(ctx), depot, info, action) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "permission deny")
+		return false
+	}
+	return true
+}
+
+// 检查当前用户在box上的权限
+func (fh *FileHandler) checkBoxPermission(ctx *vortex.Context, box *logic.Box, action string) bool {
+	depot, err := fh.depot.QueryDepotInfo(ctx.GetContext(), ptr.ToString(box.DepotId))
+	if err != nil {
+		logx.Errorf("FileHandler|checkBoxPermission|QueryDepotInfo|boxId: %s|err: %v", box.BoxId, err)
+		return false
+	}
+	if !fh.access.CheckPermission(ctx.GetContext(), principal(ctx), depot, box.BoxId, action) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "permission deny")
+		return false
+	}
+	return true
+}
+
+// 扫描状态对应的子状态码
+func ScanSubCode(err error) vortex.SubCode {
+	if errors.Is(err, pkg.ErrorEnums.ErrFileInfected) {
+		return pkg.SubStatusCodes.FileInfected
+	}
+	return pkg.SubStatusCodes.FileScanPending
+}
+
 // 获取到仓库id
 func GetDepotId(ctx *vortex.Context) string {
 	id := ctx.Param("depot_id")
@@ -199,10 +575,165 @@ func (fh *FileHandler) HandleFileInfo(ctx *vortex.Context) error {
 		}
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
 	}
+	if !fh.checkFilePermission(ctx, info, logic.AccessActions.Info) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
 	logx.Infof("HandleFileInfo|QueryFileInfo|fid: %s|info: %s", fid, conv.ToJsonWithoutError(info))
 	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, info)
 }
 
+// 删除文件，需要文件所在 box 的删除权限
+func (fh *FileHandler) HandleFileDelete(ctx *vortex.Context) error {
+	fid := ctx.Param("fid")
+	if len(fid) == 0 {
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	depotId := GetDepotId(ctx)
+	auditEntry(ctx).SetScope(depotId, "", fid)
+
+	info, err := fh.file.QueryFileInfo(ctx.GetContext(), depotId, fid)
+	if err != nil {
+		logx.Errorf("HandleFileDelete|QueryFileInfo|fid: %s|err: %v", fid, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		if errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileNotExist), nil)
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if info.Box != nil {
+		auditEntry(ctx).SetScope(depotId, info.Box.BoxId, fid)
+	}
+	if !fh.checkFilePermission(ctx, info, logic.AccessActions.Delete) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "permission deny")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	if err = fh.file.DeleteFile(ctx.GetContext(), info); err != nil {
+		logx.Errorf("HandleFileDelete|DeleteFile|fid: %s|err: %v", fid, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		if errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileNotExist), nil)
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, nil)
+}
+
+// 列举box下的文件，按上传时间排序，使用 cursor / limit 分页
+func (fh *FileHandler) HandleFileList(ctx *vortex.Context) error {
+	boxId := ctx.Param("box_id")
+	if len(boxId) == 0 {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	cursor := ctx.QueryParam("cursor")
+	limit, _ := strconv.Atoi(ctx.QueryParam("limit"))
+	if limit <= 0 || limit > maxListLimit {
+		limit = defaultListLimit
+	}
+
+	depotId := GetDepotId(ctx)
+	depot, err := fh.depot.QueryDepotInfo(ctx.GetContext(), depotId)
+	if err != nil {
+		logx.Errorf("HandleFileList|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	permission, err := fh.access.EffectivePermissions(ctx.GetContext(), principal(ctx), depot, boxId)
+	if err != nil {
+		logx.Errorf("HandleFileList|EffectivePermissions|boxId: %s|err: %v", boxId, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+
+	infos, next, err := fh.file.ListBoxFiles(ctx.GetContext(), depotId, boxId, cursor, limit, func(info *logic.MediaFileInfo) bool {
+		return permission.AllowFile(info, logic.AccessActions.Info)
+	})
+	if err != nil {
+		logx.Errorf("HandleFileList|ListBoxFiles|boxId: %s|cursor: %s|err: %v", boxId, cursor, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrListCursorInvalid) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"files":       infos,
+		"next_cursor": next,
+	})
+}
+
+// 解析相似阈值参数，没有传时使用默认值
+func parseHashDistance(ctx *vortex.Context) (int, bool) {
+	raw := ctx.QueryParam("distance")
+	if len(raw) == 0 {
+		return logic.ImageHashDefaultDistance, true
+	}
+	distance, err := strconv.Atoi(raw)
+	if err != nil || distance < 0 || distance > logic.ImageHashMaxDistance {
+		return 0, false
+	}
+	return distance, true
+}
+
+// 查找和指定图片相似的图片
+func (fh *FileHandler) HandleSimilarImages(ctx *vortex.Context) error {
+	fid := ctx.Param("fid")
+	distance, ok := parseHashDistance(ctx)
+	if len(fid) == 0 || !ok {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+
+	depotId := GetDepotId(ctx)
+	info, err := fh.file.QueryFileInfo(ctx.GetContext(), depotId, fid)
+	if err != nil {
+		logx.Errorf("HandleSimilarImages|QueryFileInfo|fid: %s|err: %v", fid, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileNotExist), nil)
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if !fh.checkFilePermission(ctx, info, logic.AccessActions.Info) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+
+	similar, err := fh.image.FindSimilarImages(ctx.GetContext(), info, distance)
+	if err != nil {
+		logx.Errorf("HandleSimilarImages|FindSimilarImages|fid: %s|err: %v", fid, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrNotImage) || errors.Is(err, pkg.ErrorEnums.ErrImageHashNotReady) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"fid":     fid,
+		"similar": similar,
+	})
+}
+
+// 仓库中重复图片的报告，报告在任务中异步生成，通过任务查询结果
+func (fh *FileHandler) HandleDuplicateReport(ctx *vortex.Context) error {
+	distance, ok := parseHashDistance(ctx)
+	if !ok {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	depotId := GetDepotId(ctx)
+	depot, err := fh.depot.QueryDepotInfo(ctx.GetContext(), depotId)
+	if err != nil {
+		logx.Errorf("HandleDuplicateReport|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if !fh.access.CheckPermission(ctx.GetContext(), principal(ctx), depot, "", logic.AccessActions.Admin) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	job, err := fh.image.StartDuplicateReport(ctx.GetContext(), depotId, principal(ctx).Uid, distance)
+	if err != nil {
+		logx.Errorf("HandleDuplicateReport|StartDuplicateReport|depotId: %s|err: %v", depotId, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"job": job,
+	})
+}
+
 // 支持文件的分片上传
 func (fh *FileHandler) HandleInitUpload(ctx *vortex.Context) error {
 
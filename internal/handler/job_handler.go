@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+type JobHandler struct {
+	ctx    context.Context
+	job    *logic.JobLogic
+	access *logic.AccessLogic
+}
+
+func NewJobHandler(ctx context.Context, job *logic.JobLogic, access *logic.AccessLogic) *JobHandler {
+	return &JobHandler{
+		ctx:    ctx,
+		job:    job,
+		access: access,
+	}
+}
+
+// 查询任务
+func (jh *JobHandler) HandleJobInfo(ctx *vortex.Context) error {
+	jobId := ctx.Param("job_id")
+	if len(jobId) == 0 {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	job, err := jh.job.QueryJob(ctx.GetContext(), jobId)
+	if err != nil {
+		logx.Errorf("HandleJobInfo|QueryJob|jobId: %s|err: %v", jobId, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrJobNotExist) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.JobNotExist), nil)
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	// 只有任务的创建者和管理员可以查看，密钥创建的任务属于密钥所属的用户
+	if !job.IsCreator(principal(ctx).Uid) && !jh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"job": job,
+	})
+}
+
+// 列举任务，只有管理员可以查看所有任务，可以按状态和类型过滤
+func (jh *JobHandler) HandleJobList(ctx *vortex.Context) error {
+	if !jh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	jobs, err := jh.job.ListJobs(ctx.GetContext(), ctx.QueryParam("status"), ctx.QueryParam("job_type"))
+	if err != nil {
+		logx.Errorf("HandleJobList|ListJobs|err: %v", err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"jobs": jobs,
+	})
+}
+
+// 取消任务，任务的创建者和管理员可以取消
+func (jh *JobHandler) HandleJobCancel(ctx *vortex.Context) error {
+	jobId := ctx.Param("job_id")
+	if len(jobId) == 0 {
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	job, err := jh.job.QueryJob(ctx.GetContext(), jobId)
+	if err != nil {
+		logx.Errorf("HandleJobCancel|QueryJob|jobId: %s|err: %v", jobId, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrJobNotExist) {
+			auditFail(ctx, pkg.SubStatusCodes.JobNotExist, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.JobNotExist), nil)
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if !job.IsCreator(principal(ctx).Uid) && !jh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "permission deny")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	auditEntry(ctx).SetScope(ptr.ToString(job.DepotId), ptr.ToString(job.BoxId), "")
+	job, err = jh.job.CancelJob(ctx.GetContext(), jobId)
+	if err != nil {
+		logx.Errorf("HandleJobCancel|CancelJob|jobId: %s|err: %v", jobId, err)
+		switch {
+		case errors.Is(err, pkg.ErrorEnums.ErrJobFinished):
+			auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.JobFinished), echo.Map{
+				"job": job,
+			})
+		case errors.Is(err, pkg.ErrorEnums.ErrJobNotExist):
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.JobNotExist), nil)
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"job": job,
+	})
+}
@@ -3,29 +3,122 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"time"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
-	"github.com/dzjyyds666/Allspark-go/jwtx"
 	"github.com/dzjyyds666/Allspark-go/logx"
 	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
 	"github.com/dzjyyds666/vortex/v2"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
 )
 
+// 校验通过的 access token 和控制台 token 在请求上下文中的key
+const (
+	tokenClaimsContextKey   = "media_storage_token_claims"
+	consoleClaimsContextKey = "media_storage_console_claims"
+)
+
 type LoginHandler struct {
 	ctx        context.Context
 	jwtToken   *config.Jwt
 	consoleJwt *config.Jwt
-	admin      *config.Admin
+	user       *logic.UserLogic
+	session    *logic.SessionLogic
+	oidc       *logic.OidcLogic
 }
 
-func NewLoginHandler(ctx context.Context, jwtToken *config.Jwt, consoleJwt *config.Jwt, admin *config.Admin) *LoginHandler {
+func NewLoginHandler(ctx context.Context, jwtToken *config.Jwt, consoleJwt *config.Jwt, user *logic.UserLogic, session *logic.SessionLogic, oidc *logic.OidcLogic) *LoginHandler {
 	return &LoginHandler{
 		ctx:        ctx,
 		jwtToken:   jwtToken,
 		consoleJwt: consoleJwt,
-		admin:      admin,
+		user:       user,
+		session:    session,
+		oidc:       oidc,
+	}
+}
+
+// 获取请求中的 bearer token
+func bearerToken(ctx *vortex.Context) string {
+	auth := ctx.Request().Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// 会话接口的错误码
+func sessionSubCode(err error) vortex.SubCode {
+	switch {
+	case errors.Is(err, pkg.ErrorEnums.ErrTokenRevoked):
+		return pkg.SubStatusCodes.TokenRevoked
+	case errors.Is(err, pkg.ErrorEnums.ErrTokenInvalid), errors.Is(err, pkg.ErrorEnums.ErrSessionNotExist):
+		return pkg.SubStatusCodes.TokenInvalid
+	case errors.Is(err, pkg.ErrorEnums.ErrUserDisabled):
+		return pkg.SubStatusCodes.UserDisabled
+	default:
+		return pkg.SubStatusCodes.InternalError
+	}
+}
+
+// CheckToken 校验 access token 是否已经被吊销的中间件，没有 bearer token 的请求直接交给下一个处理函数
+func (lh *LoginHandler) CheckToken(next func(*vortex.Context) error) func(*vortex.Context) error {
+	return func(ctx *vortex.Context) error {
+		token := bearerToken(ctx)
+		if len(token) == 0 {
+			// 框架从其他位置解析出了会话，但没有可以校验的 token
+			if ctx.GetSessionPayload() != nil {
+				logx.Errorf("LoginHandler|CheckToken|session without token|path: %s", ctx.Request().URL.Path)
+				return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.TokenInvalid), nil)
+			}
+			return next(ctx)
+		}
+		claims, err := lh.session.ParseAccessToken(ctx.GetContext(), token)
+		if err != nil {
+			logx.Errorf("LoginHandler|CheckToken|ParseAccessToken|path: %s|err: %v", ctx.Request().URL.Path, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(sessionSubCode(err)), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		if payload := ctx.GetSessionPayload(); payload != nil && payload.Uid != claims.Uid {
+			logx.Errorf("LoginHandler|CheckToken|session not match|path: %s|uid: %s", ctx.Request().URL.Path, claims.Uid)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.TokenInvalid), nil)
+		}
+		ctx.Set(tokenClaimsContextKey, claims)
+		return next(ctx)
+	}
+}
+
+// CheckConsoleToken 管理接口的认证中间件，只接受控制台 token，数据接口的 token 和访问密钥都不能访问
+func (lh *LoginHandler) CheckConsoleToken(next func(*vortex.Context) error) func(*vortex.Context) error {
+	return func(ctx *vortex.Context) error {
+		token := bearerToken(ctx)
+		if len(token) == 0 {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.TokenInvalid), nil)
+		}
+		claims, err := lh.session.ParseConsoleToken(ctx.GetContext(), token)
+		if err != nil {
+			logx.Errorf("LoginHandler|CheckConsoleToken|ParseConsoleToken|path: %s|err: %v", ctx.Request().URL.Path, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(sessionSubCode(err)), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		// 控制台 token 没有会话，禁用用户后需要立即失效
+		user, err := lh.user.QueryUser(ctx.GetContext(), claims.Uid)
+		if err != nil {
+			logx.Errorf("LoginHandler|CheckConsoleToken|QueryUser|uid: %s|err: %v", claims.Uid, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.TokenInvalid), nil)
+		}
+		if user.Disabled {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.UserDisabled), nil)
+		}
+		ctx.Set(consoleClaimsContextKey, claims)
+		return next(ctx)
 	}
 }
 
@@ -34,35 +127,225 @@ type loginReq struct {
 	Password string `json:"password"`
 }
 
-// 签名token
-func (lh *LoginHandler) HandleLogin(ctx *vortex.Context) error {
+// 校验用户名密码，通过后由 issue 签发 token 并返回响应
+func (lh *LoginHandler) passwordLogin(ctx *vortex.Context, issue func(user *logic.User) error) error {
 	var req loginReq
 	err := json.NewDecoder(ctx.Request().Body).Decode(&req)
 	if nil != err {
-		logx.Errorf("StorageServer|HandleLogin|decode login req error: %v", err)
+		logx.Errorf("StorageServer|passwordLogin|decode login req error: %v", err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, "param error")
 		return vortex.HttpJsonResponse(ctx, vortex.Statuses.ParamsInvaild, echo.Map{
 			"msg": "param error",
 		})
 	}
-	if req.UserName != lh.admin.Username || req.Password != lh.admin.Password {
-		logx.Errorf("StorageServer|HandleLogin|username: %s|password: %s", req.UserName, req.Password)
-		return vortex.HttpJsonResponse(ctx, vortex.Statuses.ParamsInvaild, echo.Map{
-			"msg": "username or password not match",
+	// 审计记录只保存用户名，不记录密码
+	auditEntry(ctx).SetTarget(req.UserName)
+	user, err := lh.user.Authenticate(ctx.GetContext(), req.UserName, req.Password)
+	if err != nil {
+		logx.Errorf("StorageServer|passwordLogin|Authenticate|username: %s|err: %v", req.UserName, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrPasswordNotMatch) || errors.Is(err, pkg.ErrorEnums.ErrUserDisabled) {
+			auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, err.Error())
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.ParamsInvaild, echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError, echo.Map{
+			"msg": "login failure",
 		})
 	}
-	jwtToken, err := jwtx.SignJwt(lh.jwtToken.Secret, jwt.MapClaims{
-		"uid":     req.UserName,
-		"expires": time.Now().Add(time.Duration(lh.jwtToken.Expire) * time.Second).Unix(),
+	if entry := auditEntry(ctx); entry != nil {
+		entry.Actor = user.Uid
+	}
+	// 启用单点登录后配置文件中的管理员只能通过 IdP 登录
+	if user.Bootstrap && lh.oidc.AdminLoginDisabled() {
+		logx.Errorf("StorageServer|passwordLogin|bootstrap admin login disabled|username: %s", req.UserName)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "bootstrap admin login disabled")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	return issue(user)
+}
+
+// 签名token
+func (lh *LoginHandler) HandleLogin(ctx *vortex.Context) error {
+	return lh.passwordLogin(ctx, func(user *logic.User) error {
+		tokens, err := lh.session.CreateSession(ctx.GetContext(), user)
+		if err != nil {
+			logx.Errorf("StorageServer|HandleLogin|CreateSession|err: %v", err)
+			auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError, echo.Map{
+				"msg": "login failure",
+			})
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+			"msg":           "login success",
+			"jwt":           tokens.AccessToken,
+			"refresh_token": tokens.RefreshToken,
+			"expires_ts":    tokens.ExpiresTs,
+			"user":          user.Username,
+			"uid":           user.Uid,
+			"roles":         user.Roles,
+		})
 	})
+}
+
+// 控制台使用用户名密码登录，签发控制台 token
+func (lh *LoginHandler) HandleConsoleLogin(ctx *vortex.Context) error {
+	return lh.passwordLogin(ctx, func(user *logic.User) error {
+		token, expires, err := lh.session.CreateConsoleToken(user)
+		if err != nil {
+			logx.Errorf("StorageServer|HandleConsoleLogin|CreateConsoleToken|uid: %s|err: %v", user.Uid, err)
+			auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError, echo.Map{
+				"msg": "login failure",
+			})
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+			"console_jwt": token,
+			"expires_ts":  expires,
+			"user":        user.Username,
+			"uid":         user.Uid,
+			"roles":       user.Roles,
+		})
+	})
+}
+
+// 注销控制台 token
+func (lh *LoginHandler) HandleConsoleLogout(ctx *vortex.Context) error {
+	claims, ok := ctx.Get(consoleClaimsContextKey).(*logic.AccessClaims)
+	if !ok || claims == nil {
+		auditFail(ctx, pkg.SubStatusCodes.TokenInvalid, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.TokenInvalid), nil)
+	}
+	if err := lh.session.Logout(ctx.GetContext(), claims); err != nil {
+		logx.Errorf("StorageServer|HandleConsoleLogout|Logout|uid: %s|err: %v", claims.Uid, err)
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, nil)
+}
+
+type refreshReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// 使用 refresh token 换取新的 token
+func (lh *LoginHandler) HandleRefresh(ctx *vortex.Context) error {
+	var req refreshReq
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil || len(req.RefreshToken) == 0 {
+		logx.Errorf("StorageServer|HandleRefresh|decode refresh req error: %v", err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	tokens, err := lh.session.Refresh(ctx.GetContext(), req.RefreshToken)
 	if err != nil {
-		logx.Errorf("StorageServer|HandleLogin|SignJwt|err: %v", err)
-		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError, echo.Map{
-			"msg": "login failure",
+		logx.Errorf("StorageServer|HandleRefresh|Refresh|err: %v", err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(sessionSubCode(err)), echo.Map{
+			"msg": err.Error(),
 		})
 	}
 	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
-		"msg":  "login success",
-		"jwt":  jwtToken,
-		"user": req.UserName,
+		"jwt":           tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_ts":    tokens.ExpiresTs,
+	})
+}
+
+// 注销当前会话，access token 和 refresh token 同时失效
+func (lh *LoginHandler) HandleLogout(ctx *vortex.Context) error {
+	claims, ok := ctx.Get(tokenClaimsContextKey).(*logic.AccessClaims)
+	if !ok || claims == nil {
+		auditFail(ctx, pkg.SubStatusCodes.TokenInvalid, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.TokenInvalid), nil)
+	}
+	if err := lh.session.Logout(ctx.GetContext(), claims); err != nil {
+		logx.Errorf("StorageServer|HandleLogout|Logout|uid: %s|err: %v", claims.Uid, err)
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, nil)
+}
+
+// 单点登录的错误码
+func oidcSubCode(err error) vortex.SubCode {
+	switch {
+	case errors.Is(err, pkg.ErrorEnums.ErrOidcNotEnabled):
+		return pkg.SubStatusCodes.BadRequest
+	case errors.Is(err, pkg.ErrorEnums.ErrOidcNoRole):
+		return pkg.SubStatusCodes.PermissionDeny
+	case errors.Is(err, pkg.ErrorEnums.ErrUserDisabled):
+		return pkg.SubStatusCodes.UserDisabled
+	default:
+		return pkg.SubStatusCodes.OidcLoginFailed
+	}
+}
+
+// 登录后跳转的页面只允许站内的相对路径，避免被用来跳转到外部站点
+func safeRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.Contains(redirect, "\\") {
+		return ""
+	}
+	return redirect
+}
+
+// 控制台单点登录，跳转到 IdP 的授权页面
+func (lh *LoginHandler) HandleOidcLogin(ctx *vortex.Context) error {
+	authUrl, stateCookie, err := lh.oidc.StartLogin(ctx.GetContext(), safeRedirect(ctx.QueryParam("redirect")))
+	if err != nil {
+		logx.Errorf("StorageServer|HandleOidcLogin|StartLogin|err: %v", err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(oidcSubCode(err)), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	// state 绑定到当前浏览器，回调时校验
+	ctx.SetCookie(stateCookie)
+	return ctx.Redirect(http.StatusFound, authUrl)
+}
+
+// IdP 授权后的回调，校验通过后签发控制台 token
+// 登录时指定了跳转页面时 token 放在 url 的 fragment 中，不会被发送到服务端和记录到访问日志
+func (lh *LoginHandler) HandleOidcCallback(ctx *vortex.Context) error {
+	if idpErr := ctx.QueryParam("error"); len(idpErr) > 0 {
+		logx.Errorf("StorageServer|HandleOidcCallback|idp error: %s|desc: %s", idpErr, ctx.QueryParam("error_description"))
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "idp error: "+idpErr)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.OidcLoginFailed), echo.Map{
+			"msg": idpErr,
+		})
+	}
+	var stateCookie string
+	if cookie, err := ctx.Cookie(logic.OidcStateCookieName); err == nil {
+		stateCookie = cookie.Value
+		// state cookie 只能使用一次
+		ctx.SetCookie(lh.oidc.StateCookie("", -1))
+	}
+	user, redirect, err := lh.oidc.FinishLogin(ctx.GetContext(), ctx.QueryParam("state"), stateCookie, ctx.QueryParam("code"))
+	if err != nil {
+		logx.Errorf("StorageServer|HandleOidcCallback|FinishLogin|err: %v", err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, err.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(oidcSubCode(err)), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	if entry := auditEntry(ctx); entry != nil {
+		entry.Actor = user.Uid
+		entry.SetTarget(user.Username)
+	}
+	token, expires, err := lh.session.CreateConsoleToken(user)
+	if err != nil {
+		logx.Errorf("StorageServer|HandleOidcCallback|CreateConsoleToken|uid: %s|err: %v", user.Uid, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if len(redirect) > 0 {
+		fragment := url.Values{}
+		fragment.Set("console_jwt", token)
+		fragment.Set("expires_ts", strconv.FormatInt(expires, 10))
+		return ctx.Redirect(http.StatusFound, redirect+"#"+fragment.Encode())
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"console_jwt": token,
+		"expires_ts":  expires,
+		"user":        user.Username,
+		"uid":         user.Uid,
+		"roles":       user.Roles,
 	})
 }
@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+// 带宽限制时每次预占的字节数范围
+const (
+	throttleMinChunk = 16 << 10
+	throttleMaxChunk = 1 << 20
+)
+
+type RateLimitHandler struct {
+	ctx      context.Context
+	limit    *logic.RateLimitLogic
+	depot    *logic.DepotLogic
+	box      *logic.BoxLogic
+	file     *logic.FileIndexLogic
+	clientIp echo.IPExtractor
+}
+
+func NewRateLimitHandler(ctx context.Context, limit *logic.RateLimitLogic, depot *logic.DepotLogic, box *logic.BoxLogic, file *logic.FileIndexLogic, clientIp echo.IPExtractor) *RateLimitHandler {
+	return &RateLimitHandler{
+		ctx:      ctx,
+		limit:    limit,
+		depot:    depot,
+		box:      box,
+		file:     file,
+		clientIp: clientIp,
+	}
+}
+
+// 限流使用的仓库从请求的 box、文件或者申请上传的记录上获取，不直接使用客户端传入的 depot_id
+// 无法确定仓库时使用全局配置
+func (rh *RateLimitHandler) resolveDepotId(ctx *vortex.Context) string {
+	boxId := ctx.Param("box_id")
+	if len(boxId) == 0 {
+		boxId = ctx.QueryParam("boxId")
+	}
+	if len(boxId) > 0 {
+		box, err := rh.box.QueryBoxInfo(ctx.GetContext(), boxId)
+		if err != nil {
+			return ""
+		}
+		return ptr.ToString(box.DepotId)
+	}
+	fid := ctx.Param("fid")
+	if len(fid) == 0 {
+		return ""
+	}
+	// 文件只能在它所在的仓库中查到
+	depotId := GetDepotId(ctx)
+	if info, err := rh.file.QueryFileInfo(ctx.GetContext(), depotId, fid); err == nil && info.Box != nil {
+		return info.GetDepotId()
+	}
+	if prepare, err := rh.file.QueryPrepareFileInfo(ctx.GetContext(), depotId, fid); err == nil && prepare.Box != nil {
+		return prepare.GetDepotId()
+	}
+	return ""
+}
+
+// Limit 限流中间件，超过请求频率时返回 429，同时限制上传和下载的带宽
+// 需要放在签名和 token 校验之后，才能按用户和访问密钥限流
+func (rh *RateLimitHandler) Limit(next func(*vortex.Context) error) func(*vortex.Context) error {
+	return func(ctx *vortex.Context) error {
+		scope := "global"
+		var depot *logic.Depot
+		if depotId := rh.resolveDepotId(ctx); len(depotId) > 0 {
+			if info, err := rh.depot.QueryDepotInfo(ctx.GetContext(), depotId); err == nil {
+				depot, scope = info, depotId
+			}
+		}
+		limit := rh.limit.EffectiveLimit(depot)
+		identity := logic.RateLimitIdentity(principal(ctx), rh.clientIp(ctx.Request()))
+		if wait := rh.limit.AllowRequest(ctx.GetContext(), scope, identity, limit); wait > 0 {
+			return tooManyRequests(ctx, wait)
+		}
+
+		// 客户端断开后停止等待
+		reqCtx := ctx.Request().Context()
+		if limit.UploadRate > 0 && ctx.Request().Body != nil {
+			ctx.Request().Body = &throttledReader{
+				ReadCloser: ctx.Request().Body,
+				ctx:        reqCtx,
+				chunk:      throttleChunk(limit.UploadRate),
+				reserve: func(n int) time.Duration {
+					return rh.limit.ReserveBytes(reqCtx, logic.RateLimitKinds.Upload, scope, identity, limit.UploadRate, n)
+				},
+			}
+		}
+		if limit.DownloadRate > 0 {
+			ctx.Response().Writer = &throttledWriter{
+				ResponseWriter: ctx.Response().Writer,
+				ctx:            reqCtx,
+				chunk:          throttleChunk(limit.DownloadRate),
+				reserve: func(n int) time.Duration {
+					return rh.limit.ReserveBytes(reqCtx, logic.RateLimitKinds.Download, scope, identity, limit.DownloadRate, n)
+				},
+			}
+		}
+		return next(ctx)
+	}
+}
+
+// vortex 没有 429 对应的状态，直接返回
+func tooManyRequests(ctx *vortex.Context, wait time.Duration) error {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	ctx.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return ctx.JSON(http.StatusTooManyRequests, echo.Map{
+		"sub_code":    pkg.SubStatusCodes.TooManyRequests.SubCode,
+		"msg":         "too many requests",
+		"retry_after": retryAfter,
+	})
+}
+
+// 每次预占的字节数，大约是八分之一秒的流量
+func throttleChunk(rate int64) int {
+	return int(min(max(rate/8, throttleMinChunk), throttleMaxChunk))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// 限速的响应
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	chunk   int
+	reserve func(n int) time.Duration
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), w.chunk)
+		if err := sleepContext(w.ctx, w.reserve(n)); err != nil {
+			return written, err
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// 限速的请求体
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	chunk   int
+	reserve func(n int) time.Duration
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := sleepContext(r.ctx, r.reserve(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/dzjyyds666/Allspark-go/conv"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+type ReconcileHandler struct {
+	ctx       context.Context
+	reconcile *logic.ReconcileLogic
+	scan      *logic.ScanLogic
+	access    *logic.AccessLogic
+}
+
+func NewReconcileHandler(ctx context.Context, reconcile *logic.ReconcileLogic, scan *logic.ScanLogic, access *logic.AccessLogic) *ReconcileHandler {
+	return &ReconcileHandler{
+		ctx:       ctx,
+		reconcile: reconcile,
+		scan:      scan,
+		access:    access,
+	}
+}
+
+// 索引与存储对账
+func (rh *ReconcileHandler) HandleReconcile(ctx *vortex.Context) error {
+	if !rh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	var req logic.ReconcileRequest
+	decoder := json.NewDecoder(ctx.Request().Body)
+	if err := decoder.Decode(&req); err != nil {
+		logx.Errorf("HandleReconcile|ParamsError|decoder err: %v", err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+
+	report, err := rh.reconcile.Reconcile(ctx.GetContext(), &req)
+	if nil != err {
+		logx.Errorf("HandleReconcile|Reconcile|req: %s|err: %v", conv.ToJsonWithoutError(req), err)
+		if errors.Is(err, pkg.ErrorEnums.ErrReconcileActionNotSupport) || errors.Is(err, pkg.ErrorEnums.ErrDepotNotExist) {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"report": report,
+	})
+}
+
+// 重新扫描文件，fid 为空时重新提交仓库下等待扫描和扫描失败的文件
+func (rh *ReconcileHandler) HandleRescan(ctx *vortex.Context) error {
+	if !rh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	var req struct {
+		DepotId string `json:"depot_id,omitempty"`
+		Fid     string `json:"fid,omitempty"`
+	}
+	decoder := json.NewDecoder(ctx.Request().Body)
+	if err := decoder.Decode(&req); err != nil || (len(req.Fid) > 0 && len(req.DepotId) == 0) {
+		logx.Errorf("HandleRescan|ParamsError|req: %s|err: %v", conv.ToJsonWithoutError(req), err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+
+	count := 1
+	var err error
+	if len(req.Fid) > 0 {
+		err = rh.scan.Rescan(ctx.GetContext(), req.DepotId, req.Fid)
+	} else {
+		count, err = rh.scan.RescanPending(ctx.GetContext(), req.DepotId)
+	}
+	if nil != err {
+		logx.Errorf("HandleRescan|Rescan|req: %s|err: %v", conv.ToJsonWithoutError(req), err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		if errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileNotExist), nil)
+		} else if errors.Is(err, pkg.ErrorEnums.ErrFileInfected) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileInfected), nil)
+		} else if errors.Is(err, pkg.ErrorEnums.ErrScanQueueFull) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.TooManyRequests), echo.Map{
+				"count": count,
+			})
+		} else if errors.Is(err, pkg.ErrorEnums.ErrScannerNotEnabled) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.InternalError.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"count": count,
+	})
+}
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+// 分享链接的密码，只通过请求头传递，不接受 url 参数
+const sharePasswordHeader = "X-Share-Password"
+
+// 分享接口的错误码
+func shareSubCode(err error) vortex.SubCode {
+	switch {
+	case errors.Is(err, pkg.ErrorEnums.ErrShareNotExist):
+		return pkg.SubStatusCodes.ShareNotExist
+	case errors.Is(err, pkg.ErrorEnums.ErrSharePasswordNotMatch):
+		return pkg.SubStatusCodes.SharePasswordNotMatch
+	case errors.Is(err, pkg.ErrorEnums.ErrShareExhausted):
+		return pkg.SubStatusCodes.ShareExhausted
+	case errors.Is(err, pkg.ErrorEnums.ErrShareForbidden):
+		return pkg.SubStatusCodes.PermissionDeny
+	case errors.Is(err, pkg.ErrorEnums.ErrShareInvalid):
+		return pkg.SubStatusCodes.BadRequest
+	case errors.Is(err, pkg.ErrorEnums.ErrFileNotExist):
+		return pkg.SubStatusCodes.FileNotExist
+	case errors.Is(err, pkg.ErrorEnums.ErrBoxNotExist):
+		return pkg.SubStatusCodes.BoxNotExist
+	default:
+		return pkg.SubStatusCodes.InternalError
+	}
+}
+
+type createShareReq struct {
+	Fid          *string  `json:"fid,omitempty"`
+	BoxId        *string  `json:"box_id,omitempty"`
+	ExpiresIn    *int64   `json:"expires_in,omitempty"` // 有效期，单位秒
+	Password     string   `json:"password,omitempty"`
+	MaxDownloads *int64   `json:"max_downloads,omitempty"`
+	AllowedIps   []string `json:"allowed_ips,omitempty"`
+}
+
+// 创建分享链接，需要对分享的文件或者box有读取权限
+func (fh *FileHandler) HandleShareCreate(ctx *vortex.Context) error {
+	uid := principal(ctx).Uid
+	if len(uid) == 0 {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "not login")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	var req createShareReq
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		logx.Errorf("HandleShareCreate|ParamsError|decoder err: %v", err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, "param error")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+
+	auditEntry(ctx).SetScope("", ptr.ToString(req.BoxId), ptr.ToString(req.Fid))
+	share := &logic.Share{
+		Creator:      uid,
+		Fid:          req.Fid,
+		BoxId:        req.BoxId,
+		MaxDownloads: req.MaxDownloads,
+		AllowedIps:   req.AllowedIps,
+	}
+	if req.ExpiresIn != nil {
+		share.ExpiresTs = ptr.Int64(time.Now().Unix() + *req.ExpiresIn)
+	}
+	switch {
+	case req.Fid != nil && req.BoxId == nil:
+		info, err := fh.file.QueryFileInfo(ctx.GetContext(), GetDepotId(ctx), *req.Fid)
+		if err != nil {
+			logx.Errorf("HandleShareCreate|QueryFileInfo|fid: %s|err: %v", *req.Fid, err)
+			auditFail(ctx, shareSubCode(err), err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(shareSubCode(err)), nil)
+		}
+		if !fh.checkFilePermission(ctx, info, logic.AccessActions.Read) {
+			auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+		}
+		share.DepotId = info.GetDepotId()
+	case req.BoxId != nil && req.Fid == nil:
+		box, err := fh.box.QueryBoxInfo(ctx.GetContext(), *req.BoxId)
+		if err != nil {
+			logx.Errorf("HandleShareCreate|QueryBoxInfo|boxId: %s|err: %v", *req.BoxId, err)
+			auditFail(ctx, shareSubCode(err), err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(shareSubCode(err)), nil)
+		}
+		if !fh.checkBoxPermission(ctx, box, logic.AccessActions.Read) {
+			auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+		}
+		share.DepotId = ptr.ToString(box.DepotId)
+	default:
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, "one of fid and box_id required")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+			"msg": "one of fid and box_id required",
+		})
+	}
+
+	share, err := fh.share.CreateShare(ctx.GetContext(), share, req.Password)
+	if err != nil {
+		logx.Errorf("HandleShareCreate|CreateShare|uid: %s|err: %v", uid, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(shareSubCode(err)), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	auditEntry(ctx).SetTokenTarget(share.Token)
+	auditEntry(ctx).SetScope(share.DepotId, "", "")
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"share": share,
+	})
+}
+
+// 列举自己创建的分享链接，管理员可以通过 creator 参数查看其他用户的分享
+func (fh *FileHandler) HandleShareList(ctx *vortex.Context) error {
+	creator := principal(ctx).Uid
+	if len(creator) == 0 {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	if other := ctx.QueryParam("creator"); len(other) > 0 && other != creator {
+		if !fh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx)) {
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+		}
+		creator = other
+	}
+	shares, err := fh.share.ListShares(ctx.GetContext(), creator)
+	if err != nil {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"shares": shares,
+	})
+}
+
+// 撤销分享链接，只有创建者和管理员可以撤销
+func (fh *FileHandler) HandleShareRevoke(ctx *vortex.Context) error {
+	uid := principal(ctx).Uid
+	share, err := fh.share.QueryShare(ctx.GetContext(), ctx.Param("token"))
+	if err != nil {
+		auditFail(ctx, shareSubCode(err), err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(shareSubCode(err)), nil)
+	}
+	if len(uid) == 0 || (share.Creator != uid && !fh.access.CheckAdmin(ctx.GetContext(), sessionUid(ctx))) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "permission deny")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	if err = fh.share.RevokeShare(ctx.GetContext(), share); err != nil {
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, nil)
+}
+
+// 查询并校验分享链接，返回分享所在的仓库
+func (fh *FileHandler) resolveShare(ctx *vortex.Context) (*logic.Share, *logic.Depot, error) {
+	share, err := fh.share.QueryShare(ctx.GetContext(), ctx.Param("token"))
+	if err != nil {
+		return nil, nil, err
+	}
+	// 密码不能放在 url 中，会被代理和访问日志记录
+	password := ctx.Request().Header.Get(sharePasswordHeader)
+	if err = fh.share.Authorize(ctx.GetContext(), share, fh.clientIp(ctx.Request()), password); err != nil {
+		return nil, nil, err
+	}
+	auditEntry(ctx).SetScope(share.DepotId, ptr.ToString(share.BoxId), ptr.ToString(share.Fid))
+	depot, err := fh.depot.QueryDepotInfo(ctx.GetContext(), share.DepotId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return share, depot, nil
+}
+
+// 通过分享链接访问，分享单个文件时直接返回文件，分享box时返回文件列表
+func (fh *FileHandler) HandleShare(ctx *vortex.Context) error {
+	share, depot, err := fh.resolveShare(ctx)
+	if err != nil {
+		logx.Errorf("HandleShare|resolveShare|err: %v", err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, err.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(shareSubCode(err)), nil)
+	}
+	if share.Fid != nil {
+		return fh.serveSharedFile(ctx, share, depot, *share.Fid)
+	}
+
+	// 创建者失去box的读取权限后分享同时失效
+	creator := &logic.Principal{Uid: share.Creator}
+	permission, err := fh.access.EffectivePermissions(ctx.GetContext(), creator, depot, ptr.ToString(share.BoxId))
+	if err != nil {
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	infos := make([]*logic.MediaFileInfo, 0)
+	err = fh.file.ScanBoxFiles(ctx.GetContext(), depot.DepotId, ptr.ToString(share.BoxId), func(info *logic.MediaFileInfo) error {
+		if permission.AllowFile(info, logic.AccessActions.Read) && info.CheckReadable() == nil {
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	if err != nil {
+		logx.Errorf("HandleShare|ScanBoxFiles|boxId: %s|err: %v", ptr.ToString(share.BoxId), err)
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	files := make([]echo.Map, 0, len(infos))
+	for _, info := range infos {
+		files = append(files, echo.Map{
+			"fid":            info.Fid,
+			"file_name":      info.FileName,
+			"content_type":   info.ContentType,
+			"content_length": info.ContentLength,
+		})
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"box_id": share.BoxId,
+		"files":  files,
+	})
+}
+
+// 通过box的分享链接访问其中的文件
+func (fh *FileHandler) HandleShareFile(ctx *vortex.Context) error {
+	share, depot, err := fh.resolveShare(ctx)
+	if err != nil {
+		logx.Errorf("HandleShareFile|resolveShare|err: %v", err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, err.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(shareSubCode(err)), nil)
+	}
+	fid := ctx.Param("fid")
+	if share.BoxId == nil && ptr.ToString(share.Fid) != fid {
+		auditFail(ctx, pkg.SubStatusCodes.FileNotExist, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileNotExist), nil)
+	}
+	return fh.serveSharedFile(ctx, share, depot, fid)
+}
+
+// 返回分享的文件，分享给外部的图片在仓库配置了水印时总是加水印
+func (fh *FileHandler) serveSharedFile(ctx *vortex.Context, share *logic.Share, depot *logic.Depot, fid string) error {
+	info, err := fh.file.QueryFileInfo(ctx.GetContext(), depot.DepotId, fid)
+	if err != nil {
+		logx.Errorf("HandleShare|QueryFileInfo|fid: %s|err: %v", fid, err)
+		auditFail(ctx, shareSubCode(err), err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(shareSubCode(err)), nil)
+	}
+	if share.BoxId != nil && (info.Box == nil || info.Box.BoxId != *share.BoxId) {
+		auditFail(ctx, pkg.SubStatusCodes.FileNotExist, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileNotExist), nil)
+	}
+	// 创建者失去文件的读取权限后分享同时失效
+	if !fh.access.CheckFilePermission(ctx.GetContext(), &logic.Principal{Uid: share.Creator}, depot, info, logic.AccessActions.Read) {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "creator permission deny")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	if ctx.Request().Method != http.MethodHead {
+		if err = fh.share.ConsumeDownload(ctx.GetContext(), share); err != nil {
+			logx.Errorf("HandleShare|ConsumeDownload|token: %s|err: %v", share.Token, err)
+			auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, err.Error())
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(shareSubCode(err)), nil)
+		}
+	}
+
+	var watermark *logic.Watermark
+	if depot.WatermarkApplies(info) {
+		watermark = depot.Watermark
+	}
+	return fh.serveFile(ctx, info, watermark)
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+// 签发url时可以指定的图片处理参数
+var signTransformParams = []string{"w", "h", "q", "fit", "format"}
+
+type signUrlReq struct {
+	Fid       string            `json:"fid"`
+	ExpiresIn int64             `json:"expires_in"`          // 有效期，单位秒
+	Variant   string            `json:"variant,omitempty"`   // 预设的衍生图
+	Transform map[string]string `json:"transform,omitempty"` // 图片处理参数 w / h / q / fit / format
+}
+
+// 签发文件的访问url，需要对文件有读取权限，没有原图权限时签发的url总是返回加水印的图片
+func (fh *FileHandler) HandleSignUrl(ctx *vortex.Context) error {
+	var req signUrlReq
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil || len(req.Fid) == 0 {
+		logx.Errorf("HandleSignUrl|ParamsError|decoder err: %v", err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	depotId := GetDepotId(ctx)
+	info, err := fh.file.QueryFileInfo(ctx.GetContext(), depotId, req.Fid)
+	if err != nil {
+		logx.Errorf("HandleSignUrl|QueryFileInfo|fid: %s|err: %v", req.Fid, err)
+		if errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+			auditFail(ctx, pkg.SubStatusCodes.FileNotExist, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.FileNotExist), nil)
+		}
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	depot, err := fh.depot.QueryDepotInfo(ctx.GetContext(), info.GetDepotId())
+	if err != nil {
+		logx.Errorf("HandleSignUrl|QueryDepotInfo|depotId: %s|err: %v", info.GetDepotId(), err)
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	if !fh.access.CheckFilePermission(ctx.GetContext(), principal(ctx), depot, info, logic.AccessActions.Read) {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+
+	// 只接受图片处理参数，depot_id、过期时间和水印由服务端决定
+	query := url.Values{}
+	for _, key := range signTransformParams {
+		if value, ok := req.Transform[key]; ok {
+			query.Set(key, value)
+		}
+	}
+	query.Set("depot_id", depot.DepotId)
+	if len(req.Variant) > 0 {
+		if _, err = fh.image.VariantTransform(ctx.GetContext(), info, req.Variant); err != nil {
+			auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+				"msg": err.Error(),
+			})
+		}
+		query.Set("variant", req.Variant)
+	} else if _, err = logic.ParseImageTransform(query); err != nil {
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	if depot.WatermarkApplies(info) &&
+		!fh.access.CheckFilePermission(ctx.GetContext(), principal(ctx), depot, info, logic.AccessActions.Original) {
+		query.Set(logic.UrlWatermarkParam, "1")
+	}
+
+	signed, expires, err := fh.urlSign.Sign(info.Fid, query, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"url":        (&url.URL{Path: "/media/file/" + info.Fid, RawQuery: signed.Encode()}).String(),
+		"expires_ts": expires,
+	})
+}
@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+)
+
+type UserHandler struct {
+	ctx     context.Context
+	user    *logic.UserLogic
+	session *logic.SessionLogic
+}
+
+func NewUserHandler(ctx context.Context, user *logic.UserLogic, session *logic.SessionLogic) *UserHandler {
+	return &UserHandler{
+		ctx:     ctx,
+		user:    user,
+		session: session,
+	}
+}
+
+// 查询当前登录的用户，未登录或者用户不存在时返回nil
+func (uh *UserHandler) currentUser(ctx *vortex.Context) *logic.User {
+	uid := sessionUid(ctx)
+	if len(uid) == 0 {
+		return nil
+	}
+	user, err := uh.user.QueryUser(ctx.GetContext(), uid)
+	if err != nil {
+		logx.Errorf("UserHandler|currentUser|QueryUser|uid: %s|err: %v", uid, err)
+		return nil
+	}
+	return user
+}
+
+// 校验当前用户是否为管理员
+func (uh *UserHandler) requireAdmin(ctx *vortex.Context) (*logic.User, bool) {
+	user := uh.currentUser(ctx)
+	if user == nil || !user.IsAdmin() {
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Denied, "permission deny")
+		return nil, false
+	}
+	return user, true
+}
+
+// 用户接口的错误码
+func userSubCode(err error) vortex.SubCode {
+	switch {
+	case errors.Is(err, pkg.ErrorEnums.ErrUserExist):
+		return pkg.SubStatusCodes.UserExist
+	case errors.Is(err, pkg.ErrorEnums.ErrUserNotExist):
+		return pkg.SubStatusCodes.UserNotExist
+	case errors.Is(err, pkg.ErrorEnums.ErrPasswordNotMatch):
+		return pkg.SubStatusCodes.PasswordNotMatch
+	case errors.Is(err, pkg.ErrorEnums.ErrBootstrapUser):
+		return pkg.SubStatusCodes.PermissionDeny
+	case errors.Is(err, pkg.ErrorEnums.ErrUsernameInvalid), errors.Is(err, pkg.ErrorEnums.ErrUserRoleInvalid),
+		errors.Is(err, pkg.ErrorEnums.ErrPasswordTooWeak):
+		return pkg.SubStatusCodes.BadRequest
+	default:
+		return pkg.SubStatusCodes.InternalError
+	}
+}
+
+type createUserReq struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles,omitempty"`
+}
+
+// 创建用户，只有管理员可以创建
+func (uh *UserHandler) HandleUserCreate(ctx *vortex.Context) error {
+	admin, ok := uh.requireAdmin(ctx)
+	if !ok {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	var req createUserReq
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		logx.Errorf("HandleUserCreate|ParamsError|decoder err: %v", err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, "param error")
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+
+	auditEntry(ctx).SetTarget(req.Username)
+	user, err := uh.user.CreateUser(ctx.GetContext(), &logic.User{
+		Username: req.Username,
+		Roles:    req.Roles,
+		Creator:  &admin.Uid,
+	}, req.Password)
+	if err != nil {
+		logx.Errorf("HandleUserCreate|CreateUser|username: %s|err: %v", req.Username, err)
+		auditEntry(ctx).Mark(logic.AuditOutcomes.Failure, err.Error())
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(userSubCode(err)), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"user_info": user,
+	})
+}
+
+// 列举用户
+func (uh *UserHandler) HandleUserList(ctx *vortex.Context) error {
+	if _, ok := uh.requireAdmin(ctx); !ok {
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	users, err := uh.user.ListUsers(ctx.GetContext())
+	if err != nil {
+		logx.Errorf("HandleUserList|ListUsers|err: %v", err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"users": users,
+	})
+}
+
+// 禁用用户
+func (uh *UserHandler) HandleUserDisable(ctx *vortex.Context) error {
+	return uh.setUserDisabled(ctx, true)
+}
+
+// 启用用户
+func (uh *UserHandler) HandleUserEnable(ctx *vortex.Context) error {
+	return uh.setUserDisabled(ctx, false)
+}
+
+func (uh *UserHandler) setUserDisabled(ctx *vortex.Context, disabled bool) error {
+	if _, ok := uh.requireAdmin(ctx); !ok {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	uid := ctx.Param("uid")
+	if len(uid) == 0 {
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+	user, err := uh.user.SetUserDisabled(ctx.GetContext(), uid, disabled)
+	if err != nil {
+		logx.Errorf("HandleUserDisable|SetUserDisabled|uid: %s|disabled: %v|err: %v", uid, disabled, err)
+		auditFail(ctx, userSubCode(err), err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(userSubCode(err)), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	// 禁用后已经签发的 token 立即失效
+	if disabled {
+		if err = uh.session.RevokeUserSessions(ctx.GetContext(), uid); err != nil {
+			logx.Errorf("HandleUserDisable|RevokeUserSessions|uid: %s|err: %v", uid, err)
+		}
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, echo.Map{
+		"user_info": user,
+	})
+}
+
+type changePasswordReq struct {
+	Uid         *string `json:"uid,omitempty"` // 为空时修改自己的密码
+	OldPassword *string `json:"old_password,omitempty"`
+	NewPassword string  `json:"new_password"`
+}
+
+// 修改密码，修改自己的密码需要旧密码，管理员可以直接重置其他用户的密码
+func (uh *UserHandler) HandleChangePassword(ctx *vortex.Context) error {
+	current := uh.currentUser(ctx)
+	if current == nil || current.Disabled {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	var req changePasswordReq
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		logx.Errorf("HandleChangePassword|ParamsError|decoder err: %v", err)
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), nil)
+	}
+
+	uid := current.Uid
+	if req.Uid != nil && *req.Uid != current.Uid {
+		if !current.IsAdmin() {
+			auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+			return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+		}
+		uid = *req.Uid
+	} else if req.OldPassword == nil {
+		auditFail(ctx, pkg.SubStatusCodes.BadRequest, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.BadRequest), echo.Map{
+			"msg": "old password required",
+		})
+	}
+
+	// 管理员重置其他用户的密码时不校验旧密码
+	oldPassword := req.OldPassword
+	if uid != current.Uid {
+		oldPassword = nil
+	}
+	if err := uh.user.ChangePassword(ctx.GetContext(), uid, oldPassword, req.NewPassword); err != nil {
+		logx.Errorf("HandleChangePassword|ChangePassword|uid: %s|err: %v", uid, err)
+		auditFail(ctx, userSubCode(err), err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(userSubCode(err)), echo.Map{
+			"msg": err.Error(),
+		})
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, nil)
+}
+
+// 吊销用户的所有会话，用户可以吊销自己的会话，管理员可以吊销其他用户的会话
+func (uh *UserHandler) HandleRevokeSessions(ctx *vortex.Context) error {
+	current := uh.currentUser(ctx)
+	if current == nil {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	uid := ctx.Param("uid")
+	if len(uid) == 0 {
+		uid = current.Uid
+	}
+	if uid != current.Uid && !current.IsAdmin() {
+		auditFail(ctx, pkg.SubStatusCodes.PermissionDeny, nil)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.PermissionDeny), nil)
+	}
+	if _, err := uh.user.QueryUser(ctx.GetContext(), uid); err != nil {
+		auditFail(ctx, userSubCode(err), err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(userSubCode(err)), nil)
+	}
+	if err := uh.session.RevokeUserSessions(ctx.GetContext(), uid); err != nil {
+		logx.Errorf("HandleRevokeSessions|RevokeUserSessions|uid: %s|err: %v", uid, err)
+		auditFail(ctx, pkg.SubStatusCodes.InternalError, err)
+		return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success.WithSubCode(pkg.SubStatusCodes.InternalError), nil)
+	}
+	return vortex.HttpJsonResponse(ctx, vortex.Statuses.Success, nil)
+}
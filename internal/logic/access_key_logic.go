@@ -0,0 +1,488 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/ds"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/redis/go-redis/v9"
+)
+
+// 请求签名相关的常量，格式参考 aws sigv4
+const (
+	SignAlgorithm     = "MS-HMAC-SHA256"
+	SignDateHeader    = "X-Ms-Date"
+	SignContentHeader = "X-Ms-Content-Sha256"
+	SignNonceHeader   = "X-Ms-Nonce" // 每个请求不同，防止签名在有效期内被重放
+	SignDateFormat    = "20060102T150405Z"
+	UnsignedPayload   = "UNSIGNED-PAYLOAD" // 不校验请求体，只允许用于流式上传的接口
+
+	signMaxSkew          = 15 * time.Minute
+	signNonceMinLen      = 16
+	signNonceMaxLen      = 64
+	signMaxBodySize      = 32 << 20 // 校验请求体时最多读取的大小
+	accessKeyRotateGrace = 24 * time.Hour
+	accessKeyMaxGrace    = 7 * 24 * time.Hour
+)
+
+// 必须参与签名的请求头，小写并按字母排序，请求中没有的按空值签名，签名后不能再添加
+// Depot-Id 决定请求操作的仓库，Host 防止签名被用于其他服务
+var signRequiredHeaders = []string{"content-type", "depot-id", "host"}
+
+// AccessKey 服务端调用使用的密钥，只能访问指定的仓库和操作
+type AccessKey struct {
+	AccessKeyId string   `json:"access_key_id"`
+	Owner       string   `json:"owner"` // 所属用户，权限不会超过所属用户
+	DepotIds    []string `json:"depot_ids"`
+	Actions     []string `json:"actions"`
+	Description *string  `json:"description,omitempty"`
+	ExpiresTs   *int64   `json:"expires_ts,omitempty"` // 过期时间，为空时不过期
+	CreatedTs   int64    `json:"created_ts"`
+	RotatedTs   *int64   `json:"rotated_ts,omitempty"`
+}
+
+// Expired 是否已经过期
+func (ak *AccessKey) Expired() bool {
+	return ak.ExpiresTs != nil && time.Now().Unix() >= *ak.ExpiresTs
+}
+
+// 密钥单独存储，轮换后旧的密钥在宽限期内仍然可用
+type accessKeySecret struct {
+	Secret         string `json:"secret"`
+	Previous       string `json:"previous,omitempty"`
+	PreviousExpire int64  `json:"previous_expire,omitempty"`
+}
+
+// Principal 请求的调用方，使用 jwt 登录时只有 Uid，使用密钥签名时 AccessKey 不为空
+type Principal struct {
+	Uid       string
+	AccessKey *AccessKey
+}
+
+// GetUid 调用方的用户id，匿名时为空
+func (p *Principal) GetUid() string {
+	if p == nil {
+		return ""
+	}
+	return p.Uid
+}
+
+// 检查请求的操作是否都是已知的操作
+func checkAccessActions(actions []string) bool {
+	for _, action := range actions {
+		switch action {
+		case AccessActions.Read, AccessActions.Info, AccessActions.Original, AccessActions.Upload, AccessActions.Delete, AccessActions.Admin:
+		default:
+			return false
+		}
+	}
+	return len(actions) > 0
+}
+
+// 派生签名使用的密钥
+func deriveSigningKey(secret, date string) []byte {
+	mac := hmac.New(sha256.New, []byte("MS"+secret))
+	mac.Write([]byte(date[:8]))
+	mac = hmac.New(sha256.New, mac.Sum(nil))
+	mac.Write([]byte("ms_request"))
+	return mac.Sum(nil)
+}
+
+// 构建参与签名的请求头，每行为 小写的名称:去掉首尾空白的值
+func buildCanonicalHeaders(req *http.Request, signedHeaders []string) string {
+	var sb strings.Builder
+	for _, name := range signedHeaders {
+		value := strings.Join(req.Header.Values(name), ",")
+		if name == "host" {
+			// Host 头被 net/http 移到了 req.Host 中
+			value = req.Host
+			if len(value) == 0 {
+				value = req.URL.Host
+			}
+		}
+		sb.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	return sb.String()
+}
+
+// 签名的请求头需要包含所有必须签名的请求头，小写、有序且不重复
+func checkSignedHeaders(signedHeaders []string) bool {
+	for i, name := range signedHeaders {
+		if name != strings.ToLower(name) || (i > 0 && name <= signedHeaders[i-1]) {
+			return false
+		}
+	}
+	for _, name := range signRequiredHeaders {
+		if !slices.Contains(signedHeaders, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// 构建待签名的字符串，query 参数按 key 排序
+func buildStringToSign(req *http.Request, date, nonce, payloadHash string, signedHeaders []string) string {
+	return strings.Join([]string{
+		SignAlgorithm,
+		date,
+		nonce,
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		buildCanonicalHeaders(req, signedHeaders),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func computeSignature(secret, date, stringToSign string) string {
+	mac := hmac.New(sha256.New, deriveSigningKey(secret, date))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest 使用密钥对请求签名，请求体的哈希参与签名
+func SignRequest(req *http.Request, accessKeyId, secret string, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	signRequest(req, accessKeyId, secret, hex.EncodeToString(sum[:]), now)
+}
+
+// SignStreamRequest 按 UNSIGNED-PAYLOAD 签名，用于流式上传大文件
+func SignStreamRequest(req *http.Request, accessKeyId, secret string, now time.Time) {
+	signRequest(req, accessKeyId, secret, UnsignedPayload, now)
+}
+
+func signRequest(req *http.Request, accessKeyId, secret, payloadHash string, now time.Time) {
+	date := now.UTC().Format(SignDateFormat)
+	nonce := generateRandomString(24)
+	req.Header.Set(SignDateHeader, date)
+	req.Header.Set(SignNonceHeader, nonce)
+	req.Header.Set(SignContentHeader, payloadHash)
+	signature := computeSignature(secret, date, buildStringToSign(req, date, nonce, payloadHash, signRequiredHeaders))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, SignedHeaders=%s, Signature=%s",
+		SignAlgorithm, accessKeyId, strings.Join(signRequiredHeaders, ";"), signature))
+}
+
+// SignedRequest 从请求中解析出的签名信息
+type SignedRequest struct {
+	AccessKeyId   string
+	Signature     string
+	SignedHeaders []string
+	Date          string
+	Nonce         string
+	PayloadHash   string
+}
+
+// ParseSignedRequest 解析签名，校验签名时间和请求体的哈希，不校验签名本身
+// allowUnsigned 为 false 时必须对请求体签名，校验请求体时会读取请求体并重新放回请求中
+func ParseSignedRequest(req *http.Request, allowUnsigned bool, now time.Time) (*SignedRequest, error) {
+	id, signedHeaders, signature, ok := parseSignAuthorization(req.Header.Get("Authorization"))
+	if !ok {
+		return nil, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	sr := &SignedRequest{
+		AccessKeyId:   id,
+		Signature:     signature,
+		SignedHeaders: strings.Split(signedHeaders, ";"),
+		Date:          req.Header.Get(SignDateHeader),
+		Nonce:         req.Header.Get(SignNonceHeader),
+		PayloadHash:   req.Header.Get(SignContentHeader),
+	}
+	if !checkSignedHeaders(sr.SignedHeaders) {
+		return nil, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	signTime, err := time.Parse(SignDateFormat, sr.Date)
+	if err != nil {
+		return nil, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	if skew := now.Sub(signTime); skew > signMaxSkew || skew < -signMaxSkew {
+		return nil, pkg.ErrorEnums.ErrSignatureExpired
+	}
+	if len(sr.Nonce) < signNonceMinLen || len(sr.Nonce) > signNonceMaxLen {
+		return nil, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+
+	if sr.PayloadHash == UnsignedPayload {
+		if !allowUnsigned {
+			return nil, pkg.ErrorEnums.ErrPayloadNotSigned
+		}
+		return sr, nil
+	}
+	if len(sr.PayloadHash) != sha256.Size*2 {
+		return nil, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	body := []byte{}
+	if req.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(req.Body, signMaxBodySize+1))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(body) > signMaxBodySize {
+		return nil, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	sum := sha256.Sum256(body)
+	if !hmac.Equal([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(sr.PayloadHash))) {
+		return nil, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return sr, nil
+}
+
+// Match 使用密钥计算签名，和请求中的签名比较
+func (sr *SignedRequest) Match(req *http.Request, secret string) bool {
+	stringToSign := buildStringToSign(req, sr.Date, sr.Nonce, sr.PayloadHash, sr.SignedHeaders)
+	return hmac.Equal([]byte(computeSignature(secret, sr.Date, stringToSign)), []byte(sr.Signature))
+}
+
+// IsSignedRequest 请求是否使用密钥签名
+func IsSignedRequest(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Authorization"), SignAlgorithm+" ")
+}
+
+// 解析 Authorization 头中的 Credential、SignedHeaders 和 Signature
+func parseSignAuthorization(header string) (string, string, string, bool) {
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(strings.TrimPrefix(header, SignAlgorithm+" "), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "Credential":
+			credential = v
+		case "SignedHeaders":
+			signedHeaders = v
+		case "Signature":
+			signature = v
+		}
+	}
+	return credential, signedHeaders, signature, len(credential) > 0 && len(signedHeaders) > 0 && len(signature) > 0
+}
+
+// 密钥服务
+type AccessKeyLogic struct {
+	ctx      context.Context
+	group    string
+	akRedis  *redis.Client
+	userServ *UserLogic
+}
+
+func NewAccessKeyLogic(ctx context.Context, cfg *config.Config, dsServer *ds.DatabaseServer, userServ *UserLogic) *AccessKeyLogic {
+	akRedis, ok := dsServer.GetRedis("user")
+	if !ok {
+		panic("redis [user] not found")
+	}
+	return &AccessKeyLogic{
+		ctx:      ctx,
+		group:    ptr.ToString(cfg.Group),
+		akRedis:  akRedis,
+		userServ: userServ,
+	}
+}
+
+func (akl *AccessKeyLogic) buildAccessKeyInfoKey(id string) string {
+	return fmt.Sprintf("media_storage:%s:accesskey:%s:info", akl.group, id)
+}
+
+func (akl *AccessKeyLogic) buildAccessKeySecretKey(id string) string {
+	return fmt.Sprintf("media_storage:%s:accesskey:%s:secret", akl.group, id)
+}
+
+func (akl *AccessKeyLogic) buildAccessKeyNonceKey(id, nonce string) string {
+	return fmt.Sprintf("media_storage:%s:accesskey:%s:nonce:%s", akl.group, id, nonce)
+}
+
+// CreateAccessKey 创建密钥，secret 只在创建和轮换时返回一次
+func (akl *AccessKeyLogic) CreateAccessKey(ctx context.Context, key *AccessKey) (*AccessKey, string, error) {
+	if len(key.DepotIds) == 0 || !checkAccessActions(key.Actions) {
+		return nil, "", pkg.ErrorEnums.ErrAccessKeyScopeInvalid
+	}
+	if key.ExpiresTs != nil && *key.ExpiresTs <= time.Now().Unix() {
+		return nil, "", pkg.ErrorEnums.ErrAccessKeyScopeInvalid
+	}
+	key.AccessKeyId = "AK" + generateRandomString(18, "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	key.CreatedTs = time.Now().Unix()
+	key.RotatedTs = nil
+	secret := &accessKeySecret{Secret: generateRandomString(40)}
+
+	pipe := akl.akRedis.TxPipeline()
+	pipe.SetNX(ctx, akl.buildAccessKeyInfoKey(key.AccessKeyId), mustMarshal(key), 0)
+	pipe.SetNX(ctx, akl.buildAccessKeySecretKey(key.AccessKeyId), mustMarshal(secret), 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logx.Errorf("AccessKeyLogic|CreateAccessKey|Exec|owner: %s|err: %v", key.Owner, err)
+		return nil, "", err
+	}
+	return key, secret.Secret, nil
+}
+
+func mustMarshal(v any) []byte {
+	raw, _ := json.Marshal(v)
+	return raw
+}
+
+// QueryAccessKey 查询密钥信息
+func (akl *AccessKeyLogic) QueryAccessKey(ctx context.Context, id string) (*AccessKey, error) {
+	raw, err := akl.akRedis.Get(ctx, akl.buildAccessKeyInfoKey(id)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, pkg.ErrorEnums.ErrAccessKeyNotExist
+		}
+		logx.Errorf("AccessKeyLogic|QueryAccessKey|Get|id: %s|err: %v", id, err)
+		return nil, err
+	}
+	var key AccessKey
+	if err = json.Unmarshal(raw, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (akl *AccessKeyLogic) querySecret(ctx context.Context, id string) (*accessKeySecret, error) {
+	raw, err := akl.akRedis.Get(ctx, akl.buildAccessKeySecretKey(id)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, pkg.ErrorEnums.ErrAccessKeyNotExist
+		}
+		return nil, err
+	}
+	var secret accessKeySecret
+	if err = json.Unmarshal(raw, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// RotateAccessKey 生成新的密钥，旧的密钥在宽限期内仍然可以使用，grace 为0时使用默认宽限期
+func (akl *AccessKeyLogic) RotateAccessKey(ctx context.Context, key *AccessKey, grace time.Duration) (string, error) {
+	if grace <= 0 {
+		grace = accessKeyRotateGrace
+	}
+	grace = min(grace, accessKeyMaxGrace)
+	secret, err := akl.querySecret(ctx, key.AccessKeyId)
+	if err != nil {
+		logx.Errorf("AccessKeyLogic|RotateAccessKey|querySecret|id: %s|err: %v", key.AccessKeyId, err)
+		return "", err
+	}
+	now := time.Now()
+	secret.Previous, secret.PreviousExpire = secret.Secret, now.Add(grace).Unix()
+	secret.Secret = generateRandomString(40)
+	key.RotatedTs = ptr.Int64(now.Unix())
+
+	pipe := akl.akRedis.TxPipeline()
+	pipe.Set(ctx, akl.buildAccessKeyInfoKey(key.AccessKeyId), mustMarshal(key), 0)
+	pipe.Set(ctx, akl.buildAccessKeySecretKey(key.AccessKeyId), mustMarshal(secret), 0)
+	if _, err = pipe.Exec(ctx); err != nil {
+		logx.Errorf("AccessKeyLogic|RotateAccessKey|Exec|id: %s|err: %v", key.AccessKeyId, err)
+		return "", err
+	}
+	return secret.Secret, nil
+}
+
+// DeleteAccessKey 删除密钥，立即失效
+func (akl *AccessKeyLogic) DeleteAccessKey(ctx context.Context, id string) error {
+	err := akl.akRedis.Del(ctx, akl.buildAccessKeyInfoKey(id), akl.buildAccessKeySecretKey(id)).Err()
+	if err != nil {
+		logx.Errorf("AccessKeyLogic|DeleteAccessKey|Del|id: %s|err: %v", id, err)
+	}
+	return err
+}
+
+// ListAccessKeys 列举用户的密钥，owner 为空时列举所有密钥
+func (akl *AccessKeyLogic) ListAccessKeys(ctx context.Context, owner string) ([]*AccessKey, error) {
+	keys := make([]*AccessKey, 0)
+	iter := akl.akRedis.Scan(ctx, 0, akl.buildAccessKeyInfoKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		raw, err := akl.akRedis.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			logx.Errorf("AccessKeyLogic|ListAccessKeys|Get|key: %s|err: %v", iter.Val(), err)
+			return nil, err
+		}
+		var key AccessKey
+		if err = json.Unmarshal(raw, &key); err != nil {
+			continue
+		}
+		if len(owner) == 0 || key.Owner == owner {
+			keys = append(keys, &key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		logx.Errorf("AccessKeyLogic|ListAccessKeys|Scan|err: %v", err)
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedTs < keys[j].CreatedTs
+	})
+	return keys, nil
+}
+
+// VerifyRequest 校验请求的签名，校验通过后返回签名使用的密钥
+// allowUnsigned 只在流式上传的接口开启，其他接口必须对请求体签名
+func (akl *AccessKeyLogic) VerifyRequest(ctx context.Context, req *http.Request, allowUnsigned bool) (*AccessKey, error) {
+	sr, err := ParseSignedRequest(req, allowUnsigned, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := akl.QueryAccessKey(ctx, sr.AccessKeyId)
+	if err != nil {
+		if errors.Is(err, pkg.ErrorEnums.ErrAccessKeyNotExist) {
+			return nil, pkg.ErrorEnums.ErrSignatureInvalid
+		}
+		return nil, err
+	}
+	if key.Expired() {
+		return nil, pkg.ErrorEnums.ErrAccessKeyExpired
+	}
+	secret, err := akl.querySecret(ctx, sr.AccessKeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []string{secret.Secret}
+	if len(secret.Previous) > 0 && time.Now().Unix() < secret.PreviousExpire {
+		candidates = append(candidates, secret.Previous)
+	}
+	matched := slices.ContainsFunc(candidates, func(s string) bool {
+		return sr.Match(req, s)
+	})
+	if !matched {
+		return nil, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+
+	// 签名通过后记录 nonce，签名时间前后15分钟都可能有效，保留两倍的时间
+	succ, err := akl.akRedis.SetNX(ctx, akl.buildAccessKeyNonceKey(sr.AccessKeyId, sr.Nonce), 1, 2*signMaxSkew).Result()
+	if err != nil {
+		logx.Errorf("AccessKeyLogic|VerifyRequest|SetNX|id: %s|err: %v", sr.AccessKeyId, err)
+		return nil, err
+	}
+	if !succ {
+		return nil, pkg.ErrorEnums.ErrSignatureReplayed
+	}
+
+	// 所属用户被禁用后密钥同时失效
+	owner, err := akl.userServ.QueryUser(ctx, key.Owner)
+	if err != nil || owner.Disabled {
+		return nil, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	return key, nil
+}
@@ -0,0 +1,319 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/conv"
+	"github.com/dzjyyds666/Allspark-go/ds"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/redis/go-redis/v9"
+)
+
+// 仓库和box上授予的角色
+var AccessRoles = struct {
+	Owner    string // 所有操作，包括授权和管理
+	Editor   string // 读写和删除
+	Uploader string // 只能上传和查看文件信息
+	Viewer   string // 只读
+}{
+	Owner:    "owner",
+	Editor:   "editor",
+	Uploader: "uploader",
+	Viewer:   "viewer",
+}
+
+// 需要校验的操作
+var AccessActions = struct {
+	Read     string // 读取文件内容
+	Info     string // 查看文件和box信息
+	Original string // 读取无水印的原图
+	Upload   string
+	Delete   string
+	Admin    string // 授权、创建box、仓库报告等管理操作
+}{
+	Read:     "read",
+	Info:     "info",
+	Original: "original",
+	Upload:   "upload",
+	Delete:   "delete",
+	Admin:    "admin",
+}
+
+// 角色拥有的操作
+var roleActions = map[string][]string{
+	AccessRoles.Owner:    {AccessActions.Read, AccessActions.Info, AccessActions.Original, AccessActions.Upload, AccessActions.Delete, AccessActions.Admin},
+	AccessRoles.Editor:   {AccessActions.Read, AccessActions.Info, AccessActions.Original, AccessActions.Upload, AccessActions.Delete},
+	AccessRoles.Uploader: {AccessActions.Info, AccessActions.Upload},
+	AccessRoles.Viewer:   {AccessActions.Read, AccessActions.Info},
+}
+
+// 上传者对自己的文件总是拥有的操作
+var uploaderActions = []string{AccessActions.Read, AccessActions.Info, AccessActions.Original}
+
+// AccessGrant 一条授权记录，BoxId 为空时授权整个仓库
+type AccessGrant struct {
+	Uid     string  `json:"uid"`
+	Role    string  `json:"role"`
+	DepotId string  `json:"depot_id"`
+	BoxId   *string `json:"box_id,omitempty"`
+}
+
+// EffectivePermission 用户在仓库或者box上最终拥有的权限
+type EffectivePermission struct {
+	Uid         string   `json:"uid"`
+	DepotId     string   `json:"depot_id"`
+	BoxId       *string  `json:"box_id,omitempty"`
+	AccessKeyId *string  `json:"access_key_id,omitempty"` // 使用密钥签名时的密钥
+	Admin       bool     `json:"admin"`                   // 全局管理员
+	DepotRole   *string  `json:"depot_role,omitempty"`
+	BoxRole     *string  `json:"box_role,omitempty"`
+	Actions     []string `json:"actions"`
+
+	keyActions []string // 密钥允许的操作，为空表示不限制
+}
+
+// Has 是否拥有指定的操作
+func (ep *EffectivePermission) Has(action string) bool {
+	return slices.Contains(ep.Actions, action)
+}
+
+// AllowFile 是否可以对文件执行指定的操作，上传者总是可以读取自己的文件
+func (ep *EffectivePermission) AllowFile(info *MediaFileInfo, action string) bool {
+	if ep.Has(action) {
+		return true
+	}
+	if ep.keyActions != nil && !slices.Contains(ep.keyActions, action) {
+		return false
+	}
+	return info.IsUploader(ep.Uid) && slices.Contains(uploaderActions, action)
+}
+
+// 权限服务，按仓库和box授予角色
+type AccessLogic struct {
+	ctx       context.Context
+	group     string
+	aclRedis  *redis.Client
+	userServ  *UserLogic
+	depotServ *DepotLogic
+	boxServ   *BoxLogic
+}
+
+func NewAccessLogic(ctx context.Context, cfg *config.Config, dsServer *ds.DatabaseServer, userServ *UserLogic, depotServ *DepotLogic, boxServ *BoxLogic) *AccessLogic {
+	aclRedis, ok := dsServer.GetRedis("user")
+	if !ok {
+		panic("redis [user] not found")
+	}
+	return &AccessLogic{
+		ctx:       ctx,
+		group:     ptr.ToString(cfg.Group),
+		aclRedis:  aclRedis,
+		userServ:  userServ,
+		depotServ: depotServ,
+		boxServ:   boxServ,
+	}
+}
+
+// 构建授权记录的key，hash 结构，field 为uid，value 为角色
+func (al *AccessLogic) buildGrantKey(depotId, boxId string) string {
+	if len(boxId) == 0 {
+		return fmt.Sprintf("media_storage:%s:acl:%s", al.group, depotId)
+	}
+	return fmt.Sprintf("media_storage:%s:acl:%s:box:%s", al.group, depotId, boxId)
+}
+
+// Grant 授予角色，同一个范围内重复授权时覆盖之前的角色
+func (al *AccessLogic) Grant(ctx context.Context, grant *AccessGrant) error {
+	if _, ok := roleActions[grant.Role]; !ok {
+		return pkg.ErrorEnums.ErrAccessRoleInvalid
+	}
+	if _, err := al.userServ.QueryUser(ctx, grant.Uid); err != nil {
+		return err
+	}
+	if err := al.checkScope(ctx, grant.DepotId, ptr.ToString(grant.BoxId)); err != nil {
+		return err
+	}
+	err := al.aclRedis.HSet(ctx, al.buildGrantKey(grant.DepotId, ptr.ToString(grant.BoxId)), grant.Uid, grant.Role).Err()
+	if err != nil {
+		logx.Errorf("AccessLogic|Grant|HSet|grant: %s|err: %v", conv.ToJsonWithoutError(grant), err)
+		return err
+	}
+	return nil
+}
+
+// Revoke 撤销用户在范围内的角色
+func (al *AccessLogic) Revoke(ctx context.Context, uid, depotId, boxId string) error {
+	err := al.aclRedis.HDel(ctx, al.buildGrantKey(depotId, boxId), uid).Err()
+	if err != nil {
+		logx.Errorf("AccessLogic|Revoke|HDel|uid: %s|depotId: %s|boxId: %s|err: %v", uid, depotId, boxId, err)
+		return err
+	}
+	return nil
+}
+
+// ListGrants 列举范围内的授权
+func (al *AccessLogic) ListGrants(ctx context.Context, depotId, boxId string) ([]*AccessGrant, error) {
+	roles, err := al.aclRedis.HGetAll(ctx, al.buildGrantKey(depotId, boxId)).Result()
+	if err != nil {
+		logx.Errorf("AccessLogic|ListGrants|HGetAll|depotId: %s|boxId: %s|err: %v", depotId, boxId, err)
+		return nil, err
+	}
+	grants := make([]*AccessGrant, 0, len(roles))
+	for uid, role := range roles {
+		grant := &AccessGrant{Uid: uid, Role: role, DepotId: depotId}
+		if len(boxId) > 0 {
+			grant.BoxId = ptr.String(boxId)
+		}
+		grants = append(grants, grant)
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].Uid < grants[j].Uid
+	})
+	return grants, nil
+}
+
+// 检查授权范围是否存在，box 必须属于仓库
+func (al *AccessLogic) checkScope(ctx context.Context, depotId, boxId string) error {
+	if _, err := al.depotServ.QueryDepotInfo(ctx, depotId); err != nil {
+		return err
+	}
+	if len(boxId) == 0 {
+		return nil
+	}
+	box, err := al.boxServ.QueryBoxInfo(ctx, boxId)
+	if err != nil {
+		return err
+	}
+	if ptr.ToString(box.DepotId) != depotId {
+		return pkg.ErrorEnums.ErrBoxNotExist
+	}
+	return nil
+}
+
+// 查询用户在范围内的角色，没有授权时返回空
+func (al *AccessLogic) queryRole(ctx context.Context, uid, depotId, boxId string) (*string, error) {
+	role, err := al.aclRedis.HGet(ctx, al.buildGrantKey(depotId, boxId), uid).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &role, nil
+}
+
+// EffectivePermissions 计算调用方在仓库或者box上的权限
+// 全局管理员拥有所有操作，仓库的公开设置给所有人默认的权限，仓库和box上的角色取并集
+// 使用密钥时，密钥范围外的仓库按匿名用户处理，范围内的权限不超过密钥允许的操作
+func (al *AccessLogic) EffectivePermissions(ctx context.Context, p *Principal, depot *Depot, boxId string) (*EffectivePermission, error) {
+	uid := p.GetUid()
+	ep := &EffectivePermission{Uid: uid, DepotId: depot.DepotId}
+	if len(boxId) > 0 {
+		ep.BoxId = ptr.String(boxId)
+	}
+	if key := p.AccessKey; key != nil {
+		ep.AccessKeyId = ptr.String(key.AccessKeyId)
+		if !slices.Contains(key.DepotIds, depot.DepotId) {
+			uid, ep.Uid = "", ""
+		} else {
+			ep.keyActions = key.Actions
+		}
+	}
+	actions := make([]string, 0)
+	switch ptr.ToString(depot.Permission) {
+	case DepotPermissions.Public:
+		actions = append(actions, AccessActions.Read, AccessActions.Info, AccessActions.Upload)
+	case DepotPermissions.PublicRead:
+		actions = append(actions, AccessActions.Read, AccessActions.Info)
+	}
+	if depot.Watermark == nil {
+		actions = append(actions, AccessActions.Original)
+	}
+
+	if len(uid) > 0 {
+		user, err := al.userServ.QueryUser(ctx, uid)
+		if err != nil && !errors.Is(err, pkg.ErrorEnums.ErrUserNotExist) {
+			return nil, err
+		}
+		if user != nil && user.Disabled {
+			// 禁用的用户只保留匿名用户的权限
+			ep.Actions = actions
+			return ep, nil
+		}
+		granted := make([]string, 0)
+		ep.Admin = user != nil && user.IsAdmin()
+		if ep.Admin {
+			granted = append(granted, roleActions[AccessRoles.Owner]...)
+		}
+		if slices.Contains(depot.OriginalUsers, uid) {
+			granted = append(granted, AccessActions.Original)
+		}
+		if ep.DepotRole, err = al.queryRole(ctx, uid, depot.DepotId, ""); err != nil {
+			logx.Errorf("AccessLogic|EffectivePermissions|queryRole|uid: %s|depotId: %s|err: %v", uid, depot.DepotId, err)
+			return nil, err
+		}
+		if ep.DepotRole != nil {
+			granted = append(granted, roleActions[*ep.DepotRole]...)
+		}
+		if len(boxId) > 0 {
+			if ep.BoxRole, err = al.queryRole(ctx, uid, depot.DepotId, boxId); err != nil {
+				logx.Errorf("AccessLogic|EffectivePermissions|queryRole|uid: %s|boxId: %s|err: %v", uid, boxId, err)
+				return nil, err
+			}
+			if ep.BoxRole != nil {
+				granted = append(granted, roleActions[*ep.BoxRole]...)
+			}
+		}
+		for _, action := range granted {
+			if ep.keyActions == nil || slices.Contains(ep.keyActions, action) {
+				actions = append(actions, action)
+			}
+		}
+	}
+
+	slices.Sort(actions)
+	ep.Actions = slices.Compact(actions)
+	return ep, nil
+}
+
+// CheckPermission 检查调用方在仓库或者box上是否可以执行操作，查询出错时按没有权限处理
+func (al *AccessLogic) CheckPermission(ctx context.Context, p *Principal, depot *Depot, boxId, action string) bool {
+	ep, err := al.EffectivePermissions(ctx, p, depot, boxId)
+	if err != nil {
+		logx.Errorf("AccessLogic|CheckPermission|EffectivePermissions|uid: %s|depotId: %s|boxId: %s|err: %v", p.GetUid(), depot.DepotId, boxId, err)
+		return false
+	}
+	return ep.Has(action)
+}
+
+// CheckFilePermission 检查调用方是否可以对文件执行操作
+func (al *AccessLogic) CheckFilePermission(ctx context.Context, p *Principal, depot *Depot, info *MediaFileInfo, action string) bool {
+	var boxId string
+	if info.Box != nil {
+		boxId = info.Box.BoxId
+	}
+	ep, err := al.EffectivePermissions(ctx, p, depot, boxId)
+	if err != nil {
+		logx.Errorf("AccessLogic|CheckFilePermission|EffectivePermissions|uid: %s|fid: %s|err: %v", p.GetUid(), info.Fid, err)
+		return false
+	}
+	return ep.AllowFile(info, action)
+}
+
+// CheckAdmin 是否为全局管理员
+func (al *AccessLogic) CheckAdmin(ctx context.Context, uid string) bool {
+	if len(uid) == 0 {
+		return false
+	}
+	user, err := al.userServ.QueryUser(ctx, uid)
+	if err != nil {
+		return false
+	}
+	return user.IsAdmin()
+}
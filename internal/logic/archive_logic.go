@@ -0,0 +1,309 @@
+package logic
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+)
+
+const (
+	defaultArchiveMaxEntries   = 1000
+	defaultArchiveMaxTotalSize = 4 << 30 // 默认解压后最大4G
+)
+
+// 解压后文件元数据中保存相对路径的key
+const archiveRelativePathKey = "relative_path"
+
+// 归档中的单个文件
+type archiveEntry struct {
+	name string
+	size int64
+	r    io.Reader
+}
+
+// 解压服务，把归档文件展开为箱子中的多个文件
+type ArchiveLogic struct {
+	ctx      context.Context
+	cfg      *config.Archive
+	fileServ *FileIndexLogic
+	jobServ  *JobLogic
+}
+
+func NewArchiveLogic(ctx context.Context, cfg *config.Config, fileServ *FileIndexLogic, jobServ *JobLogic) *ArchiveLogic {
+	return &ArchiveLogic{
+		ctx:      ctx,
+		cfg:      cfg.Archive,
+		fileServ: fileServ,
+		jobServ:  jobServ,
+	}
+}
+
+func (al *ArchiveLogic) limits() (maxEntries int, maxTotalSize int64) {
+	maxEntries, maxTotalSize = defaultArchiveMaxEntries, defaultArchiveMaxTotalSize
+	if al.cfg != nil {
+		if al.cfg.MaxEntries > 0 {
+			maxEntries = al.cfg.MaxEntries
+		}
+		if al.cfg.MaxTotalSize > 0 {
+			maxTotalSize = al.cfg.MaxTotalSize
+		}
+	}
+	return
+}
+
+// StartExtract 保存归档文件并创建解压任务，解压异步执行
+func (al *ArchiveLogic) StartExtract(ctx context.Context, prepare *MediaFileInfo, box *Box, r io.Reader) (*Job, error) {
+	// 请求结束后上传的文件会被清理，先落到临时文件
+	tmp, err := os.CreateTemp("", "media-archive-*")
+	if err != nil {
+		logx.Errorf("ArchiveLogic|StartExtract|CreateTemp|fid: %s|err: %v", prepare.Fid, err)
+		return nil, err
+	}
+	if _, err = io.Copy(tmp, r); err != nil {
+		logx.Errorf("ArchiveLogic|StartExtract|Copy|fid: %s|err: %v", prepare.Fid, err)
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	job, err := al.jobServ.CreateJob(ctx, &Job{
+		JobType: JobTypes.Archive,
+		Source:  ptr.String(prepare.FileName),
+		BoxId:   ptr.String(box.BoxId),
+		DepotId: box.DepotId,
+		Creator: prepare.Uploader,
+		Fid:     ptr.String(prepare.Fid),
+		Entries: []*JobEntry{},
+	})
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	// 归档文件本身不再入库
+	if err = al.fileServ.DeletePrepareFileInfo(ctx, prepare.GetDepotId(), prepare.Fid); err != nil {
+		logx.Errorf("ArchiveLogic|StartExtract|DeletePrepareFileInfo|fid: %s|err: %v", prepare.Fid, err)
+	}
+
+	go func() {
+		defer func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}()
+		al.extract(al.ctx, job, prepare, box, tmp)
+	}()
+	return job, nil
+}
+
+// 执行解压，并记录每个条目的状态
+func (al *ArchiveLogic) extract(ctx context.Context, job *Job, prepare *MediaFileInfo, box *Box, archive *os.File) {
+	job.Status = JobStatuses.Running
+	if err := al.jobServ.SaveJob(ctx, job); errors.Is(err, pkg.ErrorEnums.ErrJobCanceled) {
+		return
+	}
+
+	maxEntries, maxTotalSize := al.limits()
+	var total int64
+	err := walkArchive(archive, func(entry *archiveEntry) error {
+		if len(job.Entries) >= maxEntries {
+			return pkg.ErrorEnums.ErrArchiveTooManyEntries
+		}
+		jobEntry := &JobEntry{Name: entry.name, Status: JobStatuses.Running}
+		job.Entries = append(job.Entries, jobEntry)
+
+		relPath, ok := cleanArchivePath(entry.name)
+		if !ok {
+			jobEntry.Status = JobStatuses.Failed
+			jobEntry.Error = ptr.String(pkg.ErrorEnums.ErrArchivePathInvalid.Error())
+			return nil
+		}
+		if total+entry.size > maxTotalSize {
+			jobEntry.Status = JobStatuses.Failed
+			jobEntry.Error = ptr.String(pkg.ErrorEnums.ErrArchiveTooLarge.Error())
+			return pkg.ErrorEnums.ErrArchiveTooLarge
+		}
+		// 头部记录的大小不可信，先按剩余额度落盘，超出时不写入存储和索引
+		tmp, size, err := SpoolArchiveEntry(entry.r, maxTotalSize-total)
+		if err != nil {
+			jobEntry.Status = JobStatuses.Failed
+			jobEntry.Error = ptr.String(err.Error())
+			return err
+		}
+		defer func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}()
+		total += size
+		jobEntry.Size = ptr.Int64(size)
+		fid, err := al.storeEntry(ctx, prepare, box, relPath, tmp, size)
+		if err != nil {
+			logx.Errorf("ArchiveLogic|extract|storeEntry|jobId: %s|entry: %s|err: %v", job.JobId, entry.name, err)
+			jobEntry.Status = JobStatuses.Failed
+			jobEntry.Error = ptr.String(err.Error())
+			return nil
+		}
+		jobEntry.Fid = ptr.String(fid)
+		jobEntry.Status = JobStatuses.Success
+		job.Progress = total
+		return al.jobServ.SaveJob(ctx, job)
+	})
+	if err != nil {
+		logx.Errorf("ArchiveLogic|extract|walkArchive|jobId: %s|err: %v", job.JobId, err)
+		job.Fail(err)
+	} else {
+		job.Status = JobStatuses.Success
+	}
+	job.Progress = total
+	if err = al.jobServ.SaveJob(ctx, job); err != nil && !errors.Is(err, pkg.ErrorEnums.ErrJobCanceled) {
+		logx.Errorf("ArchiveLogic|extract|SaveJob|jobId: %s|err: %v", job.JobId, err)
+	}
+}
+
+// SpoolArchiveEntry 把归档条目落到临时文件，条目流不能seek
+// 超过 budget 时删除临时文件并返回 ErrArchiveTooLarge，成功时由调用方负责删除临时文件
+func SpoolArchiveEntry(r io.Reader, budget int64) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", "media-archive-entry-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(tmp, io.LimitReader(r, budget+1))
+	if err == nil && size > budget {
+		err = pkg.ErrorEnums.ErrArchiveTooLarge
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
+
+// 把归档中的单个文件作为新文件上传到箱子
+func (al *ArchiveLogic) storeEntry(ctx context.Context, prepare *MediaFileInfo, box *Box, relPath string, tmp *os.File, size int64) (string, error) {
+	contentType := mime.TypeByExtension(path.Ext(relPath))
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	header := url.Values{}
+	for k, v := range prepare.MetaData {
+		header[k] = v
+	}
+	header.Set(archiveRelativePathKey, relPath)
+
+	init := &InitUpload{
+		FileName:      ptr.String(path.Base(relPath)),
+		ContentLength: ptr.Int64(size),
+		ContentType:   ptr.String(contentType),
+		Header:        header,
+		Uploader:      prepare.Uploader,
+		BoxId:         ptr.String(box.BoxId),
+	}
+	fid, err := al.fileServ.ApplyUpload(ctx, init, box)
+	if err != nil {
+		return "", err
+	}
+	return fid, al.fileServ.SingleUpload(ctx, box, fid, tmp)
+}
+
+// 清理归档中的路径，拒绝绝对路径和跳出目录的路径
+func cleanArchivePath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if len(name) == 0 || strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+	return cleaned, true
+}
+
+// 遍历归档中的普通文件，支持 zip / tar / tar.gz
+func walkArchive(archive *os.File, fn func(entry *archiveEntry) error) error {
+	magic := make([]byte, 4)
+	if _, err := archive.ReadAt(magic, 0); err != nil {
+		return pkg.ErrorEnums.ErrArchiveNotSupport
+	}
+	stat, err := archive.Stat()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(archive, stat.Size())
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(&archiveEntry{name: f.Name, size: int64(f.UncompressedSize64), r: rc})
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case bytes.Equal(magic[:2], []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(io.NewSectionReader(archive, 0, stat.Size()))
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		return walkTar(tar.NewReader(gr), fn)
+	default:
+		// tar 的魔数在257字节处
+		ustar := make([]byte, 5)
+		if _, err := archive.ReadAt(ustar, 257); err != nil || string(ustar) != "ustar" {
+			return pkg.ErrorEnums.ErrArchiveNotSupport
+		}
+		return walkTar(tar.NewReader(io.NewSectionReader(archive, 0, stat.Size())), fn)
+	}
+}
+
+func walkTar(tr *tar.Reader, fn func(entry *archiveEntry) error) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// 只处理普通文件，软链接等直接跳过
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = fn(&archiveEntry{name: hdr.Name, size: hdr.Size, r: tr}); err != nil {
+			return err
+		}
+	}
+}
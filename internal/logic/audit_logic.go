@@ -0,0 +1,363 @@
+package logic
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/ds"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 审计记录的操作
+var AuditActions = struct {
+	Login           string
+	Logout          string
+	Read            string
+	Apply           string
+	Upload          string
+	Fetch           string
+	Download        string // 打包下载
+	Delete          string
+	SignUrl         string
+	ShareCreate     string
+	ShareRevoke     string
+	ShareAccess     string
+	Grant           string
+	Revoke          string
+	UserCreate      string
+	UserDisable     string
+	UserEnable      string
+	PasswordChange  string
+	SessionRevoke   string
+	AccessKeyCreate string
+	AccessKeyRotate string
+	AccessKeyDelete string
+	DepotCreate     string
+	DepotUpdate     string
+	BoxCreate       string
+	JobCancel       string
+	Reconcile       string
+	Rescan          string
+}{
+	Login:           "login",
+	Logout:          "logout",
+	Read:            "read",
+	Apply:           "apply",
+	Upload:          "upload",
+	Fetch:           "fetch",
+	Download:        "download",
+	Delete:          "delete",
+	SignUrl:         "sign_url",
+	ShareCreate:     "share_create",
+	ShareRevoke:     "share_revoke",
+	ShareAccess:     "share_access",
+	Grant:           "grant",
+	Revoke:          "revoke",
+	UserCreate:      "user_create",
+	UserDisable:     "user_disable",
+	UserEnable:      "user_enable",
+	PasswordChange:  "password_change",
+	SessionRevoke:   "session_revoke",
+	AccessKeyCreate: "access_key_create",
+	AccessKeyRotate: "access_key_rotate",
+	AccessKeyDelete: "access_key_delete",
+	DepotCreate:     "depot_create",
+	DepotUpdate:     "depot_update",
+	BoxCreate:       "box_create",
+	JobCancel:       "job_cancel",
+	Reconcile:       "reconcile",
+	Rescan:          "rescan",
+}
+
+// 操作的结果
+var AuditOutcomes = struct {
+	Success string
+	Failure string
+	Denied  string // 没有权限或者认证失败
+}{
+	Success: "success",
+	Failure: "failure",
+	Denied:  "denied",
+}
+
+const (
+	auditQueueSize       = 4096
+	auditDefaultLimit    = 100
+	auditMaxLimit        = 1000
+	auditCollectionName  = "audit_log"
+	auditShutdownTimeout = 5 * time.Second
+)
+
+// AuditEntry 一条审计记录，只追加不修改
+type AuditEntry struct {
+	Id          string  `json:"id" bson:"_id"`
+	Ts          int64   `json:"ts" bson:"ts"` // 毫秒时间戳
+	Action      string  `json:"action" bson:"action"`
+	Actor       string  `json:"actor,omitempty" bson:"actor,omitempty"` // 操作的用户，匿名访问时为空
+	AccessKeyId *string `json:"access_key_id,omitempty" bson:"access_key_id,omitempty"`
+	Ip          string  `json:"ip" bson:"ip"`
+	UserAgent   string  `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	Method      string  `json:"method" bson:"method"`
+	Path        string  `json:"path" bson:"path"`
+	DepotId     *string `json:"depot_id,omitempty" bson:"depot_id,omitempty"`
+	BoxId       *string `json:"box_id,omitempty" bson:"box_id,omitempty"`
+	Fid         *string `json:"fid,omitempty" bson:"fid,omitempty"`
+	Target      *string `json:"target,omitempty" bson:"target,omitempty"` // 操作的对象，如被授权的用户、分享token、登录的用户名
+	Outcome     string  `json:"outcome" bson:"outcome"`
+	Detail      *string `json:"detail,omitempty" bson:"detail,omitempty"`
+}
+
+// Mark 设置操作的结果，entry 为空时忽略，方便在没有开启审计的接口中调用
+func (e *AuditEntry) Mark(outcome, detail string) {
+	if e == nil {
+		return
+	}
+	e.Outcome = outcome
+	if len(detail) > 0 {
+		e.Detail = &detail
+	}
+}
+
+// SetTarget 设置操作的对象
+func (e *AuditEntry) SetTarget(target string) {
+	if e == nil || len(target) == 0 {
+		return
+	}
+	e.Target = &target
+}
+
+// HashAuditToken 可以直接访问文件的 token 只记录哈希，查询时用已知的 token 计算后比较
+func HashAuditToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// SetTokenTarget 操作的对象是分享 token，对象和路径中只保存哈希
+func (e *AuditEntry) SetTokenTarget(token string) {
+	if e == nil || len(token) == 0 {
+		return
+	}
+	hashed := HashAuditToken(token)
+	e.Target = &hashed
+	e.Path = strings.ReplaceAll(e.Path, token, hashed)
+}
+
+// SetScope 设置操作涉及的仓库、box和文件，为空的参数不覆盖
+func (e *AuditEntry) SetScope(depotId, boxId, fid string) {
+	if e == nil {
+		return
+	}
+	if len(depotId) > 0 {
+		e.DepotId = &depotId
+	}
+	if len(boxId) > 0 {
+		e.BoxId = &boxId
+	}
+	if len(fid) > 0 {
+		e.Fid = &fid
+	}
+}
+
+// AuditQuery 查询审计记录的条件，为空的条件不过滤
+type AuditQuery struct {
+	Actor   string
+	Action  string
+	DepotId string
+	BoxId   string
+	Fid     string
+	Outcome string
+	Ip      string
+	StartTs int64 // 毫秒，包含
+	EndTs   int64 // 毫秒，不包含
+	Offset  int64
+	Limit   int64
+}
+
+func (q *AuditQuery) filter() bson.M {
+	filter := bson.M{}
+	for key, value := range map[string]string{
+		"actor":    q.Actor,
+		"action":   q.Action,
+		"depot_id": q.DepotId,
+		"box_id":   q.BoxId,
+		"fid":      q.Fid,
+		"outcome":  q.Outcome,
+		"ip":       q.Ip,
+	} {
+		if len(value) > 0 {
+			filter[key] = value
+		}
+	}
+	ts := bson.M{}
+	if q.StartTs > 0 {
+		ts["$gte"] = q.StartTs
+	}
+	if q.EndTs > 0 {
+		ts["$lt"] = q.EndTs
+	}
+	if len(ts) > 0 {
+		filter["ts"] = ts
+	}
+	return filter
+}
+
+// 审计服务，记录异步写入 mongo，队列满或者已经关闭时同步写入，不丢弃记录
+type AuditLogic struct {
+	ctx     context.Context
+	coll    *mongo.Collection
+	entries chan *AuditEntry
+	closed  chan struct{}
+	mu      sync.RWMutex // 保护 closing，关闭队列之后不能再写入
+	closing bool
+}
+
+func NewAuditLogic(ctx context.Context, dsServer *ds.DatabaseServer) *AuditLogic {
+	db, ok := dsServer.GetMongo("media_storage")
+	if !ok {
+		panic("mongo [media_storage] not found")
+	}
+	al := &AuditLogic{
+		ctx:     ctx,
+		coll:    db.Collection(auditCollectionName),
+		entries: make(chan *AuditEntry, auditQueueSize),
+		closed:  make(chan struct{}),
+	}
+	al.ensureIndexes()
+	go al.runWriter()
+	return al
+}
+
+// 创建查询使用的索引
+func (al *AuditLogic) ensureIndexes() {
+	_, err := al.coll.Indexes().CreateMany(al.ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "ts", Value: -1}}},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "ts", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "ts", Value: -1}}},
+		{Keys: bson.D{{Key: "depot_id", Value: 1}, {Key: "ts", Value: -1}}},
+		{Keys: bson.D{{Key: "fid", Value: 1}, {Key: "ts", Value: -1}}},
+	})
+	if err != nil {
+		logx.Errorf("AuditLogic|ensureIndexes|CreateMany|err: %v", err)
+	}
+}
+
+func (al *AuditLogic) runWriter() {
+	defer close(al.closed)
+	for entry := range al.entries {
+		al.insert(entry)
+	}
+}
+
+func (al *AuditLogic) insert(entry *AuditEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), auditShutdownTimeout)
+	defer cancel()
+	if _, err := al.coll.InsertOne(ctx, entry); err != nil {
+		logx.Errorf("AuditLogic|insert|InsertOne|action: %s|actor: %s|err: %v", entry.Action, entry.Actor, err)
+	}
+}
+
+// Record 写入一条审计记录
+func (al *AuditLogic) Record(entry *AuditEntry) {
+	if len(entry.Id) == 0 {
+		entry.Id = "au_" + generateRandomString(20)
+	}
+	if entry.Ts == 0 {
+		entry.Ts = time.Now().UnixMilli()
+	}
+	if len(entry.Outcome) == 0 {
+		entry.Outcome = AuditOutcomes.Success
+	}
+	// 关闭后仍在处理的请求直接写入
+	al.mu.RLock()
+	queued := false
+	if !al.closing {
+		select {
+		case al.entries <- entry:
+			queued = true
+		default:
+		}
+	}
+	al.mu.RUnlock()
+	if !queued {
+		al.insert(entry)
+	}
+}
+
+// Close 停止接收记录，等待队列中的记录写完，之后的记录同步写入
+func (al *AuditLogic) Close(ctx context.Context) error {
+	al.mu.Lock()
+	if !al.closing {
+		al.closing = true
+		close(al.entries)
+	}
+	al.mu.Unlock()
+	select {
+	case <-al.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (al *AuditLogic) findOptions(q *AuditQuery) *options.FindOptions {
+	opts := options.Find().SetSort(bson.D{{Key: "ts", Value: -1}, {Key: "_id", Value: -1}})
+	if q.Offset > 0 {
+		opts.SetSkip(q.Offset)
+	}
+	return opts
+}
+
+// Query 分页查询审计记录，按时间倒序
+func (al *AuditLogic) Query(ctx context.Context, q *AuditQuery) ([]*AuditEntry, int64, error) {
+	if q.Limit <= 0 || q.Limit > auditMaxLimit {
+		q.Limit = auditDefaultLimit
+	}
+	filter := q.filter()
+	total, err := al.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		logx.Errorf("AuditLogic|Query|CountDocuments|err: %v", err)
+		return nil, 0, err
+	}
+	cursor, err := al.coll.Find(ctx, filter, al.findOptions(q).SetLimit(q.Limit))
+	if err != nil {
+		logx.Errorf("AuditLogic|Query|Find|err: %v", err)
+		return nil, 0, err
+	}
+	entries := make([]*AuditEntry, 0)
+	if err = cursor.All(ctx, &entries); err != nil {
+		logx.Errorf("AuditLogic|Query|All|err: %v", err)
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+// Export 按条件导出所有审计记录，每行一条 json
+func (al *AuditLogic) Export(ctx context.Context, q *AuditQuery, w io.Writer) error {
+	cursor, err := al.coll.Find(ctx, q.filter(), al.findOptions(q))
+	if err != nil {
+		logx.Errorf("AuditLogic|Export|Find|err: %v", err)
+		return err
+	}
+	defer cursor.Close(ctx)
+	encoder := json.NewEncoder(w)
+	for cursor.Next(ctx) {
+		var entry AuditEntry
+		if err = cursor.Decode(&entry); err != nil {
+			logx.Errorf("AuditLogic|Export|Decode|err: %v", err)
+			return err
+		}
+		if err = encoder.Encode(&entry); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
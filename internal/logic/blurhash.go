@@ -0,0 +1,182 @@
+package logic
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	blurHashComponentX = 4
+	blurHashComponentY = 3
+	placeholderSize    = 64 // 计算占位信息前先缩小图片
+	paletteSize        = 5
+)
+
+// PaletteColor 图片的主要颜色
+type PaletteColor struct {
+	Color string  `json:"color" bson:"color"` // #rrggbb
+	Ratio float64 `json:"ratio" bson:"ratio"` // 占比
+}
+
+// 缩小图片用于计算占位信息，计算量和原图大小无关
+func shrinkImage(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > placeholderSize || h > placeholderSize {
+		if w >= h {
+			w, h = placeholderSize, max(1, h*placeholderSize/w)
+		} else {
+			w, h = max(1, w*placeholderSize/h), placeholderSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(sb *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// EncodeBlurHash 计算图片的 BlurHash，https://blurha.sh
+func EncodeBlurHash(src image.Image) string {
+	img := shrinkImage(src)
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	// 先把像素转换到线性空间
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*img.Stride + x*4
+			linear[y*w+x] = [3]float64{srgbToLinear(img.Pix[i]), srgbToLinear(img.Pix[i+1]), srgbToLinear(img.Pix[i+2])}
+		}
+	}
+
+	factors := make([][3]float64, 0, blurHashComponentX*blurHashComponentY)
+	for j := 0; j < blurHashComponentY; j++ {
+		for i := 0; i < blurHashComponentX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := linear[y*w+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	encodeBase83(&sb, (blurHashComponentX-1)+(blurHashComponentY-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		encodeBase83(&sb, quantisedMax, 1)
+	} else {
+		encodeBase83(&sb, 0, 1)
+	}
+
+	encodeBase83(&sb, linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4)
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		encodeBase83(&sb, quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+	return sb.String()
+}
+
+// DominantColors 统计图片中占比最高的几种颜色，颜色按每通道4位量化后合并
+func DominantColors(src image.Image) []*PaletteColor {
+	img := shrinkImage(src)
+	type bucket struct {
+		key, r, g, b, count int
+	}
+	buckets := make(map[int]*bucket)
+	total := 0
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		// 忽略透明像素
+		if img.Pix[i+3] < 128 {
+			continue
+		}
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		key := r>>4<<8 | g>>4<<4 | b>>4
+		bk, ok := buckets[key]
+		if !ok {
+			bk = &bucket{key: key}
+			buckets[key] = bk
+		}
+		bk.r += r
+		bk.g += g
+		bk.b += b
+		bk.count++
+		total++
+	}
+	if total == 0 {
+		return nil
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].key < sorted[j].key
+	})
+	palette := make([]*PaletteColor, 0, paletteSize)
+	for _, bk := range sorted[:min(paletteSize, len(sorted))] {
+		palette = append(palette, &PaletteColor{
+			Color: fmt.Sprintf("#%02x%02x%02x", bk.r/bk.count, bk.g/bk.count, bk.b/bk.count),
+			Ratio: math.Round(float64(bk.count)/float64(total)*1000) / 1000,
+		})
+	}
+	return palette
+}
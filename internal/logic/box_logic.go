@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"github.com/dzjyyds666/mediaStorage/pkg"
 	"net/url"
+	"sort"
+	"strconv"
 
 	"github.com/aws/smithy-go/ptr"
 	"github.com/dzjyyds666/Allspark-go/ds"
@@ -17,12 +19,17 @@ import (
 
 // 箱子的结构
 type Box struct {
-	BoxId      string     `json:"box_id" bson:"_id"`
-	BoxName    *string    `json:"box_name,omitempty" bson:"box_name,omitempty"`
-	FileNumber *int64     `json:"file_number,omitempty" bson:"file_number,omitempty"`
-	SpaceUsed  *int64     `json:"space_used,omitempty" bson:"space_used,omitempty"`
-	MetaData   url.Values `json:"meta_data,omitempty" bson:"meta_data,omitempty"`
-	DepotId    *string    `json:"depot_id,omitempty" bson:"depot_id,omitempty"`
+	BoxId             string     `json:"box_id" bson:"_id"`
+	BoxName           *string    `json:"box_name,omitempty" bson:"box_name,omitempty"`
+	FileNumber        *int64     `json:"file_number,omitempty" bson:"file_number,omitempty"`
+	SpaceUsed         *int64     `json:"space_used,omitempty" bson:"space_used,omitempty"`                   // 逻辑大小，压缩前
+	PhysicalSpaceUsed *int64     `json:"physical_space_used,omitempty" bson:"physical_space_used,omitempty"` // 实际存储大小
+	MetaData          url.Values `json:"meta_data,omitempty" bson:"meta_data,omitempty"`
+	DepotId           *string    `json:"depot_id,omitempty" bson:"depot_id,omitempty"`
+
+	Variants   map[string]*ImageTransform `json:"variants,omitempty" bson:"variants,omitempty"`       // 图片衍生图预设，上传完成后自动生成
+	AllowTypes []string                   `json:"allow_types,omitempty" bson:"allow_types,omitempty"` // 允许上传的类型，MIME 类型或者 .扩展名
+	DenyTypes  []string                   `json:"deny_types,omitempty" bson:"deny_types,omitempty"`   // 禁止上传的类型，优先于允许列表
 }
 
 type BoxLogic struct {
@@ -54,6 +61,11 @@ func (bs *BoxLogic) buildBoxInfoKey(id string) string {
 	return fmt.Sprintf("media_storage:%s:box:%s:info", bs.group, id)
 }
 
+// 构建box用量key
+func (bs *BoxLogic) buildBoxUsageKey(id string) string {
+	return fmt.Sprintf("media_storage:%s:box:%s:usage", bs.group, id)
+}
+
 func (bs *BoxLogic) StartCheck() error {
 	// 创建默认的box
 	defaultBox := &Box{
@@ -73,6 +85,9 @@ func (bs *BoxLogic) CreateBox(ctx context.Context, info *Box) (*Box, error) {
 	if info.DepotId == nil {
 		info.DepotId = ptr.String("default")
 	}
+	if err := CheckVariantPresets(info.Variants); err != nil {
+		return nil, err
+	}
 	raw, err := json.Marshal(info)
 	if nil != err {
 		logx.Errorf("BoxServer|CreateBox|json.Marshal|err: %v", err)
@@ -118,3 +133,71 @@ func (bs *BoxLogic) QueryBoxInfo(ctx context.Context, boxId string) (*Box, error
 	}
 	return &box, nil
 }
+
+// 查询盒子的用量
+func (bs *BoxLogic) QueryBoxUsage(ctx context.Context, box *Box) error {
+	usage, err := bs.boxRDB.HGetAll(ctx, bs.buildBoxUsageKey(box.BoxId)).Result()
+	if err != nil {
+		logx.Errorf("BoxServer|QueryBoxUsage|HGetAll|boxId: %s|err: %v", box.BoxId, err)
+		return err
+	}
+	parse := func(field string) *int64 {
+		v, err := strconv.ParseInt(usage[field], 10, 64)
+		if err != nil {
+			return ptr.Int64(0)
+		}
+		return ptr.Int64(v)
+	}
+	box.FileNumber = parse("file_number")
+	box.SpaceUsed = parse("space_used")
+	box.PhysicalSpaceUsed = parse("physical_space_used")
+	return nil
+}
+
+// 增加盒子的用量，删除文件时传入负数
+func (bs *BoxLogic) IncrBoxUsage(ctx context.Context, boxId string, fileNumber, logical, physical int64) error {
+	key := bs.buildBoxUsageKey(boxId)
+	pipe := bs.boxRDB.TxPipeline()
+	pipe.HIncrBy(ctx, key, "file_number", fileNumber)
+	pipe.HIncrBy(ctx, key, "space_used", logical)
+	pipe.HIncrBy(ctx, key, "physical_space_used", physical)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		logx.Errorf("BoxServer|IncrBoxUsage|Exec|boxId: %s|err: %v", boxId, err)
+		return err
+	}
+	return nil
+}
+
+// ListBoxes 列举仓库下的盒子，depotId 为空时列举所有盒子，按 id 排序
+func (bs *BoxLogic) ListBoxes(ctx context.Context, depotId string) ([]*Box, error) {
+	boxes := make([]*Box, 0)
+	iter := bs.boxRDB.Scan(ctx, 0, bs.buildBoxInfoKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		raw, err := bs.boxRDB.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			logx.Errorf("BoxServer|ListBoxes|Get|key: %s|err: %v", iter.Val(), err)
+			return nil, err
+		}
+		var box Box
+		if err = json.Unmarshal(raw, &box); err != nil {
+			logx.Errorf("BoxServer|ListBoxes|Unmarshal|key: %s|err: %v", iter.Val(), err)
+			continue
+		}
+		if len(depotId) > 0 && ptr.ToString(box.DepotId) != depotId {
+			continue
+		}
+		boxes = append(boxes, &box)
+	}
+	if err := iter.Err(); err != nil {
+		logx.Errorf("BoxServer|ListBoxes|Scan|err: %v", err)
+		return nil, err
+	}
+	sort.Slice(boxes, func(i, j int) bool {
+		return boxes[i].BoxId < boxes[j].BoxId
+	})
+	return boxes, nil
+}
@@ -0,0 +1,125 @@
+package logic
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 支持的压缩方式，同时也是 Content-Encoding 的取值
+var Compressions = struct {
+	None string
+	Gzip string
+	Zstd string
+}{
+	None: "",
+	Gzip: "gzip",
+	Zstd: "zstd",
+}
+
+// 仓库未配置时默认压缩的文件类型，按前缀匹配
+var defaultCompressTypes = []string{
+	"text/",
+	"application/json",
+	"application/xml",
+	"application/javascript",
+	"image/svg+xml",
+}
+
+// 检查压缩方式是否支持
+func checkCompression(compression string) error {
+	switch compression {
+	case Compressions.None, Compressions.Gzip, Compressions.Zstd:
+		return nil
+	default:
+		return pkg.ErrorEnums.ErrCompressionNotSupport
+	}
+}
+
+// 判断文件是否需要压缩存储
+func shouldCompress(depot *Depot, contentType string) bool {
+	if depot == nil || depot.Compression == nil || len(*depot.Compression) == 0 {
+		return false
+	}
+	types := depot.CompressTypes
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, t := range types {
+		if strings.HasPrefix(contentType, strings.ToLower(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 创建压缩流，写入的数据压缩后写到 w
+func newCompressWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case Compressions.Gzip:
+		return gzip.NewWriter(w), nil
+	case Compressions.Zstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, pkg.ErrorEnums.ErrCompressionNotSupport
+	}
+}
+
+// CompressReader 边读边压缩，不把整个文件放到内存中
+// 读取方需要读到 EOF 或者调用 Close，否则压缩的协程不会退出
+func CompressReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	w, err := newCompressWriter(encoding, pw)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, err := io.Copy(w, r)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z *zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// NewDecompressReader 创建解压流
+func NewDecompressReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case Compressions.Gzip:
+		return gzip.NewReader(r)
+	case Compressions.Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &zstdReadCloser{Decoder: zr}, nil
+	default:
+		return nil, pkg.ErrorEnums.ErrCompressionNotSupport
+	}
+}
+
+// 统计读取的字节数
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
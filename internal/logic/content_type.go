@@ -0,0 +1,176 @@
+package logic
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/dzjyyds666/mediaStorage/pkg"
+)
+
+// 判断文件类型时读取的文件头长度
+const sniffHeadSize = 512
+
+// 可执行文件的类型，标准库无法识别
+var executableTypes = []struct {
+	magic       []byte
+	contentType string
+}{
+	{magic: []byte("MZ"), contentType: "application/x-msdownload"},
+	{magic: []byte("\x7fELF"), contentType: "application/x-executable"},
+	{magic: []byte{0xfe, 0xed, 0xfa, 0xce}, contentType: "application/x-mach-binary"},
+	{magic: []byte{0xfe, 0xed, 0xfa, 0xcf}, contentType: "application/x-mach-binary"},
+	{magic: []byte{0xce, 0xfa, 0xed, 0xfe}, contentType: "application/x-mach-binary"},
+	{magic: []byte{0xcf, 0xfa, 0xed, 0xfe}, contentType: "application/x-mach-binary"},
+	{magic: []byte("#!"), contentType: "text/x-shellscript"},
+}
+
+// DetectContentType 根据文件头判断文件的真实类型
+func DetectContentType(head []byte) string {
+	for _, t := range executableTypes {
+		if bytes.HasPrefix(head, t.magic) {
+			return t.contentType
+		}
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0 && head[1]>>1&0x03 == 0x01:
+		// 没有 ID3 标签的 mp3
+		return "audio/mpeg"
+	}
+	return normalizeContentType(http.DetectContentType(head))
+}
+
+// zip 容器格式按扩展名对应的具体类型，文件头只能识别为 application/zip
+var zipContainerTypes = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".epub": "application/epub+zip",
+	".jar":  "application/java-archive",
+	".apk":  "application/vnd.android.package-archive",
+}
+
+// xml 格式按扩展名对应的具体类型
+var xmlContainerTypes = map[string]string{
+	".svg": "image/svg+xml",
+}
+
+// RefineDetectedType 文件头只能识别出容器格式时，按扩展名或者同一容器格式的声明类型细化为具体类型
+// 声明的类型和容器格式不一致时保留文件头的结果
+func RefineDetectedType(detected, declared, fileName string) string {
+	ext := strings.ToLower(path.Ext(fileName))
+	declared = normalizeContentType(declared)
+	switch detected {
+	case "application/zip":
+		if t, ok := zipContainerTypes[ext]; ok {
+			return t
+		}
+		for _, t := range zipContainerTypes {
+			if declared == t {
+				return t
+			}
+		}
+	case "text/xml":
+		if t, ok := xmlContainerTypes[ext]; ok {
+			return t
+		}
+		if declared == "application/xml" || strings.HasSuffix(declared, "+xml") {
+			return declared
+		}
+	}
+	return detected
+}
+
+// 文件头无法判断具体格式的类型
+func isGenericType(contentType string) bool {
+	return contentType == "text/plain" || contentType == "application/octet-stream"
+}
+
+// 去掉参数并转换为小写，如 text/plain; charset=utf-8 => text/plain
+func normalizeContentType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+// CheckFileType 校验文件是否符合箱子的类型限制
+// 规则以 . 开头的是扩展名，其他的是 MIME 类型，支持 image/* 的写法
+// 先检查黑名单，再检查白名单，白名单为空时不限制
+func CheckFileType(box *Box, fileName string, contentTypes ...string) error {
+	if box == nil {
+		return nil
+	}
+	ext := strings.ToLower(path.Ext(fileName))
+	types := make([]string, 0, len(contentTypes))
+	for _, t := range contentTypes {
+		if t = normalizeContentType(t); len(t) > 0 {
+			types = append(types, t)
+		}
+	}
+
+	for _, rule := range box.DenyTypes {
+		rule = strings.ToLower(rule)
+		if isExtRule(rule) {
+			if ext == rule {
+				return pkg.ErrorEnums.ErrFileTypeNotAllowed
+			}
+			continue
+		}
+		for _, t := range types {
+			if matchMimeRule(rule, t) {
+				return pkg.ErrorEnums.ErrFileTypeNotAllowed
+			}
+		}
+	}
+
+	if len(box.AllowTypes) == 0 {
+		return nil
+	}
+	var extRules, mimeRules []string
+	for _, rule := range box.AllowTypes {
+		rule = strings.ToLower(rule)
+		if isExtRule(rule) {
+			extRules = append(extRules, rule)
+		} else {
+			mimeRules = append(mimeRules, rule)
+		}
+	}
+	if len(extRules) > 0 && !slices.Contains(extRules, ext) {
+		return pkg.ErrorEnums.ErrFileTypeNotAllowed
+	}
+	if len(mimeRules) == 0 {
+		return nil
+	}
+	for _, t := range types {
+		matched := false
+		for _, rule := range mimeRules {
+			if matchMimeRule(rule, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return pkg.ErrorEnums.ErrFileTypeNotAllowed
+		}
+	}
+	return nil
+}
+
+func isExtRule(rule string) bool {
+	return strings.HasPrefix(rule, ".")
+}
+
+func matchMimeRule(rule, contentType string) bool {
+	if rule == "*/*" || rule == contentType {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(rule, "/*"); ok {
+		return strings.HasPrefix(contentType, prefix+"/")
+	}
+	return false
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"math/big"
 	"net/url"
+	"sort"
 
 	"github.com/aws/smithy-go/ptr"
 	"github.com/dzjyyds666/Allspark-go/conv"
@@ -67,6 +68,20 @@ type Depot struct {
 	Permission     *string    `json:"permission,omitempty" bson:"permission,omitempty"`
 	PermissionHook *string    `json:"permission_hook,omitempty" bson:"permission_hook,omitempty"` // 权限钩子,是一个url类型的，可以是webhook，也可以是redis
 	MetaData       url.Values `json:"meta_data,omitempty" bson:"meta_data,omitempty"`             // 元数据
+	Encryption     *string    `json:"encryption,omitempty" bson:"encryption,omitempty"`           // 服务端加密方式 sse-s3 / sse-c
+	SSECKeyId      *string    `json:"sse_c_key_id,omitempty" bson:"sse_c_key_id,omitempty"`       // sse-c 使用的密钥id，对应配置中的 sse_c_keys
+	Compression    *string    `json:"compression,omitempty" bson:"compression,omitempty"`         // 存储压缩方式 gzip / zstd
+	CompressTypes  []string   `json:"compress_types,omitempty" bson:"compress_types,omitempty"`   // 需要压缩的文件类型，按前缀匹配
+	StripMetadata  *string    `json:"strip_metadata,omitempty" bson:"strip_metadata,omitempty"`   // 上传时去除图片元数据 gps / all
+	Watermark      *Watermark `json:"watermark,omitempty" bson:"watermark,omitempty"`             // 读取图片时叠加的水印
+	OriginalUsers  []string   `json:"original_users,omitempty" bson:"original_users,omitempty"`   // 可以读取无水印原图的用户，上传者总是可以读取
+
+	RateLimit *config.RateLimit `json:"rate_limit,omitempty" bson:"rate_limit,omitempty"` // 仓库单独的频率和带宽限制，覆盖全局配置
+}
+
+// WatermarkApplies 仓库设置了水印时，没有原图权限的调用方读取图片需要加水印
+func (d *Depot) WatermarkApplies(info *MediaFileInfo) bool {
+	return d.Watermark != nil && IsImage(info)
 }
 
 // 切片服务，文件存储分为两部分 桶 => 仓库 => 箱子 => file
@@ -75,6 +90,7 @@ type DepotLogic struct {
 	group    string
 	depotRDB *redis.Client
 	boxServ  *BoxLogic
+	sseKeys  map[string]string // sse-c 密钥，用于创建仓库时校验
 }
 
 // 仓库
@@ -89,6 +105,7 @@ func NewDepotLogic(ctx context.Context, cfg *config.Config, dsServer *ds.Databas
 		group:    ptr.ToString(cfg.Group),
 		depotRDB: depotRedis,
 		boxServ:  boxServer,
+		sseKeys:  cfg.S3.SSECKeys,
 	}
 
 	err := ds.StartCheck()
@@ -123,6 +140,31 @@ func (ds *DepotLogic) CreateDepot(ctx context.Context, info *Depot) (*Depot, err
 	if info.Permission == nil {
 		info.Permission = ptr.String(DepotPermissions.Public)
 	}
+	switch ptr.ToString(info.Encryption) {
+	case SSEModes.None, SSEModes.SSES3:
+	case SSEModes.SSEC:
+		if _, ok := ds.sseKeys[ptr.ToString(info.SSECKeyId)]; !ok {
+			return nil, pkg.ErrorEnums.ErrSSECKeyNotExist
+		}
+	default:
+		return nil, pkg.ErrorEnums.ErrSSEModeNotSupport
+	}
+	if err := checkCompression(ptr.ToString(info.Compression)); err != nil {
+		return nil, err
+	}
+	if !checkMetadataStrip(ptr.ToString(info.StripMetadata)) {
+		return nil, pkg.ErrorEnums.ErrMetadataStripNotSupport
+	}
+	if err := CheckWatermark(info.Watermark); err != nil {
+		return nil, err
+	}
+	// 水印图片需要是仓库中的文件，仓库创建之后通过修改接口设置
+	if info.Watermark != nil && info.Watermark.ImageFid != nil {
+		return nil, pkg.ErrorEnums.ErrWatermarkInvalid
+	}
+	if !CheckRateLimit(info.RateLimit) {
+		return nil, pkg.ErrorEnums.ErrRateLimitInvalid
+	}
 
 	raw, err := json.Marshal(info)
 	if nil != err {
@@ -175,3 +217,125 @@ func do(funcs ...FileOption) FileOption {
 		return nil
 	}
 }
+
+// DepotUpdate 仓库创建后可以修改的配置，为空的字段不修改
+// 加密方式会影响已经存储的对象，不能修改
+type DepotUpdate struct {
+	DepotName      *string           `json:"depot_name,omitempty"`
+	Watermark      *Watermark        `json:"watermark,omitempty"`
+	ClearWatermark bool              `json:"clear_watermark,omitempty"` // 去掉水印
+	OriginalUsers  []string          `json:"original_users,omitempty"`
+	StripMetadata  *string           `json:"strip_metadata,omitempty"`
+	RateLimit      *config.RateLimit `json:"rate_limit,omitempty"`
+}
+
+// UpdateDepot 修改仓库的配置
+func (ds *DepotLogic) UpdateDepot(ctx context.Context, depotId string, update *DepotUpdate) (*Depot, error) {
+	depot, err := ds.QueryDepotInfo(ctx, depotId)
+	if err != nil {
+		return nil, err
+	}
+	if update.DepotName != nil {
+		depot.DepotName = update.DepotName
+	}
+	if update.ClearWatermark {
+		depot.Watermark = nil
+	} else if update.Watermark != nil {
+		if err = CheckWatermark(update.Watermark); err != nil {
+			return nil, err
+		}
+		depot.Watermark = update.Watermark
+	}
+	if update.OriginalUsers != nil {
+		depot.OriginalUsers = update.OriginalUsers
+	}
+	if update.StripMetadata != nil {
+		if !checkMetadataStrip(ptr.ToString(update.StripMetadata)) {
+			return nil, pkg.ErrorEnums.ErrMetadataStripNotSupport
+		}
+		depot.StripMetadata = update.StripMetadata
+	}
+	if update.RateLimit != nil {
+		if !CheckRateLimit(update.RateLimit) {
+			return nil, pkg.ErrorEnums.ErrRateLimitInvalid
+		}
+		depot.RateLimit = update.RateLimit
+	}
+
+	raw, err := json.Marshal(depot)
+	if err != nil {
+		logx.Errorf("DepotServer|UpdateDepot|json.Marshal|depotId: %s|err: %v", depotId, err)
+		return nil, err
+	}
+	succ, err := ds.depotRDB.SetXX(ctx, ds.buildDepotInfoKey(depotId), raw, redis.KeepTTL).Result()
+	if err != nil {
+		logx.Errorf("DepotServer|UpdateDepot|SetXX|depotId: %s|err: %v", depotId, err)
+		return nil, err
+	}
+	if !succ {
+		return nil, pkg.ErrorEnums.ErrDepotNotExist
+	}
+	return depot, nil
+}
+
+// ListDepots 列举所有仓库，按 id 排序
+func (ds *DepotLogic) ListDepots(ctx context.Context) ([]*Depot, error) {
+	depots := make([]*Depot, 0)
+	iter := ds.depotRDB.Scan(ctx, 0, ds.buildDepotInfoKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		raw, err := ds.depotRDB.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			logx.Errorf("DepotServer|ListDepots|Get|key: %s|err: %v", iter.Val(), err)
+			return nil, err
+		}
+		var depot Depot
+		if err = json.Unmarshal(raw, &depot); err != nil {
+			logx.Errorf("DepotServer|ListDepots|Unmarshal|key: %s|err: %v", iter.Val(), err)
+			continue
+		}
+		depots = append(depots, &depot)
+	}
+	if err := iter.Err(); err != nil {
+		logx.Errorf("DepotServer|ListDepots|Scan|err: %v", err)
+		return nil, err
+	}
+	sort.Slice(depots, func(i, j int) bool {
+		return depots[i].DepotId < depots[j].DepotId
+	})
+	return depots, nil
+}
+
+// DepotUsage 仓库的用量，由仓库下所有盒子的用量汇总
+type DepotUsage struct {
+	DepotId           string `json:"depot_id"`
+	BoxNumber         int64  `json:"box_number"`
+	FileNumber        int64  `json:"file_number"`
+	SpaceUsed         int64  `json:"space_used"`
+	PhysicalSpaceUsed int64  `json:"physical_space_used"`
+}
+
+// QueryDepotUsage 汇总仓库的用量，boxes 中会填充每个盒子的用量
+func (ds *DepotLogic) QueryDepotUsage(ctx context.Context, depotId string) (*DepotUsage, []*Box, error) {
+	if _, err := ds.QueryDepotInfo(ctx, depotId); err != nil {
+		return nil, nil, err
+	}
+	boxes, err := ds.boxServ.ListBoxes(ctx, depotId)
+	if err != nil {
+		logx.Errorf("DepotServer|QueryDepotUsage|ListBoxes|depotId: %s|err: %v", depotId, err)
+		return nil, nil, err
+	}
+	usage := &DepotUsage{DepotId: depotId, BoxNumber: int64(len(boxes))}
+	for _, box := range boxes {
+		if err = ds.boxServ.QueryBoxUsage(ctx, box); err != nil {
+			logx.Errorf("DepotServer|QueryDepotUsage|QueryBoxUsage|boxId: %s|err: %v", box.BoxId, err)
+			return nil, nil, err
+		}
+		usage.FileNumber += ptr.ToInt64(box.FileNumber)
+		usage.SpaceUsed += ptr.ToInt64(box.SpaceUsed)
+		usage.PhysicalSpaceUsed += ptr.ToInt64(box.PhysicalSpaceUsed)
+	}
+	return usage, boxes, nil
+}
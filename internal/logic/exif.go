@@ -0,0 +1,624 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"strings"
+	"time"
+)
+
+// 上传时去除图片元数据的方式
+var MetadataStrips = struct {
+	None string // 保留
+	Gps  string // 只去除GPS信息
+	All  string // 去除全部 EXIF / XMP
+}{
+	None: "",
+	Gps:  "gps",
+	All:  "all",
+}
+
+// 读取元数据时最多读取文件头部的字节数，EXIF 一般都在文件开头
+const imageMetaHeadSize = 1 << 20
+
+// 去除元数据时需要把整个图片读入内存，超过这个大小的图片拒绝上传
+const imageMetaStripMaxSize = 64 << 20
+
+// ImageGPS 拍摄位置
+type ImageGPS struct {
+	Latitude  float64  `json:"latitude" bson:"latitude"`
+	Longitude float64  `json:"longitude" bson:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty" bson:"altitude,omitempty"`
+}
+
+// ImageMeta 图片的元数据
+type ImageMeta struct {
+	Width       int       `json:"width" bson:"width"`
+	Height      int       `json:"height" bson:"height"`
+	Orientation int       `json:"orientation,omitempty" bson:"orientation,omitempty"` // EXIF 方向，1-8
+	Make        *string   `json:"make,omitempty" bson:"make,omitempty"`
+	Model       *string   `json:"model,omitempty" bson:"model,omitempty"`
+	CaptureTs   *int64    `json:"capture_ts,omitempty" bson:"capture_ts,omitempty"`
+	GPS         *ImageGPS `json:"gps,omitempty" bson:"gps,omitempty"`
+
+	BlurHash *string         `json:"blurhash,omitempty" bson:"blurhash,omitempty"` // 加载时的占位图，异步生成
+	Palette  []*PaletteColor `json:"palette,omitempty" bson:"palette,omitempty"`   // 主要颜色，第一个为主色
+	PHash    *string         `json:"phash,omitempty" bson:"phash,omitempty"`       // 感知哈希，用于查找相似图片
+}
+
+// 检查元数据去除方式是否支持
+func checkMetadataStrip(mode string) bool {
+	switch mode {
+	case MetadataStrips.None, MetadataStrips.Gps, MetadataStrips.All:
+		return true
+	default:
+		return false
+	}
+}
+
+// ParseImageMeta 解析图片的尺寸和 EXIF 信息，数据可以只包含文件头部
+func ParseImageMeta(data []byte) *ImageMeta {
+	meta := &ImageMeta{}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		meta.Width, meta.Height = cfg.Width, cfg.Height
+	}
+	if tiff := findExif(data); tiff != nil {
+		parseExif(tiff, meta)
+	}
+	return meta
+}
+
+// 图片格式，按文件头判断
+func sniffImageFormat(data []byte) string {
+	switch {
+	case len(data) >= 3 && data[0] == 0xff && data[1] == 0xd8 && data[2] == 0xff:
+		return "jpeg"
+	case len(data) >= 8 && string(data[:8]) == "\x89PNG\r\n\x1a\n":
+		return "png"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	default:
+		return ""
+	}
+}
+
+// 定位文件中的 EXIF 数据，返回 TIFF 结构的部分
+func findExif(data []byte) []byte {
+	var tiff []byte
+	switch sniffImageFormat(data) {
+	case "jpeg":
+		walkJpegSegments(data, func(marker byte, start int, payload []byte) bool {
+			if marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				tiff = payload[6:]
+				return false
+			}
+			return true
+		})
+	case "png":
+		walkPngChunks(data, func(typ string, start int, payload []byte) bool {
+			if typ == "eXIf" {
+				tiff = payload
+				return false
+			}
+			return true
+		})
+	case "webp":
+		walkWebpChunks(data, func(typ string, start int, payload []byte) bool {
+			if typ == "EXIF" {
+				tiff = bytes.TrimPrefix(payload, []byte("Exif\x00\x00"))
+				return false
+			}
+			return true
+		})
+	}
+	return tiff
+}
+
+// 遍历 jpeg 图像数据之前的段，start 为段内容的起始位置，返回 false 时停止
+func walkJpegSegments(data []byte, fn func(marker byte, start int, payload []byte) bool) {
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return
+		}
+		marker := data[pos+1]
+		// SOS 之后是图像数据
+		if marker == 0xda || marker == 0xd9 {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return
+		}
+		if !fn(marker, pos+4, data[pos+4:pos+2+length]) {
+			return
+		}
+		pos += 2 + length
+	}
+}
+
+// 遍历 png 的数据块，start 为块内容的起始位置，返回 false 时停止
+func walkPngChunks(data []byte, fn func(typ string, start int, payload []byte) bool) {
+	pos := 8
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			return
+		}
+		typ := string(data[pos+4 : pos+8])
+		if !fn(typ, pos+8, data[pos+8:pos+8+length]) || typ == "IEND" {
+			return
+		}
+		pos += 12 + length
+	}
+}
+
+// 遍历 webp 的数据块，start 为块内容的起始位置，返回 false 时停止
+func walkWebpChunks(data []byte, fn func(typ string, start int, payload []byte) bool) {
+	pos := 12
+	for pos+8 <= len(data) {
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if length < 0 || pos+8+length > len(data) {
+			return
+		}
+		if !fn(string(data[pos:pos+4]), pos+8, data[pos+8:pos+8+length]) {
+			return
+		}
+		pos += 8 + length + length%2
+	}
+}
+
+// EXIF 中用到的 tag
+const (
+	exifTagMake             = 0x010f
+	exifTagModel            = 0x0110
+	exifTagOrientation      = 0x0112
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagGpsIFD           = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+	exifTagOffsetOriginal   = 0x9011
+
+	gpsTagLatitudeRef  = 0x0001
+	gpsTagLatitude     = 0x0002
+	gpsTagLongitudeRef = 0x0003
+	gpsTagLongitude    = 0x0004
+	gpsTagAltitudeRef  = 0x0005
+	gpsTagAltitude     = 0x0006
+)
+
+// 各数据类型单个值的字节数
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count int
+	pos   int // 条目在 tiff 中的位置
+	value []byte
+}
+
+type exifReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newExifReader(tiff []byte) *exifReader {
+	if len(tiff) < 8 {
+		return nil
+	}
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		return &exifReader{data: tiff, order: binary.LittleEndian}
+	case "MM\x00*":
+		return &exifReader{data: tiff, order: binary.BigEndian}
+	default:
+		return nil
+	}
+}
+
+// 读取一个 IFD 的全部条目
+func (er *exifReader) readIFD(offset int) []*exifEntry {
+	if offset < 8 || offset+2 > len(er.data) {
+		return nil
+	}
+	n := int(er.order.Uint16(er.data[offset:]))
+	entries := make([]*exifEntry, 0, n)
+	for i := 0; i < n; i++ {
+		pos := offset + 2 + i*12
+		if pos+12 > len(er.data) {
+			break
+		}
+		e := &exifEntry{
+			tag:   er.order.Uint16(er.data[pos:]),
+			typ:   er.order.Uint16(er.data[pos+2:]),
+			count: int(er.order.Uint32(er.data[pos+4:])),
+			pos:   pos,
+		}
+		size, ok := exifTypeSizes[e.typ]
+		if !ok || e.count < 0 || e.count > len(er.data) {
+			continue
+		}
+		size *= e.count
+		if size <= 4 {
+			e.value = er.data[pos+8 : pos+8+size]
+		} else {
+			valueOffset := int(er.order.Uint32(er.data[pos+8:]))
+			if valueOffset < 0 || valueOffset+size > len(er.data) {
+				continue
+			}
+			e.value = er.data[valueOffset : valueOffset+size]
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (er *exifReader) uint(e *exifEntry) int {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return int(er.order.Uint16(e.value))
+	case e.typ == 4 && len(e.value) >= 4:
+		return int(er.order.Uint32(e.value))
+	case len(e.value) >= 1:
+		return int(e.value[0])
+	default:
+		return 0
+	}
+}
+
+func (er *exifReader) string(e *exifEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (er *exifReader) rationals(e *exifEntry) []float64 {
+	if e.typ != 5 {
+		return nil
+	}
+	values := make([]float64, 0, e.count)
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num, den := er.order.Uint32(e.value[i:]), er.order.Uint32(e.value[i+4:])
+		if den == 0 {
+			return nil
+		}
+		values = append(values, float64(num)/float64(den))
+	}
+	return values
+}
+
+// 解析 EXIF 中需要的字段
+func parseExif(tiff []byte, meta *ImageMeta) {
+	er := newExifReader(tiff)
+	if er == nil {
+		return
+	}
+	var dateTime, offset string
+	var exifIFD, gpsIFD int
+	for _, e := range er.readIFD(int(er.order.Uint32(tiff[4:]))) {
+		switch e.tag {
+		case exifTagMake:
+			if v := er.string(e); len(v) > 0 {
+				meta.Make = &v
+			}
+		case exifTagModel:
+			if v := er.string(e); len(v) > 0 {
+				meta.Model = &v
+			}
+		case exifTagOrientation:
+			if v := er.uint(e); v >= 1 && v <= 8 {
+				meta.Orientation = v
+			}
+		case exifTagDateTime:
+			dateTime = er.string(e)
+		case exifTagExifIFD:
+			exifIFD = er.uint(e)
+		case exifTagGpsIFD:
+			gpsIFD = er.uint(e)
+		}
+	}
+	for _, e := range er.readIFD(exifIFD) {
+		switch e.tag {
+		case exifTagDateTimeOriginal:
+			dateTime = er.string(e)
+		case exifTagOffsetOriginal:
+			offset = er.string(e)
+		}
+	}
+	if ts, ok := parseExifTime(dateTime, offset); ok {
+		meta.CaptureTs = &ts
+	}
+	meta.GPS = parseGps(er, er.readIFD(gpsIFD))
+}
+
+// 解析拍摄时间，没有时区信息时按 UTC 处理
+func parseExifTime(dateTime, offset string) (int64, bool) {
+	if len(dateTime) == 0 {
+		return 0, false
+	}
+	layout, value := "2006:01:02 15:04:05", dateTime
+	if len(offset) > 0 {
+		layout, value = layout+"-07:00", dateTime+offset
+	}
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		if t, err = time.Parse("2006:01:02 15:04:05", dateTime); err != nil {
+			return 0, false
+		}
+	}
+	return t.Unix(), true
+}
+
+// 解析 GPS 信息，经纬度转换为十进制度数
+func parseGps(er *exifReader, entries []*exifEntry) *ImageGPS {
+	var latRef, lonRef string
+	var lat, lon []float64
+	var altitude *float64
+	altBelow := false
+	for _, e := range entries {
+		switch e.tag {
+		case gpsTagLatitudeRef:
+			latRef = er.string(e)
+		case gpsTagLatitude:
+			lat = er.rationals(e)
+		case gpsTagLongitudeRef:
+			lonRef = er.string(e)
+		case gpsTagLongitude:
+			lon = er.rationals(e)
+		case gpsTagAltitudeRef:
+			altBelow = er.uint(e) == 1
+		case gpsTagAltitude:
+			if v := er.rationals(e); len(v) == 1 {
+				altitude = &v[0]
+			}
+		}
+	}
+	if len(lat) != 3 || len(lon) != 3 {
+		return nil
+	}
+	gps := &ImageGPS{
+		Latitude:  lat[0] + lat[1]/60 + lat[2]/3600,
+		Longitude: lon[0] + lon[1]/60 + lon[2]/3600,
+	}
+	if latRef == "S" {
+		gps.Latitude = -gps.Latitude
+	}
+	if lonRef == "W" {
+		gps.Longitude = -gps.Longitude
+	}
+	if altitude != nil && altBelow {
+		*altitude = -*altitude
+	}
+	gps.Altitude = altitude
+	return gps
+}
+
+// 在原位置清除 EXIF 中的 GPS 信息，不改变数据长度
+func clearExifGps(tiff []byte) {
+	er := newExifReader(tiff)
+	if er == nil {
+		return
+	}
+	for _, e := range er.readIFD(int(er.order.Uint32(tiff[4:]))) {
+		if e.tag != exifTagGpsIFD {
+			continue
+		}
+		offset := er.uint(e)
+		for _, ge := range er.readIFD(offset) {
+			clear(ge.value)
+			clear(tiff[ge.pos : ge.pos+12])
+		}
+		// 条目数置为0，GPS IFD 变为空
+		if offset+2 <= len(tiff) {
+			er.order.PutUint16(tiff[offset:], 0)
+		}
+	}
+}
+
+// StripImageMeta 去除图片中的元数据，返回新的数据，不支持的格式原样返回
+// 全部去除时保留方向信息，否则去除后图片显示的方向会变
+func StripImageMeta(data []byte, mode string) []byte {
+	if mode == MetadataStrips.None {
+		return data
+	}
+	return stripImageMeta(bytes.Clone(data), mode)
+}
+
+// 在 data 上直接修改，调用方需要确保 data 可以被修改
+func stripImageMeta(data []byte, mode string) []byte {
+	var orientation []byte
+	if mode == MetadataStrips.All {
+		if meta := ParseImageMeta(data); meta != nil && meta.Orientation > 1 && meta.Orientation <= 8 {
+			orientation = buildOrientationExif(meta.Orientation)
+		}
+	}
+	switch sniffImageFormat(data) {
+	case "jpeg":
+		return stripJpegMeta(data, mode, orientation)
+	case "png":
+		return stripPngMeta(data, mode, orientation)
+	case "webp":
+		return stripWebpMeta(data, mode, orientation)
+	default:
+		return data
+	}
+}
+
+// 构建只包含方向信息的 EXIF(TIFF 格式)
+func buildOrientationExif(orientation int) []byte {
+	tiff := make([]byte, 26)
+	copy(tiff, "MM\x00*")
+	binary.BigEndian.PutUint32(tiff[4:], 8) // IFD0 的偏移
+	binary.BigEndian.PutUint16(tiff[8:], 1) // 条目数
+	binary.BigEndian.PutUint16(tiff[10:], exifTagOrientation)
+	binary.BigEndian.PutUint16(tiff[12:], 3) // SHORT
+	binary.BigEndian.PutUint32(tiff[14:], 1)
+	binary.BigEndian.PutUint16(tiff[18:], uint16(orientation))
+	// 下一个 IFD 的偏移为0
+	return tiff
+}
+
+// 是否为 XMP 数据的标识
+var xmpJpegPrefix = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+func stripJpegMeta(data []byte, mode string, orientation []byte) []byte {
+	var edits []rangeEdit
+	walkJpegSegments(data, func(marker byte, start int, payload []byte) bool {
+		if marker != 0xe1 {
+			return true
+		}
+		switch {
+		case bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			if mode == MetadataStrips.Gps {
+				clearExifGps(payload[6:])
+				break
+			}
+			edit := rangeEdit{start: start - 4, end: start + len(payload)}
+			if orientation != nil {
+				// 第一个 EXIF 段替换为只包含方向的 EXIF
+				edit.repl = append([]byte{0xff, 0xe1, 0, 0}, "Exif\x00\x00"...)
+				edit.repl = append(edit.repl, orientation...)
+				binary.BigEndian.PutUint16(edit.repl[2:], uint16(len(edit.repl)-2))
+				orientation = nil
+			}
+			edits = append(edits, edit)
+		case bytes.HasPrefix(payload, xmpJpegPrefix) && mode == MetadataStrips.All:
+			edits = append(edits, rangeEdit{start: start - 4, end: start + len(payload)})
+		}
+		return true
+	})
+	return replaceRanges(data, edits)
+}
+
+func stripPngMeta(data []byte, mode string, orientation []byte) []byte {
+	var edits []rangeEdit
+	walkPngChunks(data, func(typ string, start int, payload []byte) bool {
+		switch {
+		case typ == "eXIf" && mode == MetadataStrips.Gps:
+			clearExifGps(payload)
+			binary.BigEndian.PutUint32(data[start+len(payload):], crc32.ChecksumIEEE(data[start-4:start+len(payload)]))
+		case typ == "eXIf" && mode == MetadataStrips.All && orientation != nil:
+			repl := make([]byte, 4, 12+len(orientation))
+			binary.BigEndian.PutUint32(repl, uint32(len(orientation)))
+			repl = append(append(repl, "eXIf"...), orientation...)
+			repl = binary.BigEndian.AppendUint32(repl, crc32.ChecksumIEEE(repl[4:]))
+			edits = append(edits, rangeEdit{start: start - 8, end: start + len(payload) + 4, repl: repl})
+			orientation = nil
+		case typ == "eXIf", typ == "iTXt" && bytes.HasPrefix(payload, []byte("XML:com.adobe.xmp\x00")):
+			if mode == MetadataStrips.All {
+				edits = append(edits, rangeEdit{start: start - 8, end: start + len(payload) + 4})
+			}
+		}
+		return true
+	})
+	return replaceRanges(data, edits)
+}
+
+func stripWebpMeta(data []byte, mode string, orientation []byte) []byte {
+	var edits []rangeEdit
+	vp8x := -1
+	keepExif := false
+	walkWebpChunks(data, func(typ string, start int, payload []byte) bool {
+		switch typ {
+		case "VP8X":
+			vp8x = start
+		case "EXIF":
+			if mode == MetadataStrips.Gps {
+				clearExifGps(bytes.TrimPrefix(payload, []byte("Exif\x00\x00")))
+				break
+			}
+			edit := rangeEdit{start: start - 8, end: start + len(payload) + len(payload)%2}
+			if orientation != nil {
+				// 长度为偶数，不需要填充
+				edit.repl = binary.LittleEndian.AppendUint32([]byte("EXIF"), uint32(len(orientation)))
+				edit.repl = append(edit.repl, orientation...)
+				orientation = nil
+				keepExif = true
+			}
+			edits = append(edits, edit)
+		case "XMP ":
+			if mode == MetadataStrips.All {
+				edits = append(edits, rangeEdit{start: start - 8, end: start + len(payload) + len(payload)%2})
+			}
+		}
+		return true
+	})
+	if len(edits) == 0 {
+		return data
+	}
+	// 清除 VP8X 中 EXIF 和 XMP 的标记
+	if vp8x >= 0 {
+		data[vp8x] &^= 0x04
+		if !keepExif {
+			data[vp8x] &^= 0x08
+		}
+	}
+	out := replaceRanges(data, edits)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+// 数据中需要替换的区间，repl 为空时删除
+type rangeEdit struct {
+	start, end int
+	repl       []byte
+}
+
+// 替换数据中的多个区间，区间按顺序排列且不重叠
+func replaceRanges(data []byte, edits []rangeEdit) []byte {
+	if len(edits) == 0 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	pos := 0
+	for _, e := range edits {
+		out = append(out, data[pos:e.start]...)
+		out = append(out, e.repl...)
+		pos = e.end
+	}
+	return append(out, data[pos:]...)
+}
+
+// OrientImage 按照 EXIF 方向把图片旋转为正向
+func OrientImage(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	}
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // 水平翻转
+				sx, sy = w-1-x, y
+			case 3: // 旋转180度
+				sx, sy = w-1-x, h-1-y
+			case 4: // 垂直翻转
+				sx, sy = x, h-1-y
+			case 5: // 沿主对角线翻转
+				sx, sy = y, x
+			case 6: // 顺时针旋转90度
+				sx, sy = y, h-1-x
+			case 7: // 沿副对角线翻转
+				sx, sy = w-1-y, h-1-x
+			case 8: // 逆时针旋转90度
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], rgba.Pix[sy*rgba.Stride+sx*4:sy*rgba.Stride+sx*4+4])
+		}
+	}
+	return dst
+}
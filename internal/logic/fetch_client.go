@@ -0,0 +1,133 @@
+package logic
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/dzjyyds666/mediaStorage/pkg"
+)
+
+// 拉取时最多跳转的次数
+const fetchMaxRedirectTime = 5
+
+// 不允许拉取的地址段，参考 IANA IPv4/IPv6 Special-Purpose Address Registry
+var blockedNets = func() []*net.IPNet {
+	cidrs := []string{
+		"0.0.0.0/8",       // 本网络
+		"10.0.0.0/8",      // 私有地址
+		"100.64.0.0/10",   // CGNAT 共享地址
+		"127.0.0.0/8",     // 回环地址
+		"169.254.0.0/16",  // 链路本地，包含云厂商元数据地址
+		"172.16.0.0/12",   // 私有地址
+		"192.0.0.0/24",    // IETF 协议分配
+		"192.0.2.0/24",    // TEST-NET-1
+		"192.31.196.0/24", // AS112
+		"192.52.193.0/24", // AMT
+		"192.88.99.0/24",  // 6to4 中继
+		"192.168.0.0/16",  // 私有地址
+		"192.175.48.0/24", // AS112 直接委派
+		"198.18.0.0/15",   // 基准测试
+		"198.51.100.0/24", // TEST-NET-2
+		"203.0.113.0/24",  // TEST-NET-3
+		"224.0.0.0/4",     // 组播
+		"240.0.0.0/4",     // 保留地址，包含广播地址
+		"::/128",          // 未指定地址
+		"::1/128",         // 回环地址
+		"64:ff9b::/96",    // NAT64
+		"64:ff9b:1::/48",  // 本地 NAT64
+		"100::/64",        // 丢弃地址
+		"2001::/23",       // IETF 协议分配，包含 Teredo
+		"2001:db8::/32",   // 文档地址
+		"2002::/16",       // 6to4
+		"3fff::/20",       // 文档地址
+		"5f00::/16",       // SRv6 SID
+		"fc00::/7",        // 唯一本地地址
+		"fe80::/10",       // 链路本地
+		"fec0::/10",       // 站点本地(已废弃)
+		"ff00::/8",        // 组播
+	}
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}()
+
+// IsBlockedIP 是否为不允许访问的地址，防止ssrf访问内网
+func IsBlockedIP(ip net.IP) bool {
+	// IPv4 映射的 IPv6 地址按照 IPv4 检查，所以列表中不包含 ::ffff:0:0/96
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, ipNet := range blockedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFetchUrl 解析并校验拉取的url
+func ParseFetchUrl(raw string) (*url.URL, error) {
+	source, err := url.Parse(raw)
+	if err != nil {
+		return nil, pkg.ErrorEnums.ErrFetchUrlInvalid
+	}
+	if source.Scheme != "http" && source.Scheme != "https" {
+		return nil, pkg.ErrorEnums.ErrFetchUrlInvalid
+	}
+	if len(source.Hostname()) == 0 || source.User != nil {
+		return nil, pkg.ErrorEnums.ErrFetchUrlInvalid
+	}
+	return source, nil
+}
+
+// 建立连接时校验实际连接的ip，dns 解析在校验之前完成，可以防止dns重绑定
+func fetchDialControl(allowPrivate bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || (!allowPrivate && IsBlockedIP(ip)) {
+			return pkg.ErrorEnums.ErrFetchAddrBlocked
+		}
+		return nil
+	}
+}
+
+// NewFetchClient 构建拉取外部url使用的客户端，不走代理，跳转后的地址同样校验
+// 不设置总超时，由调用方的ctx控制
+func NewFetchClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: fetchDialControl(allowPrivate),
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchMaxRedirectTime {
+				return pkg.ErrorEnums.ErrFetchUrlInvalid
+			}
+			if _, err := ParseFetchUrl(req.URL.String()); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+}
@@ -1,6 +1,7 @@
 package logic
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -8,6 +9,8 @@ import (
 	"io"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dzjyyds666/Allspark-go/conv"
@@ -20,6 +23,12 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// 衍生图的前缀，不参与对账
+const variantPrefix = "_variants"
+
+// 申请上传后需要在这个时间内完成上传
+const prepareFileInfoExpire = time.Hour
+
 type FileOption func(ctx context.Context, info *MediaFileInfo, opts ...func(*MediaFileInfo) *MediaFileInfo) error
 
 // randFid 随机生成文件id
@@ -38,14 +47,64 @@ type MediaFileInfo struct {
 	Uploader      *string    `json:"uploader,omitempty" bson:"uploader,omitempty"`
 	Box           *Box       `json:"box,omitempty" bson:"box,omitempty"`
 
+	ContentEncoding *string `json:"content_encoding,omitempty" bson:"content_encoding,omitempty"` // 存储时使用的压缩方式
+	StoredLength    *int64  `json:"stored_length,omitempty" bson:"stored_length,omitempty"`       // 实际存储的大小
+	Extract         *bool   `json:"extract,omitempty" bson:"extract,omitempty"`                   // 上传的是归档文件，需要解压到箱子中
+
+	Variants map[string]*FileVariant `json:"variants,omitempty" bson:"variants,omitempty"` // 已经生成的预设衍生图
+	Image    *ImageMeta              `json:"image,omitempty" bson:"image,omitempty"`       // 图片的尺寸和 EXIF 信息
+	Media    *MediaProbe             `json:"media,omitempty" bson:"media,omitempty"`       // 音视频的时长、编码等信息
+
+	DetectedType *string     `json:"detected_type,omitempty" bson:"detected_type,omitempty"` // 根据文件头判断的真实类型，ContentType 为客户端声明的类型
+	Scan         *ScanResult `json:"scan,omitempty" bson:"scan,omitempty"`                   // 病毒扫描结果，未开启扫描时为空
+
 	r io.Reader // 文件的流
 }
 
+// 获取实际存储的大小
+func (mfi *MediaFileInfo) GetStoredLength() int64 {
+	if mfi.StoredLength != nil {
+		return *mfi.StoredLength
+	}
+	return ptr.ToInt64(mfi.ContentLength)
+}
+
 // BuildObjectKey 构建对象键
 func (mfi *MediaFileInfo) BuildObjectKey() string {
 	return path.Join(mfi.GetDepotId(), mfi.Box.BoxId, mfi.Fid)
 }
 
+// BuildVariantKey 构建文件衍生图的对象键，放在单独的前缀下，避免和原文件的key冲突
+// 路径中带上文件的完成时间，源文件内容变化后旧的衍生图自动失效
+func (mfi *MediaFileInfo) BuildVariantKey(name string) string {
+	return path.Join(variantPrefix, mfi.BuildObjectKey(), mfi.ContentVersion(), name)
+}
+
+// IsUploader 是否为文件的上传者
+func (mfi *MediaFileInfo) IsUploader(uid string) bool {
+	return len(uid) > 0 && uid == ptr.ToString(mfi.Uploader)
+}
+
+// ContentVersion 文件内容的版本
+func (mfi *MediaFileInfo) ContentVersion() string {
+	return strconv.FormatInt(ptr.ToInt64(mfi.CreatedTs), 10)
+}
+
+// CheckReadable 检查文件是否可以读取，扫描未通过的文件不可读
+func (mfi *MediaFileInfo) CheckReadable() error {
+	if mfi.Scan == nil {
+		return nil
+	}
+	switch mfi.Scan.Status {
+	case ScanStatuses.Clean:
+		return nil
+	case ScanStatuses.Infected:
+		return pkg.ErrorEnums.ErrFileInfected
+	default:
+		return pkg.ErrorEnums.ErrFileScanPending
+	}
+}
+
 func (mfi *MediaFileInfo) GetDepotId() string {
 	return ptr.ToString(mfi.Box.DepotId)
 }
@@ -59,6 +118,7 @@ type InitUpload struct {
 	Header        url.Values `json:"header,omitempty"`
 	Uploader      *string    `json:"uploader,omitempty"`
 	BoxId         *string    `json:"box_id,omitempty"`
+	Extract       *bool      `json:"extract,omitempty"` // 是否把上传的归档文件解压到箱子中
 }
 
 // 转换为媒体文件信息
@@ -69,14 +129,30 @@ func (i *InitUpload) ToMediaFileInfo() *MediaFileInfo {
 		ContentMd5:    i.ContentMd5,
 		ContentType:   i.ContentType,
 		MetaData:      i.Header,
+		Uploader:      i.Uploader,
+		Extract:       i.Extract,
 	}
 }
 
+// 上传完成后异步处理的并发数和队列长度
+const (
+	processWorkerNum = 4
+	processQueueSize = 1024
+	scanWorkerNum    = 2
+	listBatchSize    = 100 // 遍历箱子文件时每批读取的数量
+)
+
 type FileIndexLogic struct {
 	ctx       context.Context
 	group     string
 	fileRedis *redis.Client
-	s3Server  *S3Logic // s3 服务
+	s3Server  *S3Logic    // s3 服务
+	boxServ   *BoxLogic   // 箱子服务
+	depotServ *DepotLogic // 仓库服务
+
+	process  *ProcessQueue // 上传完成后的异步处理
+	scan     *ProcessQueue // 病毒扫描队列，扫描步骤自己保存结果
+	scanning bool          // 是否开启病毒扫描
 }
 
 // NewFileIndexLogic 创建文件索引服务
@@ -85,12 +161,63 @@ func NewFileIndexLogic(ctx context.Context, cfg *config.Config, dsServer *ds.Dat
 	if !ok {
 		panic("redis [file] not found")
 	}
-	return &FileIndexLogic{
+	fs := &FileIndexLogic{
 		ctx:       ctx,
 		group:     ptr.ToString(cfg.Group),
 		fileRedis: fileRedis,
 		s3Server:  s3Server,
+		boxServ:   boxServ,
+		depotServ: depotServ,
+	}
+	fs.process = NewProcessQueue(ctx, processQueueSize, fs.saveProcessResult)
+	fs.scan = NewProcessQueue(ctx, processQueueSize, func(ctx context.Context, info *MediaFileInfo) error {
+		return nil
+	})
+	return fs
+}
+
+// RegisterProcessHook 注册上传完成后的异步处理步骤，需要在 StartProcess 之前注册
+func (fs *FileIndexLogic) RegisterProcessHook(hooks ...FileOption) {
+	fs.process.Register(hooks...)
+}
+
+// StartProcess 所有处理步骤注册完成后启动异步处理
+func (fs *FileIndexLogic) StartProcess() {
+	fs.process.Start(processWorkerNum)
+	fs.scan.Start(scanWorkerNum)
+}
+
+// SetScanStage 设置病毒扫描步骤，设置后文件完成上传时处于等待扫描状态，由扫描队列异步扫描
+func (fs *FileIndexLogic) SetScanStage(stage FileOption) {
+	fs.scan.Register(stage)
+	fs.scanning = true
+}
+
+// SubmitScan 提交文件到扫描队列，队列满时返回false，文件保持等待扫描状态，可以重新扫描
+func (fs *FileIndexLogic) SubmitScan(info *MediaFileInfo) bool {
+	if !fs.scanning {
+		return false
 	}
+	return fs.scan.Submit(info)
+}
+
+// 提交文件到异步处理队列，队列满时丢弃，不阻塞上传
+func (fs *FileIndexLogic) submitProcess(info *MediaFileInfo) {
+	fs.process.Submit(info)
+}
+
+// 保存异步处理的结果，只更新处理步骤生成的字段，不覆盖期间的其他修改
+func (fs *FileIndexLogic) saveProcessResult(ctx context.Context, info *MediaFileInfo) error {
+	return fs.UpdateFileInfo(ctx, info.GetDepotId(), info.Fid, func(current *MediaFileInfo) error {
+		current.Image = info.Image
+		current.Variants = info.Variants
+		return nil
+	})
+}
+
+// 构建仓库的图片感知哈希索引key，hash 结构，field 为fid
+func (fl *FileIndexLogic) buildImageHashKey(depotId string) string {
+	return fmt.Sprintf("media_storage:%s:file:%s:phash", fl.group, depotId)
 }
 
 // 构建文件预备key
@@ -103,6 +230,11 @@ func (fl *FileIndexLogic) buildFileInfoKey(depotId, id string) string {
 	return fmt.Sprintf("media_storage:%s:file:%s:%s:info", fl.group, depotId, id)
 }
 
+// 构建箱子的文件列表key，zset 结构，score 为上传完成的时间，member 为fid
+func (fl *FileIndexLogic) buildBoxFileListKey(depotId, boxId string) string {
+	return fmt.Sprintf("media_storage:%s:file:%s:box:%s:list", fl.group, depotId, boxId)
+}
+
 // 申请上传
 func (fs *FileIndexLogic) CreatePrepareFileInfo(ctx context.Context, info *MediaFileInfo, opts ...func(*MediaFileInfo) *MediaFileInfo) error {
 	for _, opt := range opts {
@@ -115,7 +247,7 @@ func (fs *FileIndexLogic) CreatePrepareFileInfo(ctx context.Context, info *Media
 	}
 
 	// 把文件信息存储到redis中,1个小时之内进行上传
-	_, err = fs.fileRedis.SetNX(ctx, fs.buildPrepareFileInfoKey(info.GetDepotId(), info.Fid), raw, time.Hour).Result()
+	_, err = fs.fileRedis.SetNX(ctx, fs.buildPrepareFileInfoKey(info.GetDepotId(), info.Fid), raw, prepareFileInfoExpire).Result()
 	if err != nil {
 		logx.Errorf("FileIndexServer|CreatePrepareFileInfo|Set|err: %v", err)
 		return err
@@ -141,12 +273,51 @@ func (fs *FileIndexLogic) QueryPrepareFileInfo(ctx context.Context, depotId, fid
 	return &info, nil
 }
 
+// ClaimPrepareFileInfo 领取文件的prepare信息，读取的同时删除，同一个fid只有一个上传可以继续
+func (fs *FileIndexLogic) ClaimPrepareFileInfo(ctx context.Context, depotId, fid string) (*MediaFileInfo, string, error) {
+	raw, err := fs.fileRedis.GetDel(ctx, fs.buildPrepareFileInfoKey(depotId, fid)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, "", pkg.ErrorEnums.ErrNoPrepareFileInfo
+		}
+		logx.Errorf("FileIndexServer|ClaimPrepareFileInfo|GetDel|fid: %s|err: %v", fid, err)
+		return nil, "", err
+	}
+	var info MediaFileInfo
+	if err = json.Unmarshal([]byte(raw), &info); err != nil {
+		logx.Errorf("FileIndexServer|ClaimPrepareFileInfo|Unmarshal|fid: %s|err: %v", fid, err)
+		return nil, "", err
+	}
+	return &info, raw, nil
+}
+
+// 上传失败时放回领取的prepare信息，可以重新上传
+func (fs *FileIndexLogic) restorePrepareFileInfo(ctx context.Context, depotId, fid, raw string) {
+	err := fs.fileRedis.SetNX(context.WithoutCancel(ctx), fs.buildPrepareFileInfoKey(depotId, fid), raw, prepareFileInfoExpire).Err()
+	if err != nil {
+		logx.Errorf("FileIndexServer|restorePrepareFileInfo|SetNX|fid: %s|err: %v", fid, err)
+	}
+}
+
+// 删除文件的prepare信息
+func (fs *FileIndexLogic) DeletePrepareFileInfo(ctx context.Context, depotId, fid string) error {
+	err := fs.fileRedis.Del(ctx, fs.buildPrepareFileInfoKey(depotId, fid)).Err()
+	if err != nil {
+		logx.Errorf("FileIndexServer|DeletePrepareFileInfo|Del|fid: %s|err: %v", fid, err)
+		return err
+	}
+	return nil
+}
+
 // 查询文件的信息
 func (fs *FileIndexLogic) QueryFileInfo(ctx context.Context, depotId, fileId string) (*MediaFileInfo, error) {
-	infoKey := fs.buildPrepareFileInfoKey(depotId, fileId)
+	infoKey := fs.buildFileInfoKey(depotId, fileId)
 	result, err := fs.fileRedis.Get(ctx, infoKey).Result()
 	if nil != err {
 		logx.Errorf("FileIndexServer|QueryFileInfo|Get|fileId: %s|err: %v", fileId, err)
+		if errors.Is(err, redis.Nil) {
+			return nil, pkg.ErrorEnums.ErrFileNotExist
+		}
 		return nil, err
 	}
 	var info MediaFileInfo
@@ -159,42 +330,549 @@ func (fs *FileIndexLogic) QueryFileInfo(ctx context.Context, depotId, fileId str
 	return &info, nil
 }
 
+// 查询文件所在仓库的服务端加密参数
+func (fs *FileIndexLogic) querySSEParams(ctx context.Context, depotId string) (*SSEParams, error) {
+	depot, err := fs.depotServ.QueryDepotInfo(ctx, depotId)
+	if err != nil {
+		logx.Errorf("FileIndexServer|querySSEParams|QueryDepotInfo|depotId: %s|err: %v", depotId, err)
+		return nil, err
+	}
+	return fs.s3Server.BuildSSEParams(depot)
+}
+
 // 保存文件到s3
 func (fs *FileIndexLogic) SaveFileData(ctx context.Context, info *MediaFileInfo, file io.Reader) error {
+	depot, err := fs.depotServ.QueryDepotInfo(ctx, info.GetDepotId())
+	if err != nil {
+		logx.Errorf("FileIndexServer|SaveFileData|QueryDepotInfo|depotId: %s|err: %v", info.GetDepotId(), err)
+		return err
+	}
+	sse, err := fs.s3Server.BuildSSEParams(depot)
+	if err != nil {
+		return err
+	}
+
+	if IsImage(info) {
+		file, err = readImageMeta(info, ptr.ToString(depot.StripMetadata), file)
+		if err != nil {
+			logx.Errorf("FileIndexServer|SaveFileData|readImageMeta|fid: %s|err: %v", info.Fid, err)
+			return err
+		}
+	}
+
+	if IsMedia(info) {
+		probeMediaInfo(info, file)
+	}
+
 	info.r = file
-	return fs.s3Server.SaveFileData(ctx, info)
+	if shouldCompress(depot, ptr.ToString(info.ContentType)) {
+		// 压缩后的大小在上传完成后才知道
+		counter := &countReader{r: file}
+		body, err := CompressReader(ptr.ToString(depot.Compression), counter)
+		if err != nil {
+			logx.Errorf("FileIndexServer|SaveFileData|CompressReader|fid: %s|err: %v", info.Fid, err)
+			return err
+		}
+		defer body.Close()
+		stored := &countReader{r: body}
+		info.r = stored
+		if err = fs.s3Server.SaveFileData(ctx, info, sse); err != nil {
+			return err
+		}
+		info.ContentLength = ptr.Int64(counter.n)
+		info.ContentEncoding = depot.Compression
+		info.StoredLength = ptr.Int64(stored.n)
+		return nil
+	}
+	if seeker, ok := file.(io.Seeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = seeker.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			logx.Errorf("FileIndexServer|SaveFileData|Seek|fid: %s|err: %v", info.Fid, err)
+			return err
+		}
+		info.ContentLength = ptr.Int64(size)
+		info.StoredLength = ptr.Int64(size)
+	}
+	return fs.s3Server.SaveFileData(ctx, info, sse)
 }
 
-// 完成文件上传
-func (fs *FileIndexLogic) CompleteFileInfo(ctx context.Context, info *MediaFileInfo, opts ...func(*MediaFileInfo) *MediaFileInfo) error {
-	// 把文件补全文件信息
-	prepareInfo, err := fs.QueryPrepareFileInfo(ctx, info.GetDepotId(), info.Fid)
+// 读取文件头判断真实类型并检查箱子的类型限制，返回可以继续读取完整内容的流
+func (fs *FileIndexLogic) detectFileType(info *MediaFileInfo, box *Box, file io.Reader) (io.Reader, error) {
+	head := make([]byte, sniffHeadSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	head = head[:n]
+	if seeker, ok := file.(io.Seeker); ok {
+		if _, err = seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	} else {
+		file = io.MultiReader(bytes.NewReader(head), file)
+	}
+
+	detected := RefineDetectedType(DetectContentType(head), ptr.ToString(info.ContentType), info.FileName)
+	info.DetectedType = ptr.String(detected)
+	types := []string{ptr.ToString(info.ContentType)}
+	// 文本和未知的二进制文件无法通过文件头区分具体格式，只检查声明的类型
+	if !isGenericType(detected) {
+		types = append(types, detected)
+	}
+	if err = CheckFileType(box, info.FileName, types...); err != nil {
+		logx.Errorf("FileIndexServer|detectFileType|CheckFileType|fid: %s|declared: %s|detected: %s|err: %v", info.Fid, ptr.ToString(info.ContentType), detected, err)
+		return nil, err
+	}
+	return file, nil
+}
+
+// 读取图片的元数据，需要去除元数据时返回处理后的数据
+func readImageMeta(info *MediaFileInfo, strip string, file io.Reader) (io.Reader, error) {
+	if strip != MetadataStrips.None {
+		// 整个图片需要读入内存，限制大小
+		raw, err := io.ReadAll(io.LimitReader(file, imageMetaStripMaxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) > imageMetaStripMaxSize {
+			return nil, pkg.ErrorEnums.ErrImageTooLarge
+		}
+		info.Image = ParseImageMeta(raw)
+		// 去除后不再保留位置信息，方向信息保留用于生成衍生图
+		info.Image.GPS = nil
+		// raw 只在这里使用，直接修改避免再复制一份
+		return bytes.NewReader(stripImageMeta(raw, strip)), nil
+	}
+
+	head := make([]byte, imageMetaHeadSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	head = head[:n]
+	info.Image = ParseImageMeta(head)
+	if seeker, ok := file.(io.Seeker); ok {
+		if _, err = seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	return io.MultiReader(bytes.NewReader(head), file), nil
+}
+
+// 探测音视频文件的信息，只处理可以随机读取的文件，探测失败不影响上传
+func probeMediaInfo(info *MediaFileInfo, file io.Reader) {
+	ra, ok := file.(io.ReaderAt)
+	seeker, ok2 := file.(io.Seeker)
+	if !ok || !ok2 {
+		return
+	}
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = seeker.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		logx.Errorf("FileIndexServer|probeMediaInfo|Seek|fid: %s|err: %v", info.Fid, err)
+		return
+	}
+	info.Media = ProbeMedia(ra, size)
+}
+
+// 把文件数据移动到隔离区
+func (fs *FileIndexLogic) QuarantineFileData(ctx context.Context, info *MediaFileInfo) error {
+	sse, err := fs.querySSEParams(ctx, info.GetDepotId())
 	if err != nil {
-		logx.Errorf("FileIndexServer|CompleteUpload|QueryPerpareFileInfo|err: %v", err)
 		return err
 	}
+	objectKey := info.BuildObjectKey()
+	if err = fs.s3Server.CopyObject(ctx, objectKey, path.Join(quarantinePrefix, objectKey), sse); err != nil {
+		return err
+	}
+	return fs.s3Server.DeleteObject(ctx, objectKey)
+}
+
+// 直接读取文件数据，用于无法预签名的文件(如sse-c加密)
+func (fs *FileIndexLogic) OpenFileData(ctx context.Context, info *MediaFileInfo) (io.ReadCloser, error) {
+	sse, err := fs.querySSEParams(ctx, info.GetDepotId())
+	if err != nil {
+		return nil, err
+	}
+	return fs.s3Server.GetObject(ctx, info.BuildObjectKey(), sse)
+}
 
+// 完成文件上传，info 为上传时领取的prepare信息，已经补全了上传过程中得到的文件信息
+func (fs *FileIndexLogic) CompleteFileInfo(ctx context.Context, info *MediaFileInfo, opts ...func(*MediaFileInfo) *MediaFileInfo) error {
+	prepareInfo := info
 	prepareInfo.CreatedTs = ptr.Int64(time.Now().Unix())
-	prepareInfo.Box = info.Box
-	prepareInfo.MetaData = info.MetaData
+	if fs.scanning {
+		// 扫描完成之前文件不可读
+		prepareInfo.Scan = &ScanResult{Status: ScanStatuses.Pending}
+	}
 
 	infoKey := fs.buildFileInfoKey(info.GetDepotId(), info.Fid)
-	_, err = fs.fileRedis.SetNX(ctx, infoKey, conv.ToJsonWithoutError(prepareInfo), time.Hour).Result()
+	// 文件索引需要长期保存，否则对象会变成孤儿
+	succ, err := fs.fileRedis.SetNX(ctx, infoKey, conv.ToJsonWithoutError(prepareInfo), 0).Result()
 	if err != nil {
 		logx.Errorf("FileIndexServer|CompleteUpload|InsertOne|err: %v", err)
 		return err
 	}
-	// 删除存储在redis中的数据
-	err = fs.fileRedis.Del(ctx, fs.buildPrepareFileInfoKey(info.GetDepotId(), info.Fid)).Err()
+	// 同一个fid已经完成过上传
+	if !succ {
+		logx.Errorf("FileIndexServer|CompleteUpload|SetNX|fid: %s|file exist", info.Fid)
+		return pkg.ErrorEnums.ErrFileExist
+	}
+	if prepareInfo.Box != nil {
+		if err = fs.IndexBoxFile(ctx, prepareInfo); err != nil {
+			logx.Errorf("FileIndexServer|CompleteUpload|IndexBoxFile|boxId: %s|err: %v", prepareInfo.Box.BoxId, err)
+		}
+		// 更新箱子的用量，逻辑大小和实际存储大小分开统计
+		err = fs.boxServ.IncrBoxUsage(ctx, prepareInfo.Box.BoxId, 1, ptr.ToInt64(prepareInfo.ContentLength), prepareInfo.GetStoredLength())
+		if err != nil {
+			logx.Errorf("FileIndexServer|CompleteUpload|IncrBoxUsage|boxId: %s|err: %v", prepareInfo.Box.BoxId, err)
+		}
+	}
+	// 需要扫描的文件在扫描通过后再处理
+	if prepareInfo.Scan == nil {
+		fs.submitProcess(prepareInfo)
+	} else {
+		fs.SubmitScan(prepareInfo)
+	}
+	return nil
+}
+
+// 并发修改同一个文件信息时的重试次数
+const updateFileInfoRetry = 5
+
+// UpdateFileInfo 更新已经完成上传的文件信息，update 中只修改需要变更的字段
+// 使用 WATCH 保证读取和写入之间没有其他修改，冲突时重新读取后再修改
+func (fs *FileIndexLogic) UpdateFileInfo(ctx context.Context, depotId, fid string, update func(info *MediaFileInfo) error) error {
+	infoKey := fs.buildFileInfoKey(depotId, fid)
+	txf := func(tx *redis.Tx) error {
+		raw, err := tx.Get(ctx, infoKey).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return pkg.ErrorEnums.ErrFileNotExist
+		}
+		if err != nil {
+			return err
+		}
+		var info MediaFileInfo
+		if err = json.Unmarshal(raw, &info); err != nil {
+			return err
+		}
+		if err = update(&info); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetXX(ctx, infoKey, conv.ToJsonWithoutError(&info), redis.KeepTTL)
+			return nil
+		})
+		return err
+	}
+	var err error
+	for i := 0; i < updateFileInfoRetry; i++ {
+		err = fs.fileRedis.Watch(ctx, txf, infoKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
+	if err != nil && !errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+		logx.Errorf("FileIndexServer|UpdateFileInfo|Watch|fid: %s|err: %v", fid, err)
+	}
+	return err
+}
+
+// 遍历仓库下所有已完成的文件索引, depotId 为空时遍历所有仓库
+func (fs *FileIndexLogic) ScanFileInfos(ctx context.Context, depotId string, fn func(info *MediaFileInfo) error) error {
+	if len(depotId) == 0 {
+		depotId = "*"
+	}
+	iter := fs.fileRedis.Scan(ctx, 0, fs.buildFileInfoKey(depotId, "*"), 500).Iterator()
+	for iter.Next(ctx) {
+		raw, err := fs.fileRedis.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			logx.Errorf("FileIndexServer|ScanFileInfos|Get|key: %s|err: %v", iter.Val(), err)
+			return err
+		}
+		var info MediaFileInfo
+		if err = json.Unmarshal(raw, &info); err != nil {
+			logx.Errorf("FileIndexServer|ScanFileInfos|Unmarshal|key: %s|err: %v", iter.Val(), err)
+			continue
+		}
+		if err = fn(&info); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// IndexBoxFile 把文件加入箱子的文件列表，重复加入不影响顺序
+func (fs *FileIndexLogic) IndexBoxFile(ctx context.Context, info *MediaFileInfo) error {
+	if info.Box == nil {
+		return nil
+	}
+	key := fs.buildBoxFileListKey(info.GetDepotId(), info.Box.BoxId)
+	return fs.fileRedis.ZAdd(ctx, key, redis.Z{Score: float64(ptr.ToInt64(info.CreatedTs)), Member: info.Fid}).Err()
+}
+
+// BuildListCursor 构建分页游标，游标为上一页最后一个文件的上传时间和fid
+func BuildListCursor(info *MediaFileInfo) string {
+	return fmt.Sprintf("%d:%s", ptr.ToInt64(info.CreatedTs), info.Fid)
+}
+
+// ParseListCursor 解析分页游标
+func ParseListCursor(cursor string) (int64, string, error) {
+	raw, fid, ok := strings.Cut(cursor, ":")
+	if !ok || len(fid) == 0 {
+		return 0, "", pkg.ErrorEnums.ErrListCursorInvalid
+	}
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, "", pkg.ErrorEnums.ErrListCursorInvalid
+	}
+	return ts, fid, nil
+}
+
+// 计算游标之后第一个文件在列表中的位置，游标对应的文件已经删除时按时间和fid定位
+// zset 中 score 相同的成员按 member 字典序排列，和游标的顺序一致
+func (fs *FileIndexLogic) cursorRank(ctx context.Context, key, cursor string) (int64, error) {
+	ts, fid, err := ParseListCursor(cursor)
+	if err != nil {
+		return 0, err
+	}
+	rank, err := fs.fileRedis.ZRank(ctx, key, fid).Result()
+	if err == nil {
+		return rank + 1, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+	score := strconv.FormatInt(ts, 10)
+	before, err := fs.fileRedis.ZCount(ctx, key, "-inf", "("+score).Result()
+	if err != nil {
+		return 0, err
+	}
+	same, err := fs.fileRedis.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: score, Max: score}).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, member := range same {
+		if member <= fid {
+			before++
+		}
+	}
+	return before, nil
+}
+
+// 批量查询文件信息，不存在的文件对应的位置为nil
+func (fs *FileIndexLogic) queryFileInfos(ctx context.Context, depotId string, fids []string) ([]*MediaFileInfo, error) {
+	keys := make([]string, 0, len(fids))
+	for _, fid := range fids {
+		keys = append(keys, fs.buildFileInfoKey(depotId, fid))
+	}
+	values, err := fs.fileRedis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*MediaFileInfo, len(fids))
+	for i, v := range values {
+		raw, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var info MediaFileInfo
+		if err = json.Unmarshal([]byte(raw), &info); err != nil {
+			logx.Errorf("FileIndexServer|queryFileInfos|Unmarshal|fid: %s|err: %v", fids[i], err)
+			continue
+		}
+		infos[i] = &info
+	}
+	return infos, nil
+}
+
+// 从列表的 start 位置开始按上传时间顺序遍历箱子下的文件
+func (fs *FileIndexLogic) scanBoxFiles(ctx context.Context, depotId, boxId string, start int64, fn func(info *MediaFileInfo) error) error {
+	key := fs.buildBoxFileListKey(depotId, boxId)
+	for {
+		fids, err := fs.fileRedis.ZRange(ctx, key, start, start+listBatchSize-1).Result()
+		if err != nil {
+			logx.Errorf("FileIndexServer|scanBoxFiles|ZRange|boxId: %s|err: %v", boxId, err)
+			return err
+		}
+		if len(fids) == 0 {
+			return nil
+		}
+		start += int64(len(fids))
+		infos, err := fs.queryFileInfos(ctx, depotId, fids)
+		if err != nil {
+			logx.Errorf("FileIndexServer|scanBoxFiles|queryFileInfos|boxId: %s|err: %v", boxId, err)
+			return err
+		}
+		for _, info := range infos {
+			if info == nil {
+				continue
+			}
+			if err = fn(info); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ScanBoxFiles 按上传时间顺序遍历箱子下的所有文件
+func (fs *FileIndexLogic) ScanBoxFiles(ctx context.Context, depotId, boxId string, fn func(info *MediaFileInfo) error) error {
+	return fs.scanBoxFiles(ctx, depotId, boxId, 0, fn)
+}
+
+// 分页已满，结束遍历
+var errListPageFull = errors.New("list page full")
+
+// ListBoxFiles 从游标之后分页列举箱子下的文件，filter 为空时不过滤
+// 返回下一页的游标，没有更多文件时游标为空
+func (fs *FileIndexLogic) ListBoxFiles(ctx context.Context, depotId, boxId, cursor string, limit int, filter func(info *MediaFileInfo) bool) ([]*MediaFileInfo, string, error) {
+	var start int64
+	if len(cursor) > 0 {
+		var err error
+		if start, err = fs.cursorRank(ctx, fs.buildBoxFileListKey(depotId, boxId), cursor); err != nil {
+			logx.Errorf("FileIndexServer|ListBoxFiles|cursorRank|boxId: %s|cursor: %s|err: %v", boxId, cursor, err)
+			return nil, "", err
+		}
+	}
+	infos := make([]*MediaFileInfo, 0, limit)
+	err := fs.scanBoxFiles(ctx, depotId, boxId, start, func(info *MediaFileInfo) error {
+		if filter != nil && !filter(info) {
+			return nil
+		}
+		infos = append(infos, info)
+		if len(infos) >= limit {
+			return errListPageFull
+		}
+		return nil
+	})
+	if errors.Is(err, errListPageFull) {
+		return infos, BuildListCursor(infos[len(infos)-1]), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return infos, "", nil
+}
+
+// DeleteFile 删除文件的索引和存储的数据，衍生图和隔离区的数据一起删除
+// 只有删除索引成功的请求扣减用量，重复删除返回 ErrFileNotExist
+func (fs *FileIndexLogic) DeleteFile(ctx context.Context, info *MediaFileInfo) error {
+	depotId := info.GetDepotId()
+	n, err := fs.fileRedis.Del(ctx, fs.buildFileInfoKey(depotId, info.Fid)).Result()
+	if err != nil {
+		logx.Errorf("FileIndexServer|DeleteFile|Del|fid: %s|err: %v", info.Fid, err)
+		return err
+	}
+	if n == 0 {
+		return pkg.ErrorEnums.ErrFileNotExist
+	}
+	quarantined := info.Scan != nil && info.Scan.Status == ScanStatuses.Infected
+	if info.Box != nil {
+		if err = fs.fileRedis.ZRem(ctx, fs.buildBoxFileListKey(depotId, info.Box.BoxId), info.Fid).Err(); err != nil {
+			logx.Errorf("FileIndexServer|DeleteFile|ZRem|fid: %s|err: %v", info.Fid, err)
+		}
+		// 隔离时已经扣减过用量
+		if !quarantined {
+			err = fs.boxServ.IncrBoxUsage(ctx, info.Box.BoxId, -1, -ptr.ToInt64(info.ContentLength), -info.GetStoredLength())
+			if err != nil {
+				logx.Errorf("FileIndexServer|DeleteFile|IncrBoxUsage|boxId: %s|err: %v", info.Box.BoxId, err)
+			}
+		}
+	}
+	fs.DeleteImageHash(ctx, depotId, info.Fid)
+
+	// 索引已经删除，存储中残留的对象由对账清理
+	objectKey := info.BuildObjectKey()
+	if quarantined {
+		objectKey = path.Join(quarantinePrefix, objectKey)
+	}
+	if err = fs.s3Server.DeleteObject(ctx, objectKey); err != nil {
+		logx.Errorf("FileIndexServer|DeleteFile|DeleteObject|objectKey: %s|err: %v", objectKey, err)
+	}
+	err = fs.s3Server.ListObjects(ctx, path.Join(variantPrefix, info.BuildObjectKey())+"/", func(obj *S3Object) error {
+		return fs.s3Server.DeleteObject(ctx, obj.Key)
+	})
 	if err != nil {
-		logx.Errorf("FileIndexServer|CompleteUpload|Del|err: %v", err)
+		logx.Errorf("FileIndexServer|DeleteFile|DeleteVariants|fid: %s|err: %v", info.Fid, err)
 	}
 	return nil
 }
 
+// 文件是否仍处于申请上传状态
+func (fs *FileIndexLogic) IsPrepareFileInfo(ctx context.Context, depotId, fid string) (bool, error) {
+	n, err := fs.fileRedis.Exists(ctx, fs.buildPrepareFileInfoKey(depotId, fid)).Result()
+	if err != nil {
+		logx.Errorf("FileIndexServer|IsPrepareFileInfo|Exists|fid: %s|err: %v", fid, err)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SaveImageHash 记录图片的感知哈希
+func (fs *FileIndexLogic) SaveImageHash(ctx context.Context, depotId, fid, hash string) error {
+	err := fs.fileRedis.HSet(ctx, fs.buildImageHashKey(depotId), fid, hash).Err()
+	if err != nil {
+		logx.Errorf("FileIndexServer|SaveImageHash|HSet|fid: %s|err: %v", fid, err)
+	}
+	return err
+}
+
+// DeleteImageHash 从仓库的索引中删除图片的感知哈希
+func (fs *FileIndexLogic) DeleteImageHash(ctx context.Context, depotId string, fids ...string) error {
+	if len(fids) == 0 {
+		return nil
+	}
+	err := fs.fileRedis.HDel(ctx, fs.buildImageHashKey(depotId), fids...).Err()
+	if err != nil {
+		logx.Errorf("FileIndexServer|DeleteImageHash|HDel|depotId: %s|fids: %v|err: %v", depotId, fids, err)
+	}
+	return err
+}
+
+// QueryImageHashes 查询仓库下所有图片的感知哈希
+func (fs *FileIndexLogic) QueryImageHashes(ctx context.Context, depotId string) (map[string]string, error) {
+	hashes, err := fs.fileRedis.HGetAll(ctx, fs.buildImageHashKey(depotId)).Result()
+	if err != nil {
+		logx.Errorf("FileIndexServer|QueryImageHashes|HGetAll|depotId: %s|err: %v", depotId, err)
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// 读取文件的衍生图
+func (fs *FileIndexLogic) OpenVariant(ctx context.Context, info *MediaFileInfo, name string) (io.ReadCloser, error) {
+	sse, err := fs.querySSEParams(ctx, info.GetDepotId())
+	if err != nil {
+		return nil, err
+	}
+	return fs.s3Server.GetObject(ctx, info.BuildVariantKey(name), sse)
+}
+
+// 保存文件的衍生图
+func (fs *FileIndexLogic) SaveVariant(ctx context.Context, info *MediaFileInfo, name string, data []byte, contentType string) error {
+	sse, err := fs.querySSEParams(ctx, info.GetDepotId())
+	if err != nil {
+		return err
+	}
+	return fs.s3Server.SaveObject(ctx, info.BuildVariantKey(name), bytes.NewReader(data), ptr.String(contentType), sse)
+}
+
 func (fs *FileIndexLogic) SignFileUrl(ctx context.Context, info *MediaFileInfo) (string, error) {
+	sse, err := fs.querySSEParams(ctx, info.GetDepotId())
+	if err != nil {
+		return "", err
+	}
 	objectKey := info.BuildObjectKey()
-	presignedURL, err := fs.s3Server.GetPresignedURL(ctx, objectKey)
+	presignedURL, err := fs.s3Server.GetPresignedURL(ctx, objectKey, sse)
 	if err != nil {
 		logx.Errorf("StorageCoreServer|SignGetFileUrl|GetPresignedURL|fid: %s|err: %s", info.Fid, err.Error())
 		return "", err
@@ -204,6 +882,10 @@ func (fs *FileIndexLogic) SignFileUrl(ctx context.Context, info *MediaFileInfo)
 
 // 申请文件上传
 func (fs *FileIndexLogic) ApplyUpload(ctx context.Context, init *InitUpload, box *Box) (string, error) {
+	// 先按声明的类型和文件名检查，上传时再按文件内容检查
+	if err := CheckFileType(box, ptr.ToString(init.FileName), ptr.ToString(init.ContentType)); err != nil {
+		return "", err
+	}
 	// 生成文件的fid
 	info := init.ToMediaFileInfo()
 	info.Fid = randFid()
@@ -221,13 +903,28 @@ func (fs *FileIndexLogic) ApplyUpload(ctx context.Context, init *InitUpload, box
 
 // 文件直接上传
 func (fs *FileIndexLogic) SingleUpload(ctx context.Context, box *Box, fid string, r io.Reader) error {
-	// 查询文件的初始化上传信息
-	prepareFileInfo, err := fs.QueryPrepareFileInfo(ctx, ptr.ToString(box.DepotId), fid)
+	// 领取文件的初始化上传信息，写入存储之前领取，同一个fid并发上传时只有一个可以继续
+	prepareFileInfo, raw, err := fs.ClaimPrepareFileInfo(ctx, ptr.ToString(box.DepotId), fid)
 	if err != nil {
-		logx.Errorf("StorageCoreServer|SingleUpload|QueryPerpareFileInfo|boxId: %s|fid: %s|err: %s", box.BoxId, fid, err.Error())
+		logx.Errorf("StorageCoreServer|SingleUpload|ClaimPrepareFileInfo|boxId: %s|fid: %s|err: %s", box.BoxId, fid, err.Error())
 		return err
 	}
-	return do(
+	// 只能上传到申请时指定的箱子，类型限制以申请记录中的箱子为准
+	if prepareFileInfo.Box == nil || prepareFileInfo.Box.BoxId != box.BoxId {
+		logx.Errorf("StorageCoreServer|SingleUpload|box not match|boxId: %s|fid: %s", box.BoxId, fid)
+		fs.restorePrepareFileInfo(ctx, ptr.ToString(box.DepotId), fid, raw)
+		return pkg.ErrorEnums.ErrFileBoxNotMatch
+	}
+	err = do(
+		// 根据文件头检查文件的真实类型
+		func(ctx context.Context, info *MediaFileInfo, opts ...func(*MediaFileInfo) *MediaFileInfo) error {
+			r, err = fs.detectFileType(info, box, r)
+			if nil != err {
+				logx.Errorf("StorageCoreServer|SingleUpload|detectFileType|boxId: %s|fid: %s|err: %s", box.BoxId, fid, err.Error())
+				return err
+			}
+			return nil
+		},
 		// 开始上传文件
 		func(ctx context.Context, info *MediaFileInfo, opts ...func(*MediaFileInfo) *MediaFileInfo) error {
 			err := fs.SaveFileData(ctx, info, r)
@@ -237,7 +934,11 @@ func (fs *FileIndexLogic) SingleUpload(ctx context.Context, box *Box, fid string
 			}
 			return nil
 		},
-		// 完成上传之后的文件信息构建
+		// 完成上传之后的文件信息构建，需要扫描的文件在扫描通过之后才可以读取
 		fs.CompleteFileInfo,
 	)(ctx, prepareFileInfo)
+	if err != nil && !errors.Is(err, pkg.ErrorEnums.ErrFileExist) {
+		fs.restorePrepareFileInfo(ctx, ptr.ToString(box.DepotId), fid, raw)
+	}
+	return err
 }
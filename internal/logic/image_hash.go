@@ -0,0 +1,266 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"golang.org/x/image/draw"
+)
+
+const (
+	ImageHashDefaultDistance = 10 // 默认的相似阈值，64位中不同的位数
+	ImageHashMaxDistance     = 32
+)
+
+// DHash 计算图片的差异哈希，缩小为 9x8 的灰度图后比较相邻像素的亮度
+// 重新编码、缩放、轻微调色后哈希基本不变
+func DHash(src image.Image) uint64 {
+	gray := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(gray, gray.Bounds(), src, src.Bounds(), draw.Src, nil)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := gray.Pix[y*gray.Stride:]
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x] > row[x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HammingDistance 两个哈希不同的位数
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func formatImageHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parseImageHash(raw string) (uint64, error) {
+	return strconv.ParseUint(raw, 16, 64)
+}
+
+// SimilarImage 相似的图片
+type SimilarImage struct {
+	Fid      string `json:"fid"`
+	Distance int    `json:"distance"`
+}
+
+// DuplicateGroup 互相相似的一组图片
+type DuplicateGroup struct {
+	Fids []string `json:"fids"`
+}
+
+// 计算图片的感知哈希并加入仓库的索引
+func (il *ImageLogic) indexImageHash(ctx context.Context, info *MediaFileInfo, src image.Image) error {
+	hash := formatImageHash(DHash(src))
+	info.Image.PHash = ptr.String(hash)
+	return il.fileServ.SaveImageHash(ctx, info.GetDepotId(), info.Fid, hash)
+}
+
+// 读取仓库中已经索引的哈希，无法解析的跳过
+func (il *ImageLogic) queryImageHashes(ctx context.Context, depotId string) (map[string]uint64, error) {
+	raw, err := il.fileServ.QueryImageHashes(ctx, depotId)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]uint64, len(raw))
+	for fid, v := range raw {
+		if hash, err := parseImageHash(v); err == nil {
+			hashes[fid] = hash
+		}
+	}
+	return hashes, nil
+}
+
+// FindSimilarImages 查找仓库中和指定图片相似的图片，按距离从近到远排序
+func (il *ImageLogic) FindSimilarImages(ctx context.Context, info *MediaFileInfo, distance int) ([]*SimilarImage, error) {
+	if !IsImage(info) {
+		return nil, pkg.ErrorEnums.ErrNotImage
+	}
+	if info.Image == nil || info.Image.PHash == nil {
+		return nil, pkg.ErrorEnums.ErrImageHashNotReady
+	}
+	target, err := parseImageHash(ptr.ToString(info.Image.PHash))
+	if err != nil {
+		return nil, pkg.ErrorEnums.ErrImageHashNotReady
+	}
+	hashes, err := il.queryImageHashes(ctx, info.GetDepotId())
+	if err != nil {
+		return nil, err
+	}
+
+	similar := make([]*SimilarImage, 0)
+	for fid, hash := range hashes {
+		if fid == info.Fid {
+			continue
+		}
+		if d := HammingDistance(target, hash); d <= distance {
+			similar = append(similar, &SimilarImage{Fid: fid, Distance: d})
+		}
+	}
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Distance != similar[j].Distance {
+			return similar[i].Distance < similar[j].Distance
+		}
+		return similar[i].Fid < similar[j].Fid
+	})
+	return similar, nil
+}
+
+// StartDuplicateReport 创建重复图片报告任务，报告在任务中异步生成
+func (il *ImageLogic) StartDuplicateReport(ctx context.Context, depotId, creator string, distance int) (*Job, error) {
+	job, err := il.jobServ.CreateJob(ctx, &Job{
+		JobType: JobTypes.Duplicate,
+		Source:  ptr.String(fmt.Sprintf("distance=%d", distance)),
+		DepotId: ptr.String(depotId),
+		Creator: ptr.String(creator),
+	})
+	if err != nil {
+		logx.Errorf("ImageLogic|StartDuplicateReport|CreateJob|depotId: %s|err: %v", depotId, err)
+		return nil, err
+	}
+	// 请求结束后继续执行，使用服务的ctx
+	go il.duplicateReport(il.ctx, job, depotId, distance)
+	return job, nil
+}
+
+// 生成重复图片报告，同时清理已经删除或者隔离的文件留下的哈希
+func (il *ImageLogic) duplicateReport(ctx context.Context, job *Job, depotId string, distance int) {
+	job.Status = JobStatuses.Running
+	if err := il.jobServ.SaveJob(ctx, job); errors.Is(err, pkg.ErrorEnums.ErrJobCanceled) {
+		return
+	}
+	hashes, err := il.queryImageHashes(ctx, depotId)
+	if err == nil {
+		job.Total = ptr.Int64(int64(len(hashes)))
+		err = il.pruneImageHashes(ctx, job, depotId, hashes)
+	}
+	if err == nil {
+		job.Duplicates = GroupDuplicateHashes(hashes, distance)
+		job.Status = JobStatuses.Success
+	}
+	if errors.Is(err, pkg.ErrorEnums.ErrJobCanceled) {
+		return
+	}
+	if err != nil {
+		logx.Errorf("ImageLogic|duplicateReport|depotId: %s|jobId: %s|err: %v", depotId, job.JobId, err)
+		job.Fail(err)
+	}
+	if err = il.jobServ.SaveJob(ctx, job); err != nil && !errors.Is(err, pkg.ErrorEnums.ErrJobCanceled) {
+		logx.Errorf("ImageLogic|duplicateReport|SaveJob|jobId: %s|err: %v", job.JobId, err)
+	}
+}
+
+// 去掉文件已经不存在或者被隔离的哈希，并从索引中删除
+func (il *ImageLogic) pruneImageHashes(ctx context.Context, job *Job, depotId string, hashes map[string]uint64) error {
+	fids := make([]string, 0, len(hashes))
+	for fid := range hashes {
+		fids = append(fids, fid)
+	}
+	for start := 0; start < len(fids); start += listBatchSize {
+		batch := fids[start:min(start+listBatchSize, len(fids))]
+		infos, err := il.fileServ.queryFileInfos(ctx, depotId, batch)
+		if err != nil {
+			return err
+		}
+		stale := make([]string, 0)
+		for i, info := range infos {
+			if info == nil || (info.Scan != nil && info.Scan.Status == ScanStatuses.Infected) {
+				stale = append(stale, batch[i])
+				delete(hashes, batch[i])
+			}
+		}
+		il.fileServ.DeleteImageHash(ctx, depotId, stale...)
+		job.Progress += int64(len(batch))
+		if err = il.jobServ.SaveJob(ctx, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GroupDuplicateHashes 找出所有重复的图片，相似关系传递的图片合并为一组
+// 把64位哈希分成 distance+1 段，距离不超过 distance 的两个哈希至少有一段完全相同，
+// 只比较有相同段的哈希，避免两两比较
+func GroupDuplicateHashes(hashes map[string]uint64, distance int) []*DuplicateGroup {
+	fids := make([]string, 0, len(hashes))
+	for fid := range hashes {
+		fids = append(fids, fid)
+	}
+	sort.Strings(fids)
+
+	// 并查集合并相似的图片
+	parent := make([]int, len(fids))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	bands := min(max(distance, 0)+1, 64)
+	width, extra := 64/bands, 64%bands
+	buckets := make(map[[2]uint64][]int)
+	shift := 0
+	for band := 0; band < bands; band++ {
+		w := width
+		if band < extra {
+			w++
+		}
+		mask := uint64(1)<<w - 1
+		for i, fid := range fids {
+			key := [2]uint64{uint64(band), hashes[fid] >> shift & mask}
+			buckets[key] = append(buckets[key], i)
+		}
+		shift += w
+	}
+	for _, members := range buckets {
+		for x := 0; x < len(members); x++ {
+			for y := x + 1; y < len(members); y++ {
+				i, j := members[x], members[y]
+				ri, rj := find(i), find(j)
+				if ri == rj || HammingDistance(hashes[fids[i]], hashes[fids[j]]) > distance {
+					continue
+				}
+				parent[max(ri, rj)] = min(ri, rj)
+			}
+		}
+	}
+
+	// fids 已经排序，组内和组之间的顺序都是稳定的
+	groups := make(map[int]*DuplicateGroup)
+	report := make([]*DuplicateGroup, 0)
+	for i, fid := range fids {
+		root := find(i)
+		group, ok := groups[root]
+		if !ok {
+			group = &DuplicateGroup{}
+			groups[root] = group
+			report = append(report, group)
+		}
+		group.Fids = append(group.Fids, fid)
+	}
+	duplicates := report[:0]
+	for _, group := range report {
+		if len(group.Fids) > 1 {
+			duplicates = append(duplicates, group)
+		}
+	}
+	return duplicates
+}
@@ -0,0 +1,433 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// 缩放的方式
+var ImageFits = struct {
+	Contain string // 等比缩放到框内
+	Cover   string // 等比缩放铺满后居中裁剪
+	Fill    string // 拉伸到指定尺寸
+}{
+	Contain: "contain",
+	Cover:   "cover",
+	Fill:    "fill",
+}
+
+// 输出的图片格式
+var ImageFormats = struct {
+	Jpeg string
+	Png  string
+	Webp string // 纯go编码，只支持无损
+}{
+	Jpeg: "jpeg",
+	Png:  "png",
+	Webp: "webp",
+}
+
+const (
+	imageMaxDimension    = 4096     // 输出的最大边长
+	imageMaxSourcePixels = 50000000 // 源图最大像素数，防止解码炸弹
+	imageDefaultQuality  = 85
+)
+
+// ImageTransform 图片处理参数
+type ImageTransform struct {
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Fit     string `json:"fit,omitempty"`
+	Quality int    `json:"quality,omitempty"`
+	Format  string `json:"format,omitempty"`
+}
+
+// ParseImageTransform 从请求参数中解析图片处理参数，没有处理参数时返回nil
+func ParseImageTransform(query url.Values) (*ImageTransform, error) {
+	t := &ImageTransform{
+		Fit:    strings.ToLower(query.Get("fit")),
+		Format: strings.ToLower(query.Get("format")),
+	}
+	parse := func(key string, max int) (int, error) {
+		raw := query.Get(key)
+		if len(raw) == 0 {
+			return 0, nil
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 || v > max {
+			return 0, pkg.ErrorEnums.ErrImageTransformInvalid
+		}
+		return v, nil
+	}
+	var err error
+	if t.Width, err = parse("w", imageMaxDimension); err != nil {
+		return nil, err
+	}
+	if t.Height, err = parse("h", imageMaxDimension); err != nil {
+		return nil, err
+	}
+	if t.Quality, err = parse("q", 100); err != nil {
+		return nil, err
+	}
+	if t.Width == 0 && t.Height == 0 && len(t.Format) == 0 {
+		return nil, nil
+	}
+	return t, t.normalize()
+}
+
+// 校验参数并补全默认值
+func (t *ImageTransform) normalize() error {
+	switch t.Fit {
+	case "":
+		t.Fit = ImageFits.Contain
+	case ImageFits.Contain, ImageFits.Cover, ImageFits.Fill:
+	default:
+		return pkg.ErrorEnums.ErrImageTransformInvalid
+	}
+	switch t.Format {
+	case "", ImageFormats.Png, ImageFormats.Webp:
+	case ImageFormats.Jpeg, "jpg":
+		t.Format = ImageFormats.Jpeg
+	default:
+		return pkg.ErrorEnums.ErrImageTransformInvalid
+	}
+	if t.Quality == 0 {
+		t.Quality = imageDefaultQuality
+	}
+	return nil
+}
+
+// Key 处理参数的规范化表示，用于缓存的对象名
+func (t *ImageTransform) Key() string {
+	return fmt.Sprintf("w%d_h%d_%s_q%d.%s", t.Width, t.Height, t.Fit, t.Quality, t.Format)
+}
+
+// ContentType 输出的文件类型
+func (t *ImageTransform) ContentType() string {
+	return "image/" + t.Format
+}
+
+// IsImage 是否为可以处理的图片
+func IsImage(info *MediaFileInfo) bool {
+	switch strings.ToLower(ptr.ToString(info.ContentType)) {
+	case "image/jpeg", "image/jpg", "image/png", "image/gif", "image/webp":
+		return true
+	default:
+		return false
+	}
+}
+
+// FileVariant 按照box预设生成的衍生图
+type FileVariant struct {
+	Name        string          `json:"name"`
+	Transform   *ImageTransform `json:"transform"`
+	ContentType string          `json:"content_type"`
+	Width       int             `json:"width"`
+	Height      int             `json:"height"`
+	Size        int64           `json:"size"`
+	Version     string          `json:"version"` // 生成时源文件的版本
+}
+
+// CheckVariantPresets 校验box中的衍生图预设
+func CheckVariantPresets(presets map[string]*ImageTransform) error {
+	for name, t := range presets {
+		if len(name) == 0 || t == nil || (t.Width == 0 && t.Height == 0) {
+			return pkg.ErrorEnums.ErrImageTransformInvalid
+		}
+		if t.Width < 0 || t.Width > imageMaxDimension || t.Height < 0 || t.Height > imageMaxDimension || t.Quality < 0 || t.Quality > 100 {
+			return pkg.ErrorEnums.ErrImageTransformInvalid
+		}
+		if err := t.normalize(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 图片处理服务
+type ImageLogic struct {
+	ctx      context.Context
+	fileServ *FileIndexLogic
+	boxServ  *BoxLogic
+	jobServ  *JobLogic
+}
+
+func NewImageLogic(ctx context.Context, fileServ *FileIndexLogic, boxServ *BoxLogic, jobServ *JobLogic) *ImageLogic {
+	il := &ImageLogic{
+		ctx:      ctx,
+		fileServ: fileServ,
+		boxServ:  boxServ,
+		jobServ:  jobServ,
+	}
+	fileServ.RegisterProcessHook(il.ProcessImage)
+	return il
+}
+
+// ProcessImage 上传完成后异步处理图片，原图只解码一次
+func (il *ImageLogic) ProcessImage(ctx context.Context, info *MediaFileInfo, opts ...func(*MediaFileInfo) *MediaFileInfo) error {
+	if !IsImage(info) {
+		return nil
+	}
+	src, err := il.decodeSource(ctx, info)
+	if err != nil {
+		// 文件内容被替换为无法解码的数据时，旧的哈希不能继续参与比较
+		il.fileServ.DeleteImageHash(ctx, info.GetDepotId(), info.Fid)
+		return err
+	}
+	il.generatePlaceholder(info, src)
+	if err = il.indexImageHash(ctx, info, src); err != nil {
+		logx.Errorf("ImageLogic|ProcessImage|indexImageHash|fid: %s|err: %v", info.Fid, err)
+	}
+	return il.generateVariants(ctx, info, src)
+}
+
+// 生成加载时使用的 BlurHash 和主要颜色
+func (il *ImageLogic) generatePlaceholder(info *MediaFileInfo, src image.Image) {
+	if info.Image == nil {
+		info.Image = &ImageMeta{Width: src.Bounds().Dx(), Height: src.Bounds().Dy()}
+	}
+	info.Image.BlurHash = ptr.String(EncodeBlurHash(src))
+	info.Image.Palette = DominantColors(src)
+}
+
+// 查询文件所在box的衍生图预设
+func (il *ImageLogic) queryPresets(ctx context.Context, info *MediaFileInfo) (map[string]*ImageTransform, error) {
+	if info.Box == nil {
+		return nil, nil
+	}
+	box, err := il.boxServ.QueryBoxInfo(ctx, info.Box.BoxId)
+	if err != nil {
+		return nil, err
+	}
+	return box.Variants, nil
+}
+
+// 按照box的预设生成衍生图
+func (il *ImageLogic) generateVariants(ctx context.Context, info *MediaFileInfo, src image.Image) error {
+	presets, err := il.queryPresets(ctx, info)
+	if err != nil || len(presets) == 0 {
+		return err
+	}
+
+	variants := make(map[string]*FileVariant, len(presets))
+	for name, preset := range presets {
+		t := *preset
+		if len(t.Format) == 0 {
+			t.Format = defaultImageFormat(ptr.ToString(info.ContentType))
+		}
+		img := ResizeImage(src, &t)
+		data, err := EncodeImage(img, &t)
+		if err != nil {
+			logx.Errorf("ImageLogic|GenerateVariants|EncodeImage|fid: %s|variant: %s|err: %v", info.Fid, name, err)
+			continue
+		}
+		if err = il.fileServ.SaveVariant(ctx, info, t.Key(), data, t.ContentType()); err != nil {
+			logx.Errorf("ImageLogic|GenerateVariants|SaveVariant|fid: %s|variant: %s|err: %v", info.Fid, name, err)
+			continue
+		}
+		variants[name] = &FileVariant{
+			Name:        name,
+			Transform:   &t,
+			ContentType: t.ContentType(),
+			Width:       img.Bounds().Dx(),
+			Height:      img.Bounds().Dy(),
+			Size:        int64(len(data)),
+			Version:     info.ContentVersion(),
+		}
+	}
+	info.Variants = variants
+	return nil
+}
+
+// OpenVariant 读取预设的衍生图，还没有生成或者已经过期时重新生成
+func (il *ImageLogic) OpenVariant(ctx context.Context, info *MediaFileInfo, name string) (io.ReadCloser, string, error) {
+	if variant, ok := info.Variants[name]; ok && variant.Version == info.ContentVersion() {
+		body, err := il.fileServ.OpenVariant(ctx, info, variant.Transform.Key())
+		if err == nil {
+			return body, variant.ContentType, nil
+		}
+		logx.Errorf("ImageLogic|OpenVariant|OpenVariant|fid: %s|variant: %s|err: %v", info.Fid, name, err)
+	}
+
+	t, err := il.VariantTransform(ctx, info, name)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := il.OpenTransformed(ctx, info, t)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, t.ContentType(), nil
+}
+
+// OpenTransformed 获取处理后的图片，优先读取缓存，没有缓存时生成并写回存储
+func (il *ImageLogic) OpenTransformed(ctx context.Context, info *MediaFileInfo, t *ImageTransform) (io.ReadCloser, error) {
+	if !IsImage(info) {
+		return nil, pkg.ErrorEnums.ErrNotImage
+	}
+	if len(t.Format) == 0 {
+		t.Format = defaultImageFormat(ptr.ToString(info.ContentType))
+	}
+	name := t.Key()
+	cached, err := il.fileServ.OpenVariant(ctx, info, name)
+	if err == nil {
+		return cached, nil
+	}
+	if !errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+		logx.Errorf("ImageLogic|OpenTransformed|OpenVariant|fid: %s|variant: %s|err: %v", info.Fid, name, err)
+	}
+
+	data, err := il.transform(ctx, info, t)
+	if err != nil {
+		return nil, err
+	}
+	if err = il.fileServ.SaveVariant(ctx, info, name, data, t.ContentType()); err != nil {
+		// 缓存失败不影响本次返回
+		logx.Errorf("ImageLogic|OpenTransformed|SaveVariant|fid: %s|variant: %s|err: %v", info.Fid, name, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// 读取原图并处理
+func (il *ImageLogic) transform(ctx context.Context, info *MediaFileInfo, t *ImageTransform) ([]byte, error) {
+	src, err := il.decodeSource(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeImage(ResizeImage(src, t), t)
+}
+
+// 解码原图
+func (il *ImageLogic) decodeSource(ctx context.Context, info *MediaFileInfo) (image.Image, error) {
+	body, err := il.fileServ.OpenFileData(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if encoding := ptr.ToString(info.ContentEncoding); len(encoding) > 0 {
+		decoded, err := NewDecompressReader(encoding, body)
+		if err != nil {
+			return nil, err
+		}
+		defer decoded.Close()
+		r = decoded
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		logx.Errorf("ImageLogic|decodeSource|DecodeConfig|fid: %s|err: %v", info.Fid, err)
+		return nil, pkg.ErrorEnums.ErrNotImage
+	}
+	if cfg.Width*cfg.Height > imageMaxSourcePixels {
+		return nil, pkg.ErrorEnums.ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		logx.Errorf("ImageLogic|decodeSource|Decode|fid: %s|err: %v", info.Fid, err)
+		return nil, pkg.ErrorEnums.ErrNotImage
+	}
+	// 按照 EXIF 方向自动旋转，去除元数据后以文件信息中记录的方向为准
+	meta := info.Image
+	if meta == nil {
+		meta = ParseImageMeta(raw)
+	}
+	return OrientImage(img, meta.Orientation), nil
+}
+
+// 没有指定格式时按原图格式输出，gif 只取第一帧输出为png
+func defaultImageFormat(contentType string) string {
+	switch strings.ToLower(contentType) {
+	case "image/jpeg", "image/jpg":
+		return ImageFormats.Jpeg
+	case "image/webp":
+		return ImageFormats.Webp
+	default:
+		return ImageFormats.Png
+	}
+}
+
+// ResizeImage 按照参数缩放图片
+func ResizeImage(src image.Image, t *ImageTransform) image.Image {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if t.Width == 0 && t.Height == 0 {
+		return src
+	}
+	tw, th := t.Width, t.Height
+	// 只指定一边时等比缩放
+	if tw == 0 {
+		tw = max(1, sw*th/sh)
+	} else if th == 0 {
+		th = max(1, sh*tw/sw)
+	}
+
+	srcRect := src.Bounds()
+	dw, dh := tw, th
+	switch t.Fit {
+	case ImageFits.Contain:
+		if sw*th > sh*tw {
+			dh = max(1, sh*tw/sw)
+		} else {
+			dw = max(1, sw*th/sh)
+		}
+	case ImageFits.Cover:
+		// 裁剪原图中间和目标比例一致的区域
+		cw, ch := sw, sh
+		if sw*th > sh*tw {
+			cw = max(1, sh*tw/th)
+		} else {
+			ch = max(1, sw*th/tw)
+		}
+		x0 := srcRect.Min.X + (sw-cw)/2
+		y0 := srcRect.Min.Y + (sh-ch)/2
+		srcRect = image.Rect(x0, y0, x0+cw, y0+ch)
+	}
+	// 不放大原图
+	if t.Fit != ImageFits.Fill && dw > srcRect.Dx() && dh > srcRect.Dy() {
+		dw, dh = srcRect.Dx(), srcRect.Dy()
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Src, nil)
+	return dst
+}
+
+// EncodeImage 按照参数编码图片
+func EncodeImage(img image.Image, t *ImageTransform) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch t.Format {
+	case ImageFormats.Jpeg:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: t.Quality})
+	case ImageFormats.Webp:
+		err = nativewebp.Encode(&buf, img, nil)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
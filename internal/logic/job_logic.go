@@ -0,0 +1,235 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/ds"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/redis/go-redis/v9"
+)
+
+// 任务类型
+var JobTypes = struct {
+	Fetch     string // 从url拉取文件
+	Archive   string // 解压归档文件
+	Duplicate string // 仓库重复图片报告
+}{
+	Fetch:     "fetch",
+	Archive:   "archive",
+	Duplicate: "duplicate",
+}
+
+// 任务状态
+var JobStatuses = struct {
+	Pending  string
+	Running  string
+	Success  string
+	Failed   string
+	Canceled string
+}{
+	Pending:  "pending",
+	Running:  "running",
+	Success:  "success",
+	Failed:   "failed",
+	Canceled: "canceled",
+}
+
+// 任务记录保留的时间
+const jobExpire = 7 * 24 * time.Hour
+
+// JobEntry 任务中单个条目的状态
+type JobEntry struct {
+	Name   string  `json:"name"`
+	Fid    *string `json:"fid,omitempty"`
+	Size   *int64  `json:"size,omitempty"`
+	Status string  `json:"status"`
+	Error  *string `json:"error,omitempty"`
+}
+
+// Job 异步任务记录
+type Job struct {
+	JobId      string            `json:"job_id"`
+	JobType    string            `json:"job_type"`
+	Status     string            `json:"status"`
+	Source     *string           `json:"source,omitempty"` // 任务来源，如url
+	BoxId      *string           `json:"box_id,omitempty"`
+	DepotId    *string           `json:"depot_id,omitempty"`
+	Creator    *string           `json:"creator,omitempty"`
+	Progress   int64             `json:"progress"`             // 已处理的字节数
+	Total      *int64            `json:"total,omitempty"`      // 总字节数，未知时为空
+	Fid        *string           `json:"fid,omitempty"`        // 生成的文件
+	FileInfo   *MediaFileInfo    `json:"file_info,omitempty"`  // 完成后的文件信息
+	Entries    []*JobEntry       `json:"entries,omitempty"`    // 多文件任务的条目
+	Duplicates []*DuplicateGroup `json:"duplicates,omitempty"` // 重复图片报告的结果
+	Error      *string           `json:"error,omitempty"`
+	CreatedTs  int64             `json:"created_ts"`
+	UpdatedTs  int64             `json:"updated_ts"`
+}
+
+// IsCreator 是否为任务的创建者，匿名调用方不是任何任务的创建者
+func (j *Job) IsCreator(uid string) bool {
+	return len(uid) > 0 && uid == ptr.ToString(j.Creator)
+}
+
+// Fail 标记任务失败
+func (j *Job) Fail(err error) {
+	j.Status = JobStatuses.Failed
+	j.Error = ptr.String(err.Error())
+}
+
+// Finished 任务是否已经结束
+func (j *Job) Finished() bool {
+	return j.Status == JobStatuses.Success || j.Status == JobStatuses.Failed || j.Status == JobStatuses.Canceled
+}
+
+type JobLogic struct {
+	ctx      context.Context
+	group    string
+	jobRedis *redis.Client
+}
+
+func NewJobLogic(ctx context.Context, cfg *config.Config, dsServer *ds.DatabaseServer) *JobLogic {
+	jobRedis, ok := dsServer.GetRedis("system")
+	if !ok {
+		panic("redis [system] not found")
+	}
+	return &JobLogic{
+		ctx:      ctx,
+		group:    ptr.ToString(cfg.Group),
+		jobRedis: jobRedis,
+	}
+}
+
+// 构建任务信息key
+func (jl *JobLogic) buildJobInfoKey(id string) string {
+	return fmt.Sprintf("media_storage:%s:job:%s:info", jl.group, id)
+}
+
+// 任务取消标记，执行任务的实例保存进度时检查，任务可能在其他实例上执行
+func (jl *JobLogic) buildJobCancelKey(id string) string {
+	return fmt.Sprintf("media_storage:%s:job:%s:cancel", jl.group, id)
+}
+
+// 创建任务
+func (jl *JobLogic) CreateJob(ctx context.Context, job *Job) (*Job, error) {
+	if len(job.JobId) == 0 {
+		job.JobId = "ji_" + generateRandomString(12)
+	}
+	job.Status = JobStatuses.Pending
+	job.CreatedTs = time.Now().Unix()
+	return job, jl.SaveJob(ctx, job)
+}
+
+// 保存任务，任务已经被取消时标记为取消并返回 ErrJobCanceled，执行方需要停止任务
+func (jl *JobLogic) SaveJob(ctx context.Context, job *Job) error {
+	canceled, err := jl.jobRedis.Exists(ctx, jl.buildJobCancelKey(job.JobId)).Result()
+	if err != nil {
+		logx.Errorf("JobLogic|SaveJob|Exists|jobId: %s|err: %v", job.JobId, err)
+		return err
+	}
+	if canceled > 0 {
+		job.Status = JobStatuses.Canceled
+		job.Error = ptr.String(pkg.ErrorEnums.ErrJobCanceled.Error())
+		if err = jl.saveJob(ctx, job); err != nil {
+			return err
+		}
+		return pkg.ErrorEnums.ErrJobCanceled
+	}
+	return jl.saveJob(ctx, job)
+}
+
+func (jl *JobLogic) saveJob(ctx context.Context, job *Job) error {
+	job.UpdatedTs = time.Now().Unix()
+	raw, err := json.Marshal(job)
+	if err != nil {
+		logx.Errorf("JobLogic|SaveJob|Marshal|jobId: %s|err: %v", job.JobId, err)
+		return err
+	}
+	err = jl.jobRedis.Set(ctx, jl.buildJobInfoKey(job.JobId), raw, jobExpire).Err()
+	if err != nil {
+		logx.Errorf("JobLogic|SaveJob|Set|jobId: %s|err: %v", job.JobId, err)
+		return err
+	}
+	return nil
+}
+
+// 查询任务
+func (jl *JobLogic) QueryJob(ctx context.Context, jobId string) (*Job, error) {
+	raw, err := jl.jobRedis.Get(ctx, jl.buildJobInfoKey(jobId)).Bytes()
+	if err != nil {
+		logx.Errorf("JobLogic|QueryJob|Get|jobId: %s|err: %v", jobId, err)
+		if errors.Is(err, redis.Nil) {
+			return nil, pkg.ErrorEnums.ErrJobNotExist
+		}
+		return nil, err
+	}
+	var job Job
+	if err = json.Unmarshal(raw, &job); err != nil {
+		logx.Errorf("JobLogic|QueryJob|Unmarshal|jobId: %s|err: %v", jobId, err)
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListJobs 列举任务，status 和 jobType 为空时不过滤，按创建时间倒序
+func (jl *JobLogic) ListJobs(ctx context.Context, status, jobType string) ([]*Job, error) {
+	jobs := make([]*Job, 0)
+	iter := jl.jobRedis.Scan(ctx, 0, jl.buildJobInfoKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		raw, err := jl.jobRedis.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			logx.Errorf("JobLogic|ListJobs|Get|key: %s|err: %v", iter.Val(), err)
+			return nil, err
+		}
+		var job Job
+		if err = json.Unmarshal(raw, &job); err != nil {
+			logx.Errorf("JobLogic|ListJobs|Unmarshal|key: %s|err: %v", iter.Val(), err)
+			continue
+		}
+		if (len(status) > 0 && job.Status != status) || (len(jobType) > 0 && job.JobType != jobType) {
+			continue
+		}
+		jobs = append(jobs, &job)
+	}
+	if err := iter.Err(); err != nil {
+		logx.Errorf("JobLogic|ListJobs|Scan|err: %v", err)
+		return nil, err
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].CreatedTs != jobs[j].CreatedTs {
+			return jobs[i].CreatedTs > jobs[j].CreatedTs
+		}
+		return jobs[i].JobId < jobs[j].JobId
+	})
+	return jobs, nil
+}
+
+// CancelJob 取消未结束的任务，正在执行的任务在下次保存进度时停止
+func (jl *JobLogic) CancelJob(ctx context.Context, jobId string) (*Job, error) {
+	job, err := jl.QueryJob(ctx, jobId)
+	if err != nil {
+		return nil, err
+	}
+	if job.Finished() {
+		return job, pkg.ErrorEnums.ErrJobFinished
+	}
+	if err = jl.jobRedis.Set(ctx, jl.buildJobCancelKey(jobId), 1, jobExpire).Err(); err != nil {
+		logx.Errorf("JobLogic|CancelJob|Set|jobId: %s|err: %v", jobId, err)
+		return nil, err
+	}
+	if err = jl.SaveJob(ctx, job); err != nil && !errors.Is(err, pkg.ErrorEnums.ErrJobCanceled) {
+		return nil, err
+	}
+	return job, nil
+}
@@ -0,0 +1,728 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/aws/smithy-go/ptr"
+)
+
+// 探测的容器格式
+var MediaFormats = struct {
+	Mp4      string
+	Mov      string
+	Webm     string
+	Matroska string
+	Mp3      string
+	Wav      string
+	Flac     string
+}{
+	Mp4:      "mp4",
+	Mov:      "mov",
+	Webm:     "webm",
+	Matroska: "matroska",
+	Mp3:      "mp3",
+	Wav:      "wav",
+	Flac:     "flac",
+}
+
+// 轨道类型
+var MediaTrackTypes = struct {
+	Video string
+	Audio string
+}{
+	Video: "video",
+	Audio: "audio",
+}
+
+const (
+	mediaProbeHeadSize = 4 << 20  // webm / mp3 等读取文件头部的大小
+	mediaProbeMaxBox   = 64 << 20 // mp4 moov 的最大读取大小
+)
+
+// MediaTrack 音视频轨道
+type MediaTrack struct {
+	Type       string `json:"type" bson:"type"`
+	Codec      string `json:"codec,omitempty" bson:"codec,omitempty"`
+	Width      int    `json:"width,omitempty" bson:"width,omitempty"`
+	Height     int    `json:"height,omitempty" bson:"height,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty" bson:"sample_rate,omitempty"`
+	Channels   int    `json:"channels,omitempty" bson:"channels,omitempty"`
+}
+
+// MediaProbe 音视频文件的探测结果
+type MediaProbe struct {
+	Format     string        `json:"format" bson:"format"`
+	Duration   float64       `json:"duration" bson:"duration"`                   // 时长，秒
+	Bitrate    int64         `json:"bitrate,omitempty" bson:"bitrate,omitempty"` // 平均码率，bit/s
+	Width      int           `json:"width,omitempty" bson:"width,omitempty"`     // 第一个视频轨道的宽
+	Height     int           `json:"height,omitempty" bson:"height,omitempty"`   // 第一个视频轨道的高
+	VideoCodec string        `json:"video_codec,omitempty" bson:"video_codec,omitempty"`
+	AudioCodec string        `json:"audio_codec,omitempty" bson:"audio_codec,omitempty"`
+	TrackCount int           `json:"track_count" bson:"track_count"`
+	Tracks     []*MediaTrack `json:"tracks,omitempty" bson:"tracks,omitempty"`
+}
+
+// IsMedia 是否为需要探测的音视频文件
+func IsMedia(info *MediaFileInfo) bool {
+	contentType := strings.ToLower(ptr.ToString(info.ContentType))
+	return strings.HasPrefix(contentType, "video/") || strings.HasPrefix(contentType, "audio/")
+}
+
+// ProbeMedia 解析音视频容器，不支持的格式返回nil
+func ProbeMedia(r io.ReaderAt, size int64) *MediaProbe {
+	head := make([]byte, min(size, mediaProbeHeadSize))
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	var probe *MediaProbe
+	switch {
+	case len(head) >= 12 && isMp4Box(string(head[4:8])):
+		probe = probeMp4(r, size, head)
+	case len(head) >= 4 && binary.BigEndian.Uint32(head) == ebmlHeaderId:
+		probe = probeMatroska(head)
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		probe = probeWav(r, size)
+	default:
+		// mp3 和 flac 可能带有 ID3 标签
+		offset := skipId3(head)
+		if offset+4 > len(head) {
+			return nil
+		}
+		if string(head[offset:offset+4]) == "fLaC" {
+			probe = probeFlac(head[offset:])
+		} else {
+			probe = probeMp3(head[offset:], size-int64(offset))
+		}
+	}
+	if probe == nil {
+		return nil
+	}
+	probe.fill(size)
+	return probe
+}
+
+// 补全汇总字段
+func (mp *MediaProbe) fill(size int64) {
+	mp.TrackCount = len(mp.Tracks)
+	for _, t := range mp.Tracks {
+		switch t.Type {
+		case MediaTrackTypes.Video:
+			if len(mp.VideoCodec) == 0 {
+				mp.VideoCodec, mp.Width, mp.Height = t.Codec, t.Width, t.Height
+			}
+		case MediaTrackTypes.Audio:
+			if len(mp.AudioCodec) == 0 {
+				mp.AudioCodec = t.Codec
+			}
+		}
+	}
+	if mp.Bitrate == 0 && mp.Duration > 0 {
+		mp.Bitrate = int64(float64(size*8) / mp.Duration)
+	}
+	mp.Duration = math.Round(mp.Duration*1000) / 1000
+}
+
+// mp4 / mov 顶层的 box 类型
+func isMp4Box(typ string) bool {
+	switch typ {
+	case "ftyp", "moov", "mdat", "wide", "free", "skip":
+		return true
+	default:
+		return false
+	}
+}
+
+// 遍历 mp4 的 box，返回 false 时停止
+func walkMp4Boxes(data []byte, fn func(typ string, payload []byte) bool) {
+	pos := 0
+	for pos+8 <= len(data) {
+		size := int64(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		header := 8
+		switch size {
+		case 0:
+			size = int64(len(data) - pos)
+		case 1:
+			if pos+16 > len(data) {
+				return
+			}
+			size = int64(binary.BigEndian.Uint64(data[pos+8:]))
+			header = 16
+		}
+		if size < int64(header) || int64(pos)+size > int64(len(data)) {
+			return
+		}
+		if !fn(typ, data[pos+header:pos+int(size)]) {
+			return
+		}
+		pos += int(size)
+	}
+}
+
+func probeMp4(r io.ReaderAt, size int64, head []byte) *MediaProbe {
+	probe := &MediaProbe{Format: MediaFormats.Mov}
+	if string(head[4:8]) == "ftyp" && string(head[8:12]) != "qt  " {
+		probe.Format = MediaFormats.Mp4
+	}
+
+	// moov 可能在文件末尾，按 box 头部跳转查找
+	var moov []byte
+	hdr := make([]byte, 16)
+	for pos := int64(0); pos+8 <= size; {
+		if _, err := r.ReadAt(hdr, pos); err != nil && err != io.EOF {
+			return nil
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr))
+		header := int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = size - pos
+		case 1:
+			boxSize, header = int64(binary.BigEndian.Uint64(hdr[8:])), 16
+		}
+		if boxSize < header || pos+boxSize > size {
+			return nil
+		}
+		if string(hdr[4:8]) == "moov" {
+			if boxSize-header > mediaProbeMaxBox {
+				return nil
+			}
+			moov = make([]byte, boxSize-header)
+			if _, err := r.ReadAt(moov, pos+header); err != nil && err != io.EOF {
+				return nil
+			}
+			break
+		}
+		pos += boxSize
+	}
+	if moov == nil {
+		return nil
+	}
+
+	walkMp4Boxes(moov, func(typ string, payload []byte) bool {
+		switch typ {
+		case "mvhd":
+			if timescale, duration := parseMp4Duration(payload); timescale > 0 {
+				probe.Duration = float64(duration) / float64(timescale)
+			}
+		case "trak":
+			if track := parseMp4Track(payload); track != nil {
+				probe.Tracks = append(probe.Tracks, track)
+			}
+		}
+		return true
+	})
+	return probe
+}
+
+// 解析 mvhd / mdhd 中的时间刻度和时长
+func parseMp4Duration(payload []byte) (uint32, uint64) {
+	if len(payload) < 24 {
+		return 0, 0
+	}
+	if payload[0] == 1 {
+		if len(payload) < 32 {
+			return 0, 0
+		}
+		return binary.BigEndian.Uint32(payload[20:]), binary.BigEndian.Uint64(payload[24:])
+	}
+	return binary.BigEndian.Uint32(payload[12:]), uint64(binary.BigEndian.Uint32(payload[16:]))
+}
+
+// 解析 trak 中的轨道类型和编码，只返回音视频轨道
+func parseMp4Track(trak []byte) *MediaTrack {
+	var handler string
+	var entry []byte
+	var find func(data []byte)
+	find = func(data []byte) {
+		walkMp4Boxes(data, func(typ string, payload []byte) bool {
+			switch typ {
+			case "mdia", "minf", "stbl":
+				find(payload)
+			case "hdlr":
+				if len(payload) >= 12 {
+					handler = string(payload[8:12])
+				}
+			case "stsd":
+				// version/flags(4) entry_count(4) 之后是第一个 sample entry
+				if len(payload) >= 16 {
+					walkMp4Boxes(payload[8:], func(format string, body []byte) bool {
+						entry = append([]byte(format), body...)
+						return false
+					})
+				}
+			}
+			return true
+		})
+	}
+	find(trak)
+	if len(entry) < 4 {
+		return nil
+	}
+	codec := mp4CodecName(string(entry[:4]))
+	body := entry[4:]
+	switch handler {
+	case "vide":
+		track := &MediaTrack{Type: MediaTrackTypes.Video, Codec: codec}
+		// reserved(6) data_reference_index(2) pre_defined/reserved(16) width(2) height(2)
+		if len(body) >= 28 {
+			track.Width = int(binary.BigEndian.Uint16(body[24:]))
+			track.Height = int(binary.BigEndian.Uint16(body[26:]))
+		}
+		return track
+	case "soun":
+		track := &MediaTrack{Type: MediaTrackTypes.Audio, Codec: codec}
+		// reserved(6) data_reference_index(2) reserved(8) channelcount(2) samplesize(2) reserved(4) samplerate(4, 16.16)
+		if len(body) >= 28 {
+			track.Channels = int(binary.BigEndian.Uint16(body[16:]))
+			track.SampleRate = int(binary.BigEndian.Uint32(body[24:]) >> 16)
+		}
+		return track
+	default:
+		return nil
+	}
+}
+
+// mp4 sample entry 对应的编码名称
+func mp4CodecName(format string) string {
+	switch format {
+	case "avc1", "avc3":
+		return "h264"
+	case "hvc1", "hev1":
+		return "hevc"
+	case "av01":
+		return "av1"
+	case "vp08":
+		return "vp8"
+	case "vp09":
+		return "vp9"
+	case "mp4v":
+		return "mpeg4"
+	case "mp4a":
+		return "aac"
+	case "Opus":
+		return "opus"
+	case "fLaC":
+		return "flac"
+	case "ac-3":
+		return "ac3"
+	case "ec-3":
+		return "eac3"
+	case ".mp3":
+		return "mp3"
+	case "alac":
+		return "alac"
+	default:
+		return strings.TrimSpace(format)
+	}
+}
+
+// matroska 用到的元素id
+const (
+	ebmlHeaderId     = 0x1a45dfa3
+	ebmlDocType      = 0x4282
+	mkvSegment       = 0x18538067
+	mkvInfo          = 0x1549a966
+	mkvTimecodeScale = 0x2ad7b1
+	mkvDuration      = 0x4489
+	mkvTracks        = 0x1654ae6b
+	mkvTrackEntry    = 0xae
+	mkvTrackType     = 0x83
+	mkvCodecId       = 0x86
+	mkvVideo         = 0xe0
+	mkvPixelWidth    = 0xb0
+	mkvPixelHeight   = 0xba
+	mkvAudio         = 0xe1
+	mkvSampleRate    = 0xb5
+	mkvChannels      = 0x9f
+	mkvCluster       = 0x1f43b675
+)
+
+// 读取 ebml 的变长整数，id 保留长度标记位，size 去掉长度标记位
+func readEbmlVint(data []byte, keepMarker bool) (uint64, int, bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || length > len(data) {
+		return 0, 0, false
+	}
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xff >> length)
+	}
+	allOnes := value == uint64(0xff>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(data[i])
+		allOnes = allOnes && data[i] == 0xff
+	}
+	// 长度全为1表示未知大小
+	if !keepMarker && allOnes {
+		return math.MaxUint64, length, true
+	}
+	return value, length, true
+}
+
+// 遍历 ebml 元素，未知大小或者超出数据范围的元素截断到数据末尾
+func walkEbml(data []byte, fn func(id uint64, payload []byte) bool) {
+	pos := 0
+	for pos < len(data) {
+		id, idLen, ok := readEbmlVint(data[pos:], true)
+		if !ok {
+			return
+		}
+		size, sizeLen, ok := readEbmlVint(data[pos+idLen:], false)
+		if !ok {
+			return
+		}
+		start := pos + idLen + sizeLen
+		end := len(data)
+		if size < uint64(len(data)-start) {
+			end = start + int(size)
+		}
+		if !fn(id, data[start:end]) {
+			return
+		}
+		pos = end
+	}
+}
+
+func ebmlUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	default:
+		return 0
+	}
+}
+
+func probeMatroska(head []byte) *MediaProbe {
+	probe := &MediaProbe{Format: MediaFormats.Matroska}
+	valid := false
+	walkEbml(head, func(id uint64, payload []byte) bool {
+		switch id {
+		case ebmlHeaderId:
+			valid = true
+			walkEbml(payload, func(id uint64, payload []byte) bool {
+				if id == ebmlDocType && string(payload) == "webm" {
+					probe.Format = MediaFormats.Webm
+				}
+				return true
+			})
+		case mkvSegment:
+			parseMkvSegment(payload, probe)
+			return false
+		}
+		return true
+	})
+	if !valid {
+		return nil
+	}
+	return probe
+}
+
+func parseMkvSegment(segment []byte, probe *MediaProbe) {
+	walkEbml(segment, func(id uint64, payload []byte) bool {
+		switch id {
+		case mkvInfo:
+			scale, duration := uint64(1000000), 0.0
+			walkEbml(payload, func(id uint64, payload []byte) bool {
+				switch id {
+				case mkvTimecodeScale:
+					scale = ebmlUint(payload)
+				case mkvDuration:
+					duration = ebmlFloat(payload)
+				}
+				return true
+			})
+			probe.Duration = duration * float64(scale) / 1e9
+		case mkvTracks:
+			walkEbml(payload, func(id uint64, payload []byte) bool {
+				if id == mkvTrackEntry {
+					if track := parseMkvTrack(payload); track != nil {
+						probe.Tracks = append(probe.Tracks, track)
+					}
+				}
+				return true
+			})
+		case mkvCluster:
+			// 之后是媒体数据
+			return false
+		}
+		return true
+	})
+}
+
+func parseMkvTrack(entry []byte) *MediaTrack {
+	track := &MediaTrack{}
+	walkEbml(entry, func(id uint64, payload []byte) bool {
+		switch id {
+		case mkvTrackType:
+			switch ebmlUint(payload) {
+			case 1:
+				track.Type = MediaTrackTypes.Video
+			case 2:
+				track.Type = MediaTrackTypes.Audio
+			}
+		case mkvCodecId:
+			track.Codec = mkvCodecName(string(payload))
+		case mkvVideo:
+			walkEbml(payload, func(id uint64, payload []byte) bool {
+				switch id {
+				case mkvPixelWidth:
+					track.Width = int(ebmlUint(payload))
+				case mkvPixelHeight:
+					track.Height = int(ebmlUint(payload))
+				}
+				return true
+			})
+		case mkvAudio:
+			walkEbml(payload, func(id uint64, payload []byte) bool {
+				switch id {
+				case mkvSampleRate:
+					track.SampleRate = int(ebmlFloat(payload))
+				case mkvChannels:
+					track.Channels = int(ebmlUint(payload))
+				}
+				return true
+			})
+		}
+		return true
+	})
+	if len(track.Type) == 0 {
+		return nil
+	}
+	return track
+}
+
+// matroska CodecID 对应的编码名称，如 V_MPEG4/ISO/AVC => h264
+func mkvCodecName(codecId string) string {
+	codecId = strings.TrimRight(codecId, "\x00")
+	switch codecId {
+	case "V_MPEG4/ISO/AVC":
+		return "h264"
+	case "V_MPEGH/ISO/HEVC":
+		return "hevc"
+	case "A_AAC":
+		return "aac"
+	case "A_MPEG/L3":
+		return "mp3"
+	}
+	if i := strings.Index(codecId, "_"); i >= 0 {
+		codecId = codecId[i+1:]
+	}
+	return strings.ToLower(strings.Split(codecId, "/")[0])
+}
+
+func probeWav(r io.ReaderAt, size int64) *MediaProbe {
+	probe := &MediaProbe{Format: MediaFormats.Wav}
+	var byteRate uint32
+	var dataSize int64
+	hdr := make([]byte, 8)
+	for pos := int64(12); pos+8 <= size; {
+		if _, err := r.ReadAt(hdr, pos); err != nil {
+			break
+		}
+		chunkSize := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		switch string(hdr[:4]) {
+		case "fmt ":
+			fmtChunk := make([]byte, 16)
+			if chunkSize < 16 {
+				return nil
+			}
+			if _, err := r.ReadAt(fmtChunk, pos+8); err != nil {
+				return nil
+			}
+			byteRate = binary.LittleEndian.Uint32(fmtChunk[8:])
+			probe.Tracks = []*MediaTrack{{
+				Type:       MediaTrackTypes.Audio,
+				Codec:      wavCodecName(binary.LittleEndian.Uint16(fmtChunk)),
+				Channels:   int(binary.LittleEndian.Uint16(fmtChunk[2:])),
+				SampleRate: int(binary.LittleEndian.Uint32(fmtChunk[4:])),
+			}}
+		case "data":
+			// 流式写入的文件 data 大小可能为0或者超出文件
+			dataSize = min(chunkSize, size-pos-8)
+			if dataSize <= 0 {
+				dataSize = size - pos - 8
+			}
+		}
+		if len(probe.Tracks) > 0 && dataSize > 0 {
+			break
+		}
+		pos += 8 + chunkSize + chunkSize%2
+	}
+	if len(probe.Tracks) == 0 {
+		return nil
+	}
+	if byteRate > 0 {
+		probe.Duration = float64(dataSize) / float64(byteRate)
+		probe.Bitrate = int64(byteRate) * 8
+	}
+	return probe
+}
+
+func wavCodecName(format uint16) string {
+	switch format {
+	case 1, 0xfffe:
+		return "pcm"
+	case 3:
+		return "pcm_float"
+	case 6:
+		return "alaw"
+	case 7:
+		return "mulaw"
+	case 0x55:
+		return "mp3"
+	default:
+		return "unknown"
+	}
+}
+
+// 跳过文件开头的 ID3v2 标签，返回音频数据的起始位置
+func skipId3(data []byte) int {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return 0
+	}
+	size := int(data[6]&0x7f)<<21 | int(data[7]&0x7f)<<14 | int(data[8]&0x7f)<<7 | int(data[9]&0x7f)
+	offset := 10 + size
+	// 带有 footer
+	if data[5]&0x10 != 0 {
+		offset += 10
+	}
+	return offset
+}
+
+func probeFlac(data []byte) *MediaProbe {
+	// fLaC(4) 之后第一个元数据块必须是 STREAMINFO
+	if len(data) < 8+34 || data[4]&0x7f != 0 {
+		return nil
+	}
+	info := data[8:]
+	sampleRate := int(info[10])<<12 | int(info[11])<<4 | int(info[12])>>4
+	channels := int(info[12]>>1&0x07) + 1
+	totalSamples := uint64(info[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(info[14:]))
+	probe := &MediaProbe{
+		Format: MediaFormats.Flac,
+		Tracks: []*MediaTrack{{
+			Type:       MediaTrackTypes.Audio,
+			Codec:      "flac",
+			SampleRate: sampleRate,
+			Channels:   channels,
+		}},
+	}
+	if sampleRate > 0 {
+		probe.Duration = float64(totalSamples) / float64(sampleRate)
+	}
+	return probe
+}
+
+// mp3 帧头对应的码率表，单位 kbit/s，[MPEG1, MPEG2/2.5][bitrate index]
+var mp3Bitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// mp3 采样率表，[MPEG1, MPEG2, MPEG2.5][sample rate index]
+var mp3SampleRates = [3][3]int{
+	{44100, 48000, 32000},
+	{22050, 24000, 16000},
+	{11025, 12000, 8000},
+}
+
+// 只支持 Layer III，VBR 文件通过 Xing / Info 头计算时长
+func probeMp3(data []byte, audioSize int64) *MediaProbe {
+	// 在开头的一小段中寻找第一个帧头
+	pos := -1
+	for i := 0; i+4 <= min(len(data), 64<<10); i++ {
+		if data[i] == 0xff && data[i+1]&0xe0 == 0xe0 && data[i+1]>>1&0x03 == 0x01 {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return nil
+	}
+	frame := data[pos:]
+	var version int // 0: MPEG1, 1: MPEG2, 2: MPEG2.5
+	switch frame[1] >> 3 & 0x03 {
+	case 3:
+		version = 0
+	case 2:
+		version = 1
+	case 0:
+		version = 2
+	default:
+		return nil
+	}
+	bitrateIndex, rateIndex := frame[2]>>4, frame[2]>>2&0x03
+	if rateIndex == 3 || bitrateIndex == 0 || bitrateIndex == 15 {
+		return nil
+	}
+	table := 0
+	if version > 0 {
+		table = 1
+	}
+	bitrate := mp3Bitrates[table][bitrateIndex] * 1000
+	sampleRate := mp3SampleRates[version][rateIndex]
+	mono := frame[3]>>6 == 0x03
+	channels := 2
+	if mono {
+		channels = 1
+	}
+	samplesPerFrame := 1152
+	if version > 0 {
+		samplesPerFrame = 576
+	}
+
+	probe := &MediaProbe{
+		Format: MediaFormats.Mp3,
+		Tracks: []*MediaTrack{{
+			Type:       MediaTrackTypes.Audio,
+			Codec:      "mp3",
+			SampleRate: sampleRate,
+			Channels:   channels,
+		}},
+	}
+
+	// Xing 头在帧头和 side info 之后
+	sideInfo := 32
+	switch {
+	case version == 0 && mono:
+		sideInfo = 17
+	case version > 0 && !mono:
+		sideInfo = 17
+	case version > 0 && mono:
+		sideInfo = 9
+	}
+	if xing := 4 + sideInfo; len(frame) >= xing+12 {
+		tag := frame[xing : xing+4]
+		flags := binary.BigEndian.Uint32(frame[xing+4:])
+		if (bytes.Equal(tag, []byte("Xing")) || bytes.Equal(tag, []byte("Info"))) && flags&0x01 != 0 {
+			frames := binary.BigEndian.Uint32(frame[xing+8:])
+			probe.Duration = float64(frames) * float64(samplesPerFrame) / float64(sampleRate)
+			return probe
+		}
+	}
+	// 固定码率
+	probe.Bitrate = int64(bitrate)
+	probe.Duration = float64(audioSize-int64(pos)) * 8 / float64(bitrate)
+	return probe
+}
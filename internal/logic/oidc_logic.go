@@ -0,0 +1,588 @@
+package logic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/ds"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	oidcDiscoveryPath     = "/.well-known/openid-configuration"
+	oidcStateExpire       = 10 * time.Minute
+	oidcJwksMinRefresh    = time.Minute // 遇到未知的kid时刷新公钥的最小间隔，避免被伪造的token打满 IdP
+	oidcClockSkew         = time.Minute
+	oidcMaxResponseSize   = 1 << 20
+	defaultUsernameClaim  = "preferred_username"
+	defaultGroupsClaim    = "groups"
+	oidcPkceVerifierLen   = 64
+	oidcStateAndNonceLen  = 32
+	oidcUidHashLen        = 20
+	oidcErrorDescMaxBytes = 256
+	OidcStateCookieName   = "ms_oidc_state"
+)
+
+var oidcDefaultScopes = []string{"openid", "profile", "email"}
+
+// id token 允许的签名算法，不接受 none 和对称算法
+var oidcSignMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// OidcIdentity IdP 认证后的用户身份
+type OidcIdentity struct {
+	Issuer   string   `json:"issuer"`
+	Subject  string   `json:"subject"`
+	Username string   `json:"username"`
+	Email    string   `json:"email,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcJwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcTokenResp struct {
+	IdToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// PkceChallenge 计算 S256 方式的 code_challenge
+func PkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// OidcProvider 负责和 IdP 交互：发现端点、授权码换取 id token、校验签名
+// 不依赖存储，可以直接对接测试用的 IdP
+type OidcProvider struct {
+	cfg  config.Oidc
+	hcli *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+func NewOidcProvider(cfg *config.Oidc, hcli *http.Client) *OidcProvider {
+	op := &OidcProvider{
+		cfg:  *cfg,
+		hcli: hcli,
+	}
+	op.cfg.Issuer = strings.TrimSuffix(op.cfg.Issuer, "/")
+	if len(op.cfg.Scopes) == 0 {
+		op.cfg.Scopes = oidcDefaultScopes
+	} else if !slices.Contains(op.cfg.Scopes, "openid") {
+		op.cfg.Scopes = append([]string{"openid"}, op.cfg.Scopes...)
+	}
+	if len(op.cfg.UsernameClaim) == 0 {
+		op.cfg.UsernameClaim = defaultUsernameClaim
+	}
+	if len(op.cfg.GroupsClaim) == 0 {
+		op.cfg.GroupsClaim = defaultGroupsClaim
+	}
+	return op
+}
+
+// Issuer IdP 的地址
+func (op *OidcProvider) Issuer() string {
+	return op.cfg.Issuer
+}
+
+func (op *OidcProvider) getJson(ctx context.Context, rawUrl string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := op.hcli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: unexpected status %d", rawUrl, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(v)
+}
+
+// 获取 IdP 的端点，成功后缓存，失败时下次请求重试，启动时 IdP 不可用不影响服务
+func (op *OidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.discovery != nil {
+		return op.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := op.getJson(ctx, op.cfg.Issuer+oidcDiscoveryPath, &d); err != nil {
+		logx.Errorf("OidcProvider|discover|getJson|issuer: %s|err: %v", op.cfg.Issuer, err)
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != op.cfg.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", d.Issuer)
+	}
+	if len(d.AuthorizationEndpoint) == 0 || len(d.TokenEndpoint) == 0 || len(d.JwksUri) == 0 {
+		return nil, fmt.Errorf("incomplete discovery document from %s", op.cfg.Issuer)
+	}
+	op.discovery = &d
+	return op.discovery, nil
+}
+
+// AuthCodeUrl 生成跳转到 IdP 的授权地址
+func (op *OidcProvider) AuthCodeUrl(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := op.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	authUrl, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	query := authUrl.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", op.cfg.ClientId)
+	query.Set("redirect_uri", op.cfg.RedirectUrl)
+	query.Set("scope", strings.Join(op.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", PkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authUrl.RawQuery = query.Encode()
+	return authUrl.String(), nil
+}
+
+// Exchange 使用授权码和 code_verifier 换取 id token，校验后返回用户身份
+func (op *OidcProvider) Exchange(ctx context.Context, code, verifier, nonce string) (*OidcIdentity, error) {
+	d, err := op.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", op.cfg.RedirectUrl)
+	form.Set("client_id", op.cfg.ClientId)
+	form.Set("code_verifier", verifier)
+	if len(op.cfg.ClientSecret) > 0 {
+		form.Set("client_secret", op.cfg.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := op.hcli.Do(req)
+	if err != nil {
+		logx.Errorf("OidcProvider|Exchange|Do|err: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokenResp oidcTokenResp
+	if err = json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(&tokenResp); err != nil {
+		logx.Errorf("OidcProvider|Exchange|Decode|status: %d|err: %v", resp.StatusCode, err)
+		return nil, pkg.ErrorEnums.ErrOidcTokenInvalid
+	}
+	if resp.StatusCode != http.StatusOK || len(tokenResp.Error) > 0 {
+		desc := tokenResp.ErrorDescription
+		if len(desc) > oidcErrorDescMaxBytes {
+			desc = desc[:oidcErrorDescMaxBytes]
+		}
+		logx.Errorf("OidcProvider|Exchange|status: %d|error: %s|desc: %s", resp.StatusCode, tokenResp.Error, desc)
+		return nil, fmt.Errorf("%w: %s", pkg.ErrorEnums.ErrOidcTokenInvalid, tokenResp.Error)
+	}
+	if len(tokenResp.IdToken) == 0 {
+		return nil, pkg.ErrorEnums.ErrOidcTokenInvalid
+	}
+	return op.VerifyIdToken(ctx, tokenResp.IdToken, nonce)
+}
+
+// VerifyIdToken 校验 id token 的签名、issuer、audience、过期时间和 nonce
+func (op *OidcProvider) VerifyIdToken(ctx context.Context, rawToken, nonce string) (*OidcIdentity, error) {
+	d, err := op.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.Parse(rawToken, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return op.publicKey(ctx, d, kid)
+	},
+		jwt.WithValidMethods(oidcSignMethods),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(op.cfg.ClientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcClockSkew),
+	)
+	if err != nil {
+		logx.Errorf("OidcProvider|VerifyIdToken|Parse|err: %v", err)
+		return nil, pkg.ErrorEnums.ErrOidcTokenInvalid
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, pkg.ErrorEnums.ErrOidcTokenInvalid
+	}
+	if tokenNonce, _ := claims["nonce"].(string); len(nonce) > 0 && tokenNonce != nonce {
+		logx.Errorf("OidcProvider|VerifyIdToken|nonce mismatch")
+		return nil, pkg.ErrorEnums.ErrOidcTokenInvalid
+	}
+	identity := &OidcIdentity{Issuer: op.cfg.Issuer}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Username, _ = claims[op.cfg.UsernameClaim].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Groups = claimStrings(claims[op.cfg.GroupsClaim])
+	if len(identity.Subject) == 0 {
+		return nil, pkg.ErrorEnums.ErrOidcTokenInvalid
+	}
+	return identity, nil
+}
+
+// 用户组可能是字符串数组，也可能是单个字符串
+func claimStrings(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// 根据kid查找公钥，找不到时刷新一次 jwks，IdP 轮换密钥后不需要重启
+func (op *OidcProvider) publicKey(ctx context.Context, d *oidcDiscovery, kid string) (any, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if key, ok := op.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(op.keysFetched) < oidcJwksMinRefresh {
+		return nil, fmt.Errorf("unknown kid: %s", kid)
+	}
+	var jwks struct {
+		Keys []oidcJwk `json:"keys"`
+	}
+	op.keysFetched = time.Now()
+	if err := op.getJson(ctx, d.JwksUri, &jwks); err != nil {
+		logx.Errorf("OidcProvider|publicKey|getJson|jwks: %s|err: %v", d.JwksUri, err)
+		return nil, err
+	}
+	keys := make(map[string]any, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJwk(&k)
+		if err != nil {
+			logx.Errorf("OidcProvider|publicKey|parseJwk|kid: %s|err: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	op.keys = keys
+	if key, ok := op.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown kid: %s", kid)
+}
+
+// token 没有kid时只在 IdP 只有一个公钥的情况下使用这个公钥
+func (op *OidcProvider) lookupKey(kid string) (any, bool) {
+	if key, ok := op.keys[kid]; ok {
+		return key, true
+	}
+	if len(kid) == 0 && len(op.keys) == 1 {
+		for _, key := range op.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func decodeJwkInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// 解析 RSA 和 EC 公钥
+func parseJwk(k *oidcJwk) (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJwkInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJwkInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeJwkInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJwkInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("ec point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+// MapRoles 把 IdP 的用户组映射为存储角色，没有匹配时使用默认角色
+func (op *OidcProvider) MapRoles(groups []string) []string {
+	roles := make([]string, 0)
+	for _, group := range groups {
+		if role, ok := op.cfg.RoleMapping[group]; ok && !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 && len(op.cfg.DefaultRole) > 0 {
+		roles = append(roles, op.cfg.DefaultRole)
+	}
+	slices.Sort(roles)
+	return roles
+}
+
+// 登录过程中保存的状态，回调时使用一次后删除
+type oidcLoginState struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect,omitempty"`
+}
+
+// 控制台的 OIDC 登录，登录状态保存在 redis 中，多个实例共享
+type OidcLogic struct {
+	ctx        context.Context
+	group      string
+	stateRedis *redis.Client
+	provider   *OidcProvider
+	user       *UserLogic
+	cfg        *config.Oidc
+	secret     []byte // state cookie 的签名密钥
+}
+
+func NewOidcLogic(ctx context.Context, cfg *config.Config, dsServer *ds.DatabaseServer, user *UserLogic, hcli *http.Client) *OidcLogic {
+	stateRedis, ok := dsServer.GetRedis("system")
+	if !ok {
+		panic("redis [system] not found")
+	}
+	ol := &OidcLogic{
+		ctx:        ctx,
+		group:      ptr.ToString(cfg.Group),
+		stateRedis: stateRedis,
+		user:       user,
+		cfg:        cfg.Oidc,
+	}
+	// state cookie 的签名密钥从 jwt 密钥派生
+	mac := hmac.New(sha256.New, []byte(cfg.Server.Jwt.Secret))
+	mac.Write([]byte("media_storage_oidc_state"))
+	ol.secret = mac.Sum(nil)
+	if ol.Enabled() {
+		ol.provider = NewOidcProvider(cfg.Oidc, hcli)
+	}
+	return ol
+}
+
+// Enabled 是否配置了 OIDC 登录
+func (ol *OidcLogic) Enabled() bool {
+	return ol.cfg != nil && len(ol.cfg.Issuer) > 0
+}
+
+// AdminLoginDisabled 启用 OIDC 后是否禁止配置文件中的管理员使用密码登录
+func (ol *OidcLogic) AdminLoginDisabled() bool {
+	return ol.Enabled() && ol.cfg.DisableAdmin
+}
+
+func (ol *OidcLogic) buildStateKey(state string) string {
+	return fmt.Sprintf("media_storage:%s:oidc:state:%s", ol.group, state)
+}
+
+// SignOidcState 生成绑定浏览器的 state cookie，内容为 state 和它的签名
+func SignOidcState(secret []byte, state string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(state))
+	return state + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyOidcState 校验回调中的 state 和发起登录的浏览器中的 cookie 一致，且 cookie 没有被篡改
+func VerifyOidcState(secret []byte, cookie, state string) bool {
+	if len(state) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(SignOidcState(secret, state)), []byte(cookie)) == 1
+}
+
+// StateCookie 登录时写入浏览器的 state cookie，只在回调地址下发送，maxAge 为负数时删除
+func (ol *OidcLogic) StateCookie(value string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     OidcStateCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		// IdP 回调是跨站的顶层跳转，Lax 下 cookie 仍然会被发送
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ol.cfg != nil {
+		if callback, err := url.Parse(ol.cfg.RedirectUrl); err == nil {
+			if len(callback.Path) > 0 {
+				cookie.Path = callback.Path
+			}
+			cookie.Secure = callback.Scheme == "https"
+		}
+	}
+	return cookie
+}
+
+// StartLogin 生成 state、nonce 和 PKCE 的 code_verifier，返回跳转到 IdP 的地址和需要写入浏览器的 state cookie
+func (ol *OidcLogic) StartLogin(ctx context.Context, redirect string) (string, *http.Cookie, error) {
+	if !ol.Enabled() {
+		return "", nil, pkg.ErrorEnums.ErrOidcNotEnabled
+	}
+	state := generateRandomString(oidcStateAndNonceLen)
+	loginState := &oidcLoginState{
+		Verifier: generateRandomString(oidcPkceVerifierLen),
+		Nonce:    generateRandomString(oidcStateAndNonceLen),
+		Redirect: redirect,
+	}
+	authUrl, err := ol.provider.AuthCodeUrl(ctx, state, loginState.Nonce, loginState.Verifier)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = ol.stateRedis.Set(ctx, ol.buildStateKey(state), mustMarshal(loginState), oidcStateExpire).Err(); err != nil {
+		logx.Errorf("OidcLogic|StartLogin|Set|err: %v", err)
+		return "", nil, err
+	}
+	return authUrl, ol.StateCookie(SignOidcState(ol.secret, state), int(oidcStateExpire/time.Second)), nil
+}
+
+// FinishLogin 处理 IdP 的回调，校验 state 和浏览器中的 cookie 后换取身份，创建或者更新对应的用户，返回用户和登录前的页面
+func (ol *OidcLogic) FinishLogin(ctx context.Context, state, stateCookie, code string) (*User, string, error) {
+	if !ol.Enabled() {
+		return nil, "", pkg.ErrorEnums.ErrOidcNotEnabled
+	}
+	if len(state) == 0 || len(code) == 0 {
+		return nil, "", pkg.ErrorEnums.ErrOidcStateInvalid
+	}
+	// 回调必须来自发起登录的浏览器，在删除 state 之前校验，避免别人的回调把 state 用掉
+	if !VerifyOidcState(ol.secret, stateCookie, state) {
+		return nil, "", pkg.ErrorEnums.ErrOidcStateInvalid
+	}
+	// state 只能使用一次
+	raw, err := ol.stateRedis.GetDel(ctx, ol.buildStateKey(state)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, "", pkg.ErrorEnums.ErrOidcStateInvalid
+		}
+		logx.Errorf("OidcLogic|FinishLogin|GetDel|err: %v", err)
+		return nil, "", err
+	}
+	var loginState oidcLoginState
+	if err = json.Unmarshal(raw, &loginState); err != nil {
+		return nil, "", pkg.ErrorEnums.ErrOidcStateInvalid
+	}
+	identity, err := ol.provider.Exchange(ctx, code, loginState.Verifier, loginState.Nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	roles := ol.provider.MapRoles(identity.Groups)
+	if len(roles) == 0 {
+		logx.Errorf("OidcLogic|FinishLogin|MapRoles|sub: %s|groups: %v|no role", identity.Subject, identity.Groups)
+		return nil, "", pkg.ErrorEnums.ErrOidcNoRole
+	}
+	user, err := ol.user.SyncExternalUser(ctx, &User{
+		Uid:      oidcUid(identity),
+		Username: oidcUsername(identity),
+		Roles:    roles,
+		Provider: "oidc",
+	})
+	if err != nil {
+		logx.Errorf("OidcLogic|FinishLogin|SyncExternalUser|sub: %s|err: %v", identity.Subject, err)
+		return nil, "", err
+	}
+	return user, loginState.Redirect, nil
+}
+
+// 同一个 IdP 下的 sub 唯一且不变，使用哈希作为 uid
+func oidcUid(identity *OidcIdentity) string {
+	sum := sha256.Sum256([]byte(identity.Issuer + "\n" + identity.Subject))
+	return "oidc_" + hex.EncodeToString(sum[:])[:oidcUidHashLen]
+}
+
+// 优先使用 IdP 的用户名，其次是邮箱，都不符合用户名规则时使用 uid
+func oidcUsername(identity *OidcIdentity) string {
+	for _, name := range []string{identity.Username, identity.Email} {
+		if usernamePattern.MatchString(name) {
+			return name
+		}
+	}
+	return oidcUid(identity)
+}
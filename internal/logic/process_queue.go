@@ -0,0 +1,86 @@
+package logic
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dzjyyds666/Allspark-go/logx"
+)
+
+// ProcessQueue 上传完成后的异步处理队列
+// 处理步骤需要在 Start 之前注册，避免启动后的文件漏掉部分步骤
+type ProcessQueue struct {
+	ctx     context.Context
+	hooks   []FileOption
+	ch      chan *MediaFileInfo
+	save    func(ctx context.Context, info *MediaFileInfo) error // 保存处理结果
+	mu      sync.Mutex
+	started bool
+}
+
+func NewProcessQueue(ctx context.Context, size int, save func(ctx context.Context, info *MediaFileInfo) error) *ProcessQueue {
+	return &ProcessQueue{
+		ctx:  ctx,
+		ch:   make(chan *MediaFileInfo, size),
+		save: save,
+	}
+}
+
+// Register 注册处理步骤，启动之后注册直接panic
+func (pq *ProcessQueue) Register(hooks ...FileOption) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if pq.started {
+		panic("process hook registered after queue started")
+	}
+	pq.hooks = append(pq.hooks, hooks...)
+}
+
+// Start 启动处理协程，重复调用只启动一次
+func (pq *ProcessQueue) Start(workers int) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if pq.started {
+		return
+	}
+	pq.started = true
+	for i := 0; i < workers; i++ {
+		go pq.worker()
+	}
+}
+
+// Submit 提交文件到处理队列，队列满时丢弃，不阻塞上传
+func (pq *ProcessQueue) Submit(info *MediaFileInfo) bool {
+	pq.mu.Lock()
+	empty := len(pq.hooks) == 0
+	pq.mu.Unlock()
+	if empty {
+		return false
+	}
+	select {
+	case pq.ch <- info:
+		return true
+	default:
+		logx.Errorf("ProcessQueue|Submit|queue full|fid: %s", info.Fid)
+		return false
+	}
+}
+
+// 每个步骤单独执行，一个步骤失败不影响其他步骤
+func (pq *ProcessQueue) worker() {
+	for {
+		select {
+		case <-pq.ctx.Done():
+			return
+		case info := <-pq.ch:
+			for _, hook := range pq.hooks {
+				if err := hook(pq.ctx, info); err != nil {
+					logx.Errorf("ProcessQueue|worker|hook|fid: %s|err: %v", info.Fid, err)
+				}
+			}
+			if err := pq.save(pq.ctx, info); err != nil {
+				logx.Errorf("ProcessQueue|worker|save|fid: %s|err: %v", info.Fid, err)
+			}
+		}
+	}
+}
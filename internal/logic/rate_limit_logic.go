@@ -0,0 +1,156 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/ds"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// 限流的类型
+var RateLimitKinds = struct {
+	Request  string
+	Download string
+	Upload   string
+}{
+	Request:  "req",
+	Download: "down",
+	Upload:   "up",
+}
+
+// 令牌桶脚本，返回需要等待的毫秒数，0表示令牌足够
+// debt 为1时允许令牌为负数(带宽限制，先消费再等待)，为0时令牌不足直接拒绝且不扣减(请求限制)
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local debt = tonumber(ARGV[5])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+end
+local wait = 0
+if debt == 1 then
+	tokens = tokens - cost
+	if tokens < 0 then
+		wait = math.ceil(-tokens * 1000 / rate)
+	end
+elseif tokens >= cost then
+	tokens = tokens - cost
+else
+	wait = math.ceil((cost - tokens) * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', math.max(now, ts))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + wait + 1000)
+return wait
+`)
+
+// CheckRateLimit 校验仓库上的限流配置
+func CheckRateLimit(limit *config.RateLimit) bool {
+	if limit == nil {
+		return true
+	}
+	return limit.RequestRate >= 0 && limit.RequestBurst >= 0 && limit.DownloadRate >= 0 && limit.UploadRate >= 0
+}
+
+// 限流服务，令牌桶保存在 redis 中，多个实例共享
+type RateLimitLogic struct {
+	ctx         context.Context
+	group       string
+	limitRedis  *redis.Client
+	defaultRate *config.RateLimit
+}
+
+func NewRateLimitLogic(ctx context.Context, cfg *config.Config, dsServer *ds.DatabaseServer) *RateLimitLogic {
+	limitRedis, ok := dsServer.GetRedis("system")
+	if !ok {
+		panic("redis [system] not found")
+	}
+	defaultRate := cfg.RateLimit
+	if defaultRate == nil {
+		defaultRate = &config.RateLimit{}
+	}
+	return &RateLimitLogic{
+		ctx:         ctx,
+		group:       ptr.ToString(cfg.Group),
+		limitRedis:  limitRedis,
+		defaultRate: defaultRate,
+	}
+}
+
+// 令牌桶的key，scope 为仓库id或者 global，identity 为 user:uid / ak:id / ip:addr
+func (rl *RateLimitLogic) buildBucketKey(kind, scope, identity string) string {
+	return fmt.Sprintf("media_storage:%s:ratelimit:%s:%s:%s", rl.group, kind, scope, identity)
+}
+
+// RateLimitIdentity 限流的对象，优先使用访问密钥，其次是登录用户，匿名请求按ip限流
+func RateLimitIdentity(p *Principal, ip string) string {
+	if p != nil && p.AccessKey != nil {
+		return "ak:" + p.AccessKey.AccessKeyId
+	}
+	if uid := p.GetUid(); len(uid) > 0 {
+		return "user:" + uid
+	}
+	return "ip:" + ip
+}
+
+// EffectiveLimit 仓库上不为0的配置覆盖全局配置，depot 为空时使用全局配置
+func (rl *RateLimitLogic) EffectiveLimit(depot *Depot) *config.RateLimit {
+	limit := *rl.defaultRate
+	if depot == nil || depot.RateLimit == nil {
+		return &limit
+	}
+	if depot.RateLimit.RequestRate > 0 {
+		limit.RequestRate = depot.RateLimit.RequestRate
+		limit.RequestBurst = depot.RateLimit.RequestBurst
+	}
+	if depot.RateLimit.DownloadRate > 0 {
+		limit.DownloadRate = depot.RateLimit.DownloadRate
+	}
+	if depot.RateLimit.UploadRate > 0 {
+		limit.UploadRate = depot.RateLimit.UploadRate
+	}
+	return &limit
+}
+
+func (rl *RateLimitLogic) take(ctx context.Context, key string, rate, burst float64, cost int64, debt bool) time.Duration {
+	debtFlag := 0
+	if debt {
+		debtFlag = 1
+	}
+	wait, err := tokenBucketScript.Run(ctx, rl.limitRedis, []string{key}, rate, burst, time.Now().UnixMilli(), cost, debtFlag).Int64()
+	if err != nil {
+		// redis 不可用时不限流，避免影响正常访问
+		logx.Errorf("RateLimitLogic|take|Run|key: %s|err: %v", key, err)
+		return 0
+	}
+	return time.Duration(wait) * time.Millisecond
+}
+
+// AllowRequest 消耗一次请求的令牌，被限流时返回需要等待的时间
+func (rl *RateLimitLogic) AllowRequest(ctx context.Context, scope, identity string, limit *config.RateLimit) time.Duration {
+	if limit.RequestRate <= 0 {
+		return 0
+	}
+	burst := float64(limit.RequestBurst)
+	if burst < 1 {
+		burst = max(limit.RequestRate, 1)
+	}
+	return rl.take(ctx, rl.buildBucketKey(RateLimitKinds.Request, scope, identity), limit.RequestRate, burst, 1, false)
+}
+
+// ReserveBytes 预占传输的字节数，返回调用方需要等待的时间，rate 为0时不限速
+func (rl *RateLimitLogic) ReserveBytes(ctx context.Context, kind, scope, identity string, rate int64, n int) time.Duration {
+	if rate <= 0 || n <= 0 {
+		return 0
+	}
+	return rl.take(ctx, rl.buildBucketKey(kind, scope, identity), float64(rate), float64(rate), int64(n), true)
+}
@@ -0,0 +1,261 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/conv"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+)
+
+// 孤儿对象的处理方式
+var ReconcileActions = struct {
+	Report     string // 只生成报告
+	Quarantine string // 移动到隔离区
+	Delete     string // 直接删除
+}{
+	Report:     "report",
+	Quarantine: "quarantine",
+	Delete:     "delete",
+}
+
+// 隔离区的前缀，隔离区中的对象不参与对账
+const quarantinePrefix = "_quarantine"
+
+// 上传窗口期内的对象可能还没有完成索引，不视为孤儿
+const reconcileGracePeriod = time.Hour
+
+// ReconcileRequest 对账请求
+type ReconcileRequest struct {
+	DepotId string `json:"depot_id,omitempty"`
+	BoxId   string `json:"box_id,omitempty"`
+	Action  string `json:"action,omitempty"`
+}
+
+// ReconcileItem 对账发现的不一致项
+type ReconcileItem struct {
+	Fid        string `json:"fid"`
+	ObjectKey  string `json:"object_key,omitempty"`
+	ObjectSize *int64 `json:"object_size,omitempty"`
+	IndexSize  *int64 `json:"index_size,omitempty"`
+	Handled    bool   `json:"handled,omitempty"` // 孤儿是否已被隔离或删除
+}
+
+// ReconcileReport 对账报告
+type ReconcileReport struct {
+	DepotId       string           `json:"depot_id,omitempty"`
+	BoxId         string           `json:"box_id,omitempty"`
+	Action        string           `json:"action"`
+	StartTs       int64            `json:"start_ts"`
+	EndTs         int64            `json:"end_ts"`
+	ObjectCount   int64            `json:"object_count"`
+	IndexCount    int64            `json:"index_count"`
+	Orphans       []*ReconcileItem `json:"orphans"`        // 存储中有，索引中没有
+	Missing       []*ReconcileItem `json:"missing"`        // 索引中有，存储中没有
+	SizeMismatchs []*ReconcileItem `json:"size_mismatchs"` // 大小不一致
+}
+
+// 对账服务，检查文件索引和存储之间的一致性
+type ReconcileLogic struct {
+	ctx      context.Context
+	cfg      *config.Reconcile
+	s3Server *S3Logic
+	fileServ *FileIndexLogic
+}
+
+func NewReconcileLogic(ctx context.Context, cfg *config.Config, s3Server *S3Logic, fileServ *FileIndexLogic) *ReconcileLogic {
+	return &ReconcileLogic{
+		ctx:      ctx,
+		cfg:      cfg.Reconcile,
+		s3Server: s3Server,
+		fileServ: fileServ,
+	}
+}
+
+// 构建对账的前缀
+func (rl *ReconcileLogic) buildPrefix(req *ReconcileRequest) string {
+	if len(req.DepotId) == 0 {
+		return ""
+	}
+	if len(req.BoxId) == 0 {
+		return req.DepotId + "/"
+	}
+	return path.Join(req.DepotId, req.BoxId) + "/"
+}
+
+// 解析对象key, 格式为 depot/box/fid
+func parseObjectKey(key string) (depotId, boxId, fid string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || parts[0] == quarantinePrefix {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// Reconcile 对比存储和索引，按照action处理孤儿对象
+func (rl *ReconcileLogic) Reconcile(ctx context.Context, req *ReconcileRequest) (*ReconcileReport, error) {
+	if len(req.Action) == 0 {
+		req.Action = ReconcileActions.Report
+	}
+	switch req.Action {
+	case ReconcileActions.Report, ReconcileActions.Quarantine, ReconcileActions.Delete:
+	default:
+		return nil, pkg.ErrorEnums.ErrReconcileActionNotSupport
+	}
+	if len(req.DepotId) == 0 && len(req.BoxId) != 0 {
+		return nil, pkg.ErrorEnums.ErrDepotNotExist
+	}
+
+	report := &ReconcileReport{
+		DepotId:       req.DepotId,
+		BoxId:         req.BoxId,
+		Action:        req.Action,
+		StartTs:       time.Now().Unix(),
+		Orphans:       []*ReconcileItem{},
+		Missing:       []*ReconcileItem{},
+		SizeMismatchs: []*ReconcileItem{},
+	}
+
+	// 存储中已经存在的对象, objectKey => size
+	objects := make(map[string]int64)
+	graceTs := time.Now().Add(-reconcileGracePeriod).Unix()
+	err := rl.s3Server.ListObjects(ctx, rl.buildPrefix(req), func(obj *S3Object) error {
+		depotId, _, fid, ok := parseObjectKey(obj.Key)
+		if !ok {
+			return nil
+		}
+		report.ObjectCount++
+		objects[obj.Key] = obj.Size
+
+		info, err := rl.fileServ.QueryFileInfo(ctx, depotId, fid)
+		if err != nil && !errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+			return err
+		}
+		if info == nil {
+			// 还在上传窗口期内的对象不处理
+			if obj.LastModified > graceTs {
+				return nil
+			}
+			prepare, err := rl.fileServ.IsPrepareFileInfo(ctx, depotId, fid)
+			if err != nil {
+				return err
+			}
+			if prepare {
+				return nil
+			}
+			report.Orphans = append(report.Orphans, &ReconcileItem{
+				Fid:        fid,
+				ObjectKey:  obj.Key,
+				ObjectSize: ptr.Int64(obj.Size),
+			})
+			return nil
+		}
+		// 压缩存储的文件需要和实际存储大小比较
+		if (info.StoredLength != nil || info.ContentLength != nil) && info.GetStoredLength() != obj.Size {
+			report.SizeMismatchs = append(report.SizeMismatchs, &ReconcileItem{
+				Fid:        fid,
+				ObjectKey:  obj.Key,
+				ObjectSize: ptr.Int64(obj.Size),
+				IndexSize:  ptr.Int64(info.GetStoredLength()),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		logx.Errorf("ReconcileLogic|Reconcile|ListObjects|req: %s|err: %v", conv.ToJsonWithoutError(req), err)
+		return nil, err
+	}
+
+	// 检查索引中存在但是存储中没有的文件
+	err = rl.fileServ.ScanFileInfos(ctx, req.DepotId, func(info *MediaFileInfo) error {
+		if info.Box == nil {
+			return nil
+		}
+		if len(req.BoxId) != 0 && info.Box.BoxId != req.BoxId {
+			return nil
+		}
+		report.IndexCount++
+		// 补全箱子的文件列表，列表引入之前上传的文件不在列表中
+		if err := rl.fileServ.IndexBoxFile(ctx, info); err != nil {
+			logx.Errorf("ReconcileLogic|Reconcile|IndexBoxFile|fid: %s|err: %v", info.Fid, err)
+		}
+		// 感染的文件已经移动到隔离区
+		if info.Scan != nil && info.Scan.Status == ScanStatuses.Infected {
+			return nil
+		}
+		objectKey := info.BuildObjectKey()
+		if _, ok := objects[objectKey]; ok {
+			return nil
+		}
+		// 列举开始之后才完成上传的文件不统计
+		if ptr.ToInt64(info.CreatedTs) >= report.StartTs {
+			return nil
+		}
+		report.Missing = append(report.Missing, &ReconcileItem{
+			Fid:       info.Fid,
+			ObjectKey: objectKey,
+			IndexSize: ptr.Int64(info.GetStoredLength()),
+		})
+		return nil
+	})
+	if err != nil {
+		logx.Errorf("ReconcileLogic|Reconcile|ScanFileInfos|req: %s|err: %v", conv.ToJsonWithoutError(req), err)
+		return nil, err
+	}
+
+	if req.Action != ReconcileActions.Report {
+		for _, orphan := range report.Orphans {
+			if err := rl.handleOrphan(ctx, req.Action, orphan); err != nil {
+				logx.Errorf("ReconcileLogic|Reconcile|handleOrphan|objectKey: %s|err: %v", orphan.ObjectKey, err)
+				continue
+			}
+			orphan.Handled = true
+		}
+	}
+	report.EndTs = time.Now().Unix()
+	logx.Infof("ReconcileLogic|Reconcile|depotId: %s|boxId: %s|action: %s|objects: %d|indexes: %d|orphans: %d|missing: %d|sizeMismatchs: %d",
+		req.DepotId, req.BoxId, req.Action, report.ObjectCount, report.IndexCount, len(report.Orphans), len(report.Missing), len(report.SizeMismatchs))
+	return report, nil
+}
+
+// 处理孤儿对象
+func (rl *ReconcileLogic) handleOrphan(ctx context.Context, action string, orphan *ReconcileItem) error {
+	if action == ReconcileActions.Quarantine {
+		depotId, _, _, _ := parseObjectKey(orphan.ObjectKey)
+		sse, err := rl.fileServ.querySSEParams(ctx, depotId)
+		if err != nil {
+			return err
+		}
+		err = rl.s3Server.CopyObject(ctx, orphan.ObjectKey, path.Join(quarantinePrefix, orphan.ObjectKey), sse)
+		if err != nil {
+			return err
+		}
+	}
+	return rl.s3Server.DeleteObject(ctx, orphan.ObjectKey)
+}
+
+// RunSchedule 定时对账，直到ctx结束
+func (rl *ReconcileLogic) RunSchedule() {
+	if rl.cfg == nil || rl.cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(rl.cfg.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := rl.Reconcile(rl.ctx, &ReconcileRequest{Action: rl.cfg.Action})
+			if err != nil {
+				logx.Errorf("ReconcileLogic|RunSchedule|Reconcile|err: %v", err)
+			}
+		}
+	}
+}
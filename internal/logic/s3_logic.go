@@ -1,21 +1,99 @@
 package logic
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
+	"io"
+	"path"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/dzjyyds666/Allspark-go/logx"
 	myconfig "github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
 )
 
+// 服务端加密方式
+var SSEModes = struct {
+	None  string // 不加密
+	SSES3 string // s3 托管密钥加密
+	SSEC  string // 客户提供密钥加密，密钥由服务端保管
+}{
+	None:  "",
+	SSES3: "sse-s3",
+	SSEC:  "sse-c",
+}
+
+// SSEParams 服务端加密参数
+type SSEParams struct {
+	Mode   string
+	Key    string // base64 编码的 sse-c 密钥
+	KeyMd5 string // base64 编码的 sse-c 密钥md5
+}
+
+// IsSSEC 是否为客户密钥加密
+func (p *SSEParams) IsSSEC() bool {
+	return p != nil && p.Mode == SSEModes.SSEC
+}
+
+// sse-c 请求头中的算法、密钥和密钥md5
+func (p *SSEParams) customerKey() (*string, *string, *string) {
+	return aws.String(string(types.ServerSideEncryptionAes256)), aws.String(p.Key), aws.String(p.KeyMd5)
+}
+
+// 写入对象时的加密参数
+func (p *SSEParams) applyPut(input *s3.PutObjectInput) {
+	if p.IsSSEC() {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = p.customerKey()
+	} else if p != nil {
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	}
+}
+
+// 创建分片上传时的加密参数
+func (p *SSEParams) applyCreateMultipart(input *s3.CreateMultipartUploadInput) {
+	if p.IsSSEC() {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = p.customerKey()
+	} else if p != nil {
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	}
+}
+
+// 上传分片时 sse-c 需要每次携带密钥，sse-s3 不需要
+func (p *SSEParams) applyUploadPart(input *s3.UploadPartInput) {
+	if p.IsSSEC() {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = p.customerKey()
+	}
+}
+
+// 读取对象时 sse-c 需要携带密钥，sse-s3 不需要
+func (p *SSEParams) applyGet(input *s3.GetObjectInput) {
+	if p.IsSSEC() {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = p.customerKey()
+	}
+}
+
+// 复制对象时源和目标使用相同的加密参数
+func (p *SSEParams) applyCopy(input *s3.CopyObjectInput) {
+	if p.IsSSEC() {
+		input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = p.customerKey()
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = p.customerKey()
+	} else if p != nil {
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	}
+}
+
 type S3Logic struct {
-	ctx    context.Context
-	bucket string
-	client *s3.Client // s3客户端
+	ctx     context.Context
+	bucket  string
+	client  *s3.Client        // s3客户端
+	sseKeys map[string]string // sse-c 密钥, keyId => base64(32字节)
 }
 
 // 创建s3服务，直接操作s3
@@ -47,34 +125,245 @@ func NewS3Logic(ctx context.Context, cfg *myconfig.Config) *S3Logic {
 	}
 
 	return &S3Logic{
-		ctx:    ctx,
-		bucket: cfg.S3.Bucket,
-		client: s3Client,
+		ctx:     ctx,
+		bucket:  cfg.S3.Bucket,
+		client:  s3Client,
+		sseKeys: cfg.S3.SSECKeys,
+	}
+}
+
+// BuildSSEParams 根据仓库配置构建服务端加密参数
+func (ss *S3Logic) BuildSSEParams(depot *Depot) (*SSEParams, error) {
+	if depot == nil || depot.Encryption == nil {
+		return nil, nil
+	}
+	switch *depot.Encryption {
+	case SSEModes.None:
+		return nil, nil
+	case SSEModes.SSES3:
+		return &SSEParams{Mode: SSEModes.SSES3}, nil
+	case SSEModes.SSEC:
+		if depot.SSECKeyId == nil {
+			return nil, pkg.ErrorEnums.ErrSSECKeyNotExist
+		}
+		encoded, ok := ss.sseKeys[*depot.SSECKeyId]
+		if !ok {
+			return nil, pkg.ErrorEnums.ErrSSECKeyNotExist
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if nil != err || len(key) != 32 {
+			logx.Errorf("S3Server|BuildSSEParams|invalid sse-c key|keyId: %s|err: %v", *depot.SSECKeyId, err)
+			return nil, pkg.ErrorEnums.ErrSSECKeyNotExist
+		}
+		sum := md5.Sum(key)
+		return &SSEParams{
+			Mode:   SSEModes.SSEC,
+			Key:    encoded,
+			KeyMd5: base64.StdEncoding.EncodeToString(sum[:]),
+		}, nil
+	default:
+		return nil, pkg.ErrorEnums.ErrSSEModeNotSupport
 	}
 }
 
 // SaveFileData 保存文件信息到s3
-func (ss *S3Logic) SaveFileData(ctx context.Context, info *MediaFileInfo) error {
+func (ss *S3Logic) SaveFileData(ctx context.Context, info *MediaFileInfo, sse *SSEParams) error {
 	if info.r == nil {
 		return errors.New("file data is nil")
 	}
-	objKey := info.BuildObjectKey()
+	// 不能seek的数据(例如边读边压缩)分片上传，避免整个对象放到内存中
+	if _, ok := info.r.(io.Seeker); !ok {
+		return ss.SaveObjectStream(ctx, info.BuildObjectKey(), info.r, info.ContentType, sse)
+	}
+	return ss.SaveObject(ctx, info.BuildObjectKey(), info.r, info.ContentType, sse)
+}
+
+// 分片上传的分片大小，s3 要求除最后一片外不小于5MB
+const streamPartSize = 8 << 20
+
+// SaveObjectStream 流式保存对象，内存中最多保留一个分片
+// 数据不足一个分片时直接 PutObject
+func (ss *S3Logic) SaveObjectStream(ctx context.Context, objKey string, body io.Reader, contentType *string, sse *SSEParams) error {
+	buf := make([]byte, streamPartSize)
+	n, err := io.ReadFull(body, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ss.SaveObject(ctx, objKey, bytes.NewReader(buf[:n]), contentType, sse)
+	}
+	if err != nil {
+		logx.Errorf("S3Server|SaveObjectStream|ReadFull|objectKey: %s|err: %v", objKey, err)
+		return err
+	}
 
-	_, err := ss.client.PutObject(ctx, &s3.PutObjectInput{
+	input := &s3.CreateMultipartUploadInput{
 		Bucket:      aws.String(ss.bucket),
 		Key:         aws.String(objKey),
-		Body:        info.r,
-		ContentType: info.ContentType,
+		ContentType: contentType,
+	}
+	sse.applyCreateMultipart(input)
+	output, err := ss.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		logx.Errorf("S3Server|SaveObjectStream|CreateMultipartUpload|objectKey: %s|err: %v", objKey, err)
+		return err
+	}
+
+	parts, err := ss.uploadParts(ctx, objKey, output.UploadId, body, buf, n, sse)
+	if err == nil {
+		_, err = ss.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(ss.bucket),
+			Key:             aws.String(objKey),
+			UploadId:        output.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		logx.Errorf("S3Server|SaveObjectStream|upload|objectKey: %s|err: %v", objKey, err)
+		// 失败时清理已经上传的分片
+		_, abortErr := ss.client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(ss.bucket),
+			Key:      aws.String(objKey),
+			UploadId: output.UploadId,
+		})
+		if abortErr != nil {
+			logx.Errorf("S3Server|SaveObjectStream|AbortMultipartUpload|objectKey: %s|err: %v", objKey, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// 依次上传分片，buf 中已经读入了第一个分片的 n 个字节
+func (ss *S3Logic) uploadParts(ctx context.Context, objKey string, uploadId *string, body io.Reader, buf []byte, n int, sse *SSEParams) ([]types.CompletedPart, error) {
+	var parts []types.CompletedPart
+	for partNumber := int32(1); ; partNumber++ {
+		input := &s3.UploadPartInput{
+			Bucket:     aws.String(ss.bucket),
+			Key:        aws.String(objKey),
+			UploadId:   uploadId,
+			PartNumber: aws.Int32(partNumber),
+			Body:       bytes.NewReader(buf[:n]),
+		}
+		sse.applyUploadPart(input)
+		output, err := ss.client.UploadPart(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, types.CompletedPart{ETag: output.ETag, PartNumber: aws.Int32(partNumber)})
+
+		var readErr error
+		n, readErr = io.ReadFull(body, buf)
+		if errors.Is(readErr, io.EOF) {
+			return parts, nil
+		}
+		// 读到的不足一个分片时为最后一个分片，下一轮上传
+		if readErr != nil && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return nil, readErr
+		}
+	}
+}
+
+// SaveObject 保存对象到s3
+func (ss *S3Logic) SaveObject(ctx context.Context, objKey string, body io.Reader, contentType *string, sse *SSEParams) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(ss.bucket),
+		Key:         aws.String(objKey),
+		Body:        body,
+		ContentType: contentType,
+	}
+	sse.applyPut(input)
+	_, err := ss.client.PutObject(ctx, input)
+	if nil != err {
+		logx.Errorf("S3Server|SaveObject|PutObject|objectKey: %s|err: %v", objKey, err)
+		return err
+	}
+	return nil
+}
+
+// GetObject 直接从s3读取对象
+func (ss *S3Logic) GetObject(ctx context.Context, objectKey string, sse *SSEParams) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(objectKey),
+	}
+	sse.applyGet(input)
+	output, err := ss.client.GetObject(ctx, input)
+	if nil != err {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, pkg.ErrorEnums.ErrFileNotExist
+		}
+		logx.Errorf("S3Server|GetObject|GetObject|objectKey: %s|err: %v", objectKey, err)
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+// CopyObject 在桶内复制对象，源和目标使用相同的加密参数
+func (ss *S3Logic) CopyObject(ctx context.Context, srcKey, dstKey string, sse *SSEParams) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(ss.bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(path.Join(ss.bucket, srcKey)),
+	}
+	sse.applyCopy(input)
+	_, err := ss.client.CopyObject(ctx, input)
+	if nil != err {
+		logx.Errorf("S3Server|CopyObject|CopyObject|src: %s|dst: %s|err: %v", srcKey, dstKey, err)
+		return err
+	}
+	return nil
+}
+
+// S3Object 桶中对象的简要信息
+type S3Object struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	LastModified int64  `json:"last_modified"`
+}
+
+// ListObjects 按前缀列出桶中的所有对象
+func (ss *S3Logic) ListObjects(ctx context.Context, prefix string, fn func(obj *S3Object) error) error {
+	paginator := s3.NewListObjectsV2Paginator(ss.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(ss.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if nil != err {
+			logx.Errorf("S3Server|ListObjects|NextPage|prefix: %s|err: %v", prefix, err)
+			return err
+		}
+		for _, item := range page.Contents {
+			obj := &S3Object{
+				Key:          aws.ToString(item.Key),
+				Size:         aws.ToInt64(item.Size),
+				LastModified: aws.ToTime(item.LastModified).Unix(),
+			}
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteObject 删除桶中的对象
+func (ss *S3Logic) DeleteObject(ctx context.Context, objectKey string) error {
+	_, err := ss.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(objectKey),
 	})
 	if nil != err {
-		logx.Errorf("S3Server|SaveFileData|PutObject|err: %v", err)
+		logx.Errorf("S3Server|DeleteObject|DeleteObject|objectKey: %s|err: %v", objectKey, err)
 		return err
 	}
 	return nil
 }
 
-// 获取s3的访问预签名url
-func (ss *S3Logic) GetPresignedURL(ctx context.Context, objectKey string) (string, error) {
+// 获取s3的访问预签名url, sse-c 的对象无法通过url安全携带密钥，不允许预签名
+func (ss *S3Logic) GetPresignedURL(ctx context.Context, objectKey string, sse *SSEParams) (string, error) {
+	if sse.IsSSEC() {
+		return "", pkg.ErrorEnums.ErrPresignNotAllowed
+	}
 	presignClient := s3.NewPresignClient(ss.client)
 	presignedURL, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(ss.bucket),
@@ -0,0 +1,327 @@
+package logic
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+)
+
+// 扫描器类型
+var ScannerTypes = struct {
+	None  string
+	Clamd string // clamd 的 INSTREAM 协议
+	Http  string // 通用http扫描服务
+}{
+	None:  "",
+	Clamd: "clamd",
+	Http:  "http",
+}
+
+// 扫描状态
+var ScanStatuses = struct {
+	Pending  string // 等待扫描，文件不可读
+	Clean    string
+	Infected string // 已隔离
+	Failed   string // 扫描出错，文件不可读
+}{
+	Pending:  "pending",
+	Clean:    "clean",
+	Infected: "infected",
+	Failed:   "failed",
+}
+
+const (
+	defaultScanTimeout = 60
+	clamdChunkSize     = 64 << 10
+)
+
+// ScanResult 文件的扫描结果
+type ScanResult struct {
+	Status    string  `json:"status" bson:"status"`
+	Engine    string  `json:"engine,omitempty" bson:"engine,omitempty"`
+	Signature *string `json:"signature,omitempty" bson:"signature,omitempty"` // 命中的病毒特征
+	Error     *string `json:"error,omitempty" bson:"error,omitempty"`
+	ScannedTs *int64  `json:"scanned_ts,omitempty" bson:"scanned_ts,omitempty"`
+}
+
+// Scanner 病毒扫描器
+type Scanner interface {
+	Name() string
+	// Scan 扫描文件内容，返回是否感染和命中的特征
+	Scan(ctx context.Context, r io.Reader) (bool, string, error)
+}
+
+// NewScanner 根据配置创建扫描器，未配置时返回nil
+func NewScanner(cfg *config.Scanner, hcli *http.Client) (Scanner, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch cfg.Type {
+	case ScannerTypes.None:
+		return nil, nil
+	case ScannerTypes.Clamd:
+		return &ClamdScanner{addr: cfg.Addr}, nil
+	case ScannerTypes.Http:
+		return &HttpScanner{url: cfg.Url, hcli: hcli}, nil
+	default:
+		return nil, pkg.ErrorEnums.ErrScannerNotSupport
+	}
+}
+
+// ClamdScanner 通过 tcp 连接 clamd，使用 INSTREAM 命令扫描
+type ClamdScanner struct {
+	addr string
+}
+
+func (cs *ClamdScanner) Name() string {
+	return ScannerTypes.Clamd
+}
+
+func (cs *ClamdScanner) Scan(ctx context.Context, r io.Reader) (bool, string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", cs.addr)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, "", err
+	}
+	// 数据按块发送，每块前面是4字节的长度，长度为0表示结束
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return false, "", werr
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return false, "", err
+		}
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return false, "", err
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return false, "", err
+	}
+	// 返回格式 stream: OK / stream: Eicar-Signature FOUND / ... ERROR
+	result := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	result = strings.TrimSpace(strings.TrimPrefix(result, "stream:"))
+	switch {
+	case result == "OK":
+		return false, "", nil
+	case strings.HasSuffix(result, "FOUND"):
+		return true, strings.TrimSpace(strings.TrimSuffix(result, "FOUND")), nil
+	default:
+		return false, "", fmt.Errorf("clamd: %s", result)
+	}
+}
+
+// HttpScanner 把文件内容 POST 到扫描服务
+// 服务返回 {"infected": true, "signature": "..."}
+type HttpScanner struct {
+	url  string
+	hcli *http.Client
+}
+
+func (hs *HttpScanner) Name() string {
+	return ScannerTypes.Http
+}
+
+func (hs *HttpScanner) Scan(ctx context.Context, r io.Reader) (bool, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hs.url, r)
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := hs.hcli.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("scanner status: %d", resp.StatusCode)
+	}
+	var verdict struct {
+		Infected  bool   `json:"infected"`
+		Signature string `json:"signature"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return false, "", err
+	}
+	return verdict.Infected, verdict.Signature, nil
+}
+
+// 病毒扫描服务，文件完成上传后在扫描队列中异步执行
+type ScanLogic struct {
+	ctx      context.Context
+	timeout  time.Duration
+	scanner  Scanner
+	fileServ *FileIndexLogic
+}
+
+func NewScanLogic(ctx context.Context, cfg *config.Config, hcli *http.Client, fileServ *FileIndexLogic) *ScanLogic {
+	scanner, err := NewScanner(cfg.Scanner, hcli)
+	if err != nil {
+		panic(err)
+	}
+	timeout := int64(defaultScanTimeout)
+	if cfg.Scanner != nil && cfg.Scanner.Timeout > 0 {
+		timeout = cfg.Scanner.Timeout
+	}
+	sl := &ScanLogic{
+		ctx:      ctx,
+		timeout:  time.Duration(timeout) * time.Second,
+		scanner:  scanner,
+		fileServ: fileServ,
+	}
+	if scanner != nil {
+		fileServ.SetScanStage(sl.ScanFile)
+	}
+	return sl
+}
+
+// ScanFile 扫描已经保存的文件并记录结果，感染的文件移动到隔离区
+func (sl *ScanLogic) ScanFile(ctx context.Context, info *MediaFileInfo, opts ...func(*MediaFileInfo) *MediaFileInfo) error {
+	fileInfo, err := sl.fileServ.QueryFileInfo(ctx, info.GetDepotId(), info.Fid)
+	if err != nil {
+		logx.Errorf("ScanLogic|ScanFile|QueryFileInfo|fid: %s|err: %v", info.Fid, err)
+		return err
+	}
+
+	result := &ScanResult{Engine: sl.scanner.Name()}
+	infected, signature, err := sl.scan(ctx, fileInfo)
+	result.ScannedTs = ptr.Int64(time.Now().Unix())
+	switch {
+	case err != nil:
+		logx.Errorf("ScanLogic|ScanFile|scan|fid: %s|err: %v", info.Fid, err)
+		result.Status = ScanStatuses.Failed
+		result.Error = ptr.String(err.Error())
+	case infected:
+		logx.Infof("ScanLogic|ScanFile|infected|fid: %s|signature: %s", info.Fid, signature)
+		result.Status = ScanStatuses.Infected
+		result.Signature = ptr.String(signature)
+		if err = sl.fileServ.QuarantineFileData(ctx, fileInfo); err != nil {
+			logx.Errorf("ScanLogic|ScanFile|QuarantineFileData|fid: %s|err: %v", info.Fid, err)
+		}
+		// 重新扫描时才会出现已经处理过的图片
+		sl.fileServ.DeleteImageHash(ctx, fileInfo.GetDepotId(), fileInfo.Fid)
+	default:
+		result.Status = ScanStatuses.Clean
+	}
+
+	fileInfo.Scan = result
+	quarantined := false
+	err = sl.fileServ.UpdateFileInfo(ctx, fileInfo.GetDepotId(), fileInfo.Fid, func(current *MediaFileInfo) error {
+		// 只在第一次隔离时扣减用量
+		quarantined = infected && (current.Scan == nil || current.Scan.Status != ScanStatuses.Infected)
+		current.Scan = result
+		return nil
+	})
+	if err != nil {
+		logx.Errorf("ScanLogic|ScanFile|UpdateFileInfo|fid: %s|err: %v", info.Fid, err)
+		return err
+	}
+	if quarantined && fileInfo.Box != nil {
+		// 隔离的文件不再计入箱子用量
+		err = sl.fileServ.boxServ.IncrBoxUsage(ctx, fileInfo.Box.BoxId, -1, -ptr.ToInt64(fileInfo.ContentLength), -fileInfo.GetStoredLength())
+		if err != nil {
+			logx.Errorf("ScanLogic|ScanFile|IncrBoxUsage|boxId: %s|err: %v", fileInfo.Box.BoxId, err)
+		}
+	}
+	if result.Status == ScanStatuses.Clean {
+		sl.fileServ.submitProcess(fileInfo)
+	}
+	if infected {
+		return pkg.ErrorEnums.ErrFileInfected
+	}
+	return nil
+}
+
+// 读取存储中的文件交给扫描器
+func (sl *ScanLogic) scan(ctx context.Context, info *MediaFileInfo) (bool, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, sl.timeout)
+	defer cancel()
+
+	body, err := sl.fileServ.OpenFileData(ctx, info)
+	if err != nil {
+		return false, "", err
+	}
+	defer body.Close()
+	var r io.Reader = body
+	if encoding := ptr.ToString(info.ContentEncoding); len(encoding) > 0 {
+		decoded, err := NewDecompressReader(encoding, body)
+		if err != nil {
+			return false, "", err
+		}
+		defer decoded.Close()
+		r = decoded
+	}
+	return sl.scanner.Scan(ctx, r)
+}
+
+// Rescan 重新扫描单个文件，已经隔离的文件不能重新扫描
+func (sl *ScanLogic) Rescan(ctx context.Context, depotId, fid string) error {
+	if sl.scanner == nil {
+		return pkg.ErrorEnums.ErrScannerNotEnabled
+	}
+	info, err := sl.fileServ.QueryFileInfo(ctx, depotId, fid)
+	if err != nil {
+		logx.Errorf("ScanLogic|Rescan|QueryFileInfo|fid: %s|err: %v", fid, err)
+		return err
+	}
+	if info.Scan != nil && info.Scan.Status == ScanStatuses.Infected {
+		return pkg.ErrorEnums.ErrFileInfected
+	}
+	if !sl.fileServ.SubmitScan(info) {
+		return pkg.ErrorEnums.ErrScanQueueFull
+	}
+	return nil
+}
+
+// RescanPending 重新提交等待扫描和扫描失败的文件，用于服务重启或者扫描队列满之后补扫
+// depotId 为空时处理所有仓库，返回提交的文件数量
+func (sl *ScanLogic) RescanPending(ctx context.Context, depotId string) (int, error) {
+	if sl.scanner == nil {
+		return 0, pkg.ErrorEnums.ErrScannerNotEnabled
+	}
+	count := 0
+	err := sl.fileServ.ScanFileInfos(ctx, depotId, func(info *MediaFileInfo) error {
+		if info.Scan == nil || (info.Scan.Status != ScanStatuses.Pending && info.Scan.Status != ScanStatuses.Failed) {
+			return nil
+		}
+		if !sl.fileServ.SubmitScan(info) {
+			return pkg.ErrorEnums.ErrScanQueueFull
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		logx.Errorf("ScanLogic|RescanPending|ScanFileInfos|depotId: %s|count: %d|err: %v", depotId, count, err)
+	}
+	return count, err
+}
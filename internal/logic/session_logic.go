@@ -0,0 +1,459 @@
+package logic
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/ds"
+	"github.com/dzjyyds666/Allspark-go/jwtx"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRefreshExpire = 7 * 24 * time.Hour
+	defaultConsoleExpire = time.Hour
+)
+
+// token 的类型，控制台 token 只能访问 /admin 接口，数据接口的 token 不能访问 /admin 接口
+var TokenTypes = struct {
+	Access  string
+	Console string
+}{
+	Access:  "access",
+	Console: "console",
+}
+
+// Session 一次登录的会话，refresh token 只保存哈希
+type Session struct {
+	SessionId string `json:"session_id"`
+	Uid       string `json:"uid"`
+	Jti       string `json:"jti"` // 当前有效的 access token
+	CreatedTs int64  `json:"created_ts"`
+	CreatedMs int64  `json:"created_ms,omitempty"` // 创建时间，毫秒，和吊销所有会话的时间比较
+	ExpiresTs int64  `json:"expires_ts"`           // refresh token 过期时间
+}
+
+// 会话的创建时间，毫秒，之前创建的会话只有秒
+func (s *Session) createdMs() int64 {
+	if s.CreatedMs > 0 {
+		return s.CreatedMs
+	}
+	return s.CreatedTs * 1000
+}
+
+// TokenPair 登录和刷新时返回的 token
+type TokenPair struct {
+	AccessToken  string `json:"jwt"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresTs    int64  `json:"expires_ts"` // access token 过期时间
+}
+
+// AccessClaims 从 access token 中解析出的信息
+type AccessClaims struct {
+	Uid       string
+	Type      string
+	Jti       string
+	SessionId string
+	IssuedMs  int64 // 签发时间，毫秒
+	ExpiresTs int64
+}
+
+// 会话服务，负责签发、刷新和吊销 token
+type SessionLogic struct {
+	ctx           context.Context
+	group         string
+	sessionRedis  *redis.Client
+	jwtToken      *config.Jwt
+	consoleJwt    *config.Jwt
+	refreshExpire time.Duration
+	userServ      *UserLogic
+}
+
+func NewSessionLogic(ctx context.Context, cfg *config.Config, dsServer *ds.DatabaseServer, userServ *UserLogic) *SessionLogic {
+	sessionRedis, ok := dsServer.GetRedis("system")
+	if !ok {
+		panic("redis [system] not found")
+	}
+	refreshExpire := defaultRefreshExpire
+	if cfg.Server.Jwt.RefreshExpire > 0 {
+		refreshExpire = time.Duration(cfg.Server.Jwt.RefreshExpire) * time.Second
+	}
+	return &SessionLogic{
+		ctx:           ctx,
+		group:         ptr.ToString(cfg.Group),
+		sessionRedis:  sessionRedis,
+		jwtToken:      cfg.Server.Jwt,
+		consoleJwt:    cfg.Server.ConsoleJwt,
+		refreshExpire: refreshExpire,
+		userServ:      userServ,
+	}
+}
+
+func (sl *SessionLogic) buildSessionKey(sessionId string) string {
+	return fmt.Sprintf("media_storage:%s:session:%s", sl.group, sessionId)
+}
+
+// refresh token 哈希到会话id的索引
+func (sl *SessionLogic) buildRefreshKey(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return fmt.Sprintf("media_storage:%s:refresh:%s", sl.group, hex.EncodeToString(sum[:]))
+}
+
+// 用户的所有会话，set 结构
+func (sl *SessionLogic) buildUserSessionsKey(uid string) string {
+	return fmt.Sprintf("media_storage:%s:user:%s:sessions", sl.group, uid)
+}
+
+// 已吊销的 access token，过期时间和 token 的有效期一致
+func (sl *SessionLogic) buildRevokedKey(jti string) string {
+	return fmt.Sprintf("media_storage:%s:revoked:%s", sl.group, jti)
+}
+
+// 用户在该时间(毫秒)及之前签发的 token 和创建的会话全部失效
+func (sl *SessionLogic) buildRevokedBeforeKey(uid string) string {
+	return fmt.Sprintf("media_storage:%s:user:%s:revoked_before", sl.group, uid)
+}
+
+func (sl *SessionLogic) accessExpire() time.Duration {
+	return time.Duration(sl.jwtToken.Expire) * time.Second
+}
+
+func (sl *SessionLogic) consoleExpire() time.Duration {
+	if sl.consoleJwt == nil || sl.consoleJwt.Expire <= 0 {
+		return defaultConsoleExpire
+	}
+	return time.Duration(sl.consoleJwt.Expire) * time.Second
+}
+
+// 吊销记录需要保留到两种 token 中较长的有效期
+func (sl *SessionLogic) revokeExpire() time.Duration {
+	return max(sl.accessExpire(), sl.consoleExpire())
+}
+
+// 签发 access token
+func (sl *SessionLogic) signAccessToken(user *User, session *Session) (string, int64, error) {
+	now := time.Now()
+	expires := now.Add(sl.accessExpire()).Unix()
+	session.Jti = generateRandomString(24)
+	token, err := jwtx.SignJwt(sl.jwtToken.Secret, jwt.MapClaims{
+		"uid":     user.Uid,
+		"roles":   user.Roles,
+		"typ":     TokenTypes.Access,
+		"jti":     session.Jti,
+		"sid":     session.SessionId,
+		"iat":     now.Unix(),
+		"iat_ms":  now.UnixMilli(),
+		"expires": expires,
+	})
+	return token, expires, err
+}
+
+// 保存会话和 refresh token 索引
+func (sl *SessionLogic) saveSession(ctx context.Context, session *Session, refreshToken string) error {
+	raw, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(time.Unix(session.ExpiresTs, 0))
+	pipe := sl.sessionRedis.TxPipeline()
+	pipe.Set(ctx, sl.buildSessionKey(session.SessionId), raw, ttl)
+	pipe.Set(ctx, sl.buildRefreshKey(refreshToken), session.SessionId, ttl)
+	pipe.SAdd(ctx, sl.buildUserSessionsKey(session.Uid), session.SessionId)
+	if _, err = pipe.Exec(ctx); err != nil {
+		logx.Errorf("SessionLogic|saveSession|Exec|sessionId: %s|err: %v", session.SessionId, err)
+		return err
+	}
+	return nil
+}
+
+// 刷新时更新会话，会话已经被删除或者在吊销所有会话之前创建时失败
+// WATCH 会话和吊销时间，避免和吊销所有会话并发时把已经删除的会话重新写回
+func (sl *SessionLogic) updateSession(ctx context.Context, session *Session, refreshToken string) error {
+	raw, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(time.Unix(session.ExpiresTs, 0))
+	sessionKey := sl.buildSessionKey(session.SessionId)
+	revokedBeforeKey := sl.buildRevokedBeforeKey(session.Uid)
+	err = sl.sessionRedis.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, sessionKey).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return pkg.ErrorEnums.ErrSessionNotExist
+		}
+		if before, err := tx.Get(ctx, revokedBeforeKey).Int64(); err == nil && session.createdMs() <= before {
+			return pkg.ErrorEnums.ErrSessionNotExist
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, sessionKey, raw, ttl)
+			pipe.Set(ctx, sl.buildRefreshKey(refreshToken), session.SessionId, ttl)
+			return nil
+		})
+		return err
+	}, sessionKey, revokedBeforeKey)
+	if errors.Is(err, redis.TxFailedErr) {
+		return pkg.ErrorEnums.ErrSessionNotExist
+	}
+	if err != nil && !errors.Is(err, pkg.ErrorEnums.ErrSessionNotExist) {
+		logx.Errorf("SessionLogic|updateSession|Watch|sessionId: %s|err: %v", session.SessionId, err)
+	}
+	return err
+}
+
+// CreateSession 登录成功后创建会话，签发 access token 和 refresh token
+func (sl *SessionLogic) CreateSession(ctx context.Context, user *User) (*TokenPair, error) {
+	now := time.Now()
+	session := &Session{
+		SessionId: "ss_" + generateRandomString(16),
+		Uid:       user.Uid,
+		CreatedTs: now.Unix(),
+		CreatedMs: now.UnixMilli(),
+		ExpiresTs: now.Add(sl.refreshExpire).Unix(),
+	}
+	accessToken, expires, err := sl.signAccessToken(user, session)
+	if err != nil {
+		logx.Errorf("SessionLogic|CreateSession|signAccessToken|uid: %s|err: %v", user.Uid, err)
+		return nil, err
+	}
+	refreshToken := generateRandomString(48)
+	if err = sl.saveSession(ctx, session, refreshToken); err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken, ExpiresTs: expires}, nil
+}
+
+// QuerySession 查询会话
+func (sl *SessionLogic) QuerySession(ctx context.Context, sessionId string) (*Session, error) {
+	raw, err := sl.sessionRedis.Get(ctx, sl.buildSessionKey(sessionId)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, pkg.ErrorEnums.ErrSessionNotExist
+		}
+		logx.Errorf("SessionLogic|QuerySession|Get|sessionId: %s|err: %v", sessionId, err)
+		return nil, err
+	}
+	var session Session
+	if err = json.Unmarshal(raw, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Refresh 使用 refresh token 换取新的 token，旧的 refresh token 和 access token 同时失效
+func (sl *SessionLogic) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	refreshKey := sl.buildRefreshKey(refreshToken)
+	// GetDel 保证同一个 refresh token 只能使用一次
+	sessionId, err := sl.sessionRedis.GetDel(ctx, refreshKey).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, pkg.ErrorEnums.ErrSessionNotExist
+		}
+		logx.Errorf("SessionLogic|Refresh|GetDel|err: %v", err)
+		return nil, err
+	}
+	session, err := sl.QuerySession(ctx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	user, err := sl.userServ.QueryUser(ctx, session.Uid)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		sl.RevokeSession(ctx, session)
+		return nil, pkg.ErrorEnums.ErrUserDisabled
+	}
+
+	sl.revokeJti(ctx, session.Jti)
+	accessToken, expires, err := sl.signAccessToken(user, session)
+	if err != nil {
+		logx.Errorf("SessionLogic|Refresh|signAccessToken|uid: %s|err: %v", user.Uid, err)
+		return nil, err
+	}
+	newRefreshToken := generateRandomString(48)
+	if err = sl.updateSession(ctx, session, newRefreshToken); err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: accessToken, RefreshToken: newRefreshToken, ExpiresTs: expires}, nil
+}
+
+// 吊销 access token，记录保留到 token 过期
+func (sl *SessionLogic) revokeJti(ctx context.Context, jti string) {
+	if len(jti) == 0 {
+		return
+	}
+	if err := sl.sessionRedis.Set(ctx, sl.buildRevokedKey(jti), 1, sl.revokeExpire()).Err(); err != nil {
+		logx.Errorf("SessionLogic|revokeJti|Set|jti: %s|err: %v", jti, err)
+	}
+}
+
+// RevokeSession 注销会话，会话的 access token 同时失效
+func (sl *SessionLogic) RevokeSession(ctx context.Context, session *Session) error {
+	sl.revokeJti(ctx, session.Jti)
+	pipe := sl.sessionRedis.TxPipeline()
+	pipe.Del(ctx, sl.buildSessionKey(session.SessionId))
+	pipe.SRem(ctx, sl.buildUserSessionsKey(session.Uid), session.SessionId)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logx.Errorf("SessionLogic|RevokeSession|Exec|sessionId: %s|err: %v", session.SessionId, err)
+		return err
+	}
+	return nil
+}
+
+// Logout 注销 access token 所属的会话
+func (sl *SessionLogic) Logout(ctx context.Context, claims *AccessClaims) error {
+	sl.revokeJti(ctx, claims.Jti)
+	// 控制台 token 没有会话
+	if len(claims.SessionId) == 0 {
+		return nil
+	}
+	session, err := sl.QuerySession(ctx, claims.SessionId)
+	if err != nil {
+		if errors.Is(err, pkg.ErrorEnums.ErrSessionNotExist) {
+			return nil
+		}
+		return err
+	}
+	return sl.RevokeSession(ctx, session)
+}
+
+// RevokeUserSessions 吊销用户的所有会话，之前签发的 access token 全部失效
+// refresh token 的索引没有单独删除，会话删除后无法再换取 token，随过期时间清理
+func (sl *SessionLogic) RevokeUserSessions(ctx context.Context, uid string) error {
+	err := sl.sessionRedis.Set(ctx, sl.buildRevokedBeforeKey(uid), time.Now().UnixMilli(), sl.revokeExpire()).Err()
+	if err != nil {
+		logx.Errorf("SessionLogic|RevokeUserSessions|Set|uid: %s|err: %v", uid, err)
+		return err
+	}
+	sessionIds, err := sl.sessionRedis.SMembers(ctx, sl.buildUserSessionsKey(uid)).Result()
+	if err != nil {
+		logx.Errorf("SessionLogic|RevokeUserSessions|SMembers|uid: %s|err: %v", uid, err)
+		return err
+	}
+	keys := []string{sl.buildUserSessionsKey(uid)}
+	for _, sessionId := range sessionIds {
+		if session, err := sl.QuerySession(ctx, sessionId); err == nil {
+			sl.revokeJti(ctx, session.Jti)
+		}
+		keys = append(keys, sl.buildSessionKey(sessionId))
+	}
+	if err = sl.sessionRedis.Del(ctx, keys...).Err(); err != nil {
+		logx.Errorf("SessionLogic|RevokeUserSessions|Del|uid: %s|err: %v", uid, err)
+		return err
+	}
+	return nil
+}
+
+// CreateConsoleToken 签发控制台 token，不创建会话，过期后重新登录
+func (sl *SessionLogic) CreateConsoleToken(user *User) (string, int64, error) {
+	now := time.Now()
+	expires := now.Add(sl.consoleExpire()).Unix()
+	token, err := jwtx.SignJwt(sl.consoleJwt.Secret, jwt.MapClaims{
+		"uid":      user.Uid,
+		"roles":    user.Roles,
+		"typ":      TokenTypes.Console,
+		"provider": user.Provider,
+		"jti":      generateRandomString(24),
+		"iat":      now.Unix(),
+		"iat_ms":   now.UnixMilli(),
+		"expires":  expires,
+	})
+	return token, expires, err
+}
+
+// ParseAccessToken 解析并校验 access token，已吊销的 token 返回错误
+func (sl *SessionLogic) ParseAccessToken(ctx context.Context, tokenString string) (*AccessClaims, error) {
+	claims, err := sl.parseToken(ctx, sl.jwtToken.Secret, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type != TokenTypes.Access {
+		return nil, pkg.ErrorEnums.ErrTokenInvalid
+	}
+	return claims, nil
+}
+
+// ParseConsoleToken 解析并校验控制台 token
+func (sl *SessionLogic) ParseConsoleToken(ctx context.Context, tokenString string) (*AccessClaims, error) {
+	if sl.consoleJwt == nil || len(sl.consoleJwt.Secret) == 0 {
+		return nil, pkg.ErrorEnums.ErrTokenInvalid
+	}
+	claims, err := sl.parseToken(ctx, sl.consoleJwt.Secret, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type != TokenTypes.Console {
+		return nil, pkg.ErrorEnums.ErrTokenInvalid
+	}
+	return claims, nil
+}
+
+// 校验签名、过期时间和吊销记录
+func (sl *SessionLogic) parseToken(ctx context.Context, secret, tokenString string) (*AccessClaims, error) {
+	claims, err := ParseTokenClaims(secret, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := sl.sessionRedis.Pipeline()
+	revoked := pipe.Exists(ctx, sl.buildRevokedKey(claims.Jti))
+	revokedBefore := pipe.Get(ctx, sl.buildRevokedBeforeKey(claims.Uid))
+	if _, err = pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		logx.Errorf("SessionLogic|parseToken|Exec|jti: %s|err: %v", claims.Jti, err)
+		return nil, err
+	}
+	if revoked.Val() > 0 {
+		return nil, pkg.ErrorEnums.ErrTokenRevoked
+	}
+	// 和吊销在同一毫秒内签发的 token 同样失效
+	if before, err := revokedBefore.Int64(); err == nil && claims.IssuedMs <= before {
+		return nil, pkg.ErrorEnums.ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// ParseTokenClaims 校验 token 的签名和过期时间并解析出 claims，不检查吊销记录
+func ParseTokenClaims(secret, tokenString string) (*AccessClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
+		return []byte(secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, pkg.ErrorEnums.ErrTokenInvalid
+	}
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, pkg.ErrorEnums.ErrTokenInvalid
+	}
+	claims := &AccessClaims{}
+	claims.Uid, _ = mapClaims["uid"].(string)
+	claims.Type, _ = mapClaims["typ"].(string)
+	claims.Jti, _ = mapClaims["jti"].(string)
+	claims.SessionId, _ = mapClaims["sid"].(string)
+	// 签发时间优先使用毫秒，只有秒的按所在秒的开始计算
+	if iatMs, ok := mapClaims["iat_ms"].(float64); ok {
+		claims.IssuedMs = int64(iatMs)
+	} else if iat, ok := mapClaims["iat"].(float64); ok {
+		claims.IssuedMs = int64(iat) * 1000
+	}
+	if expires, ok := mapClaims["expires"].(float64); ok {
+		claims.ExpiresTs = int64(expires)
+	}
+	// 没有 jti 的 token 无法吊销，不再接受
+	if len(claims.Uid) == 0 || len(claims.Jti) == 0 || time.Now().Unix() >= claims.ExpiresTs {
+		return nil, pkg.ErrorEnums.ErrTokenInvalid
+	}
+	return claims, nil
+}
@@ -0,0 +1,245 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/ds"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share 分享链接，分享单个文件或者整个box，Fid 和 BoxId 只有一个不为空
+type Share struct {
+	Token        string   `json:"token"`
+	Creator      string   `json:"creator"`
+	DepotId      string   `json:"depot_id"`
+	Fid          *string  `json:"fid,omitempty"`
+	BoxId        *string  `json:"box_id,omitempty"`
+	ExpiresTs    *int64   `json:"expires_ts,omitempty"`    // 过期时间，为空时不过期
+	MaxDownloads *int64   `json:"max_downloads,omitempty"` // 最大下载次数，为空时不限制
+	Downloads    int64    `json:"downloads"`
+	AllowedIps   []string `json:"allowed_ips,omitempty"` // 允许访问的ip或者网段，为空时不限制
+	HasPassword  bool     `json:"has_password"`
+	CreatedTs    int64    `json:"created_ts"`
+}
+
+// Expired 是否已经过期
+func (s *Share) Expired() bool {
+	return s.ExpiresTs != nil && time.Now().Unix() >= *s.ExpiresTs
+}
+
+// AllowIP 检查访问的ip是否在允许的列表中
+func (s *Share) AllowIP(ip string) bool {
+	if len(s.AllowedIps) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, allowed := range s.AllowedIps {
+		if _, ipNet, err := net.ParseCIDR(allowed); err == nil {
+			if ipNet.Contains(addr) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// 校验允许访问的ip列表
+func checkAllowedIps(ips []string) bool {
+	for _, ip := range ips {
+		if _, _, err := net.ParseCIDR(ip); err == nil {
+			continue
+		}
+		if net.ParseIP(ip) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// 分享链接服务
+type ShareLogic struct {
+	ctx        context.Context
+	group      string
+	shareRedis *redis.Client
+}
+
+func NewShareLogic(ctx context.Context, cfg *config.Config, dsServer *ds.DatabaseServer) *ShareLogic {
+	shareRedis, ok := dsServer.GetRedis("file")
+	if !ok {
+		panic("redis [file] not found")
+	}
+	return &ShareLogic{
+		ctx:        ctx,
+		group:      ptr.ToString(cfg.Group),
+		shareRedis: shareRedis,
+	}
+}
+
+func (sl *ShareLogic) buildShareKey(token string) string {
+	return fmt.Sprintf("media_storage:%s:share:%s", sl.group, token)
+}
+
+func (sl *ShareLogic) buildSharePasswordKey(token string) string {
+	return fmt.Sprintf("media_storage:%s:share:%s:password", sl.group, token)
+}
+
+// 下载次数单独计数，保证并发下载时不会超过限制
+func (sl *ShareLogic) buildShareDownloadsKey(token string) string {
+	return fmt.Sprintf("media_storage:%s:share:%s:downloads", sl.group, token)
+}
+
+// 用户创建的分享，set 结构
+func (sl *ShareLogic) buildUserSharesKey(uid string) string {
+	return fmt.Sprintf("media_storage:%s:user:%s:shares", sl.group, uid)
+}
+
+// CreateShare 创建分享链接，password 为空时不需要密码
+func (sl *ShareLogic) CreateShare(ctx context.Context, share *Share, password string) (*Share, error) {
+	if (share.Fid == nil) == (share.BoxId == nil) {
+		return nil, pkg.ErrorEnums.ErrShareInvalid
+	}
+	if share.Expired() || (share.MaxDownloads != nil && *share.MaxDownloads <= 0) || !checkAllowedIps(share.AllowedIps) {
+		return nil, pkg.ErrorEnums.ErrShareInvalid
+	}
+	share.Token = generateRandomString(32)
+	share.CreatedTs = time.Now().Unix()
+	share.Downloads = 0
+	share.HasPassword = len(password) > 0
+
+	var ttl time.Duration
+	if share.ExpiresTs != nil {
+		ttl = time.Until(time.Unix(*share.ExpiresTs, 0))
+	}
+	raw, err := json.Marshal(share)
+	if err != nil {
+		return nil, err
+	}
+	pipe := sl.shareRedis.TxPipeline()
+	pipe.Set(ctx, sl.buildShareKey(share.Token), raw, ttl)
+	if share.HasPassword {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		pipe.Set(ctx, sl.buildSharePasswordKey(share.Token), hash, ttl)
+	}
+	pipe.SAdd(ctx, sl.buildUserSharesKey(share.Creator), share.Token)
+	if _, err = pipe.Exec(ctx); err != nil {
+		logx.Errorf("ShareLogic|CreateShare|Exec|creator: %s|err: %v", share.Creator, err)
+		return nil, err
+	}
+	return share, nil
+}
+
+// QueryShare 查询分享链接，过期的链接按不存在处理
+func (sl *ShareLogic) QueryShare(ctx context.Context, token string) (*Share, error) {
+	pipe := sl.shareRedis.Pipeline()
+	rawCmd := pipe.Get(ctx, sl.buildShareKey(token))
+	downloadsCmd := pipe.Get(ctx, sl.buildShareDownloadsKey(token))
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		logx.Errorf("ShareLogic|QueryShare|Exec|token: %s|err: %v", token, err)
+		return nil, err
+	}
+	raw, err := rawCmd.Bytes()
+	if err != nil {
+		return nil, pkg.ErrorEnums.ErrShareNotExist
+	}
+	var share Share
+	if err = json.Unmarshal(raw, &share); err != nil {
+		return nil, err
+	}
+	if share.Expired() {
+		return nil, pkg.ErrorEnums.ErrShareNotExist
+	}
+	share.Downloads, _ = downloadsCmd.Int64()
+	return &share, nil
+}
+
+// Authorize 校验访问者的ip和密码
+func (sl *ShareLogic) Authorize(ctx context.Context, share *Share, ip, password string) error {
+	if !share.AllowIP(ip) {
+		return pkg.ErrorEnums.ErrShareForbidden
+	}
+	if !share.HasPassword {
+		return nil
+	}
+	hash, err := sl.shareRedis.Get(ctx, sl.buildSharePasswordKey(share.Token)).Bytes()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logx.Errorf("ShareLogic|Authorize|Get|token: %s|err: %v", share.Token, err)
+		return err
+	}
+	if len(hash) == 0 || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return pkg.ErrorEnums.ErrSharePasswordNotMatch
+	}
+	return nil
+}
+
+// ConsumeDownload 记录一次下载，超过最大下载次数时返回错误
+func (sl *ShareLogic) ConsumeDownload(ctx context.Context, share *Share) error {
+	downloads, err := sl.shareRedis.Incr(ctx, sl.buildShareDownloadsKey(share.Token)).Result()
+	if err != nil {
+		logx.Errorf("ShareLogic|ConsumeDownload|Incr|token: %s|err: %v", share.Token, err)
+		return err
+	}
+	if share.ExpiresTs != nil && downloads == 1 {
+		sl.shareRedis.ExpireAt(ctx, sl.buildShareDownloadsKey(share.Token), time.Unix(*share.ExpiresTs, 0))
+	}
+	if share.MaxDownloads != nil && downloads > *share.MaxDownloads {
+		return pkg.ErrorEnums.ErrShareExhausted
+	}
+	share.Downloads = downloads
+	return nil
+}
+
+// RevokeShare 撤销分享链接
+func (sl *ShareLogic) RevokeShare(ctx context.Context, share *Share) error {
+	pipe := sl.shareRedis.TxPipeline()
+	pipe.Del(ctx, sl.buildShareKey(share.Token), sl.buildSharePasswordKey(share.Token), sl.buildShareDownloadsKey(share.Token))
+	pipe.SRem(ctx, sl.buildUserSharesKey(share.Creator), share.Token)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logx.Errorf("ShareLogic|RevokeShare|Exec|token: %s|err: %v", share.Token, err)
+		return err
+	}
+	return nil
+}
+
+// ListShares 列举用户创建的分享链接，同时清理已经过期的记录
+func (sl *ShareLogic) ListShares(ctx context.Context, creator string) ([]*Share, error) {
+	tokens, err := sl.shareRedis.SMembers(ctx, sl.buildUserSharesKey(creator)).Result()
+	if err != nil {
+		logx.Errorf("ShareLogic|ListShares|SMembers|creator: %s|err: %v", creator, err)
+		return nil, err
+	}
+	shares := make([]*Share, 0, len(tokens))
+	for _, token := range tokens {
+		share, err := sl.QueryShare(ctx, token)
+		if err != nil {
+			if errors.Is(err, pkg.ErrorEnums.ErrShareNotExist) {
+				sl.shareRedis.SRem(ctx, sl.buildUserSharesKey(creator), token)
+				continue
+			}
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].CreatedTs < shares[j].CreatedTs
+	})
+	return shares, nil
+}
@@ -0,0 +1,72 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/dzjyyds666/mediaStorage/pkg"
+)
+
+// NewStreamClient 构建读取大文件使用的客户端，不设置总超时，只限制等待响应头的时间
+// 传输的时长由调用方的ctx控制
+func NewStreamClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   32,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// OpenUrl 打开url的数据流，ctx结束时读取中断
+func OpenUrl(ctx context.Context, cli *http.Client, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// 多个流共享的读取额度，超出时返回 ErrDownloadTooLarge
+type budgetReader struct {
+	r      io.Reader
+	remain *int64
+}
+
+// NewBudgetReader 从共享额度中扣减读取的字节数
+func NewBudgetReader(r io.Reader, remain *int64) io.Reader {
+	return &budgetReader{r: r, remain: remain}
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	if *b.remain <= 0 {
+		// 额度用完时再探测一个字节，数据刚好用完时正常结束
+		var one [1]byte
+		n, err := b.r.Read(one[:])
+		if n > 0 {
+			return 0, pkg.ErrorEnums.ErrDownloadTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > *b.remain {
+		p = p[:*b.remain]
+	}
+	n, err := b.r.Read(p)
+	*b.remain -= int64(n)
+	return n, err
+}
@@ -0,0 +1,118 @@
+package logic
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+)
+
+// 签名url中的参数
+const (
+	UrlSignParam      = "sig"
+	UrlExpiresParam   = "expires"
+	UrlWatermarkParam = "wm" // 签名者没有原图权限时强制加水印
+
+	defaultUrlSignMaxExpire = 7 * 24 * time.Hour
+	defaultUrlSignBucket    = 5 * time.Minute
+)
+
+// 参与签名的参数，其他参数不影响返回的内容，cdn 追加的参数不会导致签名失败
+var urlSignedParams = []string{"depot_id", "variant", "w", "h", "q", "fit", "format", UrlExpiresParam, UrlWatermarkParam}
+
+// 服务自己签发的文件访问url，无状态校验，可以放在cdn后面
+type UrlSignLogic struct {
+	ctx       context.Context
+	secret    []byte
+	maxExpire time.Duration
+	bucket    time.Duration
+}
+
+func NewUrlSignLogic(ctx context.Context, cfg *config.Config) *UrlSignLogic {
+	usl := &UrlSignLogic{
+		ctx:       ctx,
+		maxExpire: defaultUrlSignMaxExpire,
+		bucket:    defaultUrlSignBucket,
+	}
+	signCfg := cfg.UrlSign
+	if signCfg != nil && len(signCfg.Secret) > 0 {
+		usl.secret = []byte(signCfg.Secret)
+	} else {
+		// 没有单独配置密钥时从 jwt 密钥派生
+		mac := hmac.New(sha256.New, []byte(cfg.Server.Jwt.Secret))
+		mac.Write([]byte("media_storage_url_sign"))
+		usl.secret = mac.Sum(nil)
+	}
+	if signCfg != nil && signCfg.MaxExpire > 0 {
+		usl.maxExpire = time.Duration(signCfg.MaxExpire) * time.Second
+	}
+	if signCfg != nil && signCfg.Bucket > 0 {
+		usl.bucket = time.Duration(signCfg.Bucket) * time.Second
+	}
+	return usl
+}
+
+// 构建待签名的字符串，只包含参与签名的参数
+func (usl *UrlSignLogic) buildStringToSign(fid string, query url.Values) string {
+	signed := url.Values{}
+	for _, key := range urlSignedParams {
+		if values, ok := query[key]; ok {
+			signed[key] = values
+		}
+	}
+	return strings.Join([]string{fid, signed.Encode()}, "\n")
+}
+
+func (usl *UrlSignLogic) computeSignature(fid string, query url.Values) string {
+	mac := hmac.New(sha256.New, usl.secret)
+	mac.Write([]byte(usl.buildStringToSign(fid, query)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign 为文件生成签名参数，过期时间向上对齐到时间桶，同一时间段内生成的url相同，便于cdn缓存
+func (usl *UrlSignLogic) Sign(fid string, query url.Values, expiresIn time.Duration) (url.Values, int64, error) {
+	if expiresIn <= 0 || expiresIn > usl.maxExpire {
+		return nil, 0, pkg.ErrorEnums.ErrUrlSignExpireInvalid
+	}
+	expires := time.Now().Add(expiresIn).Unix()
+	if bucket := int64(usl.bucket.Seconds()); bucket > 0 {
+		expires = (expires + bucket - 1) / bucket * bucket
+	}
+	signed := url.Values{}
+	for _, key := range urlSignedParams {
+		if values, ok := query[key]; ok {
+			signed[key] = values
+		}
+	}
+	signed.Set(UrlExpiresParam, strconv.FormatInt(expires, 10))
+	signed.Set(UrlSignParam, usl.computeSignature(fid, signed))
+	return signed, expires, nil
+}
+
+// IsSignedUrl 请求是否带有签名参数
+func IsSignedUrl(query url.Values) bool {
+	return len(query.Get(UrlSignParam)) > 0
+}
+
+// Verify 校验签名和过期时间，返回过期时间
+func (usl *UrlSignLogic) Verify(fid string, query url.Values) (int64, error) {
+	expires, err := strconv.ParseInt(query.Get(UrlExpiresParam), 10, 64)
+	if err != nil {
+		return 0, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	expected := usl.computeSignature(fid, query)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(UrlSignParam))) {
+		return 0, pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	if time.Now().Unix() >= expires {
+		return 0, pkg.ErrorEnums.ErrSignatureExpired
+	}
+	return expires, nil
+}
@@ -0,0 +1,398 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/ds"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 用户的全局角色
+var UserRoles = struct {
+	Admin string // 管理员，可以管理用户
+	User  string // 普通用户
+}{
+	Admin: "admin",
+	User:  "user",
+}
+
+const (
+	passwordMinLen = 8
+	passwordMaxLen = 72 // bcrypt 只使用前72个字节
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{3,64}$`)
+
+// 账号不存在时也做一次比较，避免通过耗时判断账号是否存在
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("media_storage_dummy"), bcrypt.DefaultCost)
+	return hash
+})
+
+// User 用户信息，密码哈希单独存储，不会出现在接口返回中
+type User struct {
+	Uid       string   `json:"uid"`
+	Username  string   `json:"username"`
+	Roles     []string `json:"roles,omitempty"`
+	Disabled  bool     `json:"disabled"`
+	Bootstrap bool     `json:"bootstrap,omitempty"` // 配置文件中的管理员，不能被禁用
+	Provider  string   `json:"provider,omitempty"`  // 外部登录的来源，如 oidc，这类用户没有密码
+	Creator   *string  `json:"creator,omitempty"`
+	CreatedTs int64    `json:"created_ts"`
+	UpdatedTs int64    `json:"updated_ts"`
+}
+
+// IsAdmin 是否为可用的管理员
+func (u *User) IsAdmin() bool {
+	return !u.Disabled && slices.Contains(u.Roles, UserRoles.Admin)
+}
+
+// 校验角色
+func checkUserRoles(roles []string) bool {
+	for _, role := range roles {
+		if role != UserRoles.Admin && role != UserRoles.User {
+			return false
+		}
+	}
+	return true
+}
+
+// 校验密码长度
+func checkPassword(password string) error {
+	if len(password) < passwordMinLen || len(password) > passwordMaxLen {
+		return pkg.ErrorEnums.ErrPasswordTooWeak
+	}
+	return nil
+}
+
+// CheckNewUser 校验新用户的用户名、密码和角色，没有角色时设置为普通用户
+func CheckNewUser(user *User, password string) error {
+	if !usernamePattern.MatchString(user.Username) {
+		return pkg.ErrorEnums.ErrUsernameInvalid
+	}
+	if err := checkPassword(password); err != nil {
+		return err
+	}
+	if len(user.Roles) == 0 {
+		user.Roles = []string{UserRoles.User}
+	}
+	if !checkUserRoles(user.Roles) {
+		return pkg.ErrorEnums.ErrUserRoleInvalid
+	}
+	return nil
+}
+
+// HashPassword 校验密码长度后使用 bcrypt 哈希
+func HashPassword(password string) ([]byte, error) {
+	if err := checkPassword(password); err != nil {
+		return nil, err
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// ComparePasswordHash 比较密码和保存的哈希，没有哈希的用户(外部登录)不能使用密码登录
+func ComparePasswordHash(hash []byte, password string) error {
+	if len(hash) == 0 || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return pkg.ErrorEnums.ErrPasswordNotMatch
+	}
+	return nil
+}
+
+type UserLogic struct {
+	ctx       context.Context
+	group     string
+	userRedis *redis.Client
+	admin     *config.Admin
+}
+
+func NewUserLogic(ctx context.Context, cfg *config.Config, dsServer *ds.DatabaseServer) *UserLogic {
+	userRedis, ok := dsServer.GetRedis("user")
+	if !ok {
+		panic("redis [user] not found")
+	}
+	ul := &UserLogic{
+		ctx:       ctx,
+		group:     ptr.ToString(cfg.Group),
+		userRedis: userRedis,
+		admin:     cfg.Admin,
+	}
+	if err := ul.StartCheck(); err != nil {
+		panic(err)
+	}
+	return ul
+}
+
+// StartCheck 创建配置文件中的管理员，已经存在时不覆盖，之后通过接口修改密码
+// uid 使用配置中的用户名，兼容之前签发的token和已上传文件的上传者
+func (ul *UserLogic) StartCheck() error {
+	if ul.admin == nil || len(ul.admin.Username) == 0 {
+		return nil
+	}
+	_, err := ul.CreateUser(ul.ctx, &User{
+		Uid:       ul.admin.Username,
+		Username:  ul.admin.Username,
+		Roles:     []string{UserRoles.Admin},
+		Bootstrap: true,
+	}, ul.admin.Password)
+	if errors.Is(err, pkg.ErrorEnums.ErrUserExist) {
+		return nil
+	}
+	return err
+}
+
+func (ul *UserLogic) buildUserInfoKey(uid string) string {
+	return fmt.Sprintf("media_storage:%s:user:%s:info", ul.group, uid)
+}
+
+func (ul *UserLogic) buildUserPasswordKey(uid string) string {
+	return fmt.Sprintf("media_storage:%s:user:%s:password", ul.group, uid)
+}
+
+// 用户名到uid的索引，保证用户名唯一
+func (ul *UserLogic) buildUsernameKey(username string) string {
+	return fmt.Sprintf("media_storage:%s:username:%s", ul.group, username)
+}
+
+// CreateUser 创建用户，密码使用 bcrypt 哈希后保存
+func (ul *UserLogic) CreateUser(ctx context.Context, user *User, password string) (*User, error) {
+	if err := CheckNewUser(user, password); err != nil {
+		return nil, err
+	}
+	if len(user.Uid) == 0 {
+		user.Uid = "ui_" + generateRandomString(12)
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		logx.Errorf("UserLogic|CreateUser|HashPassword|username: %s|err: %v", user.Username, err)
+		return nil, err
+	}
+
+	succ, err := ul.userRedis.SetNX(ctx, ul.buildUsernameKey(user.Username), user.Uid, 0).Result()
+	if err != nil {
+		logx.Errorf("UserLogic|CreateUser|SetNX|username: %s|err: %v", user.Username, err)
+		return nil, err
+	}
+	if !succ {
+		return nil, pkg.ErrorEnums.ErrUserExist
+	}
+
+	user.CreatedTs = time.Now().Unix()
+	user.UpdatedTs = user.CreatedTs
+	raw, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	pipe := ul.userRedis.TxPipeline()
+	pipe.Set(ctx, ul.buildUserInfoKey(user.Uid), raw, 0)
+	pipe.Set(ctx, ul.buildUserPasswordKey(user.Uid), hash, 0)
+	if _, err = pipe.Exec(ctx); err != nil {
+		logx.Errorf("UserLogic|CreateUser|Exec|uid: %s|err: %v", user.Uid, err)
+		ul.userRedis.Del(ctx, ul.buildUsernameKey(user.Username))
+		return nil, err
+	}
+	return user, nil
+}
+
+// QueryUser 查询用户信息
+func (ul *UserLogic) QueryUser(ctx context.Context, uid string) (*User, error) {
+	raw, err := ul.userRedis.Get(ctx, ul.buildUserInfoKey(uid)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, pkg.ErrorEnums.ErrUserNotExist
+		}
+		logx.Errorf("UserLogic|QueryUser|Get|uid: %s|err: %v", uid, err)
+		return nil, err
+	}
+	var user User
+	if err = json.Unmarshal(raw, &user); err != nil {
+		logx.Errorf("UserLogic|QueryUser|Unmarshal|uid: %s|err: %v", uid, err)
+		return nil, err
+	}
+	return &user, nil
+}
+
+// QueryUserByName 根据用户名查询用户
+func (ul *UserLogic) QueryUserByName(ctx context.Context, username string) (*User, error) {
+	uid, err := ul.userRedis.Get(ctx, ul.buildUsernameKey(username)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, pkg.ErrorEnums.ErrUserNotExist
+		}
+		logx.Errorf("UserLogic|QueryUserByName|Get|username: %s|err: %v", username, err)
+		return nil, err
+	}
+	return ul.QueryUser(ctx, uid)
+}
+
+// 保存用户信息
+func (ul *UserLogic) saveUser(ctx context.Context, user *User) error {
+	user.UpdatedTs = time.Now().Unix()
+	raw, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if err = ul.userRedis.Set(ctx, ul.buildUserInfoKey(user.Uid), raw, 0).Err(); err != nil {
+		logx.Errorf("UserLogic|saveUser|Set|uid: %s|err: %v", user.Uid, err)
+		return err
+	}
+	return nil
+}
+
+// 校验用户的密码
+func (ul *UserLogic) comparePassword(ctx context.Context, uid, password string) error {
+	hash, err := ul.userRedis.Get(ctx, ul.buildUserPasswordKey(uid)).Bytes()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logx.Errorf("UserLogic|comparePassword|Get|uid: %s|err: %v", uid, err)
+		return err
+	}
+	return ComparePasswordHash(hash, password)
+}
+
+// Authenticate 校验用户名和密码，返回用户信息
+func (ul *UserLogic) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	user, err := ul.QueryUserByName(ctx, username)
+	if err != nil {
+		if errors.Is(err, pkg.ErrorEnums.ErrUserNotExist) {
+			bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+			return nil, pkg.ErrorEnums.ErrPasswordNotMatch
+		}
+		return nil, err
+	}
+	if err = ul.comparePassword(ctx, user.Uid, password); err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, pkg.ErrorEnums.ErrUserDisabled
+	}
+	return user, nil
+}
+
+// SyncExternalUser 创建或者更新外部登录的用户，角色以 IdP 为准，不保存密码，不能使用密码登录
+func (ul *UserLogic) SyncExternalUser(ctx context.Context, user *User) (*User, error) {
+	if !checkUserRoles(user.Roles) {
+		return nil, pkg.ErrorEnums.ErrUserRoleInvalid
+	}
+	exist, err := ul.QueryUser(ctx, user.Uid)
+	if err == nil {
+		if exist.Disabled {
+			return nil, pkg.ErrorEnums.ErrUserDisabled
+		}
+		exist.Roles = user.Roles
+		if err = ul.saveUser(ctx, exist); err != nil {
+			return nil, err
+		}
+		return exist, nil
+	}
+	if !errors.Is(err, pkg.ErrorEnums.ErrUserNotExist) {
+		return nil, err
+	}
+
+	if !usernamePattern.MatchString(user.Username) {
+		return nil, pkg.ErrorEnums.ErrUsernameInvalid
+	}
+	// 用户名已经被其他用户(例如本地用户)占用时改用 uid 作为用户名，不能接管已有的账号
+	succ, err := ul.userRedis.SetNX(ctx, ul.buildUsernameKey(user.Username), user.Uid, 0).Result()
+	if err == nil && !succ && user.Username != user.Uid {
+		logx.Infof("UserLogic|SyncExternalUser|username: %s|uid: %s|username taken, fallback to uid", user.Username, user.Uid)
+		user.Username = user.Uid
+		succ, err = ul.userRedis.SetNX(ctx, ul.buildUsernameKey(user.Username), user.Uid, 0).Result()
+	}
+	if err != nil {
+		logx.Errorf("UserLogic|SyncExternalUser|SetNX|username: %s|err: %v", user.Username, err)
+		return nil, err
+	}
+	if !succ {
+		return nil, pkg.ErrorEnums.ErrUserExist
+	}
+	user.CreatedTs = time.Now().Unix()
+	if err = ul.saveUser(ctx, user); err != nil {
+		ul.userRedis.Del(ctx, ul.buildUsernameKey(user.Username))
+		return nil, err
+	}
+	return user, nil
+}
+
+// ChangePassword 修改密码，oldPassword 为空时不校验旧密码(管理员重置)
+func (ul *UserLogic) ChangePassword(ctx context.Context, uid string, oldPassword *string, newPassword string) error {
+	if err := checkPassword(newPassword); err != nil {
+		return err
+	}
+	user, err := ul.QueryUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if oldPassword != nil {
+		if err = ul.comparePassword(ctx, uid, *oldPassword); err != nil {
+			return err
+		}
+	}
+	hash, err := HashPassword(newPassword)
+	if err != nil {
+		logx.Errorf("UserLogic|ChangePassword|HashPassword|uid: %s|err: %v", uid, err)
+		return err
+	}
+	if err = ul.userRedis.Set(ctx, ul.buildUserPasswordKey(uid), hash, 0).Err(); err != nil {
+		logx.Errorf("UserLogic|ChangePassword|Set|uid: %s|err: %v", uid, err)
+		return err
+	}
+	return ul.saveUser(ctx, user)
+}
+
+// SetUserDisabled 禁用或启用用户，配置文件中的管理员不能被禁用
+func (ul *UserLogic) SetUserDisabled(ctx context.Context, uid string, disabled bool) (*User, error) {
+	user, err := ul.QueryUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if user.Bootstrap && disabled {
+		return nil, pkg.ErrorEnums.ErrBootstrapUser
+	}
+	user.Disabled = disabled
+	return user, ul.saveUser(ctx, user)
+}
+
+// ListUsers 列举所有用户，按创建时间排序
+func (ul *UserLogic) ListUsers(ctx context.Context) ([]*User, error) {
+	users := make([]*User, 0)
+	iter := ul.userRedis.Scan(ctx, 0, ul.buildUserInfoKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		raw, err := ul.userRedis.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			logx.Errorf("UserLogic|ListUsers|Get|key: %s|err: %v", iter.Val(), err)
+			return nil, err
+		}
+		var user User
+		if err = json.Unmarshal(raw, &user); err != nil {
+			logx.Errorf("UserLogic|ListUsers|Unmarshal|key: %s|err: %v", iter.Val(), err)
+			continue
+		}
+		users = append(users, &user)
+	}
+	if err := iter.Err(); err != nil {
+		logx.Errorf("UserLogic|ListUsers|Scan|err: %v", err)
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].CreatedTs != users[j].CreatedTs {
+			return users[i].CreatedTs < users[j].CreatedTs
+		}
+		return users[i].Uid < users[j].Uid
+	})
+	return users, nil
+}
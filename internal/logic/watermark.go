@@ -0,0 +1,245 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"sync"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/Allspark-go/conv"
+	"github.com/dzjyyds666/Allspark-go/logx"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// 水印的位置
+var WatermarkPositions = struct {
+	TopLeft     string
+	TopRight    string
+	BottomLeft  string
+	BottomRight string
+	Center      string
+	Tile        string // 平铺整张图片
+}{
+	TopLeft:     "top_left",
+	TopRight:    "top_right",
+	BottomLeft:  "bottom_left",
+	BottomRight: "bottom_right",
+	Center:      "center",
+	Tile:        "tile",
+}
+
+const (
+	watermarkDefaultOpacity = 0.5
+	watermarkDefaultScale   = 0.25
+	watermarkFontSize       = 64 // 文字先按这个大小渲染再缩放
+	watermarkMaxTextLen     = 128
+)
+
+// Watermark 仓库的水印配置，文字和图片二选一
+type Watermark struct {
+	Text     *string  `json:"text,omitempty" bson:"text,omitempty"`
+	ImageFid *string  `json:"image_fid,omitempty" bson:"image_fid,omitempty"` // 水印图片，同一仓库中的文件
+	Position string   `json:"position,omitempty" bson:"position,omitempty"`
+	Opacity  *float64 `json:"opacity,omitempty" bson:"opacity,omitempty"` // 不透明度 0-1，为空时使用默认值
+	Scale    float64  `json:"scale,omitempty" bson:"scale,omitempty"`     // 水印宽度占图片宽度的比例 0-1
+}
+
+// CheckWatermark 校验水印配置并补全默认值
+func CheckWatermark(wm *Watermark) error {
+	if wm == nil {
+		return nil
+	}
+	text, fid := ptr.ToString(wm.Text), ptr.ToString(wm.ImageFid)
+	if (len(text) == 0) == (len(fid) == 0) || len(text) > watermarkMaxTextLen {
+		return pkg.ErrorEnums.ErrWatermarkInvalid
+	}
+	switch wm.Position {
+	case "":
+		wm.Position = WatermarkPositions.BottomRight
+	case WatermarkPositions.TopLeft, WatermarkPositions.TopRight, WatermarkPositions.BottomLeft,
+		WatermarkPositions.BottomRight, WatermarkPositions.Center, WatermarkPositions.Tile:
+	default:
+		return pkg.ErrorEnums.ErrWatermarkInvalid
+	}
+	if wm.Opacity == nil {
+		wm.Opacity = ptr.Float64(watermarkDefaultOpacity)
+	}
+	if wm.Scale == 0 {
+		wm.Scale = watermarkDefaultScale
+	}
+	if opacity := *wm.Opacity; opacity < 0 || opacity > 1 || wm.Scale < 0 || wm.Scale > 1 {
+		return pkg.ErrorEnums.ErrWatermarkInvalid
+	}
+	return nil
+}
+
+// 水印配置的摘要，配置或者水印图片变化后缓存自动失效
+func (wm *Watermark) key(mark *MediaFileInfo) string {
+	raw := conv.ToJsonWithoutError(wm)
+	if mark != nil {
+		raw += mark.ContentVersion()
+	}
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:6])
+}
+
+// 只解析一次字体，Face 不能并发使用，每次渲染单独创建
+var watermarkFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(goregular.TTF)
+})
+
+// 把文字渲染为带阴影的白色透明图片
+func renderWatermarkText(text string) (image.Image, error) {
+	f, err := watermarkFont()
+	if err != nil {
+		return nil, err
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: watermarkFontSize, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	const pad = 4
+	metrics := face.Metrics()
+	w := font.MeasureString(face, text).Ceil() + pad*2
+	h := (metrics.Ascent + metrics.Descent).Ceil() + pad*2
+	img := image.NewRGBA(image.Rect(0, 0, max(1, w), h))
+	d := &font.Drawer{Dst: img, Face: face}
+	// 先画阴影，浅色背景上也能看清
+	d.Src = image.NewUniform(color.RGBA{A: 160})
+	d.Dot = fixed.Point26_6{X: fixed.I(pad + 2), Y: fixed.I(pad+2) + metrics.Ascent}
+	d.DrawString(text)
+	d.Src = image.White
+	d.Dot = fixed.Point26_6{X: fixed.I(pad), Y: fixed.I(pad) + metrics.Ascent}
+	d.DrawString(text)
+	return img, nil
+}
+
+// ApplyWatermark 把水印按配置叠加到图片上
+func ApplyWatermark(src image.Image, mark image.Image, wm *Watermark) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+
+	// 按比例缩放水印
+	mw, mh := mark.Bounds().Dx(), mark.Bounds().Dy()
+	tw := max(1, int(float64(b.Dx())*wm.Scale))
+	th := max(1, mh*tw/max(1, mw))
+	scaled := image.NewRGBA(image.Rect(0, 0, tw, th))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), mark, mark.Bounds(), draw.Src, nil)
+	mask := image.NewUniform(color.Alpha{A: uint8(ptr.ToFloat64(wm.Opacity) * 255)})
+
+	margin := min(b.Dx(), b.Dy()) / 40
+	dw, dh := dst.Bounds().Dx(), dst.Bounds().Dy()
+	var points []image.Point
+	switch wm.Position {
+	case WatermarkPositions.TopLeft:
+		points = append(points, image.Pt(margin, margin))
+	case WatermarkPositions.TopRight:
+		points = append(points, image.Pt(dw-tw-margin, margin))
+	case WatermarkPositions.BottomLeft:
+		points = append(points, image.Pt(margin, dh-th-margin))
+	case WatermarkPositions.Center:
+		points = append(points, image.Pt((dw-tw)/2, (dh-th)/2))
+	case WatermarkPositions.Tile:
+		// 水印之间留出一个水印大小的间隔，隔行错开
+		for row, y := 0, 0; y < dh; row, y = row+1, y+th*2 {
+			for x := (row % 2) * tw; x < dw; x += tw * 2 {
+				points = append(points, image.Pt(x, y))
+			}
+		}
+	default:
+		points = append(points, image.Pt(dw-tw-margin, dh-th-margin))
+	}
+	for _, p := range points {
+		draw.DrawMask(dst, image.Rectangle{Min: p, Max: p.Add(image.Pt(tw, th))}, scaled, image.Point{}, mask, image.Point{}, draw.Over)
+	}
+	return dst
+}
+
+// 加载水印图片或者渲染水印文字
+func (il *ImageLogic) loadWatermark(ctx context.Context, wm *Watermark, mark *MediaFileInfo) (image.Image, error) {
+	if mark == nil {
+		return renderWatermarkText(ptr.ToString(wm.Text))
+	}
+	return il.decodeSource(ctx, mark)
+}
+
+// OpenWatermarked 获取加了水印的图片，t 为空时按原图尺寸和格式输出，结果缓存到存储
+func (il *ImageLogic) OpenWatermarked(ctx context.Context, info *MediaFileInfo, t *ImageTransform, wm *Watermark) (io.ReadCloser, string, error) {
+	if !IsImage(info) {
+		return nil, "", pkg.ErrorEnums.ErrNotImage
+	}
+	if t == nil {
+		t = &ImageTransform{}
+		if err := t.normalize(); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(t.Format) == 0 {
+		t.Format = defaultImageFormat(ptr.ToString(info.ContentType))
+	}
+
+	var mark *MediaFileInfo
+	if fid := ptr.ToString(wm.ImageFid); len(fid) > 0 {
+		var err error
+		if mark, err = il.fileServ.QueryFileInfo(ctx, info.GetDepotId(), fid); err != nil {
+			logx.Errorf("ImageLogic|OpenWatermarked|QueryFileInfo|watermark: %s|err: %v", fid, err)
+			return nil, "", err
+		}
+	}
+
+	name := "wm_" + wm.key(mark) + "_" + t.Key()
+	cached, err := il.fileServ.OpenVariant(ctx, info, name)
+	if err == nil {
+		return cached, t.ContentType(), nil
+	}
+	if !errors.Is(err, pkg.ErrorEnums.ErrFileNotExist) {
+		logx.Errorf("ImageLogic|OpenWatermarked|OpenVariant|fid: %s|variant: %s|err: %v", info.Fid, name, err)
+	}
+
+	src, err := il.decodeSource(ctx, info)
+	if err != nil {
+		return nil, "", err
+	}
+	markImg, err := il.loadWatermark(ctx, wm, mark)
+	if err != nil {
+		logx.Errorf("ImageLogic|OpenWatermarked|loadWatermark|fid: %s|err: %v", info.Fid, err)
+		return nil, "", err
+	}
+	data, err := EncodeImage(ApplyWatermark(ResizeImage(src, t), markImg, wm), t)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = il.fileServ.SaveVariant(ctx, info, name, data, t.ContentType()); err != nil {
+		// 缓存失败不影响本次返回
+		logx.Errorf("ImageLogic|OpenWatermarked|SaveVariant|fid: %s|variant: %s|err: %v", info.Fid, name, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), t.ContentType(), nil
+}
+
+// VariantTransform 查询预设衍生图的处理参数
+func (il *ImageLogic) VariantTransform(ctx context.Context, info *MediaFileInfo, name string) (*ImageTransform, error) {
+	presets, err := il.queryPresets(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	preset, ok := presets[name]
+	if !ok {
+		return nil, pkg.ErrorEnums.ErrVariantNotExist
+	}
+	t := *preset
+	return &t, nil
+}
@@ -1,6 +1,6 @@
 package locale
 
-var V = "{\"code_for_bad_request.en-us\":\"bad request\",\"code_for_bad_request.zh-cn\":\"错误请求\",\"code_for_box_not_exists.en-us\":\"box not exists\",\"code_for_box_not_exists.zh-cn\":\"box不存在\",\"code_for_file_exists.en-us\":\"file exists\",\"code_for_file_exists.zh-cn\":\"文件已存在\",\"code_for_file_no_prepare_info.en-us\":\"file no prepare info\",\"code_for_file_no_prepare_info.zh-cn\":\"文件未初始化上传\",\"code_for_file_not_exists.en-us\":\"file not exists\",\"code_for_file_not_exists.zh-cn\":\"文件不存在\",\"code_for_internal_error.en-us\":\"internal error\",\"code_for_internal_error.zh-cn\":\"服务器内部错误\",\"code_for_permission_deny.en-us\":\"permission deny\",\"code_for_permission_deny.zh-cn\":\"权限不足\"}"
+var V = "{\"code_for_access_key_not_exists.en-us\":\"access key not exists\",\"code_for_access_key_not_exists.zh-cn\":\"访问密钥不存在\",\"code_for_bad_request.en-us\":\"bad request\",\"code_for_bad_request.zh-cn\":\"错误请求\",\"code_for_box_not_exists.en-us\":\"box not exists\",\"code_for_box_not_exists.zh-cn\":\"box不存在\",\"code_for_download_too_large.en-us\":\"download content too large\",\"code_for_download_too_large.zh-cn\":\"下载的内容过大\",\"code_for_file_exists.en-us\":\"file exists\",\"code_for_file_exists.zh-cn\":\"文件已存在\",\"code_for_file_infected.en-us\":\"file infected\",\"code_for_file_infected.zh-cn\":\"文件含有病毒\",\"code_for_file_no_prepare_info.en-us\":\"file no prepare info\",\"code_for_file_no_prepare_info.zh-cn\":\"文件未初始化上传\",\"code_for_file_not_exists.en-us\":\"file not exists\",\"code_for_file_not_exists.zh-cn\":\"文件不存在\",\"code_for_file_scan_pending.en-us\":\"file is waiting for virus scan\",\"code_for_file_scan_pending.zh-cn\":\"文件等待病毒扫描\",\"code_for_file_type_not_allowed.en-us\":\"file type not allowed\",\"code_for_file_type_not_allowed.zh-cn\":\"文件类型不允许上传\",\"code_for_internal_error.en-us\":\"internal error\",\"code_for_internal_error.zh-cn\":\"服务器内部错误\",\"code_for_job_finished.en-us\":\"job already finished\",\"code_for_job_finished.zh-cn\":\"任务已经结束\",\"code_for_job_not_exists.en-us\":\"job not exists\",\"code_for_job_not_exists.zh-cn\":\"任务不存在\",\"code_for_oidc_login_failed.en-us\":\"single sign-on failed, please try again\",\"code_for_oidc_login_failed.zh-cn\":\"单点登录失败，请重试\",\"code_for_password_not_match.en-us\":\"username or password not match\",\"code_for_password_not_match.zh-cn\":\"用户名或密码错误\",\"code_for_permission_deny.en-us\":\"permission deny\",\"code_for_permission_deny.zh-cn\":\"权限不足\",\"code_for_share_exhausted.en-us\":\"share download limit reached\",\"code_for_share_exhausted.zh-cn\":\"分享链接下载次数已用完\",\"code_for_share_not_exists.en-us\":\"share not exists or expired\",\"code_for_share_not_exists.zh-cn\":\"分享链接不存在或已过期\",\"code_for_share_password_not_match.en-us\":\"share password required or not match\",\"code_for_share_password_not_match.zh-cn\":\"分享密码错误\",\"code_for_signature_expired.en-us\":\"request signature expired\",\"code_for_signature_expired.zh-cn\":\"请求签名已过期\",\"code_for_signature_invalid.en-us\":\"request signature invalid\",\"code_for_signature_invalid.zh-cn\":\"请求签名无效\",\"code_for_token_invalid.en-us\":\"token invalid or expired\",\"code_for_token_invalid.zh-cn\":\"令牌无效或已过期\",\"code_for_token_revoked.en-us\":\"token revoked\",\"code_for_token_revoked.zh-cn\":\"令牌已被吊销\",\"code_for_too_many_requests.en-us\":\"too many requests\",\"code_for_too_many_requests.zh-cn\":\"请求过于频繁\",\"code_for_user_disabled.en-us\":\"user disabled\",\"code_for_user_disabled.zh-cn\":\"用户已被禁用\",\"code_for_user_exists.en-us\":\"user exists\",\"code_for_user_exists.zh-cn\":\"用户已存在\",\"code_for_user_not_exists.en-us\":\"user not exists\",\"code_for_user_not_exists.zh-cn\":\"用户不存在\"}"
 
 var K = struct {
 	CODE_FOR_PERMISSION_DENY string
@@ -10,6 +10,26 @@ var K = struct {
 	CODE_FOR_BOX_NOT_EXISTS string
 	CODE_FOR_BAD_REQUEST string
 	CODE_FOR_INTERNAL_ERROR string
+	CODE_FOR_JOB_NOT_EXISTS string
+	CODE_FOR_FILE_TYPE_NOT_ALLOWED string
+	CODE_FOR_FILE_SCAN_PENDING string
+	CODE_FOR_FILE_INFECTED string
+	CODE_FOR_USER_EXISTS string
+	CODE_FOR_USER_NOT_EXISTS string
+	CODE_FOR_USER_DISABLED string
+	CODE_FOR_PASSWORD_NOT_MATCH string
+	CODE_FOR_ACCESS_KEY_NOT_EXISTS string
+	CODE_FOR_SIGNATURE_INVALID string
+	CODE_FOR_SIGNATURE_EXPIRED string
+	CODE_FOR_TOKEN_INVALID string
+	CODE_FOR_TOKEN_REVOKED string
+	CODE_FOR_SHARE_NOT_EXISTS string
+	CODE_FOR_SHARE_PASSWORD_NOT_MATCH string
+	CODE_FOR_SHARE_EXHAUSTED string
+	CODE_FOR_TOO_MANY_REQUESTS string
+	CODE_FOR_OIDC_LOGIN_FAILED string
+	CODE_FOR_JOB_FINISHED string
+	CODE_FOR_DOWNLOAD_TOO_LARGE string
 } {
 	CODE_FOR_FILE_NOT_EXISTS: "code_for_file_not_exists",
 	CODE_FOR_FILE_NO_PREPARE_INFO: "code_for_file_no_prepare_info",
@@ -18,4 +38,24 @@ var K = struct {
 	CODE_FOR_INTERNAL_ERROR: "code_for_internal_error",
 	CODE_FOR_PERMISSION_DENY: "code_for_permission_deny",
 	CODE_FOR_FILE_EXISTS: "code_for_file_exists",
+	CODE_FOR_JOB_NOT_EXISTS: "code_for_job_not_exists",
+	CODE_FOR_FILE_TYPE_NOT_ALLOWED: "code_for_file_type_not_allowed",
+	CODE_FOR_FILE_SCAN_PENDING: "code_for_file_scan_pending",
+	CODE_FOR_FILE_INFECTED: "code_for_file_infected",
+	CODE_FOR_USER_EXISTS: "code_for_user_exists",
+	CODE_FOR_USER_NOT_EXISTS: "code_for_user_not_exists",
+	CODE_FOR_USER_DISABLED: "code_for_user_disabled",
+	CODE_FOR_PASSWORD_NOT_MATCH: "code_for_password_not_match",
+	CODE_FOR_ACCESS_KEY_NOT_EXISTS: "code_for_access_key_not_exists",
+	CODE_FOR_SIGNATURE_INVALID: "code_for_signature_invalid",
+	CODE_FOR_SIGNATURE_EXPIRED: "code_for_signature_expired",
+	CODE_FOR_TOKEN_INVALID: "code_for_token_invalid",
+	CODE_FOR_TOKEN_REVOKED: "code_for_token_revoked",
+	CODE_FOR_SHARE_NOT_EXISTS: "code_for_share_not_exists",
+	CODE_FOR_SHARE_PASSWORD_NOT_MATCH: "code_for_share_password_not_match",
+	CODE_FOR_SHARE_EXHAUSTED: "code_for_share_exhausted",
+	CODE_FOR_TOO_MANY_REQUESTS: "code_for_too_many_requests",
+	CODE_FOR_OIDC_LOGIN_FAILED: "code_for_oidc_login_failed",
+	CODE_FOR_JOB_FINISHED: "code_for_job_finished",
+	CODE_FOR_DOWNLOAD_TOO_LARGE: "code_for_download_too_large",
 }
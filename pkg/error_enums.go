@@ -9,10 +9,79 @@ var ErrorEnums = struct {
 	ErrNoPrepareFileInfo     error
 	ErrFileNotExist          error
 	ErrFileExist             error
+	ErrFileTypeNotAllowed    error
+	ErrFileScanPending       error
+	ErrFileInfected          error
+	ErrScannerNotSupport     error
+	ErrScannerNotEnabled     error
+	ErrScanQueueFull         error
+	ErrFileBoxNotMatch       error
+	ErrListCursorInvalid     error
 
 	ErrBoxNotExist error
 
-	ErrDepotNotExist error
+	ErrUserExist         error
+	ErrUserNotExist      error
+	ErrUserDisabled      error
+	ErrUsernameInvalid   error
+	ErrUserRoleInvalid   error
+	ErrPasswordTooWeak   error
+	ErrPasswordNotMatch  error
+	ErrBootstrapUser     error
+	ErrAccessRoleInvalid error
+	ErrSessionNotExist   error
+	ErrTokenInvalid      error
+	ErrTokenRevoked      error
+	ErrOidcNotEnabled    error
+	ErrOidcStateInvalid  error
+	ErrOidcTokenInvalid  error
+	ErrOidcNoRole        error
+
+	ErrAccessKeyNotExist     error
+	ErrAccessKeyExpired      error
+	ErrAccessKeyScopeInvalid error
+	ErrSignatureInvalid      error
+	ErrSignatureExpired      error
+	ErrSignatureReplayed     error
+	ErrPayloadNotSigned      error
+	ErrUrlSignExpireInvalid  error
+
+	ErrShareNotExist         error
+	ErrShareInvalid          error
+	ErrShareForbidden        error
+	ErrSharePasswordNotMatch error
+	ErrShareExhausted        error
+
+	ErrDepotNotExist     error
+	ErrSSECKeyNotExist   error
+	ErrSSEModeNotSupport error
+	ErrPresignNotAllowed error
+
+	ErrCompressionNotSupport     error
+	ErrMetadataStripNotSupport   error
+	ErrReconcileActionNotSupport error
+
+	ErrJobNotExist      error
+	ErrJobCanceled      error
+	ErrJobFinished      error
+	ErrFetchUrlInvalid  error
+	ErrFetchTooLarge    error
+	ErrFetchAddrBlocked error
+
+	ErrArchiveNotSupport     error
+	ErrArchiveTooManyEntries error
+	ErrArchiveTooLarge       error
+	ErrArchivePathInvalid    error
+	ErrDownloadTooLarge      error
+
+	ErrNotImage              error
+	ErrImageTooLarge         error
+	ErrImageTransformInvalid error
+	ErrVariantNotExist       error
+	ErrImageHashNotReady     error
+	ErrWatermarkInvalid      error
+
+	ErrRateLimitInvalid error
 }{
 	ErrFileNameCanNotBeEmpty: errors.New("file name can not be empty"),
 	ErrFileSizeCanNotBeZero:  errors.New("file size can not be zero"),
@@ -20,8 +89,77 @@ var ErrorEnums = struct {
 	ErrNoPrepareFileInfo:     errors.New("no prepare file info"),
 	ErrFileNotExist:          errors.New("file not exist"),
 	ErrFileExist:             errors.New("file exist"),
+	ErrFileTypeNotAllowed:    errors.New("file type not allowed"),
+	ErrFileScanPending:       errors.New("file scan pending"),
+	ErrFileInfected:          errors.New("file infected"),
+	ErrScannerNotSupport:     errors.New("scanner not support"),
+	ErrScannerNotEnabled:     errors.New("scanner not enabled"),
+	ErrScanQueueFull:         errors.New("scan queue full"),
+	ErrFileBoxNotMatch:       errors.New("file box not match"),
+	ErrListCursorInvalid:     errors.New("list cursor invalid"),
 
 	ErrBoxNotExist: errors.New("box not exist"),
 
-	ErrDepotNotExist: errors.New("depot not exist"),
+	ErrUserExist:         errors.New("user exist"),
+	ErrUserNotExist:      errors.New("user not exist"),
+	ErrUserDisabled:      errors.New("user disabled"),
+	ErrUsernameInvalid:   errors.New("username invalid"),
+	ErrUserRoleInvalid:   errors.New("user role invalid"),
+	ErrPasswordTooWeak:   errors.New("password must be 8 to 72 characters"),
+	ErrPasswordNotMatch:  errors.New("username or password not match"),
+	ErrBootstrapUser:     errors.New("bootstrap admin can not be disabled"),
+	ErrAccessRoleInvalid: errors.New("access role invalid"),
+	ErrSessionNotExist:   errors.New("session not exist"),
+	ErrTokenInvalid:      errors.New("token invalid"),
+	ErrTokenRevoked:      errors.New("token revoked"),
+	ErrOidcNotEnabled:    errors.New("oidc login not enabled"),
+	ErrOidcStateInvalid:  errors.New("oidc state invalid or expired"),
+	ErrOidcTokenInvalid:  errors.New("oidc id token invalid"),
+	ErrOidcNoRole:        errors.New("oidc user has no mapped role"),
+
+	ErrAccessKeyNotExist:     errors.New("access key not exist"),
+	ErrAccessKeyExpired:      errors.New("access key expired"),
+	ErrAccessKeyScopeInvalid: errors.New("access key scope invalid"),
+	ErrSignatureInvalid:      errors.New("request signature invalid"),
+	ErrSignatureExpired:      errors.New("request signature expired"),
+	ErrSignatureReplayed:     errors.New("request signature replayed"),
+	ErrPayloadNotSigned:      errors.New("request payload not signed"),
+	ErrUrlSignExpireInvalid:  errors.New("signed url expire invalid"),
+
+	ErrShareNotExist:         errors.New("share not exist"),
+	ErrShareInvalid:          errors.New("share invalid"),
+	ErrShareForbidden:        errors.New("share access forbidden"),
+	ErrSharePasswordNotMatch: errors.New("share password not match"),
+	ErrShareExhausted:        errors.New("share download limit reached"),
+
+	ErrDepotNotExist:     errors.New("depot not exist"),
+	ErrSSECKeyNotExist:   errors.New("sse-c key not exist"),
+	ErrSSEModeNotSupport: errors.New("sse mode not support"),
+	ErrPresignNotAllowed: errors.New("presign not allowed"),
+
+	ErrCompressionNotSupport:     errors.New("compression not support"),
+	ErrMetadataStripNotSupport:   errors.New("metadata strip mode not support"),
+	ErrReconcileActionNotSupport: errors.New("reconcile action not support"),
+
+	ErrJobNotExist:      errors.New("job not exist"),
+	ErrJobCanceled:      errors.New("job canceled"),
+	ErrJobFinished:      errors.New("job already finished"),
+	ErrFetchUrlInvalid:  errors.New("fetch url invalid"),
+	ErrFetchTooLarge:    errors.New("fetch content too large"),
+	ErrFetchAddrBlocked: errors.New("fetch address blocked"),
+
+	ErrArchiveNotSupport:     errors.New("archive format not support"),
+	ErrArchiveTooManyEntries: errors.New("archive has too many entries"),
+	ErrArchiveTooLarge:       errors.New("archive expanded size too large"),
+	ErrArchivePathInvalid:    errors.New("archive entry path invalid"),
+	ErrDownloadTooLarge:      errors.New("download content too large"),
+
+	ErrNotImage:              errors.New("file is not an image"),
+	ErrImageTooLarge:         errors.New("image too large"),
+	ErrImageTransformInvalid: errors.New("image transform invalid"),
+	ErrVariantNotExist:       errors.New("variant not exist"),
+	ErrImageHashNotReady:     errors.New("image hash not ready"),
+	ErrWatermarkInvalid:      errors.New("watermark invalid"),
+
+	ErrRateLimitInvalid: errors.New("rate limit invalid"),
 }
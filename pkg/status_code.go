@@ -6,24 +6,72 @@ import (
 )
 
 var SubStatusCodes = struct {
-	BadRequest     vortex.SubCode // 400 错误请求
-	InternalError  vortex.SubCode // 500 服务器内部错误
-	PermissionDeny vortex.SubCode // 403 权限不足
+	BadRequest      vortex.SubCode // 400 错误请求
+	InternalError   vortex.SubCode // 500 服务器内部错误
+	PermissionDeny  vortex.SubCode // 403 权限不足
+	TooManyRequests vortex.SubCode // 429 请求过于频繁
 
 	FileExist         vortex.SubCode // 20001
 	FileNotExist      vortex.SubCode // 20404
 	NoPrepareFileInfo vortex.SubCode // 20002
+	FileTypeNotAllow  vortex.SubCode // 20003
+	FileScanPending   vortex.SubCode // 20004
+	FileInfected      vortex.SubCode // 20005
+	DownloadTooLarge  vortex.SubCode // 20006
 
 	BoxNotExist vortex.SubCode // 30404
+
+	JobNotExist vortex.SubCode // 40404
+	JobFinished vortex.SubCode // 40001
+
+	UserExist        vortex.SubCode // 50001
+	UserNotExist     vortex.SubCode // 50404
+	UserDisabled     vortex.SubCode // 50002
+	PasswordNotMatch vortex.SubCode // 50003
+	TokenInvalid     vortex.SubCode // 50004
+	TokenRevoked     vortex.SubCode // 50005
+	OidcLoginFailed  vortex.SubCode // 50006
+
+	AccessKeyNotExist vortex.SubCode // 60404
+	SignatureInvalid  vortex.SubCode // 60001
+	SignatureExpired  vortex.SubCode // 60002
+
+	ShareNotExist         vortex.SubCode // 70404
+	SharePasswordNotMatch vortex.SubCode // 70001
+	ShareExhausted        vortex.SubCode // 70002
 }{
 
-	BadRequest:     vortex.SubCode{SubCode: 400, I18nKey: locale.K.CODE_FOR_BAD_REQUEST},
-	InternalError:  vortex.SubCode{SubCode: 500, I18nKey: locale.K.CODE_FOR_INTERNAL_ERROR},
-	PermissionDeny: vortex.SubCode{SubCode: 403, I18nKey: locale.K.CODE_FOR_PERMISSION_DENY},
+	BadRequest:      vortex.SubCode{SubCode: 400, I18nKey: locale.K.CODE_FOR_BAD_REQUEST},
+	InternalError:   vortex.SubCode{SubCode: 500, I18nKey: locale.K.CODE_FOR_INTERNAL_ERROR},
+	PermissionDeny:  vortex.SubCode{SubCode: 403, I18nKey: locale.K.CODE_FOR_PERMISSION_DENY},
+	TooManyRequests: vortex.SubCode{SubCode: 429, I18nKey: locale.K.CODE_FOR_TOO_MANY_REQUESTS},
 
 	FileExist:         vortex.SubCode{SubCode: 20001, I18nKey: locale.K.CODE_FOR_FILE_EXISTS},
 	FileNotExist:      vortex.SubCode{SubCode: 20404, I18nKey: locale.K.CODE_FOR_FILE_NOT_EXISTS},
 	NoPrepareFileInfo: vortex.SubCode{SubCode: 20002, I18nKey: locale.K.CODE_FOR_FILE_NO_PREPARE_INFO},
+	FileTypeNotAllow:  vortex.SubCode{SubCode: 20003, I18nKey: locale.K.CODE_FOR_FILE_TYPE_NOT_ALLOWED},
+	FileScanPending:   vortex.SubCode{SubCode: 20004, I18nKey: locale.K.CODE_FOR_FILE_SCAN_PENDING},
+	FileInfected:      vortex.SubCode{SubCode: 20005, I18nKey: locale.K.CODE_FOR_FILE_INFECTED},
+	DownloadTooLarge:  vortex.SubCode{SubCode: 20006, I18nKey: locale.K.CODE_FOR_DOWNLOAD_TOO_LARGE},
 
 	BoxNotExist: vortex.SubCode{SubCode: 30404, I18nKey: locale.K.CODE_FOR_BOX_NOT_EXISTS},
+
+	JobNotExist: vortex.SubCode{SubCode: 40404, I18nKey: locale.K.CODE_FOR_JOB_NOT_EXISTS},
+	JobFinished: vortex.SubCode{SubCode: 40001, I18nKey: locale.K.CODE_FOR_JOB_FINISHED},
+
+	UserExist:        vortex.SubCode{SubCode: 50001, I18nKey: locale.K.CODE_FOR_USER_EXISTS},
+	UserNotExist:     vortex.SubCode{SubCode: 50404, I18nKey: locale.K.CODE_FOR_USER_NOT_EXISTS},
+	UserDisabled:     vortex.SubCode{SubCode: 50002, I18nKey: locale.K.CODE_FOR_USER_DISABLED},
+	PasswordNotMatch: vortex.SubCode{SubCode: 50003, I18nKey: locale.K.CODE_FOR_PASSWORD_NOT_MATCH},
+	TokenInvalid:     vortex.SubCode{SubCode: 50004, I18nKey: locale.K.CODE_FOR_TOKEN_INVALID},
+	TokenRevoked:     vortex.SubCode{SubCode: 50005, I18nKey: locale.K.CODE_FOR_TOKEN_REVOKED},
+	OidcLoginFailed:  vortex.SubCode{SubCode: 50006, I18nKey: locale.K.CODE_FOR_OIDC_LOGIN_FAILED},
+
+	AccessKeyNotExist: vortex.SubCode{SubCode: 60404, I18nKey: locale.K.CODE_FOR_ACCESS_KEY_NOT_EXISTS},
+	SignatureInvalid:  vortex.SubCode{SubCode: 60001, I18nKey: locale.K.CODE_FOR_SIGNATURE_INVALID},
+	SignatureExpired:  vortex.SubCode{SubCode: 60002, I18nKey: locale.K.CODE_FOR_SIGNATURE_EXPIRED},
+
+	ShareNotExist:         vortex.SubCode{SubCode: 70404, I18nKey: locale.K.CODE_FOR_SHARE_NOT_EXISTS},
+	SharePasswordNotMatch: vortex.SubCode{SubCode: 70001, I18nKey: locale.K.CODE_FOR_SHARE_PASSWORD_NOT_MATCH},
+	ShareExhausted:        vortex.SubCode{SubCode: 70002, I18nKey: locale.K.CODE_FOR_SHARE_EXHAUSTED},
 }
@@ -4,19 +4,94 @@ import (
 	"net/http"
 
 	"github.com/dzjyyds666/mediaStorage/internal/handler"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
 	"github.com/dzjyyds666/vortex/v2"
 )
 
-func PrepareRouters(login *handler.LoginHandler, file *handler.FileHandler, box *handler.BoxHandler, depot *handler.DepotHandler) []*vortex.VortexHttpRouter {
+func PrepareRouters(limit *handler.RateLimitHandler, audit *handler.AuditHandler, login *handler.LoginHandler, user *handler.UserHandler, accessKey *handler.AccessKeyHandler, access *handler.AccessHandler, file *handler.FileHandler, box *handler.BoxHandler, depot *handler.DepotHandler, reconcile *handler.ReconcileHandler, job *handler.JobHandler) []*vortex.VortexHttpRouter {
+	// 所有接口都经过限流，匿名接口按ip限流
+	limited := limit.Limit
+	// 登录后的接口都需要校验 token 是否已经被吊销
+	authed := func(h func(*vortex.Context) error) func(*vortex.Context) error {
+		return login.CheckToken(limit.Limit(h))
+	}
+	// 文件相关的接口同时支持使用密钥签名访问
+	signed := func(h func(*vortex.Context) error) func(*vortex.Context) error {
+		return accessKey.VerifySignature(login.CheckToken(limit.Limit(h)))
+	}
+	// 流式上传的接口允许不对请求体签名
+	streamed := func(h func(*vortex.Context) error) func(*vortex.Context) error {
+		return accessKey.VerifyStreamSignature(login.CheckToken(limit.Limit(h)))
+	}
+	// 管理接口只接受控制台 token，用户、授权、仓库的管理和任务列表只在 /admin 下提供
+	console := func(h func(*vortex.Context) error) func(*vortex.Context) error {
+		return login.CheckConsoleToken(limit.Limit(h))
+	}
+	// 数据和管理操作都记录审计日志，只读的查询接口不记录
 	return []*vortex.VortexHttpRouter{
-		vortex.AppendHttpRouter([]string{http.MethodPost}, "/login", login.HandleLogin, "登录接口"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/login", limited(audit.Record(logic.AuditActions.Login, login.HandleLogin)), "登录接口"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/refresh", limited(login.HandleRefresh), "刷新token"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/console/oidc/login", limited(login.HandleOidcLogin), "控制台单点登录"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/console/oidc/callback", limited(audit.Record(logic.AuditActions.Login, login.HandleOidcCallback)), "控制台单点登录回调"),
+		vortex.AppendHttpRouter([]string{http.MethodGet, http.MethodHead}, "/share/:token", limited(audit.Record(logic.AuditActions.ShareAccess, file.HandleShare)), "通过分享链接访问"),
+		vortex.AppendHttpRouter([]string{http.MethodGet, http.MethodHead}, "/share/:token/:fid", limited(audit.Record(logic.AuditActions.ShareAccess, file.HandleShareFile)), "通过分享链接访问box中的文件"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/logout", authed(audit.Record(logic.AuditActions.Logout, login.HandleLogout)), "注销登录"),
+
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/accesskey/create", authed(audit.Record(logic.AuditActions.AccessKeyCreate, accessKey.HandleCreate)), "创建访问密钥"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/media/accesskey/list", authed(accessKey.HandleList), "列举访问密钥"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/accesskey/rotate/:access_key_id", authed(audit.Record(logic.AuditActions.AccessKeyRotate, accessKey.HandleRotate)), "轮换访问密钥"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/accesskey/delete/:access_key_id", authed(audit.Record(logic.AuditActions.AccessKeyDelete, accessKey.HandleDelete)), "删除访问密钥"),
+
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/media/access/effective", signed(access.HandleEffectivePermissions), "查询最终权限"),
+
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/box/create", signed(audit.Record(logic.AuditActions.BoxCreate, box.HandleBoxCreate)), "创建 box"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/media/box/info/:box_id", signed(box.HandleBoxInfo), "查看 box 信息"),
+
+		vortex.AppendHttpRouter([]string{http.MethodPost, http.MethodGet, http.MethodHead}, "/media/file/:fid", signed(audit.Record(logic.AuditActions.Read, file.HandleFile)), "查看文件"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/file/sign", signed(audit.Record(logic.AuditActions.SignUrl, file.HandleSignUrl)), "签发文件访问url"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/media/file/info/:fid", signed(file.HandleFileInfo), "查看文件"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/media/file/list/:box_id", signed(file.HandleFileList), "列举 box 下的文件"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/file/delete/:fid", signed(audit.Record(logic.AuditActions.Delete, file.HandleFileDelete)), "删除文件"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/media/file/similar/:fid", signed(file.HandleSimilarImages), "查找相似图片"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/file/duplicates", signed(file.HandleDuplicateReport), "创建仓库重复图片报告任务"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/download/zip", signed(audit.Record(logic.AuditActions.Download, file.HandleZipDownload)), "打包下载"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/upload/apply", signed(audit.Record(logic.AuditActions.Apply, file.HandleApplyUpload)), "申请上传"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/upload/single/:fid", streamed(audit.Record(logic.AuditActions.Upload, file.HandleSingleUpload)), "单文件上传"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/upload/fetch", signed(audit.Record(logic.AuditActions.Fetch, file.HandleFetchUpload)), "从url拉取上传"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/share/create", signed(audit.Record(logic.AuditActions.ShareCreate, file.HandleShareCreate)), "创建分享链接"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/media/share/list", signed(file.HandleShareList), "列举分享链接"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/share/revoke/:token", signed(audit.Record(logic.AuditActions.ShareRevoke, file.HandleShareRevoke)), "撤销分享链接"),
+		// 拉取上传、解压和重复图片报告返回的任务，创建者可以查看进度和取消
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/media/job/:job_id", signed(job.HandleJobInfo), "查看任务"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/job/cancel/:job_id", signed(audit.Record(logic.AuditActions.JobCancel, job.HandleJobCancel)), "取消任务"),
+
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/login", limited(audit.Record(logic.AuditActions.Login, login.HandleConsoleLogin)), "控制台登录"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/logout", console(audit.Record(logic.AuditActions.Logout, login.HandleConsoleLogout)), "控制台注销登录"),
+
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/depot/list", console(depot.HandleDepotList), "列举仓库"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/depot/create", console(audit.Record(logic.AuditActions.DepotCreate, depot.HandleDeportCreate)), "创建仓库"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/depot/update/:depot_id", console(audit.Record(logic.AuditActions.DepotUpdate, depot.HandleDepotUpdate)), "修改仓库配置"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/depot/usage/:depot_id", console(depot.HandleDepotUsage), "仓库用量统计"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/box/list", console(box.HandleBoxList), "列举仓库下的 box"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/box/create", console(audit.Record(logic.AuditActions.BoxCreate, box.HandleBoxCreate)), "创建 box"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/box/info/:box_id", console(box.HandleBoxInfo), "查看 box 信息"),
 
-		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/deport/create", depot.HandleDeportCreate, "创建 depot"),
-		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/box/create", box.HandleBoxCreate, "创建 box"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/user/list", console(user.HandleUserList), "列举用户"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/user/create", console(audit.Record(logic.AuditActions.UserCreate, user.HandleUserCreate)), "创建用户"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/user/disable/:uid", console(audit.Record(logic.AuditActions.UserDisable, user.HandleUserDisable)), "禁用用户"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/user/enable/:uid", console(audit.Record(logic.AuditActions.UserEnable, user.HandleUserEnable)), "启用用户"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/user/password", console(audit.Record(logic.AuditActions.PasswordChange, user.HandleChangePassword)), "修改密码"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/user/sessions/revoke/:uid", console(audit.Record(logic.AuditActions.SessionRevoke, user.HandleRevokeSessions)), "吊销用户的所有会话"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/access/grant", console(audit.Record(logic.AuditActions.Grant, access.HandleGrant)), "授予角色"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/access/revoke", console(audit.Record(logic.AuditActions.Revoke, access.HandleRevoke)), "撤销角色"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/access/grants", console(access.HandleListGrants), "列举授权"),
 
-		vortex.AppendHttpRouter([]string{http.MethodPost, http.MethodGet, http.MethodHead}, "/media/file/:fid", file.HandleFile, "查看文件"),
-		vortex.AppendHttpRouter([]string{http.MethodGet}, "/media/file/info/:fid", file.HandleFileInfo, "查看文件"),
-		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/upload/apply", file.HandleApplyUpload, "申请上传"),
-		vortex.AppendHttpRouter([]string{http.MethodPost}, "/media/upload/single/:fid", file.HandleSingleUpload, "单文件上传"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/audit", console(audit.HandleAuditQuery), "查询审计日志"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/audit/export", console(audit.HandleAuditExport), "导出审计日志"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/job/list", console(job.HandleJobList), "列举任务"),
+		vortex.AppendHttpRouter([]string{http.MethodGet}, "/admin/job/:job_id", console(job.HandleJobInfo), "查看任务"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/job/cancel/:job_id", console(audit.Record(logic.AuditActions.JobCancel, job.HandleJobCancel)), "取消任务"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/reconcile", console(audit.Record(logic.AuditActions.Reconcile, reconcile.HandleReconcile)), "索引与存储对账"),
+		vortex.AppendHttpRouter([]string{http.MethodPost}, "/admin/scan/rescan", console(audit.Record(logic.AuditActions.Rescan, reconcile.HandleRescan)), "重新扫描文件"),
 	}
 }
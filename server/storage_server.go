@@ -16,8 +16,12 @@ import (
 )
 
 type StorageServer struct {
-	ctx context.Context
-	v   *vortex.Vortex
+	ctx       context.Context
+	v         *vortex.Vortex
+	file      *logic.FileIndexLogic
+	scan      *logic.ScanLogic
+	reconcile *logic.ReconcileLogic
+	audit     *logic.AuditLogic
 }
 
 // NewStorageServer 创建一个存储服务器
@@ -26,13 +30,38 @@ func NewStorageServer(ctx context.Context, cfg *config.Config, dsServer *ds.Data
 	boxLogic := logic.NewBoxLogic(ctx, cfg, dsServer)
 	depotLogic := logic.NewDepotLogic(ctx, cfg, dsServer, boxLogic)
 	fileIndexLogic := logic.NewFileIndexLogic(ctx, cfg, dsServer, s3Logic, boxLogic, depotLogic)
+	jobLogic := logic.NewJobLogic(ctx, cfg, dsServer)
+	reconcileLogic := logic.NewReconcileLogic(ctx, cfg, s3Logic, fileIndexLogic)
+	archiveLogic := logic.NewArchiveLogic(ctx, cfg, fileIndexLogic, jobLogic)
+	imageLogic := logic.NewImageLogic(ctx, fileIndexLogic, boxLogic, jobLogic)
+	userLogic := logic.NewUserLogic(ctx, cfg, dsServer)
+	accessLogic := logic.NewAccessLogic(ctx, cfg, dsServer, userLogic, depotLogic, boxLogic)
+	accessKeyLogic := logic.NewAccessKeyLogic(ctx, cfg, dsServer, userLogic)
+	sessionLogic := logic.NewSessionLogic(ctx, cfg, dsServer, userLogic)
+	shareLogic := logic.NewShareLogic(ctx, cfg, dsServer)
+	urlSignLogic := logic.NewUrlSignLogic(ctx, cfg)
+	rateLimitLogic := logic.NewRateLimitLogic(ctx, cfg, dsServer)
+	auditLogic := logic.NewAuditLogic(ctx, dsServer)
 
 	hcli := &http.Client{Timeout: 30 * time.Second}
-	loginHandler := handler.NewLoginHandler(ctx, cfg.Server.Jwt, cfg.Server.ConsoleJwt, cfg.Admin)
-	fileHandler := handler.NewFileHandler(ctx, fileIndexLogic, boxLogic, hcli)
-	boxHandler := handler.NewBoxHandler(ctx, boxLogic)
-	depotHandler := handler.NewDepotHandler(ctx, depotLogic)
-	routers := PrepareRouters(loginHandler, fileHandler, boxHandler, depotHandler) // 创建路由
+	scanLogic := logic.NewScanLogic(ctx, cfg, &http.Client{}, fileIndexLogic) // 扫描超时由扫描服务单独控制
+	oidcLogic := logic.NewOidcLogic(ctx, cfg, dsServer, userLogic, hcli)
+	loginHandler := handler.NewLoginHandler(ctx, cfg.Server.Jwt, cfg.Server.ConsoleJwt, userLogic, sessionLogic, oidcLogic)
+	clientIp, err := handler.NewClientIpExtractor(cfg.Server.TrustedProxies)
+	if err != nil {
+		panic(err)
+	}
+	fileHandler := handler.NewFileHandler(ctx, fileIndexLogic, boxLogic, depotLogic, jobLogic, archiveLogic, imageLogic, accessLogic, shareLogic, urlSignLogic, cfg.Fetch, cfg.Download, clientIp)
+	boxHandler := handler.NewBoxHandler(ctx, boxLogic, depotLogic, accessLogic)
+	depotHandler := handler.NewDepotHandler(ctx, depotLogic, fileIndexLogic, accessLogic)
+	reconcileHandler := handler.NewReconcileHandler(ctx, reconcileLogic, scanLogic, accessLogic)
+	jobHandler := handler.NewJobHandler(ctx, jobLogic, accessLogic)
+	userHandler := handler.NewUserHandler(ctx, userLogic, sessionLogic)
+	accessHandler := handler.NewAccessHandler(ctx, accessLogic, depotLogic)
+	accessKeyHandler := handler.NewAccessKeyHandler(ctx, accessKeyLogic, userLogic, depotLogic)
+	rateLimitHandler := handler.NewRateLimitHandler(ctx, rateLimitLogic, depotLogic, boxLogic, fileIndexLogic, clientIp)
+	auditHandler := handler.NewAuditHandler(ctx, auditLogic, accessLogic, clientIp)
+	routers := PrepareRouters(rateLimitHandler, auditHandler, loginHandler, userHandler, accessKeyHandler, accessHandler, fileHandler, boxHandler, depotHandler, reconcileHandler, jobHandler) // 创建路由
 
 	v := vortex.BootStrap(
 		ctx,
@@ -43,17 +72,25 @@ func NewStorageServer(ctx context.Context, cfg *config.Config, dsServer *ds.Data
 		vortex.WithI18n(locale.V),
 	)
 	return &StorageServer{
-		ctx: ctx,
-		v:   v,
+		ctx:       ctx,
+		v:         v,
+		file:      fileIndexLogic,
+		scan:      scanLogic,
+		reconcile: reconcileLogic,
+		audit:     auditLogic,
 	}
 }
 
 // 启动服务
 func (s *StorageServer) Start() {
+	s.file.StartProcess()              // 所有处理步骤已经在创建服务时注册
+	go s.scan.RescanPending(s.ctx, "") // 重启前没有扫描完的文件重新提交扫描
 	go s.v.Start()
+	go s.reconcile.RunSchedule() // 定时对账
 }
 
 // 停止服务
 func (s *StorageServer) ShutDown(ctx context.Context) error {
-	return nil
+	// 等待未写入的审计记录
+	return s.audit.Close(ctx)
 }
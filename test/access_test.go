@@ -0,0 +1,43 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Access(t *testing.T) {
+	convey.Convey("只有记录的上传者是文件的上传者", t, func() {
+		info := &logic.MediaFileInfo{Fid: "f1", Uploader: ptr.String("u1")}
+		convey.So(info.IsUploader("u1"), convey.ShouldBeTrue)
+		convey.So(info.IsUploader("u2"), convey.ShouldBeFalse)
+		convey.So(info.IsUploader(""), convey.ShouldBeFalse)
+		// 没有上传者的文件不属于任何人，匿名调用方也不能冒充
+		convey.So((&logic.MediaFileInfo{Fid: "f2"}).IsUploader(""), convey.ShouldBeFalse)
+	})
+
+	convey.Convey("上传者可以读取自己的文件，但删除需要box的删除权限", t, func() {
+		info := &logic.MediaFileInfo{Fid: "f1", Uploader: ptr.String("u1")}
+		uploader := &logic.EffectivePermission{Uid: "u1", Actions: []string{logic.AccessActions.Info, logic.AccessActions.Upload}}
+		convey.So(uploader.AllowFile(info, logic.AccessActions.Read), convey.ShouldBeTrue)
+		convey.So(uploader.AllowFile(info, logic.AccessActions.Original), convey.ShouldBeTrue)
+		convey.So(uploader.AllowFile(info, logic.AccessActions.Delete), convey.ShouldBeFalse)
+
+		other := &logic.EffectivePermission{Uid: "u2", Actions: []string{logic.AccessActions.Info, logic.AccessActions.Upload}}
+		convey.So(other.AllowFile(info, logic.AccessActions.Read), convey.ShouldBeFalse)
+
+		editor := &logic.EffectivePermission{Uid: "u2", Actions: []string{logic.AccessActions.Read, logic.AccessActions.Delete}}
+		convey.So(editor.AllowFile(info, logic.AccessActions.Delete), convey.ShouldBeTrue)
+	})
+
+	convey.Convey("只有任务的创建者可以查看和取消任务", t, func() {
+		job := &logic.Job{JobId: "j1", Creator: ptr.String("u1")}
+		convey.So(job.IsCreator("u1"), convey.ShouldBeTrue)
+		convey.So(job.IsCreator("u2"), convey.ShouldBeFalse)
+		convey.So(job.IsCreator(""), convey.ShouldBeFalse)
+		// 没有创建者的任务匿名调用方也不能访问
+		convey.So((&logic.Job{JobId: "j2"}).IsCreator(""), convey.ShouldBeFalse)
+	})
+}
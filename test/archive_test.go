@@ -0,0 +1,46 @@
+package test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SpoolArchiveEntry(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	convey.Convey("额度内的条目落到临时文件", t, func() {
+		tmp, size, err := logic.SpoolArchiveEntry(strings.NewReader("hello"), 5)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(size, convey.ShouldEqual, 5)
+		raw, err := io.ReadAll(tmp)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(string(raw), convey.ShouldEqual, "hello")
+		tmp.Close()
+		os.Remove(tmp.Name())
+	})
+
+	convey.Convey("超出额度时不保留临时文件", t, func() {
+		tmp, size, err := logic.SpoolArchiveEntry(strings.NewReader("hello world"), 5)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrArchiveTooLarge)
+		convey.So(tmp, convey.ShouldBeNil)
+		convey.So(size, convey.ShouldEqual, 0)
+		left, _ := filepath.Glob(filepath.Join(tmpDir, "media-archive-entry-*"))
+		convey.So(left, convey.ShouldBeEmpty)
+	})
+
+	convey.Convey("额度为0时空条目可以落盘", t, func() {
+		tmp, size, err := logic.SpoolArchiveEntry(strings.NewReader(""), 0)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(size, convey.ShouldEqual, 0)
+		tmp.Close()
+		os.Remove(tmp.Name())
+	})
+}
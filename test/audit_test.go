@@ -0,0 +1,82 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/handler"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+// 审计中间件放在请求上下文中的记录，和 handler 中的 key 保持一致
+const auditContextKey = "media_storage_audit_entry"
+
+// 模拟审计中间件，匿名调用处理函数后返回审计记录
+func callAudited(method, target string, params map[string]string, h func(*vortex.Context) error) *logic.AuditEntry {
+	req := httptest.NewRequest(method, target, strings.NewReader("{}"))
+	ectx := echo.New().NewContext(req, httptest.NewRecorder())
+	for name, value := range params {
+		ectx.SetParamNames(append(ectx.ParamNames(), name)...)
+		ectx.SetParamValues(append(ectx.ParamValues(), value)...)
+	}
+	ctx := &vortex.Context{Context: ectx}
+	entry := &logic.AuditEntry{Path: req.URL.Path}
+	ctx.Set(auditContextKey, entry)
+	_ = h(ctx)
+	return entry
+}
+
+func Test_Audit(t *testing.T) {
+	convey.Convey("没有权限时审计结果为拒绝，不会默认记录为成功", t, func() {
+		depot := handler.NewDepotHandler(nil, nil, nil, nil)
+		reconcile := handler.NewReconcileHandler(nil, nil, nil, nil)
+		accessKey := handler.NewAccessKeyHandler(nil, nil, nil, nil)
+		user := handler.NewUserHandler(nil, nil, nil)
+		for _, h := range []func(*vortex.Context) error{
+			depot.HandleDeportCreate,
+			depot.HandleDepotUpdate,
+			reconcile.HandleReconcile,
+			reconcile.HandleRescan,
+			accessKey.HandleCreate,
+			accessKey.HandleRotate,
+			accessKey.HandleDelete,
+			user.HandleUserCreate,
+			user.HandleUserDisable,
+			user.HandleChangePassword,
+		} {
+			entry := callAudited(http.MethodPost, "/admin/test", nil, h)
+			convey.So(entry.Outcome, convey.ShouldEqual, logic.AuditOutcomes.Denied)
+		}
+	})
+
+	convey.Convey("参数错误时审计结果为失败", t, func() {
+		file := handler.NewFileHandler(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+		entry := callAudited(http.MethodPost, "/media/file/delete/", nil, file.HandleFileDelete)
+		convey.So(entry.Outcome, convey.ShouldEqual, logic.AuditOutcomes.Failure)
+	})
+
+	convey.Convey("分享 token 在对象和路径中只记录哈希", t, func() {
+		token := "sh_abcdef0123456789"
+		entry := &logic.AuditEntry{Path: "/share/" + token + "/f1"}
+		entry.SetTokenTarget(token)
+		hashed := logic.HashAuditToken(token)
+		convey.So(*entry.Target, convey.ShouldEqual, hashed)
+		convey.So(entry.Path, convey.ShouldEqual, "/share/"+hashed+"/f1")
+		convey.So(entry.Path, convey.ShouldNotContainSubstring, token)
+		convey.So(hashed, convey.ShouldNotContainSubstring, token)
+		convey.So(logic.HashAuditToken(token), convey.ShouldEqual, hashed)
+		convey.So(logic.HashAuditToken("sh_other"), convey.ShouldNotEqual, hashed)
+
+		// 没有开启审计的接口调用时忽略
+		var none *logic.AuditEntry
+		none.SetTokenTarget(token)
+		empty := &logic.AuditEntry{Path: "/share/"}
+		empty.SetTokenTarget("")
+		convey.So(empty.Target, convey.ShouldBeNil)
+	})
+}
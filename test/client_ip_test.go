@@ -0,0 +1,56 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/handler"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func forwardedRequest(remoteAddr, xff string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/share/token", nil)
+	req.RemoteAddr = remoteAddr
+	if len(xff) > 0 {
+		req.Header.Set("X-Forwarded-For", xff)
+	}
+	return req
+}
+
+func Test_ClientIp(t *testing.T) {
+	convey.Convey("没有配置可信代理时忽略 X-Forwarded-For", t, func() {
+		extract, err := handler.NewClientIpExtractor(nil)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(extract(forwardedRequest("203.0.113.7:5000", "198.51.100.1")), convey.ShouldEqual, "203.0.113.7")
+		// 内网地址也不能伪造
+		convey.So(extract(forwardedRequest("192.168.1.10:5000", "198.51.100.1")), convey.ShouldEqual, "192.168.1.10")
+	})
+
+	convey.Convey("只有来自可信代理的请求使用 X-Forwarded-For", t, func() {
+		extract, err := handler.NewClientIpExtractor([]string{"10.0.0.1", "172.16.0.0/12"})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(extract(forwardedRequest("10.0.0.1:5000", "198.51.100.1")), convey.ShouldEqual, "198.51.100.1")
+		convey.So(extract(forwardedRequest("172.20.1.1:5000", "198.51.100.2")), convey.ShouldEqual, "198.51.100.2")
+		// 客户端自己带的 X-Forwarded-For 排在代理追加的地址之前，不会被使用
+		convey.So(extract(forwardedRequest("10.0.0.1:5000", "192.0.2.9, 198.51.100.1")), convey.ShouldEqual, "198.51.100.1")
+		convey.So(extract(forwardedRequest("203.0.113.7:5000", "198.51.100.1")), convey.ShouldEqual, "203.0.113.7")
+		convey.So(extract(forwardedRequest("192.168.1.10:5000", "198.51.100.1")), convey.ShouldEqual, "192.168.1.10")
+	})
+
+	convey.Convey("可信代理的配置错误时返回错误", t, func() {
+		_, err := handler.NewClientIpExtractor([]string{"10.0.0.0/33"})
+		convey.So(err, convey.ShouldNotBeNil)
+		_, err = handler.NewClientIpExtractor([]string{"proxy.local"})
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+
+	convey.Convey("伪造 X-Forwarded-For 不能绕过分享的ip限制", t, func() {
+		extract, err := handler.NewClientIpExtractor([]string{"10.0.0.1"})
+		convey.So(err, convey.ShouldBeNil)
+		share := &logic.Share{AllowedIps: []string{"198.51.100.0/24"}}
+		convey.So(share.AllowIP(extract(forwardedRequest("203.0.113.7:5000", "198.51.100.1"))), convey.ShouldBeFalse)
+		convey.So(share.AllowIP(extract(forwardedRequest("10.0.0.1:5000", "198.51.100.1"))), convey.ShouldBeTrue)
+	})
+}
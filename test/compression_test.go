@@ -0,0 +1,121 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+// 读到一半出错的流
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("client closed")
+	}
+	return n, err
+}
+
+func Test_Compression(t *testing.T) {
+	text := strings.Repeat("media storage compression ", 4096)
+
+	convey.Convey("压缩后可以解压还原", t, func() {
+		for _, encoding := range []string{logic.Compressions.Gzip, logic.Compressions.Zstd} {
+			r, err := logic.CompressReader(encoding, strings.NewReader(text))
+			convey.So(err, convey.ShouldBeNil)
+			compressed, err := io.ReadAll(r)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(compressed), convey.ShouldBeLessThan, len(text))
+
+			dr, err := logic.NewDecompressReader(encoding, bytes.NewReader(compressed))
+			convey.So(err, convey.ShouldBeNil)
+			plain, err := io.ReadAll(dr)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(plain), convey.ShouldEqual, text)
+			convey.So(dr.Close(), convey.ShouldBeNil)
+		}
+	})
+
+	convey.Convey("不支持的压缩方式", t, func() {
+		_, err := logic.CompressReader("br", strings.NewReader(text))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrCompressionNotSupport)
+		_, err = logic.NewDecompressReader("br", strings.NewReader(text))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrCompressionNotSupport)
+	})
+
+	convey.Convey("源数据读取失败时压缩流返回错误", t, func() {
+		r, err := logic.CompressReader(logic.Compressions.Gzip, &failingReader{r: strings.NewReader(text)})
+		convey.So(err, convey.ShouldBeNil)
+		_, err = io.ReadAll(r)
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+
+	convey.Convey("提前关闭压缩流", t, func() {
+		r, err := logic.CompressReader(logic.Compressions.Zstd, strings.NewReader(text))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(r.Close(), convey.ShouldBeNil)
+	})
+}
+
+func Test_SaveObjectStream(t *testing.T) {
+	fake, srv := newFakeS3()
+	defer srv.Close()
+	s3Logic := newTestS3Logic(srv.URL, nil)
+	ctx := context.Background()
+
+	// 随机数据不可压缩，保证超过一个分片
+	random := make([]byte, 20<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	convey.Convey("不足一个分片时直接上传", t, func() {
+		err := s3Logic.SaveObjectStream(ctx, "d1/b1/small", io.NopCloser(strings.NewReader("hello")), ptr.String("text/plain"), nil)
+		convey.So(err, convey.ShouldBeNil)
+		body, ok := fake.body("d1/b1/small")
+		convey.So(ok, convey.ShouldBeTrue)
+		convey.So(body, convey.ShouldEqual, "hello")
+		convey.So(fake.partHeaders("d1/b1/small"), convey.ShouldBeEmpty)
+	})
+
+	convey.Convey("大对象分片上传", t, func() {
+		r, err := logic.CompressReader(logic.Compressions.Gzip, bytes.NewReader(random))
+		convey.So(err, convey.ShouldBeNil)
+		err = s3Logic.SaveObjectStream(ctx, "d1/b1/large", r, ptr.String("application/octet-stream"), &logic.SSEParams{Mode: logic.SSEModes.SSES3})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(len(fake.partHeaders("d1/b1/large")), convey.ShouldEqual, 3)
+		convey.So(fake.header("d1/b1/large").Get("X-Amz-Server-Side-Encryption"), convey.ShouldEqual, "AES256")
+
+		body, ok := fake.body("d1/b1/large")
+		convey.So(ok, convey.ShouldBeTrue)
+		dr, err := logic.NewDecompressReader(logic.Compressions.Gzip, strings.NewReader(body))
+		convey.So(err, convey.ShouldBeNil)
+		plain, err := io.ReadAll(dr)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(bytes.Equal(plain, random), convey.ShouldBeTrue)
+		pending, _ := fake.pendingUploads()
+		convey.So(pending, convey.ShouldEqual, 0)
+	})
+
+	convey.Convey("读取失败时取消分片上传", t, func() {
+		r, err := logic.CompressReader(logic.Compressions.Gzip, &failingReader{r: bytes.NewReader(random)})
+		convey.So(err, convey.ShouldBeNil)
+		err = s3Logic.SaveObjectStream(ctx, "d1/b1/broken", r, nil, nil)
+		convey.So(err, convey.ShouldNotBeNil)
+		_, ok := fake.body("d1/b1/broken")
+		convey.So(ok, convey.ShouldBeFalse)
+		pending, aborted := fake.pendingUploads()
+		convey.So(pending, convey.ShouldEqual, 0)
+		convey.So(aborted, convey.ShouldEqual, 1)
+	})
+}
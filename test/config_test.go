@@ -0,0 +1,27 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/dzjyyds666/Allspark-go/conv"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ConfigLog(t *testing.T) {
+	convey.Convey("打印配置时不输出密钥和密码", t, func() {
+		cfg := &config.Config{
+			S3:      &config.S3{Bucket: "media", SecretKey: "s3-secret", SSECKeys: map[string]string{"k1": "sse-c-key"}},
+			Server:  &config.Server{Jwt: &config.Jwt{Secret: "jwt-secret", Expire: 3600}},
+			Admin:   &config.Admin{Username: "root", Password: "admin-password"},
+			UrlSign: &config.UrlSign{Secret: "url-secret"},
+			Oidc:    &config.Oidc{ClientId: "console", ClientSecret: "oidc-secret"},
+		}
+		out := conv.ToJsonWithoutError(cfg)
+		convey.So(out, convey.ShouldContainSubstring, "media")
+		convey.So(out, convey.ShouldContainSubstring, "console")
+		for _, secret := range []string{"s3-secret", "sse-c-key", "jwt-secret", "admin-password", "url-secret", "oidc-secret"} {
+			convey.So(out, convey.ShouldNotContainSubstring, secret)
+		}
+	})
+}
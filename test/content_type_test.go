@@ -0,0 +1,53 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+const docxType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+func Test_ContentType(t *testing.T) {
+	convey.Convey("根据文件头识别类型", t, func() {
+		convey.So(logic.DetectContentType(buildTestPng(t, nil)), convey.ShouldEqual, "image/png")
+		convey.So(logic.DetectContentType([]byte("MZ\x90\x00")), convey.ShouldEqual, "application/x-msdownload")
+		convey.So(logic.DetectContentType([]byte("fLaC\x00\x00\x00\x22")), convey.ShouldEqual, "audio/flac")
+		convey.So(logic.DetectContentType([]byte("PK\x03\x04\x14\x00\x00\x00")), convey.ShouldEqual, "application/zip")
+		convey.So(logic.DetectContentType([]byte{0x00, 0x01, 0x02, 0x03}), convey.ShouldEqual, "application/octet-stream")
+	})
+
+	convey.Convey("容器格式按扩展名或者声明类型细化", t, func() {
+		convey.So(logic.RefineDetectedType("application/zip", "", "report.docx"), convey.ShouldEqual, docxType)
+		convey.So(logic.RefineDetectedType("application/zip", docxType, "report"), convey.ShouldEqual, docxType)
+		convey.So(logic.RefineDetectedType("application/zip", "image/png", "a.png"), convey.ShouldEqual, "application/zip")
+		convey.So(logic.RefineDetectedType("text/xml", "", "a.svg"), convey.ShouldEqual, "image/svg+xml")
+		convey.So(logic.RefineDetectedType("text/xml", "application/atom+xml", "feed"), convey.ShouldEqual, "application/atom+xml")
+		convey.So(logic.RefineDetectedType("text/xml", "image/png", "a.png"), convey.ShouldEqual, "text/xml")
+		convey.So(logic.RefineDetectedType("image/png", docxType, "a.docx"), convey.ShouldEqual, "image/png")
+	})
+
+	convey.Convey("按箱子的类型限制校验", t, func() {
+		imageBox := &logic.Box{AllowTypes: []string{"image/*"}}
+		convey.So(logic.CheckFileType(imageBox, "a.png", "image/png", "image/png"), convey.ShouldBeNil)
+		// 声明为图片但是文件头是文档
+		convey.So(logic.CheckFileType(imageBox, "a.png", "image/png", docxType), convey.ShouldEqual, pkg.ErrorEnums.ErrFileTypeNotAllowed)
+
+		docBox := &logic.Box{AllowTypes: []string{docxType}}
+		refined := logic.RefineDetectedType("application/zip", docxType, "report.docx")
+		convey.So(logic.CheckFileType(docBox, "report.docx", docxType, refined), convey.ShouldBeNil)
+		convey.So(logic.CheckFileType(docBox, "report.zip", docxType, "application/zip"), convey.ShouldEqual, pkg.ErrorEnums.ErrFileTypeNotAllowed)
+
+		denyBox := &logic.Box{DenyTypes: []string{".exe", "application/x-msdownload"}}
+		convey.So(logic.CheckFileType(denyBox, "setup.EXE", "application/octet-stream"), convey.ShouldEqual, pkg.ErrorEnums.ErrFileTypeNotAllowed)
+		convey.So(logic.CheckFileType(denyBox, "setup.bin", "application/octet-stream", "application/x-msdownload"), convey.ShouldEqual, pkg.ErrorEnums.ErrFileTypeNotAllowed)
+		convey.So(logic.CheckFileType(denyBox, "a.txt", "text/plain; charset=utf-8"), convey.ShouldBeNil)
+
+		extBox := &logic.Box{AllowTypes: []string{".jpg", ".png"}}
+		convey.So(logic.CheckFileType(extBox, "A.PNG", "image/png"), convey.ShouldBeNil)
+		convey.So(logic.CheckFileType(extBox, "a.gif", "image/gif"), convey.ShouldEqual, pkg.ErrorEnums.ErrFileTypeNotAllowed)
+		convey.So(logic.CheckFileType(nil, "a.exe", "application/x-msdownload"), convey.ShouldBeNil)
+	})
+}
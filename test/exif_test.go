@@ -0,0 +1,116 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+// 构建包含相机厂商和方向的 EXIF(TIFF 格式)
+func buildTestExif(orientation int) []byte {
+	tiff := make([]byte, 38)
+	copy(tiff, "MM\x00*")
+	binary.BigEndian.PutUint32(tiff[4:], 8)
+	binary.BigEndian.PutUint16(tiff[8:], 2)
+	// Make, ASCII, 4字节内联
+	binary.BigEndian.PutUint16(tiff[10:], 0x010f)
+	binary.BigEndian.PutUint16(tiff[12:], 2)
+	binary.BigEndian.PutUint32(tiff[14:], 4)
+	copy(tiff[18:], "Cam\x00")
+	// Orientation, SHORT
+	binary.BigEndian.PutUint16(tiff[22:], 0x0112)
+	binary.BigEndian.PutUint16(tiff[24:], 3)
+	binary.BigEndian.PutUint32(tiff[26:], 1)
+	binary.BigEndian.PutUint16(tiff[30:], uint16(orientation))
+	return tiff
+}
+
+// 在 SOI 之后插入 APP1 EXIF 段
+func buildTestJpeg(t *testing.T, tiff []byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, newTestImage(16, 8), nil); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	segment := []byte{0xff, 0xe1, 0, 0}
+	segment = append(append(segment, "Exif\x00\x00"...), tiff...)
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(segment)-2))
+	return append(append(append([]byte{}, raw[:2]...), segment...), raw[2:]...)
+}
+
+// 在 IHDR 之后插入 eXIf 块
+func buildTestPng(t *testing.T, tiff []byte) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, newTestImage(16, 8)); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(tiff)))
+	chunk = append(append(chunk, "eXIf"...), tiff...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	ihdrEnd := 8 + 8 + 13 + 4
+	return append(append(append([]byte{}, raw[:ihdrEnd]...), chunk...), raw[ihdrEnd:]...)
+}
+
+func Test_StripImageMeta(t *testing.T) {
+	convey.Convey("全部去除时 jpeg 保留方向", t, func() {
+		raw := buildTestJpeg(t, buildTestExif(6))
+		meta := logic.ParseImageMeta(raw)
+		convey.So(meta.Orientation, convey.ShouldEqual, 6)
+		convey.So(ptr.ToString(meta.Make), convey.ShouldEqual, "Cam")
+
+		out := logic.StripImageMeta(raw, logic.MetadataStrips.All)
+		meta = logic.ParseImageMeta(out)
+		convey.So(meta.Orientation, convey.ShouldEqual, 6)
+		convey.So(meta.Make, convey.ShouldBeNil)
+		convey.So(bytes.Contains(out, []byte("Cam")), convey.ShouldBeFalse)
+		_, _, err := image.Decode(bytes.NewReader(out))
+		convey.So(err, convey.ShouldBeNil)
+	})
+
+	convey.Convey("正向的图片直接去除 EXIF", t, func() {
+		out := logic.StripImageMeta(buildTestJpeg(t, buildTestExif(1)), logic.MetadataStrips.All)
+		convey.So(bytes.Contains(out, []byte("Exif\x00\x00")), convey.ShouldBeFalse)
+		convey.So(logic.ParseImageMeta(out).Orientation, convey.ShouldEqual, 0)
+	})
+
+	convey.Convey("全部去除时 png 保留方向且校验和正确", t, func() {
+		raw := buildTestPng(t, buildTestExif(8))
+		convey.So(logic.ParseImageMeta(raw).Orientation, convey.ShouldEqual, 8)
+
+		out := logic.StripImageMeta(raw, logic.MetadataStrips.All)
+		meta := logic.ParseImageMeta(out)
+		convey.So(meta.Orientation, convey.ShouldEqual, 8)
+		convey.So(meta.Make, convey.ShouldBeNil)
+		_, err := png.Decode(bytes.NewReader(out))
+		convey.So(err, convey.ShouldBeNil)
+	})
+
+	convey.Convey("只去除位置信息时保留其他信息", t, func() {
+		raw := buildTestJpeg(t, buildTestExif(3))
+		out := logic.StripImageMeta(raw, logic.MetadataStrips.Gps)
+		meta := logic.ParseImageMeta(out)
+		convey.So(meta.Orientation, convey.ShouldEqual, 3)
+		convey.So(ptr.ToString(meta.Make), convey.ShouldEqual, "Cam")
+	})
+
+	convey.Convey("按方向旋转图片", t, func() {
+		src := newTestImage(16, 8)
+		convey.So(logic.OrientImage(src, 1), convey.ShouldEqual, src)
+		dst := logic.OrientImage(src, 6)
+		convey.So(dst.Bounds().Dx(), convey.ShouldEqual, 8)
+		convey.So(dst.Bounds().Dy(), convey.ShouldEqual, 16)
+		// 顺时针旋转90度后，左上角为原图的左下角
+		convey.So(dst.At(0, 0), convey.ShouldResemble, src.At(0, 7))
+		dst = logic.OrientImage(src, 3)
+		convey.So(dst.At(0, 0), convey.ShouldResemble, src.At(15, 7))
+	})
+}
@@ -0,0 +1,211 @@
+package test
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+)
+
+// 内存中的 s3 服务，支持 HeadBucket、PutObject、CopyObject、GetObject、DeleteObject、ListObjectsV2 和分片上传
+type fakeS3 struct {
+	mu      sync.Mutex
+	headers map[string]http.Header // objectKey => 最后一次写入的请求头
+	bodies  map[string]string
+	uploads map[string]map[int]string // uploadId => partNumber => 分片内容
+	parts   map[string][]http.Header  // objectKey => 每个分片的请求头
+	aborted int                       // 取消的分片上传数
+}
+
+type fakeS3Content struct {
+	Key          string `xml:"Key"`
+	Size         int64  `xml:"Size"`
+	LastModified string `xml:"LastModified"`
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name        `xml:"ListBucketResult"`
+	Name        string          `xml:"Name"`
+	Prefix      string          `xml:"Prefix"`
+	KeyCount    int             `xml:"KeyCount"`
+	IsTruncated bool            `xml:"IsTruncated"`
+	Contents    []fakeS3Content `xml:"Contents"`
+}
+
+func newFakeS3() (*fakeS3, *httptest.Server) {
+	fs := &fakeS3{
+		headers: map[string]http.Header{},
+		bodies:  map[string]string{},
+		uploads: map[string]map[int]string{},
+		parts:   map[string][]http.Header{},
+	}
+	return fs, httptest.NewServer(fs)
+}
+
+func (fs *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 路径为 /bucket/key
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if len(parts) < 2 || len(parts[1]) == 0 {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+			fs.list(w, parts[0], r.URL.Query().Get("prefix"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	key := parts[1]
+	if fs.multipart(w, r, key) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		body := ""
+		if src := r.Header.Get("X-Amz-Copy-Source"); len(src) > 0 {
+			src, _ = url.PathUnescape(src)
+			srcParts := strings.SplitN(strings.TrimPrefix(src, "/"), "/", 2)
+			var ok bool
+			if body, ok = fs.bodies[srcParts[1]]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+		} else {
+			raw, _ := io.ReadAll(r.Body)
+			body = string(raw)
+			w.Header().Set("ETag", `"etag"`)
+			w.WriteHeader(http.StatusOK)
+		}
+		fs.headers[key] = r.Header.Clone()
+		fs.bodies[key] = body
+	case http.MethodGet:
+		body, ok := fs.bodies[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		_, _ = io.WriteString(w, body)
+	case http.MethodDelete:
+		delete(fs.bodies, key)
+		delete(fs.headers, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// 处理分片上传相关的请求，不是分片上传时返回false
+func (fs *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string) bool {
+	query := r.URL.Query()
+	uploadId := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadId = fmt.Sprintf("upload-%d", len(fs.uploads)+fs.aborted+1)
+		fs.uploads[uploadId] = map[int]string{}
+		fs.headers[key] = r.Header.Clone()
+		fs.parts[key] = nil
+		_, _ = fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>media</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, uploadId)
+	case r.Method == http.MethodPut && len(uploadId) > 0:
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		raw, _ := io.ReadAll(r.Body)
+		fs.uploads[uploadId][partNumber] = string(raw)
+		fs.parts[key] = append(fs.parts[key], r.Header.Clone())
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, partNumber))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPost && len(uploadId) > 0:
+		var body strings.Builder
+		upload := fs.uploads[uploadId]
+		for i := 1; i <= len(upload); i++ {
+			body.WriteString(upload[i])
+		}
+		fs.bodies[key] = body.String()
+		delete(fs.uploads, uploadId)
+		_, _ = fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`, key)
+	case r.Method == http.MethodDelete && len(uploadId) > 0:
+		delete(fs.uploads, uploadId)
+		fs.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return false
+	}
+	return true
+}
+
+// 分片上传的分片请求头
+func (fs *fakeS3) partHeaders(key string) []http.Header {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.parts[key]
+}
+
+// 进行中和取消的分片上传数
+func (fs *fakeS3) pendingUploads() (pending, aborted int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return len(fs.uploads), fs.aborted
+}
+
+func (fs *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	result := fakeS3ListResult{Name: bucket, Prefix: prefix}
+	for key, body := range fs.bodies {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, fakeS3Content{
+				Key:          key,
+				Size:         int64(len(body)),
+				LastModified: time.Now().UTC().Format(time.RFC3339),
+			})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (fs *fakeS3) header(key string) http.Header {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.headers[key]
+}
+
+func (fs *fakeS3) body(key string) (string, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	body, ok := fs.bodies[key]
+	return body, ok
+}
+
+func (fs *fakeS3) put(key, body string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.bodies[key] = body
+}
+
+func newTestS3Logic(endpoint string, keys map[string]string) *logic.S3Logic {
+	return logic.NewS3Logic(context.Background(), &config.Config{
+		S3: &config.S3{
+			Bucket:    "media",
+			Endpoint:  endpoint,
+			AccessKey: "test",
+			SecretKey: "test",
+			Region:    "us-east-1",
+			SSECKeys:  keys,
+		},
+	})
+}
@@ -0,0 +1,34 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ListCursor(t *testing.T) {
+	convey.Convey("游标记录上一页最后一个文件的上传时间和fid", t, func() {
+		cursor := logic.BuildListCursor(&logic.MediaFileInfo{Fid: "a1b2", CreatedTs: ptr.Int64(1700000000)})
+		convey.So(cursor, convey.ShouldEqual, "1700000000:a1b2")
+		ts, fid, err := logic.ParseListCursor(cursor)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(ts, convey.ShouldEqual, 1700000000)
+		convey.So(fid, convey.ShouldEqual, "a1b2")
+
+		// 没有上传时间的文件排在最前面
+		ts, fid, err = logic.ParseListCursor(logic.BuildListCursor(&logic.MediaFileInfo{Fid: "old"}))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(ts, convey.ShouldEqual, 0)
+		convey.So(fid, convey.ShouldEqual, "old")
+	})
+
+	convey.Convey("格式错误的游标", t, func() {
+		for _, cursor := range []string{"abc", "1700000000:", "x:a1b2", "-1:a1b2", ":a1b2"} {
+			_, _, err := logic.ParseListCursor(cursor)
+			convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrListCursorInvalid)
+		}
+	})
+}
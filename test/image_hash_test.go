@@ -0,0 +1,123 @@
+package test
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/smartystreets/goconvey/convey"
+	"golang.org/x/image/draw"
+)
+
+// 两两比较的结果，作为分段比较的对照
+func bruteForceGroups(hashes map[string]uint64, distance int) [][]string {
+	fids := make([]string, 0, len(hashes))
+	for fid := range hashes {
+		fids = append(fids, fid)
+	}
+	sort.Strings(fids)
+	parent := make([]int, len(fids))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range fids {
+		for j := i + 1; j < len(fids); j++ {
+			if logic.HammingDistance(hashes[fids[i]], hashes[fids[j]]) <= distance {
+				if ri, rj := find(i), find(j); ri != rj {
+					parent[max(ri, rj)] = min(ri, rj)
+				}
+			}
+		}
+	}
+	groups := make(map[int][]string)
+	order := make([]int, 0)
+	for i, fid := range fids {
+		root := find(i)
+		if _, ok := groups[root]; !ok {
+			order = append(order, root)
+		}
+		groups[root] = append(groups[root], fid)
+	}
+	result := make([][]string, 0)
+	for _, root := range order {
+		if len(groups[root]) > 1 {
+			result = append(result, groups[root])
+		}
+	}
+	return result
+}
+
+func Test_ImageHash(t *testing.T) {
+	convey.Convey("缩放和轻微调色后的图片哈希距离很小", t, func() {
+		src := newTestImage(64, 48)
+		scaled := image.NewRGBA(image.Rect(0, 0, 128, 96))
+		draw.BiLinear.Scale(scaled, scaled.Bounds(), src, src.Bounds(), draw.Src, nil)
+		tinted := image.NewRGBA(src.Bounds())
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				r, g, b, _ := src.At(x, y).RGBA()
+				tinted.Set(x, y, color.RGBA{R: uint8(min(r>>8+8, 255)), G: uint8(g >> 8), B: uint8(b >> 8), A: 255})
+			}
+		}
+		hash := logic.DHash(src)
+		convey.So(logic.HammingDistance(hash, logic.DHash(scaled)), convey.ShouldBeLessThanOrEqualTo, logic.ImageHashDefaultDistance)
+		convey.So(logic.HammingDistance(hash, logic.DHash(tinted)), convey.ShouldBeLessThanOrEqualTo, logic.ImageHashDefaultDistance)
+	})
+
+	convey.Convey("相似关系传递的图片合并为一组，没有相似图片的不输出", t, func() {
+		hashes := map[string]uint64{
+			"a": 0x0,
+			"b": 0x7,        // 和 a 距离3
+			"c": 0x7 | 0x38, // 和 b 距离3，和 a 距离6
+			"d": 0xffffffff00000000,
+		}
+		groups := logic.GroupDuplicateHashes(hashes, 3)
+		convey.So(groups, convey.ShouldHaveLength, 1)
+		convey.So(groups[0].Fids, convey.ShouldResemble, []string{"a", "b", "c"})
+
+		convey.So(logic.GroupDuplicateHashes(hashes, 2), convey.ShouldBeEmpty)
+		convey.So(logic.GroupDuplicateHashes(map[string]uint64{}, 10), convey.ShouldBeEmpty)
+	})
+
+	convey.Convey("距离为0时只合并完全相同的哈希", t, func() {
+		groups := logic.GroupDuplicateHashes(map[string]uint64{"a": 42, "b": 42, "c": 43}, 0)
+		convey.So(groups, convey.ShouldHaveLength, 1)
+		convey.So(groups[0].Fids, convey.ShouldResemble, []string{"a", "b"})
+	})
+
+	convey.Convey("分段比较和两两比较的结果一致", t, func() {
+		rnd := rand.New(rand.NewSource(1))
+		// 随机的基准哈希加上少量翻转位，构造出不同距离的相似图片
+		hashes := make(map[string]uint64)
+		for i := 0; i < 300; i++ {
+			base := rnd.Uint64()
+			hashes[fmt.Sprintf("f%03d-0", i)] = base
+			for k := 1; k <= 2; k++ {
+				h := base
+				for n := rnd.Intn(14); n > 0; n-- {
+					h ^= 1 << rnd.Intn(64)
+				}
+				hashes[fmt.Sprintf("f%03d-%d", i, k)] = h
+			}
+		}
+		for _, distance := range []int{0, 1, 5, logic.ImageHashDefaultDistance, 20, logic.ImageHashMaxDistance} {
+			groups := logic.GroupDuplicateHashes(hashes, distance)
+			got := make([][]string, 0, len(groups))
+			for _, group := range groups {
+				got = append(got, group.Fids)
+			}
+			convey.So(got, convey.ShouldResemble, bruteForceGroups(hashes, distance))
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/url"
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+	_ "golang.org/x/image/webp"
+)
+
+func newTestImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func Test_ImageTransform(t *testing.T) {
+	convey.Convey("解析处理参数", t, func() {
+		tf, err := logic.ParseImageTransform(url.Values{})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(tf, convey.ShouldBeNil)
+
+		tf, err = logic.ParseImageTransform(url.Values{"w": {"200"}, "format": {"JPG"}})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(tf.Width, convey.ShouldEqual, 200)
+		convey.So(tf.Fit, convey.ShouldEqual, logic.ImageFits.Contain)
+		convey.So(tf.Format, convey.ShouldEqual, logic.ImageFormats.Jpeg)
+		convey.So(tf.Quality, convey.ShouldEqual, 85)
+		convey.So(tf.Key(), convey.ShouldEqual, "w200_h0_contain_q85.jpeg")
+		convey.So(tf.ContentType(), convey.ShouldEqual, "image/jpeg")
+
+		for _, query := range []url.Values{
+			{"w": {"-1"}},
+			{"w": {"5000"}},
+			{"h": {"abc"}},
+			{"w": {"10"}, "q": {"101"}},
+			{"w": {"10"}, "fit": {"stretch"}},
+			{"format": {"bmp"}},
+		} {
+			_, err = logic.ParseImageTransform(query)
+			convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrImageTransformInvalid)
+		}
+	})
+
+	convey.Convey("校验衍生图预设", t, func() {
+		presets := map[string]*logic.ImageTransform{"thumb": {Width: 100}}
+		convey.So(logic.CheckVariantPresets(presets), convey.ShouldBeNil)
+		convey.So(presets["thumb"].Fit, convey.ShouldEqual, logic.ImageFits.Contain)
+
+		convey.So(logic.CheckVariantPresets(map[string]*logic.ImageTransform{"empty": {}}), convey.ShouldEqual, pkg.ErrorEnums.ErrImageTransformInvalid)
+		convey.So(logic.CheckVariantPresets(map[string]*logic.ImageTransform{"": {Width: 10}}), convey.ShouldEqual, pkg.ErrorEnums.ErrImageTransformInvalid)
+		convey.So(logic.CheckVariantPresets(map[string]*logic.ImageTransform{"big": {Width: 10000}}), convey.ShouldEqual, pkg.ErrorEnums.ErrImageTransformInvalid)
+	})
+
+	src := newTestImage(400, 200)
+
+	convey.Convey("缩放图片", t, func() {
+		// 等比缩放到框内
+		dst := logic.ResizeImage(src, &logic.ImageTransform{Width: 100, Height: 100, Fit: logic.ImageFits.Contain})
+		convey.So(dst.Bounds().Dx(), convey.ShouldEqual, 100)
+		convey.So(dst.Bounds().Dy(), convey.ShouldEqual, 50)
+
+		// 只指定一边
+		dst = logic.ResizeImage(src, &logic.ImageTransform{Height: 100, Fit: logic.ImageFits.Contain})
+		convey.So(dst.Bounds().Dx(), convey.ShouldEqual, 200)
+		convey.So(dst.Bounds().Dy(), convey.ShouldEqual, 100)
+
+		// 铺满后裁剪
+		dst = logic.ResizeImage(src, &logic.ImageTransform{Width: 100, Height: 100, Fit: logic.ImageFits.Cover})
+		convey.So(dst.Bounds().Dx(), convey.ShouldEqual, 100)
+		convey.So(dst.Bounds().Dy(), convey.ShouldEqual, 100)
+
+		// 拉伸
+		dst = logic.ResizeImage(src, &logic.ImageTransform{Width: 100, Height: 100, Fit: logic.ImageFits.Fill})
+		convey.So(dst.Bounds().Dx(), convey.ShouldEqual, 100)
+		convey.So(dst.Bounds().Dy(), convey.ShouldEqual, 100)
+
+		// 不放大原图
+		dst = logic.ResizeImage(src, &logic.ImageTransform{Width: 800, Height: 800, Fit: logic.ImageFits.Contain})
+		convey.So(dst.Bounds().Dx(), convey.ShouldEqual, 400)
+		convey.So(dst.Bounds().Dy(), convey.ShouldEqual, 200)
+	})
+
+	convey.Convey("转换格式", t, func() {
+		dst := logic.ResizeImage(src, &logic.ImageTransform{Width: 40, Fit: logic.ImageFits.Contain})
+		for _, format := range []string{logic.ImageFormats.Jpeg, logic.ImageFormats.Png, logic.ImageFormats.Webp} {
+			raw, err := logic.EncodeImage(dst, &logic.ImageTransform{Format: format, Quality: 80})
+			convey.So(err, convey.ShouldBeNil)
+			img, name, err := image.Decode(bytes.NewReader(raw))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(name, convey.ShouldEqual, format)
+			convey.So(img.Bounds().Dx(), convey.ShouldEqual, 40)
+			convey.So(img.Bounds().Dy(), convey.ShouldEqual, 20)
+		}
+	})
+}
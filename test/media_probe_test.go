@@ -0,0 +1,145 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func mp4Box(typ string, payloads ...[]byte) []byte {
+	body := bytes.Join(payloads, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(box, typ...), body...)
+}
+
+// 构建 moov 在 mdat 之后的 mp4，包含一个 1280x720 的 h264 轨道
+func buildTestMp4() []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000) // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 2500) // duration
+
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], "vide")
+	entry := make([]byte, 70)
+	binary.BigEndian.PutUint16(entry[24:], 1280)
+	binary.BigEndian.PutUint16(entry[26:], 720)
+	stsd := binary.BigEndian.AppendUint32(make([]byte, 4), 1)
+	stsd = append(stsd, mp4Box("avc1", entry)...)
+	trak := mp4Box("trak", mp4Box("mdia", mp4Box("hdlr", hdlr), mp4Box("minf", mp4Box("stbl", mp4Box("stsd", stsd)))))
+
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isom")),
+		mp4Box("mdat", make([]byte, 1000)),
+		mp4Box("moov", mp4Box("mvhd", mvhd), trak),
+	}, nil)
+}
+
+// 1秒 44.1kHz 双声道 16bit 的 wav
+func buildTestWav() []byte {
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk, 1)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 2)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], 44100)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 176400)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 4)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+	data := make([]byte, 176400)
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(4+8+len(fmtChunk)+8+len(data)))
+	buf.WriteString("WAVEfmt ")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(fmtChunk)))
+	buf.Write(fmtChunk)
+	buf.WriteString("data")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// 2秒 44.1kHz 双声道的 flac 头部
+func buildTestFlac() []byte {
+	info := make([]byte, 34)
+	sampleRate := 44100
+	info[10] = byte(sampleRate >> 12)
+	info[11] = byte(sampleRate >> 4)
+	info[12] = byte(sampleRate&0x0f)<<4 | 1<<1
+	binary.BigEndian.PutUint32(info[14:], 88200)
+	return append([]byte("fLaC\x00\x00\x00\x22"), info...)
+}
+
+func Test_ProbeMedia(t *testing.T) {
+	convey.Convey("mp4 的 moov 在文件末尾", t, func() {
+		raw := buildTestMp4()
+		probe := logic.ProbeMedia(bytes.NewReader(raw), int64(len(raw)))
+		convey.So(probe, convey.ShouldNotBeNil)
+		convey.So(probe.Format, convey.ShouldEqual, logic.MediaFormats.Mp4)
+		convey.So(probe.Duration, convey.ShouldEqual, 2.5)
+		convey.So(probe.VideoCodec, convey.ShouldEqual, "h264")
+		convey.So(probe.Width, convey.ShouldEqual, 1280)
+		convey.So(probe.Height, convey.ShouldEqual, 720)
+		convey.So(probe.TrackCount, convey.ShouldEqual, 1)
+		convey.So(probe.Bitrate, convey.ShouldEqual, int64(len(raw)*8*10/25))
+	})
+
+	convey.Convey("wav", t, func() {
+		raw := buildTestWav()
+		probe := logic.ProbeMedia(bytes.NewReader(raw), int64(len(raw)))
+		convey.So(probe, convey.ShouldNotBeNil)
+		convey.So(probe.Format, convey.ShouldEqual, logic.MediaFormats.Wav)
+		convey.So(probe.Duration, convey.ShouldEqual, 1)
+		convey.So(probe.Bitrate, convey.ShouldEqual, 1411200)
+		convey.So(probe.AudioCodec, convey.ShouldEqual, "pcm")
+		convey.So(probe.Tracks[0].Channels, convey.ShouldEqual, 2)
+		convey.So(probe.Tracks[0].SampleRate, convey.ShouldEqual, 44100)
+	})
+
+	convey.Convey("flac", t, func() {
+		raw := buildTestFlac()
+		probe := logic.ProbeMedia(bytes.NewReader(raw), int64(len(raw)))
+		convey.So(probe, convey.ShouldNotBeNil)
+		convey.So(probe.Format, convey.ShouldEqual, logic.MediaFormats.Flac)
+		convey.So(probe.Duration, convey.ShouldEqual, 2)
+		convey.So(probe.Tracks[0].Channels, convey.ShouldEqual, 2)
+		convey.So(probe.Tracks[0].SampleRate, convey.ShouldEqual, 44100)
+	})
+
+	convey.Convey("固定码率的 mp3", t, func() {
+		// MPEG1 Layer III 128kbps 44.1kHz 双声道
+		raw := make([]byte, 16000)
+		copy(raw, []byte{0xff, 0xfb, 0x90, 0x00})
+		probe := logic.ProbeMedia(bytes.NewReader(raw), int64(len(raw)))
+		convey.So(probe, convey.ShouldNotBeNil)
+		convey.So(probe.Format, convey.ShouldEqual, logic.MediaFormats.Mp3)
+		convey.So(probe.Bitrate, convey.ShouldEqual, 128000)
+		convey.So(probe.Duration, convey.ShouldEqual, 1)
+	})
+
+	convey.Convey("带有 ID3 和 Xing 头的 mp3", t, func() {
+		id3 := []byte("ID3\x03\x00\x00\x00\x00\x00\x0a")
+		frame := make([]byte, 4000)
+		copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+		copy(frame[36:], "Xing")
+		binary.BigEndian.PutUint32(frame[40:], 1)
+		binary.BigEndian.PutUint32(frame[44:], 100)
+		raw := append(append(id3, make([]byte, 10)...), frame...)
+		probe := logic.ProbeMedia(bytes.NewReader(raw), int64(len(raw)))
+		convey.So(probe, convey.ShouldNotBeNil)
+		convey.So(probe.Duration, convey.ShouldEqual, 2.612)
+	})
+
+	convey.Convey("不支持的格式", t, func() {
+		raw := []byte("plain text content")
+		convey.So(logic.ProbeMedia(bytes.NewReader(raw), int64(len(raw))), convey.ShouldBeNil)
+	})
+
+	convey.Convey("按类型判断是否需要探测", t, func() {
+		convey.So(logic.IsMedia(&logic.MediaFileInfo{ContentType: ptr.String("video/mp4")}), convey.ShouldBeTrue)
+		convey.So(logic.IsMedia(&logic.MediaFileInfo{ContentType: ptr.String("Audio/MPEG")}), convey.ShouldBeTrue)
+		convey.So(logic.IsMedia(&logic.MediaFileInfo{ContentType: ptr.String("image/png")}), convey.ShouldBeFalse)
+	})
+}
@@ -0,0 +1,217 @@
+package test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+// 测试用的 IdP，支持发现、授权和换取 token，授权时直接返回授权码
+type fakeIdp struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	groups []string
+
+	mu    sync.Mutex
+	codes map[string]url.Values // 授权码 => 授权请求的参数
+}
+
+func newFakeIdp(t *testing.T, groups []string) *fakeIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdp{key: key, groups: groups, codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kid": "k1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		code := "code-" + r.URL.Query().Get("state")
+		idp.mu.Lock()
+		idp.codes[code] = r.URL.Query()
+		idp.mu.Unlock()
+		redirect, _ := url.Parse(r.URL.Query().Get("redirect_uri"))
+		query := redirect.Query()
+		query.Set("code", code)
+		query.Set("state", r.URL.Query().Get("state"))
+		redirect.RawQuery = query.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		auth, ok := idp.codes[r.Form.Get("code")]
+		delete(idp.codes, r.Form.Get("code"))
+		idp.mu.Unlock()
+		if !ok || logic.PkceChallenge(r.Form.Get("code_verifier")) != auth.Get("code_challenge") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"id_token":     idp.sign(t, auth.Get("client_id"), auth.Get("nonce")),
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *fakeIdp) sign(t *testing.T, audience, nonce string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                idp.server.URL,
+		"sub":                "alice-sub",
+		"aud":                audience,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"nonce":              nonce,
+		"preferred_username": "alice",
+		"groups":             idp.groups,
+	})
+	token.Header["kid"] = "k1"
+	raw, err := token.SignedString(idp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// 模拟浏览器访问授权地址，返回回调中的授权码
+func authorize(authUrl string) (string, error) {
+	cli := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := cli.Get(authUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	return callback.Query().Get("code"), nil
+}
+
+func Test_OidcLogin(t *testing.T) {
+	idp := newFakeIdp(t, []string{"storage-admins", "others"})
+	defer idp.server.Close()
+	provider := logic.NewOidcProvider(&config.Oidc{
+		Issuer:      idp.server.URL,
+		ClientId:    "console",
+		RedirectUrl: "http://127.0.0.1:18080/console/oidc/callback",
+		RoleMapping: map[string]string{"storage-admins": "admin", "storage-users": "user"},
+	}, &http.Client{Timeout: 10 * time.Second})
+	ctx := context.Background()
+
+	convey.Convey("授权码 + PKCE 登录", t, func() {
+		authUrl, err := provider.AuthCodeUrl(ctx, "state1", "nonce1", "verifier-0123456789-0123456789-0123456789-0123")
+		convey.So(err, convey.ShouldBeNil)
+		code, err := authorize(authUrl)
+		convey.So(err, convey.ShouldBeNil)
+
+		identity, err := provider.Exchange(ctx, code, "verifier-0123456789-0123456789-0123456789-0123", "nonce1")
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(identity.Subject, convey.ShouldEqual, "alice-sub")
+		convey.So(identity.Username, convey.ShouldEqual, "alice")
+		convey.So(provider.MapRoles(identity.Groups), convey.ShouldResemble, []string{"admin"})
+	})
+
+	convey.Convey("code_verifier 不匹配", t, func() {
+		authUrl, err := provider.AuthCodeUrl(ctx, "state2", "nonce2", "verifier-0123456789-0123456789-0123456789-0123")
+		convey.So(err, convey.ShouldBeNil)
+		code, err := authorize(authUrl)
+		convey.So(err, convey.ShouldBeNil)
+		_, err = provider.Exchange(ctx, code, "wrong-verifier-0123456789-0123456789-0123456789", "nonce2")
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+
+	convey.Convey("nonce 不匹配", t, func() {
+		authUrl, err := provider.AuthCodeUrl(ctx, "state3", "nonce3", "verifier-0123456789-0123456789-0123456789-0123")
+		convey.So(err, convey.ShouldBeNil)
+		code, err := authorize(authUrl)
+		convey.So(err, convey.ShouldBeNil)
+		_, err = provider.Exchange(ctx, code, "verifier-0123456789-0123456789-0123456789-0123", "other-nonce")
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+
+	convey.Convey("没有匹配的用户组", t, func() {
+		convey.So(provider.MapRoles([]string{"others"}), convey.ShouldBeEmpty)
+		convey.So(provider.MapRoles(nil), convey.ShouldBeEmpty)
+	})
+
+	convey.Convey("授权码只能换取一次 token", t, func() {
+		authUrl, err := provider.AuthCodeUrl(ctx, "state4", "nonce4", "verifier-0123456789-0123456789-0123456789-0123")
+		convey.So(err, convey.ShouldBeNil)
+		code, err := authorize(authUrl)
+		convey.So(err, convey.ShouldBeNil)
+		_, err = provider.Exchange(ctx, code, "verifier-0123456789-0123456789-0123456789-0123", "nonce4")
+		convey.So(err, convey.ShouldBeNil)
+		_, err = provider.Exchange(ctx, code, "verifier-0123456789-0123456789-0123456789-0123", "nonce4")
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+
+	convey.Convey("id token 的 audience 不是当前客户端", t, func() {
+		identity, err := provider.VerifyIdToken(ctx, idp.sign(t, "console", "nonce5"), "nonce5")
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(identity.Subject, convey.ShouldEqual, "alice-sub")
+
+		_, err = provider.VerifyIdToken(ctx, idp.sign(t, "other-client", "nonce5"), "nonce5")
+		convey.So(err, convey.ShouldNotBeNil)
+		_, err = provider.VerifyIdToken(ctx, idp.sign(t, "console", "nonce5"), "nonce6")
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+}
+
+func Test_OidcState(t *testing.T) {
+	secret := []byte("state-secret")
+
+	convey.Convey("state cookie 只能用于发起登录的 state", t, func() {
+		cookie := logic.SignOidcState(secret, "state1")
+		convey.So(cookie, convey.ShouldStartWith, "state1.")
+		convey.So(logic.VerifyOidcState(secret, cookie, "state1"), convey.ShouldBeTrue)
+
+		// 其他浏览器发起的登录，或者没有 cookie
+		convey.So(logic.VerifyOidcState(secret, cookie, "state2"), convey.ShouldBeFalse)
+		convey.So(logic.VerifyOidcState(secret, logic.SignOidcState(secret, "state2"), "state1"), convey.ShouldBeFalse)
+		convey.So(logic.VerifyOidcState(secret, "", "state1"), convey.ShouldBeFalse)
+		convey.So(logic.VerifyOidcState(secret, "", ""), convey.ShouldBeFalse)
+	})
+
+	convey.Convey("篡改或者使用其他密钥签名的 cookie", t, func() {
+		cookie := logic.SignOidcState(secret, "state1")
+		convey.So(logic.VerifyOidcState(secret, "state1.00"+cookie[len("state1.")+2:], "state1"), convey.ShouldBeFalse)
+		convey.So(logic.VerifyOidcState(secret, "state1", "state1"), convey.ShouldBeFalse)
+		convey.So(logic.VerifyOidcState([]byte("other-secret"), cookie, "state1"), convey.ShouldBeFalse)
+	})
+}
@@ -0,0 +1,66 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ProcessQueue(t *testing.T) {
+	convey.Convey("启动前注册的步骤全部执行，失败的步骤不影响后续步骤", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		saved := make(chan *logic.MediaFileInfo, 1)
+		pq := logic.NewProcessQueue(ctx, 4, func(ctx context.Context, info *logic.MediaFileInfo) error {
+			saved <- info
+			return nil
+		})
+		var steps []string
+		pq.Register(func(ctx context.Context, info *logic.MediaFileInfo, opts ...func(*logic.MediaFileInfo) *logic.MediaFileInfo) error {
+			steps = append(steps, "a")
+			return errors.New("failed")
+		})
+		pq.Register(func(ctx context.Context, info *logic.MediaFileInfo, opts ...func(*logic.MediaFileInfo) *logic.MediaFileInfo) error {
+			steps = append(steps, "b")
+			info.FileName = "processed"
+			return nil
+		})
+		// 启动前提交的文件在启动后处理
+		convey.So(pq.Submit(&logic.MediaFileInfo{Fid: "f1"}), convey.ShouldBeTrue)
+		pq.Start(1)
+		pq.Start(1)
+
+		select {
+		case info := <-saved:
+			convey.So(info.Fid, convey.ShouldEqual, "f1")
+			convey.So(info.FileName, convey.ShouldEqual, "processed")
+			convey.So(steps, convey.ShouldResemble, []string{"a", "b"})
+		case <-time.After(time.Second):
+			t.Fatal("process timeout")
+		}
+
+		// 启动后不允许再注册
+		convey.So(func() {
+			pq.Register(func(ctx context.Context, info *logic.MediaFileInfo, opts ...func(*logic.MediaFileInfo) *logic.MediaFileInfo) error {
+				return nil
+			})
+		}, convey.ShouldPanic)
+	})
+
+	convey.Convey("没有处理步骤或者队列满时不提交", t, func() {
+		pq := logic.NewProcessQueue(context.Background(), 1, func(ctx context.Context, info *logic.MediaFileInfo) error {
+			return nil
+		})
+		convey.So(pq.Submit(&logic.MediaFileInfo{Fid: "f1"}), convey.ShouldBeFalse)
+
+		pq.Register(func(ctx context.Context, info *logic.MediaFileInfo, opts ...func(*logic.MediaFileInfo) *logic.MediaFileInfo) error {
+			return nil
+		})
+		convey.So(pq.Submit(&logic.MediaFileInfo{Fid: "f1"}), convey.ShouldBeTrue)
+		convey.So(pq.Submit(&logic.MediaFileInfo{Fid: "f2"}), convey.ShouldBeFalse)
+	})
+}
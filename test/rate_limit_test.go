@@ -0,0 +1,33 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/handler"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_RateLimitIdentity(t *testing.T) {
+	convey.Convey("优先按访问密钥限流，其次是登录用户", t, func() {
+		key := &logic.AccessKey{AccessKeyId: "AK1", Owner: "u1"}
+		convey.So(logic.RateLimitIdentity(&logic.Principal{Uid: "u1", AccessKey: key}, "203.0.113.7"), convey.ShouldEqual, "ak:AK1")
+		convey.So(logic.RateLimitIdentity(&logic.Principal{Uid: "u1"}, "203.0.113.7"), convey.ShouldEqual, "user:u1")
+		convey.So(logic.RateLimitIdentity(&logic.Principal{}, "203.0.113.7"), convey.ShouldEqual, "ip:203.0.113.7")
+		convey.So(logic.RateLimitIdentity(nil, "203.0.113.7"), convey.ShouldEqual, "ip:203.0.113.7")
+	})
+
+	convey.Convey("匿名请求伪造 X-Forwarded-For 不能换一个限流桶", t, func() {
+		extract, err := handler.NewClientIpExtractor([]string{"10.0.0.1"})
+		convey.So(err, convey.ShouldBeNil)
+		anonymous := &logic.Principal{}
+		first := logic.RateLimitIdentity(anonymous, extract(forwardedRequest("203.0.113.7:5000", "198.51.100.1")))
+		second := logic.RateLimitIdentity(anonymous, extract(forwardedRequest("203.0.113.7:5001", "198.51.100.2")))
+		convey.So(first, convey.ShouldEqual, "ip:203.0.113.7")
+		convey.So(second, convey.ShouldEqual, first)
+
+		// 经过可信代理时按代理记录的地址区分
+		proxied := logic.RateLimitIdentity(anonymous, extract(forwardedRequest("10.0.0.1:5000", "198.51.100.2")))
+		convey.So(proxied, convey.ShouldEqual, "ip:198.51.100.2")
+	})
+}
@@ -0,0 +1,58 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Reconcile(t *testing.T) {
+	fake, srv := newFakeS3()
+	defer srv.Close()
+	s3Logic := newTestS3Logic(srv.URL, nil)
+	ctx := context.Background()
+
+	convey.Convey("对账请求校验", t, func() {
+		reconcile := logic.NewReconcileLogic(ctx, &config.Config{}, s3Logic, nil)
+		_, err := reconcile.Reconcile(ctx, &logic.ReconcileRequest{Action: "purge"})
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrReconcileActionNotSupport)
+
+		// 只指定 box 时无法确定前缀
+		_, err = reconcile.Reconcile(ctx, &logic.ReconcileRequest{BoxId: "b1"})
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrDepotNotExist)
+	})
+
+	convey.Convey("按前缀列举对象", t, func() {
+		fake.put("d1/b1/f1", "hello")
+		fake.put("d1/b2/f2", "world!")
+		fake.put("d2/b1/f3", "x")
+		keys := map[string]int64{}
+		err := s3Logic.ListObjects(ctx, "d1/", func(obj *logic.S3Object) error {
+			keys[obj.Key] = obj.Size
+			return nil
+		})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(keys, convey.ShouldResemble, map[string]int64{"d1/b1/f1": 5, "d1/b2/f2": 6})
+	})
+
+	convey.Convey("隔离和删除孤儿对象", t, func() {
+		fake.put("d1/b1/orphan", "orphan")
+		err := s3Logic.CopyObject(ctx, "d1/b1/orphan", "_quarantine/d1/b1/orphan", nil)
+		convey.So(err, convey.ShouldBeNil)
+		err = s3Logic.DeleteObject(ctx, "d1/b1/orphan")
+		convey.So(err, convey.ShouldBeNil)
+
+		_, ok := fake.body("d1/b1/orphan")
+		convey.So(ok, convey.ShouldBeFalse)
+		body, ok := fake.body("_quarantine/d1/b1/orphan")
+		convey.So(ok, convey.ShouldBeTrue)
+		convey.So(body, convey.ShouldEqual, "orphan")
+
+		_, err = s3Logic.GetObject(ctx, "d1/b1/orphan", nil)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrFileNotExist)
+	})
+}
@@ -0,0 +1,124 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// 模拟 clamd 的 INSTREAM 协议，内容包含 EICAR 时返回命中
+func startFakeClamd(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				cmd := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+					conn.Write([]byte("stream: UNKNOWN COMMAND ERROR\x00"))
+					return
+				}
+				var data bytes.Buffer
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					if n == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, conn, int64(n)); err != nil {
+						return
+					}
+				}
+				if strings.Contains(data.String(), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE") {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func Test_Scanner(t *testing.T) {
+	convey.Convey("根据配置创建扫描器", t, func() {
+		scanner, err := logic.NewScanner(nil, nil)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(scanner, convey.ShouldBeNil)
+		scanner, err = logic.NewScanner(&config.Scanner{Type: logic.ScannerTypes.None}, nil)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(scanner, convey.ShouldBeNil)
+		_, err = logic.NewScanner(&config.Scanner{Type: "unknown"}, nil)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrScannerNotSupport)
+	})
+
+	convey.Convey("clamd 扫描器按块发送内容并解析结果", t, func() {
+		scanner, err := logic.NewScanner(&config.Scanner{Type: logic.ScannerTypes.Clamd, Addr: startFakeClamd(t)}, nil)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(scanner.Name(), convey.ShouldEqual, logic.ScannerTypes.Clamd)
+
+		// 超过一个块的干净内容
+		infected, signature, err := scanner.Scan(context.Background(), bytes.NewReader(bytes.Repeat([]byte("a"), 200<<10)))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(infected, convey.ShouldBeFalse)
+		convey.So(signature, convey.ShouldBeEmpty)
+
+		infected, signature, err = scanner.Scan(context.Background(), strings.NewReader(eicar))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(infected, convey.ShouldBeTrue)
+		convey.So(signature, convey.ShouldEqual, "Eicar-Signature")
+	})
+
+	convey.Convey("http 扫描器解析扫描服务的结果", t, func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if string(body) == "broken" {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			infected := strings.Contains(string(body), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE")
+			json.NewEncoder(w).Encode(map[string]any{"infected": infected, "signature": "Eicar-Test"})
+		}))
+		defer srv.Close()
+		scanner, err := logic.NewScanner(&config.Scanner{Type: logic.ScannerTypes.Http, Url: srv.URL}, srv.Client())
+		convey.So(err, convey.ShouldBeNil)
+
+		infected, _, err := scanner.Scan(context.Background(), strings.NewReader("hello"))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(infected, convey.ShouldBeFalse)
+
+		infected, signature, err := scanner.Scan(context.Background(), strings.NewReader(eicar))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(infected, convey.ShouldBeTrue)
+		convey.So(signature, convey.ShouldEqual, "Eicar-Test")
+
+		// 扫描服务出错时不能当作干净的文件
+		_, _, err = scanner.Scan(context.Background(), strings.NewReader("broken"))
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dzjyyds666/mediaStorage/internal/handler"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/dzjyyds666/vortex/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+const testJwtSecret = "test-jwt-secret"
+
+func signTestToken(method jwt.SigningMethod, secret any, claims jwt.MapClaims) string {
+	token, _ := jwt.NewWithClaims(method, claims).SignedString(secret)
+	return token
+}
+
+func testTokenClaims(uid string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"uid":     uid,
+		"typ":     logic.TokenTypes.Access,
+		"jti":     "jti-" + uid,
+		"sid":     "sid-" + uid,
+		"iat":     now.Unix(),
+		"expires": now.Add(time.Hour).Unix(),
+	}
+}
+
+func Test_Session(t *testing.T) {
+	convey.Convey("签发时间按毫秒解析，只有秒的 token 按所在秒的开始计算", t, func() {
+		claims := testTokenClaims("u1")
+		claims["iat"] = int64(1700000000)
+		claims["iat_ms"] = int64(1700000000123)
+		parsed, err := logic.ParseTokenClaims(testJwtSecret, signTestToken(jwt.SigningMethodHS256, []byte(testJwtSecret), claims))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(parsed.IssuedMs, convey.ShouldEqual, 1700000000123)
+
+		delete(claims, "iat_ms")
+		parsed, err = logic.ParseTokenClaims(testJwtSecret, signTestToken(jwt.SigningMethodHS256, []byte(testJwtSecret), claims))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(parsed.IssuedMs, convey.ShouldEqual, 1700000000000)
+	})
+
+	convey.Convey("签名正确的 token 解析出用户", t, func() {
+		claims, err := logic.ParseTokenClaims(testJwtSecret, signTestToken(jwt.SigningMethodHS256, []byte(testJwtSecret), testTokenClaims("u1")))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(claims.Uid, convey.ShouldEqual, "u1")
+		convey.So(claims.Jti, convey.ShouldEqual, "jti-u1")
+		convey.So(claims.SessionId, convey.ShouldEqual, "sid-u1")
+	})
+
+	convey.Convey("签名错误、过期、没有 jti 或者没有用户的 token 都不接受", t, func() {
+		_, err := logic.ParseTokenClaims(testJwtSecret, signTestToken(jwt.SigningMethodHS256, []byte("other-secret"), testTokenClaims("u1")))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrTokenInvalid)
+
+		_, err = logic.ParseTokenClaims(testJwtSecret, signTestToken(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, testTokenClaims("u1")))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrTokenInvalid)
+
+		expired := testTokenClaims("u1")
+		expired["expires"] = time.Now().Add(-time.Minute).Unix()
+		_, err = logic.ParseTokenClaims(testJwtSecret, signTestToken(jwt.SigningMethodHS256, []byte(testJwtSecret), expired))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrTokenInvalid)
+
+		noJti := testTokenClaims("u1")
+		delete(noJti, "jti")
+		_, err = logic.ParseTokenClaims(testJwtSecret, signTestToken(jwt.SigningMethodHS256, []byte(testJwtSecret), noJti))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrTokenInvalid)
+
+		_, err = logic.ParseTokenClaims(testJwtSecret, signTestToken(jwt.SigningMethodHS256, []byte(testJwtSecret), testTokenClaims("")))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrTokenInvalid)
+
+		_, err = logic.ParseTokenClaims(testJwtSecret, "not-a-token")
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrTokenInvalid)
+	})
+
+	convey.Convey("没有 bearer token 的请求按匿名处理", t, func() {
+		login := handler.NewLoginHandler(nil, nil, nil, nil, nil, nil)
+		req := httptest.NewRequest(http.MethodGet, "/media/file/info/f1", nil)
+		ctx := &vortex.Context{Context: echo.New().NewContext(req, httptest.NewRecorder())}
+		called := false
+		err := login.CheckToken(func(*vortex.Context) error {
+			called = true
+			return nil
+		})(ctx)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(called, convey.ShouldBeTrue)
+	})
+}
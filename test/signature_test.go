@@ -0,0 +1,147 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	testAccessKeyId = "AKTEST"
+	testSecret      = "test-secret"
+)
+
+// 解析签名并使用密钥校验
+func verifySigned(req *http.Request, allowUnsigned bool, now time.Time) error {
+	sr, err := logic.ParseSignedRequest(req, allowUnsigned, now)
+	if err != nil {
+		return err
+	}
+	if sr.AccessKeyId != testAccessKeyId || !sr.Match(req, testSecret) {
+		return pkg.ErrorEnums.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func Test_Signature(t *testing.T) {
+	now := time.Now()
+
+	convey.Convey("query 参数的顺序不影响签名", t, func() {
+		req := httptest.NewRequest(http.MethodGet, "/media/file/list/box1?limit=10&cursor=abc", nil)
+		logic.SignRequest(req, testAccessKeyId, testSecret, nil, now)
+
+		reordered := httptest.NewRequest(http.MethodGet, "/media/file/list/box1?cursor=abc&limit=10", nil)
+		reordered.Header = req.Header.Clone()
+		convey.So(verifySigned(reordered, false, now), convey.ShouldBeNil)
+
+		changed := httptest.NewRequest(http.MethodGet, "/media/file/list/box1?cursor=abc&limit=11", nil)
+		changed.Header = req.Header.Clone()
+		convey.So(verifySigned(changed, false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+	})
+
+	convey.Convey("请求体被修改后签名失效，校验后请求体可以再次读取", t, func() {
+		body := []byte(`{"box_id":"box1"}`)
+		req := httptest.NewRequest(http.MethodPost, "/media/share/create", bytes.NewReader(body))
+		logic.SignRequest(req, testAccessKeyId, testSecret, body, now)
+		convey.So(verifySigned(req, false, now), convey.ShouldBeNil)
+		raw, _ := io.ReadAll(req.Body)
+		convey.So(raw, convey.ShouldResemble, body)
+
+		tampered := httptest.NewRequest(http.MethodPost, "/media/share/create", bytes.NewReader([]byte(`{"box_id":"box2"}`)))
+		tampered.Header = req.Header.Clone()
+		convey.So(verifySigned(tampered, false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+
+		// 修改请求体的哈希会改变待签名的字符串
+		forged := httptest.NewRequest(http.MethodPost, "/media/share/create", bytes.NewReader([]byte(`{"box_id":"box2"}`)))
+		forged.Header = req.Header.Clone()
+		forged.Header.Set(logic.SignContentHeader, "0b56d4bbc3d4ef3c5e5bdfd4a45f85b8b7dcbc4c5ad5a50e4ae3b1f1c4fd2a17")
+		convey.So(verifySigned(forged, false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+	})
+
+	convey.Convey("只有流式上传的接口允许不对请求体签名", t, func() {
+		req := httptest.NewRequest(http.MethodPost, "/media/upload/single/f1", bytes.NewReader([]byte("data")))
+		logic.SignStreamRequest(req, testAccessKeyId, testSecret, now)
+		convey.So(verifySigned(req, true, now), convey.ShouldBeNil)
+		convey.So(verifySigned(req, false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrPayloadNotSigned)
+	})
+
+	convey.Convey("签名时间和服务端时间相差超过15分钟时过期", t, func() {
+		for _, skew := range []time.Duration{-14 * time.Minute, 14 * time.Minute} {
+			req := httptest.NewRequest(http.MethodGet, "/media/file/info/f1", nil)
+			logic.SignRequest(req, testAccessKeyId, testSecret, nil, now.Add(skew))
+			convey.So(verifySigned(req, false, now), convey.ShouldBeNil)
+		}
+		for _, skew := range []time.Duration{-16 * time.Minute, 16 * time.Minute} {
+			req := httptest.NewRequest(http.MethodGet, "/media/file/info/f1", nil)
+			logic.SignRequest(req, testAccessKeyId, testSecret, nil, now.Add(skew))
+			convey.So(verifySigned(req, false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureExpired)
+		}
+	})
+
+	convey.Convey("nonce 参与签名，每次签名都不同", t, func() {
+		first := httptest.NewRequest(http.MethodGet, "/media/file/info/f1", nil)
+		logic.SignRequest(first, testAccessKeyId, testSecret, nil, now)
+		second := httptest.NewRequest(http.MethodGet, "/media/file/info/f1", nil)
+		logic.SignRequest(second, testAccessKeyId, testSecret, nil, now)
+		convey.So(first.Header.Get(logic.SignNonceHeader), convey.ShouldNotEqual, second.Header.Get(logic.SignNonceHeader))
+		convey.So(first.Header.Get("Authorization"), convey.ShouldNotEqual, second.Header.Get("Authorization"))
+
+		// 替换 nonce 绕过重放检查会使签名失效
+		first.Header.Set(logic.SignNonceHeader, second.Header.Get(logic.SignNonceHeader))
+		convey.So(verifySigned(first, false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+
+		missing := httptest.NewRequest(http.MethodGet, "/media/file/info/f1", nil)
+		logic.SignRequest(missing, testAccessKeyId, testSecret, nil, now)
+		missing.Header.Del(logic.SignNonceHeader)
+		convey.So(verifySigned(missing, false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+	})
+
+	convey.Convey("Host、Depot-Id 和 Content-Type 参与签名", t, func() {
+		body := []byte(`{"box_id":"box1"}`)
+		req := httptest.NewRequest(http.MethodPost, "/media/share/create", bytes.NewReader(body))
+		req.Header.Set("Depot-Id", "depot1")
+		req.Header.Set("Content-Type", "application/json")
+		logic.SignRequest(req, testAccessKeyId, testSecret, body, now)
+		convey.So(req.Header.Get("Authorization"), convey.ShouldContainSubstring, "SignedHeaders=content-type;depot-id;host")
+		convey.So(verifySigned(req, false, now), convey.ShouldBeNil)
+
+		resign := func(mutate func(r *http.Request)) *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/media/share/create", bytes.NewReader(body))
+			r.Header = req.Header.Clone()
+			mutate(r)
+			return r
+		}
+		convey.So(verifySigned(resign(func(r *http.Request) { r.Header.Set("Depot-Id", "depot2") }), false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+		convey.So(verifySigned(resign(func(r *http.Request) { r.Header.Del("Depot-Id") }), false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+		convey.So(verifySigned(resign(func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") }), false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+		convey.So(verifySigned(resign(func(r *http.Request) { r.Host = "other.example.com" }), false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+		// 不参与签名的请求头可以修改
+		convey.So(verifySigned(resign(func(r *http.Request) { r.Header.Set("User-Agent", "other") }), false, now), convey.ShouldBeNil)
+	})
+
+	convey.Convey("签名时没有的 Depot-Id 不能在签名后添加", t, func() {
+		req := httptest.NewRequest(http.MethodGet, "/media/file/info/f1", nil)
+		logic.SignRequest(req, testAccessKeyId, testSecret, nil, now)
+		req.Header.Set("Depot-Id", "depot2")
+		convey.So(verifySigned(req, false, now), convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+	})
+
+	convey.Convey("SignedHeaders 必须包含必须签名的请求头", t, func() {
+		for _, signedHeaders := range []string{"", "content-type;host", "host;depot-id;content-type", "Content-Type;depot-id;host", "content-type;depot-id;depot-id;host"} {
+			req := httptest.NewRequest(http.MethodGet, "/media/file/info/f1", nil)
+			logic.SignRequest(req, testAccessKeyId, testSecret, nil, now)
+			auth := strings.Replace(req.Header.Get("Authorization"), "SignedHeaders=content-type;depot-id;host", "SignedHeaders="+signedHeaders, 1)
+			req.Header.Set("Authorization", auth)
+			_, err := logic.ParseSignedRequest(req, false, now)
+			convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package test
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SSE(t *testing.T) {
+	key := strings.Repeat("k", 32)
+	encoded := base64.StdEncoding.EncodeToString([]byte(key))
+	sum := md5.Sum([]byte(key))
+	fake, srv := newFakeS3()
+	defer srv.Close()
+	s3Logic := newTestS3Logic(srv.URL, map[string]string{
+		"k1":    encoded,
+		"short": base64.StdEncoding.EncodeToString([]byte("short")),
+	})
+
+	convey.Convey("构建加密参数", t, func() {
+		sse, err := s3Logic.BuildSSEParams(&logic.Depot{DepotId: "d1"})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(sse, convey.ShouldBeNil)
+
+		sse, err = s3Logic.BuildSSEParams(&logic.Depot{DepotId: "d1", Encryption: ptr.String(logic.SSEModes.SSES3)})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(sse.Mode, convey.ShouldEqual, logic.SSEModes.SSES3)
+		convey.So(sse.IsSSEC(), convey.ShouldBeFalse)
+
+		sse, err = s3Logic.BuildSSEParams(&logic.Depot{DepotId: "d1", Encryption: ptr.String(logic.SSEModes.SSEC), SSECKeyId: ptr.String("k1")})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(sse.IsSSEC(), convey.ShouldBeTrue)
+		convey.So(sse.Key, convey.ShouldEqual, encoded)
+		convey.So(sse.KeyMd5, convey.ShouldEqual, base64.StdEncoding.EncodeToString(sum[:]))
+	})
+
+	convey.Convey("错误的加密配置", t, func() {
+		_, err := s3Logic.BuildSSEParams(&logic.Depot{DepotId: "d1", Encryption: ptr.String(logic.SSEModes.SSEC), SSECKeyId: ptr.String("missing")})
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSSECKeyNotExist)
+
+		_, err = s3Logic.BuildSSEParams(&logic.Depot{DepotId: "d1", Encryption: ptr.String(logic.SSEModes.SSEC), SSECKeyId: ptr.String("short")})
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSSECKeyNotExist)
+
+		_, err = s3Logic.BuildSSEParams(&logic.Depot{DepotId: "d1", Encryption: ptr.String("aws:kms")})
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSSEModeNotSupport)
+	})
+
+	convey.Convey("上传时透传加密参数", t, func() {
+		ssec, err := s3Logic.BuildSSEParams(&logic.Depot{DepotId: "d1", Encryption: ptr.String(logic.SSEModes.SSEC), SSECKeyId: ptr.String("k1")})
+		convey.So(err, convey.ShouldBeNil)
+		err = s3Logic.SaveObject(context.Background(), "ssec/a.txt", strings.NewReader("hello"), ptr.String("text/plain"), ssec)
+		convey.So(err, convey.ShouldBeNil)
+		header := fake.header("ssec/a.txt")
+		convey.So(header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"), convey.ShouldEqual, "AES256")
+		convey.So(header.Get("X-Amz-Server-Side-Encryption-Customer-Key"), convey.ShouldEqual, encoded)
+		convey.So(header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5"), convey.ShouldEqual, ssec.KeyMd5)
+		convey.So(header.Get("X-Amz-Server-Side-Encryption"), convey.ShouldBeEmpty)
+
+		err = s3Logic.SaveObject(context.Background(), "sses3/a.txt", strings.NewReader("hello"), ptr.String("text/plain"), &logic.SSEParams{Mode: logic.SSEModes.SSES3})
+		convey.So(err, convey.ShouldBeNil)
+		header = fake.header("sses3/a.txt")
+		convey.So(header.Get("X-Amz-Server-Side-Encryption"), convey.ShouldEqual, "AES256")
+		convey.So(header.Get("X-Amz-Server-Side-Encryption-Customer-Key"), convey.ShouldBeEmpty)
+	})
+
+	convey.Convey("sse-c 对象不允许预签名", t, func() {
+		_, err := s3Logic.GetPresignedURL(context.Background(), "ssec/a.txt", &logic.SSEParams{Mode: logic.SSEModes.SSEC})
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrPresignNotAllowed)
+
+		url, err := s3Logic.GetPresignedURL(context.Background(), "sses3/a.txt", &logic.SSEParams{Mode: logic.SSEModes.SSES3})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(url, convey.ShouldContainSubstring, "sses3/a.txt")
+	})
+}
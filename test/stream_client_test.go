@@ -0,0 +1,94 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_StreamClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/slow":
+			// 持续输出，直到客户端断开
+			for {
+				if _, err := w.Write([]byte("data")); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		default:
+			_, _ = w.Write([]byte("hello"))
+		}
+	}))
+	defer srv.Close()
+	cli := logic.NewStreamClient()
+
+	convey.Convey("没有总超时", t, func() {
+		convey.So(cli.Timeout, convey.ShouldEqual, 0)
+	})
+
+	convey.Convey("读取文件内容", t, func() {
+		body, err := logic.OpenUrl(context.Background(), cli, srv.URL+"/a")
+		convey.So(err, convey.ShouldBeNil)
+		raw, err := io.ReadAll(body)
+		body.Close()
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(string(raw), convey.ShouldEqual, "hello")
+
+		_, err = logic.OpenUrl(context.Background(), cli, srv.URL+"/missing")
+		convey.So(err, convey.ShouldNotBeNil)
+	})
+
+	convey.Convey("ctx结束时中断读取", t, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		body, err := logic.OpenUrl(ctx, cli, srv.URL+"/slow")
+		convey.So(err, convey.ShouldBeNil)
+		defer body.Close()
+		_, err = io.Copy(io.Discard, body)
+		convey.So(errors.Is(err, context.DeadlineExceeded), convey.ShouldBeTrue)
+	})
+}
+
+func Test_BudgetReader(t *testing.T) {
+	convey.Convey("多个流共享额度", t, func() {
+		remain := int64(10)
+		raw, err := io.ReadAll(logic.NewBudgetReader(strings.NewReader("hello"), &remain))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(string(raw), convey.ShouldEqual, "hello")
+		convey.So(remain, convey.ShouldEqual, 5)
+
+		// 刚好用完额度
+		raw, err = io.ReadAll(logic.NewBudgetReader(strings.NewReader("world"), &remain))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(string(raw), convey.ShouldEqual, "world")
+		convey.So(remain, convey.ShouldEqual, 0)
+
+		_, err = io.ReadAll(logic.NewBudgetReader(strings.NewReader("!"), &remain))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrDownloadTooLarge)
+	})
+
+	convey.Convey("单个流超出额度", t, func() {
+		remain := int64(3)
+		raw, err := io.ReadAll(logic.NewBudgetReader(strings.NewReader("hello"), &remain))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrDownloadTooLarge)
+		convey.So(string(raw), convey.ShouldEqual, "hel")
+	})
+}
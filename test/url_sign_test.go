@@ -0,0 +1,110 @@
+package test
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dzjyyds666/Allspark-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/config"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func newUrlSignLogic(secret string, bucket int64) *logic.UrlSignLogic {
+	return logic.NewUrlSignLogic(nil, &config.Config{
+		Group:   ptr.String("test"),
+		Server:  &config.Server{Jwt: &config.Jwt{Secret: "jwt-secret"}},
+		UrlSign: &config.UrlSign{Secret: secret, MaxExpire: 3600, Bucket: bucket},
+	})
+}
+
+func Test_UrlSign(t *testing.T) {
+	convey.Convey("签名的url可以通过校验，过期时间对齐到时间桶", t, func() {
+		usl := newUrlSignLogic("url-secret", 300)
+		query := url.Values{"depot_id": {"d1"}, "variant": {"thumb"}, logic.UrlWatermarkParam: {"1"}}
+		signed, expires, err := usl.Sign("f1", query, 10*time.Minute)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(expires%300, convey.ShouldEqual, 0)
+		convey.So(expires, convey.ShouldBeGreaterThanOrEqualTo, time.Now().Add(10*time.Minute).Unix())
+		convey.So(signed.Get(logic.UrlExpiresParam), convey.ShouldEqual, strconv.FormatInt(expires, 10))
+		convey.So(logic.IsSignedUrl(signed), convey.ShouldBeTrue)
+
+		got, err := usl.Verify("f1", signed)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(got, convey.ShouldEqual, expires)
+
+		// 同一个时间段内签发的url相同
+		again, _, _ := usl.Sign("f1", query, 10*time.Minute)
+		convey.So(again.Encode(), convey.ShouldEqual, signed.Encode())
+	})
+
+	convey.Convey("修改参与签名的参数后校验失败，其他参数不影响", t, func() {
+		usl := newUrlSignLogic("url-secret", 300)
+		signed, _, err := usl.Sign("f1", url.Values{"variant": {"thumb"}, logic.UrlWatermarkParam: {"1"}}, time.Minute)
+		convey.So(err, convey.ShouldBeNil)
+
+		cdn := cloneValues(signed)
+		cdn.Set("utm_source", "cdn")
+		_, err = usl.Verify("f1", cdn)
+		convey.So(err, convey.ShouldBeNil)
+
+		// 去掉水印参数就能拿到原图
+		noWatermark := cloneValues(signed)
+		noWatermark.Del(logic.UrlWatermarkParam)
+		_, err = usl.Verify("f1", noWatermark)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+
+		resized := cloneValues(signed)
+		resized.Set("w", "4000")
+		_, err = usl.Verify("f1", resized)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+
+		extended := cloneValues(signed)
+		extended.Set(logic.UrlExpiresParam, strconv.FormatInt(time.Now().Add(time.Hour*24).Unix(), 10))
+		_, err = usl.Verify("f1", extended)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+
+		_, err = usl.Verify("f2", signed)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+
+		_, err = usl.Verify("f1", url.Values{logic.UrlSignParam: {"abc"}})
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+	})
+
+	convey.Convey("不同的密钥签出的url不能互相校验", t, func() {
+		signed, _, err := newUrlSignLogic("url-secret", 300).Sign("f1", url.Values{}, time.Minute)
+		convey.So(err, convey.ShouldBeNil)
+		_, err = newUrlSignLogic("other-secret", 300).Verify("f1", signed)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+		// 没有配置密钥时从 jwt 密钥派生，和 jwt 密钥本身不同
+		_, err = newUrlSignLogic("", 300).Verify("f1", signed)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+		_, err = newUrlSignLogic("jwt-secret", 300).Verify("f1", signed)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureInvalid)
+	})
+
+	convey.Convey("有效期超出范围时不签发，过期的url校验失败", t, func() {
+		usl := newUrlSignLogic("url-secret", 1)
+		_, _, err := usl.Sign("f1", url.Values{}, 0)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrUrlSignExpireInvalid)
+		_, _, err = usl.Sign("f1", url.Values{}, 2*time.Hour)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrUrlSignExpireInvalid)
+
+		signed, _, err := usl.Sign("f1", url.Values{}, time.Second)
+		convey.So(err, convey.ShouldBeNil)
+		time.Sleep(2100 * time.Millisecond)
+		_, err = usl.Verify("f1", signed)
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrSignatureExpired)
+	})
+}
+
+func cloneValues(values url.Values) url.Values {
+	cloned := url.Values{}
+	for k, v := range values {
+		cloned[k] = append([]string(nil), v...)
+	}
+	return cloned
+}
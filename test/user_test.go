@@ -0,0 +1,57 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_User(t *testing.T) {
+	convey.Convey("校验新用户的用户名、密码和角色", t, func() {
+		user := &logic.User{Username: "alice"}
+		convey.So(logic.CheckNewUser(user, "password1"), convey.ShouldBeNil)
+		convey.So(user.Roles, convey.ShouldResemble, []string{logic.UserRoles.User})
+
+		convey.So(logic.CheckNewUser(&logic.User{Username: "ab"}, "password1"), convey.ShouldEqual, pkg.ErrorEnums.ErrUsernameInvalid)
+		convey.So(logic.CheckNewUser(&logic.User{Username: "bob/../x"}, "password1"), convey.ShouldEqual, pkg.ErrorEnums.ErrUsernameInvalid)
+		convey.So(logic.CheckNewUser(&logic.User{Username: "alice"}, "short"), convey.ShouldEqual, pkg.ErrorEnums.ErrPasswordTooWeak)
+		convey.So(logic.CheckNewUser(&logic.User{Username: "alice", Roles: []string{"root"}}, "password1"), convey.ShouldEqual, pkg.ErrorEnums.ErrUserRoleInvalid)
+		convey.So(logic.CheckNewUser(&logic.User{Username: "admin.ops@example", Roles: []string{logic.UserRoles.Admin}}, "password1"), convey.ShouldBeNil)
+	})
+
+	convey.Convey("密码哈希后保存，只有正确的密码可以通过", t, func() {
+		hash, err := logic.HashPassword("correct horse")
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(string(hash), convey.ShouldNotContainSubstring, "correct horse")
+		convey.So(logic.ComparePasswordHash(hash, "correct horse"), convey.ShouldBeNil)
+		convey.So(logic.ComparePasswordHash(hash, "correct horsE"), convey.ShouldEqual, pkg.ErrorEnums.ErrPasswordNotMatch)
+
+		// 同一个密码每次的哈希不同
+		again, err := logic.HashPassword("correct horse")
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(string(again), convey.ShouldNotEqual, string(hash))
+
+		// 外部登录的用户没有密码哈希
+		convey.So(logic.ComparePasswordHash(nil, ""), convey.ShouldEqual, pkg.ErrorEnums.ErrPasswordNotMatch)
+	})
+
+	convey.Convey("密码长度限制在8到72个字节，bcrypt 只使用前72个字节", t, func() {
+		_, err := logic.HashPassword("1234567")
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrPasswordTooWeak)
+		_, err = logic.HashPassword("12345678")
+		convey.So(err, convey.ShouldBeNil)
+		_, err = logic.HashPassword(strings.Repeat("a", 72))
+		convey.So(err, convey.ShouldBeNil)
+		_, err = logic.HashPassword(strings.Repeat("a", 73))
+		convey.So(err, convey.ShouldEqual, pkg.ErrorEnums.ErrPasswordTooWeak)
+	})
+
+	convey.Convey("禁用的管理员不再是管理员", t, func() {
+		convey.So((&logic.User{Roles: []string{logic.UserRoles.Admin}}).IsAdmin(), convey.ShouldBeTrue)
+		convey.So((&logic.User{Roles: []string{logic.UserRoles.Admin}, Disabled: true}).IsAdmin(), convey.ShouldBeFalse)
+		convey.So((&logic.User{Roles: []string{logic.UserRoles.User}}).IsAdmin(), convey.ShouldBeFalse)
+	})
+}
@@ -0,0 +1,77 @@
+package test
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/aws/smithy-go/ptr"
+	"github.com/dzjyyds666/mediaStorage/internal/logic"
+	"github.com/dzjyyds666/mediaStorage/pkg"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func solidImage(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func Test_Watermark(t *testing.T) {
+	convey.Convey("没有设置不透明度时使用默认值，设置为0时保留", t, func() {
+		wm := &logic.Watermark{Text: ptr.String("demo")}
+		convey.So(logic.CheckWatermark(wm), convey.ShouldBeNil)
+		convey.So(*wm.Opacity, convey.ShouldEqual, 0.5)
+		convey.So(wm.Position, convey.ShouldEqual, logic.WatermarkPositions.BottomRight)
+
+		wm = &logic.Watermark{Text: ptr.String("demo"), Opacity: ptr.Float64(0)}
+		convey.So(logic.CheckWatermark(wm), convey.ShouldBeNil)
+		convey.So(*wm.Opacity, convey.ShouldEqual, 0)
+	})
+
+	convey.Convey("非法的水印配置", t, func() {
+		invalid := []*logic.Watermark{
+			{},
+			{Text: ptr.String("demo"), ImageFid: ptr.String("fid")},
+			{Text: ptr.String("demo"), Opacity: ptr.Float64(1.5)},
+			{Text: ptr.String("demo"), Opacity: ptr.Float64(-0.1)},
+			{Text: ptr.String("demo"), Scale: 2},
+			{Text: ptr.String("demo"), Position: "middle"},
+		}
+		for _, wm := range invalid {
+			convey.So(logic.CheckWatermark(wm), convey.ShouldEqual, pkg.ErrorEnums.ErrWatermarkInvalid)
+		}
+		convey.So(logic.CheckWatermark(nil), convey.ShouldBeNil)
+	})
+
+	convey.Convey("不透明度为0时图片不变，为1时水印完全覆盖", t, func() {
+		src := solidImage(200, 100, color.RGBA{A: 255})
+		mark := solidImage(10, 10, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+
+		wm := &logic.Watermark{ImageFid: ptr.String("mark"), Position: logic.WatermarkPositions.Center, Opacity: ptr.Float64(0)}
+		convey.So(logic.CheckWatermark(wm), convey.ShouldBeNil)
+		out := logic.ApplyWatermark(src, mark, wm)
+		r, _, _, _ := out.At(100, 50).RGBA()
+		convey.So(r, convey.ShouldEqual, 0)
+
+		wm.Opacity = ptr.Float64(1)
+		out = logic.ApplyWatermark(src, mark, wm)
+		r, _, _, _ = out.At(100, 50).RGBA()
+		convey.So(r, convey.ShouldEqual, 0xffff)
+	})
+
+	convey.Convey("设置了水印的仓库中只有图片需要原图权限", t, func() {
+		depot := &logic.Depot{Watermark: &logic.Watermark{Text: ptr.String("demo")}}
+		image := &logic.MediaFileInfo{Fid: "img", ContentType: ptr.String("image/png")}
+		video := &logic.MediaFileInfo{Fid: "video", ContentType: ptr.String("video/mp4")}
+		convey.So(depot.WatermarkApplies(image), convey.ShouldBeTrue)
+		convey.So(depot.WatermarkApplies(video), convey.ShouldBeFalse)
+		convey.So((&logic.Depot{}).WatermarkApplies(image), convey.ShouldBeFalse)
+
+		// 打包下载整个box时，只读的调用方跳过需要加水印的图片
+		viewer := &logic.EffectivePermission{Uid: "u2", Actions: []string{logic.AccessActions.Read, logic.AccessActions.Info}}
+		convey.So(viewer.AllowFile(image, logic.AccessActions.Read), convey.ShouldBeTrue)
+		convey.So(viewer.AllowFile(image, logic.AccessActions.Original), convey.ShouldBeFalse)
+	})
+}